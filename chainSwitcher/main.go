@@ -78,6 +78,11 @@ type KafkaMessage struct {
 		Hostname string              `json:"hostname"`
 		IP       map[string][]string `json:"ip"`
 	} `json:"host"`
+
+	// Only in the responses of stratumSwitcher
+	UserName   string `json:"user"`
+	WorkerName string `json:"worker"`
+	LatencyMs  int64  `json:"latency_ms"`
 }
 
 // KafkaCommand Structure of messages sent in Kafka
@@ -399,6 +404,20 @@ func readResponse() {
 			continue
 		}
 
+		if response.Type == "switcher_response" && response.Action == "switch_chain" {
+			if glog.V(2) {
+				glog.Info("Switcher Response, created_at: ", response.CreatedAt,
+					", server_id: ", response.ServerID,
+					", result: ", response.Result,
+					", user: ", response.UserName,
+					", worker: ", response.WorkerName,
+					", old_chain_name: ", response.OldChainName,
+					", new_chain_name: ", response.NewChainName,
+					", latency_ms: ", response.LatencyMs)
+			}
+			continue
+		}
+
 		if response.Type == "sserver_notify" && response.Action == "online" {
 			glog.Info("Server Online, ",
 				", created_at: ", response.CreatedAt,
@@ -0,0 +1,268 @@
+// Package coordination The coordination service storing the coin assignments of sub-accounts,
+// the server ids of stratumSwitcher and the auto-registration requests.
+// Zookeeper and etcd v3 are supported.
+package coordination
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Names of the backends in the configurations
+const (
+	// BackendZookeeper Apache Zookeeper (default)
+	BackendZookeeper = "zookeeper"
+	// BackendEtcd etcd v3 (via its JSON gateway)
+	BackendEtcd = "etcd"
+)
+
+// Errors returned by all backends
+var (
+	// ErrNoNode The node does not exist
+	ErrNoNode = errors.New("node does not exist")
+	// ErrNodeExists The node already exists
+	ErrNodeExists = errors.New("node already exists")
+	// ErrBadVersion The version of the node does not match
+	ErrBadVersion = errors.New("version conflict")
+	// ErrSessionExpired The session is expired, its ephemeral nodes and watches are lost
+	ErrSessionExpired = errors.New("session expired")
+	// ErrClosed The backend is closed
+	ErrClosed = errors.New("backend closed")
+	// ErrUnknownBackend Unknown backend in the configuration
+	ErrUnknownBackend = errors.New("unknown coordination backend")
+	// ErrNoEndpoints No server address in the configuration
+	ErrNoEndpoints = errors.New("no coordination server address")
+)
+
+// EventType Type of a watch event
+type EventType int
+
+const (
+	// EventNodeCreated The node is created
+	EventNodeCreated EventType = iota + 1
+	// EventNodeDeleted The node is deleted
+	EventNodeDeleted
+	// EventNodeDataChanged The value of the node is changed
+	EventNodeDataChanged
+	// EventNodeChildrenChanged A child is added to or removed from the node
+	EventNodeChildrenChanged
+	// EventNotWatching The watch is lost (connection or session lost), Err is set
+	EventNotWatching
+)
+
+// String Name of the event type
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventNodeCreated:
+		return "EventNodeCreated"
+	case EventNodeDeleted:
+		return "EventNodeDeleted"
+	case EventNodeDataChanged:
+		return "EventNodeDataChanged"
+	case EventNodeChildrenChanged:
+		return "EventNodeChildrenChanged"
+	case EventNotWatching:
+		return "EventNotWatching"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event A watch event. Every watch receives at most one event, then the channel is closed.
+type Event struct {
+	Type EventType
+	Path string
+	Err  error
+}
+
+// SessionEvent A change of the session of the backend
+type SessionEvent int
+
+const (
+	// SessionExpired The session is expired: its ephemeral nodes are removed and its watches may be lost
+	SessionExpired SessionEvent = iota + 1
+	// SessionRestored A new session is established after SessionExpired
+	SessionRestored
+)
+
+// Size of the buffer of the session events
+const sessionEventBufferSize = 16
+
+// String Name of the session event
+func (event SessionEvent) String() string {
+	switch event {
+	case SessionExpired:
+		return "SessionExpired"
+	case SessionRestored:
+		return "SessionRestored"
+	default:
+		return "Unknown"
+	}
+}
+
+// sendSessionEvent Send the session event without blocking the backend
+func sendSessionEvent(events chan SessionEvent, event SessionEvent) {
+	select {
+	case events <- event:
+	default:
+		glog.Warning("coordination: session event dropped, nobody is receiving: ", event)
+	}
+}
+
+// Backend A coordination service with Zookeeper-like nodes.
+// Paths are absolute and separated by "/", versions start from 0 when a node is created
+// and -1 matches any version.
+type Backend interface {
+	// Get Get the value and the version of the node
+	Get(path string) (value []byte, version int32, err error)
+	// GetW Get the value and the version of the node, and watch its change or deletion
+	GetW(path string) (value []byte, version int32, event <-chan Event, err error)
+	// Exists Check whether the node exists
+	Exists(path string) (exists bool, err error)
+	// ExistsW Check whether the node exists, and watch its creation, change or deletion
+	ExistsW(path string) (exists bool, event <-chan Event, err error)
+	// Create Create a persistent node, returns ErrNodeExists if it exists
+	Create(path string, value []byte) error
+	// CreateEphemeral Create a node removed when the session of the backend ends
+	CreateEphemeral(path string, value []byte) error
+	// Set Set the value of an existing node
+	Set(path string, value []byte, version int32) error
+	// Delete Delete the node
+	Delete(path string, version int32) error
+	// Children Get the names of the children of the node
+	Children(path string) (children []string, err error)
+	// ChildrenW Get the names of the children of the node, and watch a child being added or removed
+	ChildrenW(path string) (children []string, event <-chan Event, err error)
+	// SessionEvents Changes of the session, the ephemeral nodes must be created again after SessionRestored
+	SessionEvents() <-chan SessionEvent
+	// Close Close the connection, the ephemeral nodes are removed
+	Close()
+}
+
+// Config Configuration of the backend
+type Config struct {
+	// BackendZookeeper (default if empty) or BackendEtcd
+	Backend string
+	// Zookeeper cluster IP:port list
+	ZKBroker []string
+	// etcd client URLs, e.g. http://127.0.0.1:2379
+	EtcdEndpoints []string
+	// Zookeeper session timeout, or TTL of the etcd lease of the ephemeral nodes
+	SessionTimeout time.Duration
+	// Time to wait for connecting to Zookeeper, 0 means not waiting
+	ConnectTimeout time.Duration
+}
+
+// NewBackend Connect to the backend in the configuration
+func NewBackend(conf Config) (backend Backend, err error) {
+	switch conf.Backend {
+	case "", BackendZookeeper:
+		if len(conf.ZKBroker) == 0 {
+			return nil, ErrNoEndpoints
+		}
+		zookeeperBackend, err := NewZookeeperBackend(conf.ZKBroker, conf.SessionTimeout, conf.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return zookeeperBackend, nil
+	case BackendEtcd:
+		if len(conf.EtcdEndpoints) == 0 {
+			return nil, ErrNoEndpoints
+		}
+		etcdBackend, err := NewEtcdBackend(conf.EtcdEndpoints, conf.SessionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return etcdBackend, nil
+	default:
+		return nil, ErrUnknownBackend
+	}
+}
+
+// CreatePath Create the node and its parents if they do not exist
+func CreatePath(backend Backend, path string) error {
+	pathTrimmed := strings.Trim(path, "/")
+	dirs := strings.Split(pathTrimmed, "/")
+
+	currPath := ""
+
+	for _, dir := range dirs {
+		currPath += "/" + dir
+
+		// see if the key exists
+		exists, err := backend.Exists(currPath)
+
+		if err != nil {
+			return err
+		}
+
+		// already exists, no need to create
+		if exists {
+			continue
+		}
+
+		// does not exist, create
+		err = backend.Create(currPath, []byte{})
+
+		// the key may have been created by another process
+		if err != nil && err != ErrNodeExists {
+			return err
+		}
+
+		glog.Info("Created coordination path: ", currPath)
+	}
+
+	return nil
+}
+
+// AssignEphemeralID Create an ephemeral node dir/<id> with a free id in [minID, maxID].
+// The preferred id is tried first, then the next free ids (wrapping around).
+func AssignEphemeralID(backend Backend, dir string, minID int, maxID int, preferredID int, value []byte) (id int, nodePath string, err error) {
+	dir = strings.TrimSuffix(dir, "/")
+
+	err = CreatePath(backend, dir)
+	if err != nil {
+		return
+	}
+
+	children, err := backend.Children(dir)
+	if err != nil {
+		return
+	}
+
+	used := make(map[int]bool)
+	for _, child := range children {
+		childID, convErr := strconv.Atoi(child)
+		if convErr != nil {
+			glog.Warning("AssignEphemeralID: invalid id ", child, " in ", dir)
+			continue
+		}
+		used[childID] = true
+	}
+
+	if preferredID < minID || preferredID > maxID {
+		preferredID = minID
+	}
+
+	size := maxID - minID + 1
+	for i := 0; i < size; i++ {
+		id = minID + (preferredID-minID+i)%size
+		if used[id] {
+			continue
+		}
+
+		nodePath = dir + "/" + strconv.Itoa(id)
+		err = backend.CreateEphemeral(nodePath, value)
+		if err != nil {
+			glog.Warning("AssignEphemeralID: create ", nodePath, " failed. errmsg: ", err)
+			continue
+		}
+		return
+	}
+
+	return 0, "", errors.New("id is full")
+}
@@ -0,0 +1,215 @@
+package coordination
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackends The backends to test: the memory backend, etcd on the fake JSON gateway of Etcd_test.go,
+// and Zookeeper or etcd if their addresses are in COORDINATION_TEST_ZK or COORDINATION_TEST_ETCD (comma separated)
+func testBackends(t *testing.T) map[string]Backend {
+	backends := map[string]Backend{"memory": NewMemoryBackend()}
+	backends["fake etcd"], _ = newFakeEtcdBackend(t, 0)
+
+	if brokers := os.Getenv("COORDINATION_TEST_ZK"); brokers != "" {
+		backend, err := NewBackend(Config{Backend: BackendZookeeper, ZKBroker: strings.Split(brokers, ","), ConnectTimeout: 10 * time.Second})
+		if err != nil {
+			t.Fatal("connect zookeeper failed: ", err)
+		}
+		backends[BackendZookeeper] = backend
+	}
+	if endpoints := os.Getenv("COORDINATION_TEST_ETCD"); endpoints != "" {
+		backend, err := NewBackend(Config{Backend: BackendEtcd, EtcdEndpoints: strings.Split(endpoints, ",")})
+		if err != nil {
+			t.Fatal("connect etcd failed: ", err)
+		}
+		backends[BackendEtcd] = backend
+	}
+	return backends
+}
+
+// testRoot A path not used by other tests
+func testRoot(name string) string {
+	return "/coordination_test/" + name + "_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// waitEvent Wait for the watch event
+func waitEvent(t *testing.T, event <-chan Event, expected EventType) {
+	select {
+	case e := <-event:
+		if e.Type != expected {
+			t.Errorf("event: %v, expected: %v (%v)", e.Type, expected, e.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no event, expected: %v", expected)
+	}
+}
+
+func TestBackendNodes(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		root := testRoot("nodes")
+		node := root + "/node"
+
+		err := CreatePath(backend, root)
+		if err != nil {
+			t.Fatal(name, ": CreatePath failed: ", err)
+		}
+
+		if err = backend.Create(root+"/no/parent", nil); err != ErrNoNode {
+			t.Error(name, ": create without parent: ", err)
+		}
+		if _, _, err = backend.Get(node); err != ErrNoNode {
+			t.Error(name, ": get missing node: ", err)
+		}
+
+		if err = backend.Create(node, []byte("btc")); err != nil {
+			t.Fatal(name, ": create failed: ", err)
+		}
+		if err = backend.Create(node, []byte("btc")); err != ErrNodeExists {
+			t.Error(name, ": create twice: ", err)
+		}
+
+		value, version, err := backend.Get(node)
+		if err != nil || string(value) != "btc" || version != 0 {
+			t.Error(name, ": get: ", string(value), ", ", version, ", ", err)
+		}
+
+		if err = backend.Set(node, []byte("bch"), 1); err != ErrBadVersion {
+			t.Error(name, ": set with bad version: ", err)
+		}
+		if err = backend.Set(node, []byte("bch"), 0); err != nil {
+			t.Error(name, ": set: ", err)
+		}
+		if err = backend.Set(node, []byte("bsv"), -1); err != nil {
+			t.Error(name, ": set any version: ", err)
+		}
+		value, version, _ = backend.Get(node)
+		if string(value) != "bsv" || version != 2 {
+			t.Error(name, ": get after set: ", string(value), ", ", version)
+		}
+
+		children, err := backend.Children(root)
+		if err != nil || !reflect.DeepEqual(children, []string{"node"}) {
+			t.Error(name, ": children: ", children, ", ", err)
+		}
+
+		if err = backend.Delete(node, 0); err != ErrBadVersion {
+			t.Error(name, ": delete with bad version: ", err)
+		}
+		if err = backend.Delete(node, -1); err != nil {
+			t.Error(name, ": delete: ", err)
+		}
+		if exists, _ := backend.Exists(node); exists {
+			t.Error(name, ": node exists after delete")
+		}
+		if err = backend.Set(node, nil, -1); err != ErrNoNode {
+			t.Error(name, ": set missing node: ", err)
+		}
+	}
+}
+
+func TestBackendWatches(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		root := testRoot("watches")
+		node := root + "/node"
+		CreatePath(backend, root)
+
+		exists, existsEvent, err := backend.ExistsW(node)
+		if err != nil || exists {
+			t.Fatal(name, ": ExistsW: ", exists, ", ", err)
+		}
+		_, childrenEvent, err := backend.ChildrenW(root)
+		if err != nil {
+			t.Fatal(name, ": ChildrenW: ", err)
+		}
+
+		backend.Create(node, []byte("btc"))
+		waitEvent(t, existsEvent, EventNodeCreated)
+		waitEvent(t, childrenEvent, EventNodeChildrenChanged)
+
+		_, _, dataEvent, err := backend.GetW(node)
+		if err != nil {
+			t.Fatal(name, ": GetW: ", err)
+		}
+		// Changing a child is not a children change
+		_, childrenEvent, _ = backend.ChildrenW(root)
+
+		backend.Set(node, []byte("bch"), -1)
+		waitEvent(t, dataEvent, EventNodeDataChanged)
+
+		_, _, dataEvent, _ = backend.GetW(node)
+		backend.Delete(node, -1)
+		waitEvent(t, dataEvent, EventNodeDeleted)
+		waitEvent(t, childrenEvent, EventNodeChildrenChanged)
+	}
+}
+
+func TestAssignEphemeralID(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		dir := testRoot("ids")
+
+		id, nodePath, err := AssignEphemeralID(backend, dir, 1, 3, 2, []byte("a"))
+		if err != nil || id != 2 || nodePath != dir+"/2" {
+			t.Error(name, ": preferred id: ", id, ", ", nodePath, ", ", err)
+		}
+		// The preferred id is used, take the next one
+		id, _, err = AssignEphemeralID(backend, dir, 1, 3, 2, []byte("b"))
+		if err != nil || id != 3 {
+			t.Error(name, ": next id: ", id, ", ", err)
+		}
+		// Wrap around
+		id, _, err = AssignEphemeralID(backend, dir, 1, 3, 3, []byte("c"))
+		if err != nil || id != 1 {
+			t.Error(name, ": wrapped id: ", id, ", ", err)
+		}
+		_, _, err = AssignEphemeralID(backend, dir, 1, 3, 1, []byte("d"))
+		if err == nil {
+			t.Error(name, ": id is full but no error")
+		}
+
+		value, _, _ := backend.Get(dir + "/3")
+		if string(value) != "b" {
+			t.Error(name, ": value of the id node: ", string(value))
+		}
+	}
+}
+
+func TestMemoryBackendExpire(t *testing.T) {
+	backend := NewMemoryBackend()
+	CreatePath(backend, "/ids")
+	backend.CreateEphemeral("/ids/1", nil)
+	backend.Create("/ids/persistent", nil)
+
+	_, _, event, _ := backend.GetW("/ids/persistent")
+	backend.Expire()
+
+	select {
+	case e := <-event:
+		if e.Type != EventNotWatching || e.Err != ErrSessionExpired {
+			t.Error("event after expire: ", e)
+		}
+	default:
+		t.Error("no event after expire")
+	}
+
+	if exists, _ := backend.Exists("/ids/1"); exists {
+		t.Error("ephemeral node exists after expire")
+	}
+	if exists, _ := backend.Exists("/ids/persistent"); !exists {
+		t.Error("persistent node removed after expire")
+	}
+	for _, expected := range []SessionEvent{SessionExpired, SessionRestored} {
+		if e := <-backend.SessionEvents(); e != expected {
+			t.Error("session event: ", e, ", expected: ", expected)
+		}
+	}
+
+	backend.Close()
+	if _, err := backend.Exists("/ids"); err != ErrClosed {
+		t.Error("use after close: ", err)
+	}
+}
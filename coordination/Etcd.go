@@ -0,0 +1,674 @@
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Timeout of a request to etcd
+const etcdRequestTimeout = 10 * time.Second
+
+// Default TTL of the lease of the ephemeral nodes
+const defaultEtcdLeaseTTL = 10 * time.Second
+
+// etcdInt64 int64 in the JSON gateway of etcd, encoded as a string
+type etcdInt64 int64
+
+// MarshalJSON Encode as a string
+func (value etcdInt64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(value), 10))
+}
+
+// UnmarshalJSON Decode from a string or a number
+func (value *etcdInt64) UnmarshalJSON(data []byte) error {
+	i, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*value = etcdInt64(i)
+	return nil
+}
+
+// etcdEventType Type of a watch event, encoded as its name or its number
+type etcdEventType string
+
+// UnmarshalJSON Decode from a string or a number
+func (eventType *etcdEventType) UnmarshalJSON(data []byte) error {
+	name := strings.Trim(string(data), `"`)
+	if name == "1" {
+		name = "DELETE"
+	}
+	*eventType = etcdEventType(name)
+	return nil
+}
+
+type etcdKeyValue struct {
+	Key            []byte    `json:"key"`
+	CreateRevision etcdInt64 `json:"create_revision"`
+	ModRevision    etcdInt64 `json:"mod_revision"`
+	Version        etcdInt64 `json:"version"`
+	Value          []byte    `json:"value"`
+	Lease          etcdInt64 `json:"lease"`
+}
+
+type etcdResponseHeader struct {
+	Revision etcdInt64 `json:"revision"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdResponseHeader `json:"header"`
+	Kvs    []etcdKeyValue     `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key         []byte    `json:"key"`
+	Value       []byte    `json:"value"`
+	Lease       etcdInt64 `json:"lease,omitempty"`
+	IgnoreLease bool      `json:"ignore_lease,omitempty"`
+}
+
+type etcdDeleteRangeRequest struct {
+	Key []byte `json:"key"`
+}
+
+type etcdCompare struct {
+	Result         string     `json:"result"`
+	Target         string     `json:"target"`
+	Key            []byte     `json:"key"`
+	Version        *etcdInt64 `json:"version,omitempty"`
+	CreateRevision *etcdInt64 `json:"create_revision,omitempty"`
+}
+
+type etcdRequestOp struct {
+	RequestPut         *etcdPutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Header    etcdResponseHeader `json:"header"`
+	Succeeded bool               `json:"succeeded"`
+}
+
+type etcdWatchCreateRequest struct {
+	Key           []byte    `json:"key"`
+	RangeEnd      []byte    `json:"range_end,omitempty"`
+	StartRevision etcdInt64 `json:"start_revision,omitempty"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest etcdWatchCreateRequest `json:"create_request"`
+}
+
+type etcdEvent struct {
+	Type etcdEventType `json:"type"`
+	Kv   etcdKeyValue  `json:"kv"`
+}
+
+type etcdError struct {
+	Message string `json:"message"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Canceled     bool        `json:"canceled"`
+		CancelReason string      `json:"cancel_reason"`
+		Events       []etcdEvent `json:"events"`
+	} `json:"result"`
+	Error *etcdError `json:"error"`
+}
+
+type etcdLeaseRequest struct {
+	ID  etcdInt64 `json:"ID,omitempty"`
+	TTL etcdInt64 `json:"TTL,omitempty"`
+}
+
+type etcdLeaseResponse struct {
+	ID  etcdInt64 `json:"ID"`
+	TTL etcdInt64 `json:"TTL"`
+}
+
+type etcdLeaseKeepAliveResponse struct {
+	Result etcdLeaseResponse `json:"result"`
+	Error  *etcdError        `json:"error"`
+}
+
+// EtcdBackend Backend on etcd v3, via the JSON gateway (/v3/...) of etcd.
+// Nodes are keys with their paths, the children of a node are the keys directly under "path/".
+// Ephemeral nodes are attached to a lease kept alive by the backend.
+type EtcdBackend struct {
+	endpoints []string
+	leaseTTL  time.Duration
+
+	// Client of the requests with a timeout
+	client *http.Client
+	// Client of the watches
+	watchClient *http.Client
+
+	lock sync.Mutex
+	// Index of the endpoint in use
+	endpointIndex int
+
+	leaseLock sync.Mutex
+	// Lease of the ephemeral nodes, 0 if not granted
+	leaseID etcdInt64
+	// Session events, SessionExpired then SessionRestored when the lease expires
+	sessionEvents chan SessionEvent
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEtcdBackend Create the backend of the etcd cluster and check the connection.
+// leaseTTL is the time the ephemeral nodes live after the process is gone.
+func NewEtcdBackend(endpoints []string, leaseTTL time.Duration) (backend *EtcdBackend, err error) {
+	if leaseTTL < time.Second {
+		leaseTTL = defaultEtcdLeaseTTL
+	}
+
+	backend = new(EtcdBackend)
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		backend.endpoints = append(backend.endpoints, endpoint)
+	}
+	if len(backend.endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	backend.leaseTTL = leaseTTL
+	backend.client = &http.Client{Timeout: etcdRequestTimeout}
+	backend.watchClient = &http.Client{}
+	backend.sessionEvents = make(chan SessionEvent, sessionEventBufferSize)
+	backend.closed = make(chan struct{})
+
+	_, err = backend.Exists("/")
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// post Send the request to the endpoint in use, then the other endpoints if it cannot be connected
+func (backend *EtcdBackend) post(ctx context.Context, client *http.Client, api string, request interface{}) (response *http.Response, err error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	backend.lock.Lock()
+	index := backend.endpointIndex
+	backend.lock.Unlock()
+
+	for i := 0; i < len(backend.endpoints); i++ {
+		endpoint := backend.endpoints[(index+i)%len(backend.endpoints)]
+
+		var httpRequest *http.Request
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint+api, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+
+		response, err = client.Do(httpRequest)
+		if err == nil {
+			backend.lock.Lock()
+			backend.endpointIndex = (index + i) % len(backend.endpoints)
+			backend.lock.Unlock()
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Warning("etcd: request to ", endpoint, " failed: ", err)
+	}
+	if err != nil {
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		var etcdErr etcdError
+		json.NewDecoder(response.Body).Decode(&etcdErr)
+		return nil, errors.New("etcd: " + response.Status + " " + etcdErr.Message)
+	}
+	return
+}
+
+// call Send the request and decode the response
+func (backend *EtcdBackend) call(api string, request interface{}, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	httpResponse, err := backend.post(ctx, backend.client, api, request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// etcdParent Path of the parent of the node, empty for the nodes under the root
+func etcdParent(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index <= 0 {
+		return ""
+	}
+	return path[:index]
+}
+
+// etcdChildrenPrefix Prefix of the keys of the children
+func etcdChildrenPrefix(path string) string {
+	return strings.TrimSuffix(path, "/") + "/"
+}
+
+// etcdPrefixEnd The end of the range of the keys with the prefix
+func etcdPrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All keys after the prefix
+	return []byte{0}
+}
+
+// versionCompare Compare of the version of the node, -1 matches any version of an existing node
+func versionCompare(path string, version int32) etcdCompare {
+	if version < 0 {
+		createRevision := etcdInt64(0)
+		return etcdCompare{Result: "GREATER", Target: "CREATE", Key: []byte(path), CreateRevision: &createRevision}
+	}
+	etcdVersion := etcdInt64(version) + 1
+	return etcdCompare{Result: "EQUAL", Target: "VERSION", Key: []byte(path), Version: &etcdVersion}
+}
+
+// get Get the key and the revision of the store
+func (backend *EtcdBackend) get(path string) (kv *etcdKeyValue, revision etcdInt64, err error) {
+	var response etcdRangeResponse
+	err = backend.call("/v3/kv/range", etcdRangeRequest{Key: []byte(path)}, &response)
+	if err != nil {
+		return
+	}
+	revision = response.Header.Revision
+	if len(response.Kvs) > 0 {
+		kv = &response.Kvs[0]
+	}
+	return
+}
+
+// Get Get the value and the version of the node
+func (backend *EtcdBackend) Get(path string) (value []byte, version int32, err error) {
+	kv, _, err := backend.get(path)
+	if err != nil {
+		return
+	}
+	if kv == nil {
+		return nil, 0, ErrNoNode
+	}
+	return kv.Value, int32(kv.Version - 1), nil
+}
+
+// GetW Get the value and the version of the node, and watch its change or deletion
+func (backend *EtcdBackend) GetW(path string) (value []byte, version int32, event <-chan Event, err error) {
+	kv, revision, err := backend.get(path)
+	if err != nil {
+		return
+	}
+	if kv == nil {
+		return nil, 0, nil, ErrNoNode
+	}
+	event = backend.watch(path, []byte(path), nil, revision+1, func(e etcdEvent) (EventType, bool) {
+		if e.Type == "DELETE" {
+			return EventNodeDeleted, true
+		}
+		return EventNodeDataChanged, true
+	})
+	return kv.Value, int32(kv.Version - 1), event, nil
+}
+
+// Exists Check whether the node exists
+func (backend *EtcdBackend) Exists(path string) (exists bool, err error) {
+	kv, _, err := backend.get(path)
+	return kv != nil, err
+}
+
+// ExistsW Check whether the node exists, and watch its creation, change or deletion
+func (backend *EtcdBackend) ExistsW(path string) (exists bool, event <-chan Event, err error) {
+	kv, revision, err := backend.get(path)
+	if err != nil {
+		return
+	}
+	event = backend.watch(path, []byte(path), nil, revision+1, func(e etcdEvent) (EventType, bool) {
+		if e.Type == "DELETE" {
+			return EventNodeDeleted, true
+		}
+		if e.Kv.Version == 1 {
+			return EventNodeCreated, true
+		}
+		return EventNodeDataChanged, true
+	})
+	return kv != nil, event, nil
+}
+
+// create Create the node if it does not exist and its parent exists
+func (backend *EtcdBackend) create(path string, value []byte, lease etcdInt64) error {
+	createRevision := etcdInt64(0)
+	request := etcdTxnRequest{
+		Compare: []etcdCompare{{Result: "EQUAL", Target: "CREATE", Key: []byte(path), CreateRevision: &createRevision}},
+		Success: []etcdRequestOp{{RequestPut: &etcdPutRequest{Key: []byte(path), Value: value, Lease: lease}}},
+	}
+	parent := etcdParent(path)
+	if parent != "" {
+		request.Compare = append(request.Compare, versionCompare(parent, -1))
+	}
+
+	var response etcdTxnResponse
+	err := backend.call("/v3/kv/txn", request, &response)
+	if err != nil {
+		return err
+	}
+	if response.Succeeded {
+		return nil
+	}
+
+	exists, err := backend.Exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrNodeExists
+	}
+	return ErrNoNode
+}
+
+// Create Create a persistent node, returns ErrNodeExists if it exists
+func (backend *EtcdBackend) Create(path string, value []byte) error {
+	return backend.create(path, value, 0)
+}
+
+// CreateEphemeral Create a node removed when the lease of the backend expires
+func (backend *EtcdBackend) CreateEphemeral(path string, value []byte) error {
+	lease, err := backend.lease()
+	if err != nil {
+		return err
+	}
+	return backend.create(path, value, lease)
+}
+
+// txnOnVersion Run the operation if the version of the node matches
+func (backend *EtcdBackend) txnOnVersion(path string, version int32, op etcdRequestOp) error {
+	request := etcdTxnRequest{
+		Compare: []etcdCompare{versionCompare(path, version)},
+		Success: []etcdRequestOp{op},
+	}
+
+	var response etcdTxnResponse
+	err := backend.call("/v3/kv/txn", request, &response)
+	if err != nil {
+		return err
+	}
+	if response.Succeeded {
+		return nil
+	}
+
+	exists, err := backend.Exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrBadVersion
+	}
+	return ErrNoNode
+}
+
+// Set Set the value of an existing node
+func (backend *EtcdBackend) Set(path string, value []byte, version int32) error {
+	// Keep the lease of an ephemeral node
+	return backend.txnOnVersion(path, version, etcdRequestOp{
+		RequestPut: &etcdPutRequest{Key: []byte(path), Value: value, IgnoreLease: true},
+	})
+}
+
+// Delete Delete the node
+func (backend *EtcdBackend) Delete(path string, version int32) error {
+	return backend.txnOnVersion(path, version, etcdRequestOp{
+		RequestDeleteRange: &etcdDeleteRangeRequest{Key: []byte(path)},
+	})
+}
+
+// children Get the names of the children and the revision of the store
+func (backend *EtcdBackend) children(path string) (children []string, revision etcdInt64, err error) {
+	if path != "/" {
+		var exists bool
+		exists, err = backend.Exists(path)
+		if err != nil {
+			return
+		}
+		if !exists {
+			return nil, 0, ErrNoNode
+		}
+	}
+
+	prefix := []byte(etcdChildrenPrefix(path))
+	var response etcdRangeResponse
+	err = backend.call("/v3/kv/range", etcdRangeRequest{Key: prefix, RangeEnd: etcdPrefixEnd(prefix), KeysOnly: true}, &response)
+	if err != nil {
+		return
+	}
+
+	children = []string{}
+	for _, kv := range response.Kvs {
+		name := string(kv.Key[len(prefix):])
+		if name != "" && !strings.Contains(name, "/") {
+			children = append(children, name)
+		}
+	}
+	return children, response.Header.Revision, nil
+}
+
+// Children Get the names of the children of the node
+func (backend *EtcdBackend) Children(path string) (children []string, err error) {
+	children, _, err = backend.children(path)
+	return
+}
+
+// ChildrenW Get the names of the children of the node, and watch a child being added or removed
+func (backend *EtcdBackend) ChildrenW(path string) (children []string, event <-chan Event, err error) {
+	children, revision, err := backend.children(path)
+	if err != nil {
+		return
+	}
+
+	prefix := etcdChildrenPrefix(path)
+	// The node itself and its descendants
+	event = backend.watch(path, []byte(path), etcdPrefixEnd([]byte(prefix)), revision+1, func(e etcdEvent) (EventType, bool) {
+		key := string(e.Kv.Key)
+		if key == path {
+			if e.Type == "DELETE" {
+				return EventNodeDeleted, true
+			}
+			return 0, false
+		}
+		if !strings.HasPrefix(key, prefix) || strings.Contains(key[len(prefix):], "/") {
+			return 0, false
+		}
+		if e.Type == "DELETE" || e.Kv.Version == 1 {
+			return EventNodeChildrenChanged, true
+		}
+		return 0, false
+	})
+	return children, event, nil
+}
+
+// watch Watch the keys from the revision until the first event accepted by convert
+func (backend *EtcdBackend) watch(path string, key []byte, rangeEnd []byte, startRevision etcdInt64,
+	convert func(etcdEvent) (EventType, bool)) <-chan Event {
+	event := make(chan Event, 1)
+
+	go func() {
+		defer close(event)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-backend.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		notWatching := func(err error) {
+			select {
+			case <-backend.closed:
+				err = ErrClosed
+			default:
+			}
+			event <- Event{EventNotWatching, path, err}
+		}
+
+		request := etcdWatchRequest{etcdWatchCreateRequest{key, rangeEnd, startRevision}}
+		response, err := backend.post(ctx, backend.watchClient, "/v3/watch", request)
+		if err != nil {
+			notWatching(err)
+			return
+		}
+		defer response.Body.Close()
+
+		decoder := json.NewDecoder(response.Body)
+		for {
+			var watchResponse etcdWatchResponse
+			err = decoder.Decode(&watchResponse)
+			if err != nil {
+				notWatching(err)
+				return
+			}
+			if watchResponse.Error != nil {
+				notWatching(errors.New("etcd: " + watchResponse.Error.Message))
+				return
+			}
+			if watchResponse.Result.Canceled {
+				notWatching(errors.New("etcd: watch canceled: " + watchResponse.Result.CancelReason))
+				return
+			}
+			for _, e := range watchResponse.Result.Events {
+				if eventType, ok := convert(e); ok {
+					event <- Event{eventType, path, nil}
+					return
+				}
+			}
+		}
+	}()
+
+	return event
+}
+
+// lease Get the lease of the ephemeral nodes, grant it if needed
+func (backend *EtcdBackend) lease() (leaseID etcdInt64, err error) {
+	backend.leaseLock.Lock()
+	defer backend.leaseLock.Unlock()
+
+	if backend.leaseID != 0 {
+		return backend.leaseID, nil
+	}
+
+	var response etcdLeaseResponse
+	err = backend.call("/v3/lease/grant", etcdLeaseRequest{TTL: etcdInt64(backend.leaseTTL / time.Second)}, &response)
+	if err != nil {
+		return
+	}
+	if response.ID == 0 {
+		return 0, errors.New("etcd: lease grant failed")
+	}
+
+	backend.leaseID = response.ID
+	glog.Info("etcd: lease granted: ", response.ID, ", TTL: ", response.TTL)
+	go backend.keepAlive(response.ID)
+	return response.ID, nil
+}
+
+// keepAlive Keep the lease alive until the backend is closed or the lease expires
+func (backend *EtcdBackend) keepAlive(leaseID etcdInt64) {
+	interval := backend.leaseTTL / 3
+	for {
+		select {
+		case <-backend.closed:
+			return
+		case <-time.After(interval):
+		}
+
+		var response etcdLeaseKeepAliveResponse
+		err := backend.call("/v3/lease/keepalive", etcdLeaseRequest{ID: leaseID}, &response)
+		if err == nil && response.Error != nil {
+			err = errors.New("etcd: " + response.Error.Message)
+		}
+		if err != nil {
+			glog.Warning("etcd: lease keepalive failed: ", leaseID, "; ", err)
+			continue
+		}
+
+		if response.Result.TTL <= 0 {
+			glog.Error("etcd: lease expired, the ephemeral nodes are removed: ", leaseID)
+			backend.leaseLock.Lock()
+			if backend.leaseID == leaseID {
+				backend.leaseID = 0
+			}
+			backend.leaseLock.Unlock()
+
+			// Nothing to reconnect, the next ephemeral node gets a new lease
+			sendSessionEvent(backend.sessionEvents, SessionExpired)
+			sendSessionEvent(backend.sessionEvents, SessionRestored)
+			return
+		}
+	}
+}
+
+// SessionEvents Expiration of the lease of the ephemeral nodes
+func (backend *EtcdBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+// Close Close the backend and revoke the lease, the ephemeral nodes are removed
+func (backend *EtcdBackend) Close() {
+	backend.closeOnce.Do(func() {
+		close(backend.closed)
+
+		backend.leaseLock.Lock()
+		leaseID := backend.leaseID
+		backend.leaseID = 0
+		backend.leaseLock.Unlock()
+
+		if leaseID != 0 {
+			var response etcdLeaseResponse
+			err := backend.call("/v3/lease/revoke", etcdLeaseRequest{ID: leaseID}, &response)
+			if err != nil {
+				glog.Warning("etcd: lease revoke failed: ", leaseID, "; ", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,408 @@
+package coordination
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcdEvent An event in the history of fakeEtcd
+type fakeEtcdEvent struct {
+	revision int64
+	event    etcdEvent
+}
+
+// fakeEtcd The part of the JSON gateway of etcd used by EtcdBackend, in memory
+type fakeEtcd struct {
+	lock     sync.Mutex
+	revision int64
+	kvs      map[string]*etcdKeyValue
+	history  []fakeEtcdEvent
+	// Closed and replaced when an event is added
+	changed chan struct{}
+	// TTL of the granted leases
+	leases    map[etcdInt64]etcdInt64
+	nextLease etcdInt64
+	// The transactions received
+	txns []etcdTxnRequest
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		revision:  1,
+		kvs:       make(map[string]*etcdKeyValue),
+		changed:   make(chan struct{}),
+		leases:    make(map[etcdInt64]etcdInt64),
+		nextLease: 100,
+	}
+}
+
+// newFakeEtcdBackend Create an EtcdBackend connected to a new fakeEtcd, closed with the test
+func newFakeEtcdBackend(t *testing.T, leaseTTL time.Duration) (*EtcdBackend, *fakeEtcd) {
+	etcd := newFakeEtcd()
+	server := httptest.NewServer(etcd)
+	backend, err := NewEtcdBackend([]string{server.URL}, leaseTTL)
+	if err != nil {
+		t.Fatal("connect fake etcd failed: ", err)
+	}
+	t.Cleanup(func() {
+		// End the watches before the server waits for its requests
+		backend.Close()
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return backend, etcd
+}
+
+// inRange Whether the key is in the range of a request
+func inRange(key []byte, start []byte, end []byte) bool {
+	if len(end) == 0 {
+		return bytes.Equal(key, start)
+	}
+	if bytes.Compare(key, start) < 0 {
+		return false
+	}
+	return bytes.Equal(end, []byte{0}) || bytes.Compare(key, end) < 0
+}
+
+// addEvent Add the event to the history at a new revision, called with the lock
+func (etcd *fakeEtcd) addEvent(eventType etcdEventType, kv etcdKeyValue) {
+	etcd.history = append(etcd.history, fakeEtcdEvent{etcd.revision, etcdEvent{eventType, kv}})
+	close(etcd.changed)
+	etcd.changed = make(chan struct{})
+}
+
+// put Put the key at a new revision, called with the lock
+func (etcd *fakeEtcd) put(request *etcdPutRequest) {
+	etcd.revision++
+	key := string(request.Key)
+	kv, exists := etcd.kvs[key]
+	if !exists {
+		kv = &etcdKeyValue{Key: request.Key, CreateRevision: etcdInt64(etcd.revision)}
+		etcd.kvs[key] = kv
+	}
+	kv.ModRevision = etcdInt64(etcd.revision)
+	kv.Version++
+	kv.Value = request.Value
+	if !request.IgnoreLease {
+		kv.Lease = request.Lease
+	}
+	etcd.addEvent("PUT", *kv)
+}
+
+// deleteKey Delete the key at a new revision, called with the lock
+func (etcd *fakeEtcd) deleteKey(key string) {
+	if _, exists := etcd.kvs[key]; !exists {
+		return
+	}
+	etcd.revision++
+	delete(etcd.kvs, key)
+	etcd.addEvent("DELETE", etcdKeyValue{Key: []byte(key), ModRevision: etcdInt64(etcd.revision)})
+}
+
+// compare Evaluate the compare of a transaction, called with the lock
+func (etcd *fakeEtcd) compare(compare etcdCompare) bool {
+	var kv etcdKeyValue
+	if existing, exists := etcd.kvs[string(compare.Key)]; exists {
+		kv = *existing
+	}
+	var actual, expected etcdInt64
+	switch compare.Target {
+	case "CREATE":
+		actual, expected = kv.CreateRevision, *compare.CreateRevision
+	case "VERSION":
+		actual, expected = kv.Version, *compare.Version
+	}
+	switch compare.Result {
+	case "EQUAL":
+		return actual == expected
+	case "GREATER":
+		return actual > expected
+	}
+	return false
+}
+
+// kv Get the key
+func (etcd *fakeEtcd) kv(key string) (kv etcdKeyValue, exists bool) {
+	etcd.lock.Lock()
+	defer etcd.lock.Unlock()
+
+	if existing, exists := etcd.kvs[key]; exists {
+		return *existing, true
+	}
+	return
+}
+
+// txn Get the transaction received, the last one if index is -1
+func (etcd *fakeEtcd) txn(index int) etcdTxnRequest {
+	etcd.lock.Lock()
+	defer etcd.lock.Unlock()
+
+	if index < 0 {
+		index = len(etcd.txns) - 1
+	}
+	return etcd.txns[index]
+}
+
+// Expire Expire the lease and delete its keys
+func (etcd *fakeEtcd) Expire(leaseID etcdInt64) {
+	etcd.lock.Lock()
+	defer etcd.lock.Unlock()
+
+	etcd.expire(leaseID)
+}
+
+// expire Expire the lease and delete its keys, called with the lock
+func (etcd *fakeEtcd) expire(leaseID etcdInt64) {
+	delete(etcd.leases, leaseID)
+	for key, kv := range etcd.kvs {
+		if kv.Lease == leaseID {
+			etcd.deleteKey(key)
+		}
+	}
+}
+
+func (etcd *fakeEtcd) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v3/watch" {
+		etcd.serveWatch(w, req)
+		return
+	}
+
+	etcd.lock.Lock()
+	defer etcd.lock.Unlock()
+
+	var response interface{}
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		var request etcdRangeRequest
+		json.NewDecoder(req.Body).Decode(&request)
+		var rangeResponse etcdRangeResponse
+		for _, kv := range etcd.kvs {
+			if inRange(kv.Key, request.Key, request.RangeEnd) {
+				kv := *kv
+				if request.KeysOnly {
+					kv.Value = nil
+				}
+				rangeResponse.Kvs = append(rangeResponse.Kvs, kv)
+			}
+		}
+		rangeResponse.Header.Revision = etcdInt64(etcd.revision)
+		response = rangeResponse
+
+	case "/v3/kv/txn":
+		var request etcdTxnRequest
+		json.NewDecoder(req.Body).Decode(&request)
+		etcd.txns = append(etcd.txns, request)
+		succeeded := true
+		for _, compare := range request.Compare {
+			succeeded = succeeded && etcd.compare(compare)
+		}
+		if succeeded {
+			for _, op := range request.Success {
+				if op.RequestPut != nil {
+					etcd.put(op.RequestPut)
+				}
+				if op.RequestDeleteRange != nil {
+					etcd.deleteKey(string(op.RequestDeleteRange.Key))
+				}
+			}
+		}
+		response = etcdTxnResponse{etcdResponseHeader{etcdInt64(etcd.revision)}, succeeded}
+
+	case "/v3/lease/grant":
+		var request etcdLeaseRequest
+		json.NewDecoder(req.Body).Decode(&request)
+		etcd.nextLease++
+		etcd.leases[etcd.nextLease] = request.TTL
+		response = etcdLeaseResponse{ID: etcd.nextLease, TTL: request.TTL}
+
+	case "/v3/lease/keepalive":
+		var request etcdLeaseRequest
+		json.NewDecoder(req.Body).Decode(&request)
+		// The TTL of an expired lease is 0
+		response = etcdLeaseKeepAliveResponse{Result: etcdLeaseResponse{ID: request.ID, TTL: etcd.leases[request.ID]}}
+
+	case "/v3/lease/revoke":
+		var request etcdLeaseRequest
+		json.NewDecoder(req.Body).Decode(&request)
+		etcd.expire(request.ID)
+		response = struct{}{}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(etcdError{"unknown api " + req.URL.Path})
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveWatch Stream the events of the range from the start revision until the client is gone
+func (etcd *fakeEtcd) serveWatch(w http.ResponseWriter, req *http.Request) {
+	var request etcdWatchRequest
+	json.NewDecoder(req.Body).Decode(&request)
+	create := request.CreateRequest
+	next := int64(create.StartRevision)
+
+	encoder := json.NewEncoder(w)
+	// The first response confirms the creation of the watch
+	encoder.Encode(etcdWatchResponse{})
+	w.(http.Flusher).Flush()
+
+	for {
+		var response etcdWatchResponse
+		etcd.lock.Lock()
+		for _, e := range etcd.history {
+			if e.revision >= next && inRange(e.event.Kv.Key, create.Key, create.RangeEnd) {
+				response.Result.Events = append(response.Result.Events, e.event)
+			}
+		}
+		next = etcd.revision + 1
+		changed := etcd.changed
+		etcd.lock.Unlock()
+
+		if len(response.Result.Events) > 0 {
+			encoder.Encode(response)
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func TestEtcdVersion(t *testing.T) {
+	backend, etcd := newFakeEtcdBackend(t, time.Second)
+	backend.Create("/coin", []byte("btc"))
+
+	// The version of etcd starts from 1, the version of the backend from 0 like Zookeeper
+	if _, version, _ := backend.Get("/coin"); version != 0 {
+		t.Error("version after create: ", version)
+	}
+	backend.Set("/coin", []byte("bch"), 0)
+	kv, _ := etcd.kv("/coin")
+	if _, version, _ := backend.Get("/coin"); version != 1 || kv.Version != 2 {
+		t.Error("version after set: ", version, ", etcd version: ", kv.Version)
+	}
+
+	compare := etcd.txn(-1).Compare[0]
+	if compare.Target != "VERSION" || compare.Result != "EQUAL" || *compare.Version != 1 {
+		t.Errorf("compare of the version 0: %+v", compare)
+	}
+	if err := backend.Delete("/coin", 0); err != ErrBadVersion {
+		t.Error("delete with the version of etcd: ", err)
+	}
+
+	// -1 matches any version of an existing node
+	backend.Set("/coin", []byte("bsv"), -1)
+	compare = etcd.txn(-1).Compare[0]
+	if compare.Target != "CREATE" || compare.Result != "GREATER" || *compare.CreateRevision != 0 {
+		t.Errorf("compare of any version: %+v", compare)
+	}
+}
+
+func TestEtcdCreateParent(t *testing.T) {
+	backend, etcd := newFakeEtcdBackend(t, time.Second)
+
+	if err := backend.Create("/ids/1", nil); err != ErrNoNode {
+		t.Error("create without parent: ", err)
+	}
+	// The parent must exist in the same transaction as the creation
+	compares := etcd.txn(0).Compare
+	if len(compares) != 2 || string(compares[1].Key) != "/ids" || compares[1].Target != "CREATE" {
+		t.Errorf("compares of create: %+v", compares)
+	}
+
+	backend.Create("/ids", nil)
+	if err := backend.Create("/ids/1", nil); err != nil {
+		t.Error("create with parent: ", err)
+	}
+	if err := backend.Create("/ids/1", nil); err != ErrNodeExists {
+		t.Error("create twice: ", err)
+	}
+	// The nodes under the root have no parent to check
+	if compares := etcd.txn(1).Compare; len(compares) != 1 {
+		t.Errorf("compares of create under the root: %+v", compares)
+	}
+}
+
+func TestEtcdChildrenW(t *testing.T) {
+	backend, _ := newFakeEtcdBackend(t, time.Second)
+	CreatePath(backend, "/ids/1")
+	backend.Create("/idsx", nil)
+
+	children, event, err := backend.ChildrenW("/ids")
+	if err != nil || !reflect.DeepEqual(children, []string{"1"}) {
+		t.Fatal("children: ", children, ", ", err)
+	}
+
+	// A grandchild, a change of a child, a change of the node and a key with the same prefix are not children changes
+	backend.Create("/ids/1/a", nil)
+	backend.Set("/ids/1", []byte("b"), -1)
+	backend.Set("/ids", []byte("c"), -1)
+	backend.Create("/idsy", nil)
+	select {
+	case e := <-event:
+		t.Fatal("unexpected event: ", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	backend.Create("/ids/2", nil)
+	waitEvent(t, event, EventNodeChildrenChanged)
+
+	_, event, _ = backend.ChildrenW("/ids")
+	backend.Delete("/ids/1/a", -1)
+	backend.Delete("/ids/2", -1)
+	waitEvent(t, event, EventNodeChildrenChanged)
+}
+
+func TestEtcdLeaseExpire(t *testing.T) {
+	backend, etcd := newFakeEtcdBackend(t, time.Second)
+	CreatePath(backend, "/ids")
+
+	if err := backend.CreateEphemeral("/ids/1", nil); err != nil {
+		t.Fatal("create ephemeral: ", err)
+	}
+	kv, _ := etcd.kv("/ids/1")
+	leaseID := kv.Lease
+	if leaseID == 0 {
+		t.Fatal("ephemeral node without lease")
+	}
+	_, _, event, _ := backend.GetW("/ids/1")
+
+	etcd.Expire(leaseID)
+	waitEvent(t, event, EventNodeDeleted)
+
+	// The keepalive finds the lease expired
+	for _, expected := range []SessionEvent{SessionExpired, SessionRestored} {
+		select {
+		case e := <-backend.SessionEvents():
+			if e != expected {
+				t.Error("session event: ", e, ", expected: ", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no session event, expected: ", expected)
+		}
+	}
+
+	// The next ephemeral node gets a new lease
+	if err := backend.CreateEphemeral("/ids/1", nil); err != nil {
+		t.Fatal("create ephemeral after expire: ", err)
+	}
+	if kv, _ = etcd.kv("/ids/1"); kv.Lease == 0 || kv.Lease == leaseID {
+		t.Error("lease after expire: ", kv.Lease)
+	}
+
+	// The ephemeral nodes are removed with the backend
+	backend.Close()
+	if _, exists := etcd.kv("/ids/1"); exists {
+		t.Error("ephemeral node exists after close")
+	}
+}
@@ -0,0 +1,288 @@
+package coordination
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryNode A node of MemoryBackend
+type memoryNode struct {
+	value     []byte
+	version   int32
+	ephemeral bool
+}
+
+// MemoryBackend Backend in memory with the semantics of Zookeeper, for the tests and single-process setups.
+// All users of a MemoryBackend share one session.
+type MemoryBackend struct {
+	lock  sync.Mutex
+	nodes map[string]*memoryNode
+	// Watches of GetW and ExistsW
+	dataWatches map[string][]chan Event
+	// Watches of ChildrenW
+	childWatches map[string][]chan Event
+	// Session events sent by Expire
+	sessionEvents chan SessionEvent
+	closed        bool
+}
+
+// NewMemoryBackend Create an empty backend with the root node "/"
+func NewMemoryBackend() (backend *MemoryBackend) {
+	backend = new(MemoryBackend)
+	backend.nodes = map[string]*memoryNode{"/": {value: []byte{}}}
+	backend.dataWatches = make(map[string][]chan Event)
+	backend.childWatches = make(map[string][]chan Event)
+	backend.sessionEvents = make(chan SessionEvent, sessionEventBufferSize)
+	return
+}
+
+// memoryParent Path of the parent of the node
+func memoryParent(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index <= 0 {
+		return "/"
+	}
+	return path[:index]
+}
+
+// addWatch Add a watch of the path
+func addWatch(watches map[string][]chan Event, path string) <-chan Event {
+	event := make(chan Event, 1)
+	watches[path] = append(watches[path], event)
+	return event
+}
+
+// fireWatches Send the event to the watches of the path and remove them
+func fireWatches(watches map[string][]chan Event, path string, eventType EventType) {
+	for _, event := range watches[path] {
+		event <- Event{eventType, path, nil}
+		close(event)
+	}
+	delete(watches, path)
+}
+
+// Get Get the value and the version of the node
+func (backend *MemoryBackend) Get(path string) (value []byte, version int32, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return nil, 0, ErrClosed
+	}
+	node, ok := backend.nodes[path]
+	if !ok {
+		return nil, 0, ErrNoNode
+	}
+	return append([]byte{}, node.value...), node.version, nil
+}
+
+// GetW Get the value and the version of the node, and watch its change or deletion
+func (backend *MemoryBackend) GetW(path string) (value []byte, version int32, event <-chan Event, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return nil, 0, nil, ErrClosed
+	}
+	node, ok := backend.nodes[path]
+	if !ok {
+		return nil, 0, nil, ErrNoNode
+	}
+	return append([]byte{}, node.value...), node.version, addWatch(backend.dataWatches, path), nil
+}
+
+// Exists Check whether the node exists
+func (backend *MemoryBackend) Exists(path string) (exists bool, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return false, ErrClosed
+	}
+	_, exists = backend.nodes[path]
+	return
+}
+
+// ExistsW Check whether the node exists, and watch its creation, change or deletion
+func (backend *MemoryBackend) ExistsW(path string) (exists bool, event <-chan Event, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return false, nil, ErrClosed
+	}
+	_, exists = backend.nodes[path]
+	return exists, addWatch(backend.dataWatches, path), nil
+}
+
+// create Create the node if it does not exist and its parent exists
+func (backend *MemoryBackend) create(path string, value []byte, ephemeral bool) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return ErrClosed
+	}
+	if _, exists := backend.nodes[path]; exists {
+		return ErrNodeExists
+	}
+	parent := memoryParent(path)
+	if _, exists := backend.nodes[parent]; !exists {
+		return ErrNoNode
+	}
+
+	backend.nodes[path] = &memoryNode{value: append([]byte{}, value...), ephemeral: ephemeral}
+	fireWatches(backend.dataWatches, path, EventNodeCreated)
+	fireWatches(backend.childWatches, parent, EventNodeChildrenChanged)
+	return nil
+}
+
+// Create Create a persistent node, returns ErrNodeExists if it exists
+func (backend *MemoryBackend) Create(path string, value []byte) error {
+	return backend.create(path, value, false)
+}
+
+// CreateEphemeral Create a node removed when the backend is closed or expired
+func (backend *MemoryBackend) CreateEphemeral(path string, value []byte) error {
+	return backend.create(path, value, true)
+}
+
+// Set Set the value of an existing node
+func (backend *MemoryBackend) Set(path string, value []byte, version int32) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return ErrClosed
+	}
+	node, ok := backend.nodes[path]
+	if !ok {
+		return ErrNoNode
+	}
+	if version >= 0 && version != node.version {
+		return ErrBadVersion
+	}
+
+	node.value = append([]byte{}, value...)
+	node.version++
+	fireWatches(backend.dataWatches, path, EventNodeDataChanged)
+	return nil
+}
+
+// delete Delete the node, the lock must be held
+func (backend *MemoryBackend) delete(path string) {
+	delete(backend.nodes, path)
+	fireWatches(backend.dataWatches, path, EventNodeDeleted)
+	fireWatches(backend.childWatches, path, EventNodeDeleted)
+	fireWatches(backend.childWatches, memoryParent(path), EventNodeChildrenChanged)
+}
+
+// Delete Delete the node
+func (backend *MemoryBackend) Delete(path string, version int32) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return ErrClosed
+	}
+	node, ok := backend.nodes[path]
+	if !ok {
+		return ErrNoNode
+	}
+	if version >= 0 && version != node.version {
+		return ErrBadVersion
+	}
+
+	backend.delete(path)
+	return nil
+}
+
+// children Get the names of the children, the lock must be held
+func (backend *MemoryBackend) children(path string) []string {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	children := []string{}
+	for nodePath := range backend.nodes {
+		if nodePath != "/" && strings.HasPrefix(nodePath, prefix) && !strings.Contains(nodePath[len(prefix):], "/") {
+			children = append(children, nodePath[len(prefix):])
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// Children Get the names of the children of the node
+func (backend *MemoryBackend) Children(path string) (children []string, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return nil, ErrClosed
+	}
+	if _, ok := backend.nodes[path]; !ok {
+		return nil, ErrNoNode
+	}
+	return backend.children(path), nil
+}
+
+// ChildrenW Get the names of the children of the node, and watch a child being added or removed
+func (backend *MemoryBackend) ChildrenW(path string) (children []string, event <-chan Event, err error) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return nil, nil, ErrClosed
+	}
+	if _, ok := backend.nodes[path]; !ok {
+		return nil, nil, ErrNoNode
+	}
+	return backend.children(path), addWatch(backend.childWatches, path), nil
+}
+
+// endSession Drop the watches with the error and remove the ephemeral nodes, the lock must be held
+func (backend *MemoryBackend) endSession(err error) {
+	for _, watches := range []map[string][]chan Event{backend.dataWatches, backend.childWatches} {
+		for path, events := range watches {
+			for _, event := range events {
+				event <- Event{EventNotWatching, path, err}
+				close(event)
+			}
+			delete(watches, path)
+		}
+	}
+
+	for path, node := range backend.nodes {
+		if node.ephemeral {
+			delete(backend.nodes, path)
+		}
+	}
+}
+
+// Expire Simulate the expiration of the session: all watches receive EventNotWatching with
+// ErrSessionExpired and the ephemeral nodes are removed, then a new session is established
+// (SessionExpired and SessionRestored are sent). The backend is still usable.
+func (backend *MemoryBackend) Expire() {
+	backend.lock.Lock()
+	backend.endSession(ErrSessionExpired)
+	backend.lock.Unlock()
+
+	sendSessionEvent(backend.sessionEvents, SessionExpired)
+	sendSessionEvent(backend.sessionEvents, SessionRestored)
+}
+
+// SessionEvents The session events sent by Expire
+func (backend *MemoryBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+// Close Close the backend, the ephemeral nodes are removed
+func (backend *MemoryBackend) Close() {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.closed {
+		return
+	}
+	backend.endSession(ErrClosed)
+	backend.closed = true
+}
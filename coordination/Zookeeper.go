@@ -0,0 +1,236 @@
+package coordination
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// Default Zookeeper session timeout
+const defaultZookeeperSessionTimeout = 5 * time.Second
+
+// ZookeeperBackend Backend on Apache Zookeeper
+type ZookeeperBackend struct {
+	conn *zk.Conn
+	// Events of the connection
+	zkEvents <-chan zk.Event
+	// Session expiration and restoration
+	sessionEvents chan SessionEvent
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewZookeeperBackend Connect to the Zookeeper cluster and wait for the connection (if connectTimeout > 0)
+func NewZookeeperBackend(brokers []string, sessionTimeout time.Duration, connectTimeout time.Duration) (backend *ZookeeperBackend, err error) {
+	if sessionTimeout <= 0 {
+		sessionTimeout = defaultZookeeperSessionTimeout
+	}
+
+	backend = new(ZookeeperBackend)
+	backend.conn, backend.zkEvents, err = zk.Connect(brokers, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	backend.sessionEvents = make(chan SessionEvent, sessionEventBufferSize)
+	backend.closed = make(chan struct{})
+
+	if connectTimeout > 0 {
+		glog.Info("Zookeeper: waiting for connecting to ", brokers, "...")
+		err = backend.waitSession(connectTimeout)
+		if err != nil {
+			backend.conn.Close()
+			return nil, err
+		}
+	}
+
+	go backend.watchSession()
+	return
+}
+
+// waitSession Wait for the first session
+func (backend *ZookeeperBackend) waitSession(timeout time.Duration) error {
+	timer := time.After(timeout)
+	for {
+		select {
+		case e := <-backend.zkEvents:
+			glog.Info("Zookeeper: ", e)
+			if e.State == zk.StateHasSession {
+				return nil
+			}
+		case <-timer:
+			return errors.New("Zookeeper: connecting timeout")
+		}
+	}
+}
+
+// watchSession Convert the expiration of the session and the new session established
+// by go-zookeeper after it to session events
+func (backend *ZookeeperBackend) watchSession() {
+	expired := false
+	for {
+		select {
+		case <-backend.closed:
+			return
+		case e := <-backend.zkEvents:
+			if e.Type != zk.EventSession {
+				continue
+			}
+			glog.Info("Zookeeper: ", e)
+
+			switch e.State {
+			case zk.StateExpired:
+				if !expired {
+					expired = true
+					glog.Warning("Zookeeper: session expired, the ephemeral nodes and watches are lost")
+					sendSessionEvent(backend.sessionEvents, SessionExpired)
+				}
+			case zk.StateHasSession:
+				if expired {
+					expired = false
+					glog.Info("Zookeeper: new session established")
+					sendSessionEvent(backend.sessionEvents, SessionRestored)
+				}
+			}
+		}
+	}
+}
+
+// Conn The Zookeeper connection
+func (backend *ZookeeperBackend) Conn() *zk.Conn {
+	return backend.conn
+}
+
+// SessionEvents Expiration and restoration of the Zookeeper session
+func (backend *ZookeeperBackend) SessionEvents() <-chan SessionEvent {
+	return backend.sessionEvents
+}
+
+// convertZookeeperError Convert the errors of go-zookeeper to the errors of the package
+func convertZookeeperError(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrNoNode
+	case zk.ErrNodeExists:
+		return ErrNodeExists
+	case zk.ErrBadVersion:
+		return ErrBadVersion
+	case zk.ErrSessionExpired:
+		return ErrSessionExpired
+	case zk.ErrClosing:
+		return ErrClosed
+	default:
+		return err
+	}
+}
+
+// convertZookeeperEvent Convert the watch channel of go-zookeeper
+func convertZookeeperEvent(zkEvent <-chan zk.Event) <-chan Event {
+	event := make(chan Event, 1)
+	go func() {
+		defer close(event)
+
+		e, ok := <-zkEvent
+		if !ok {
+			return
+		}
+
+		var eventType EventType
+		switch e.Type {
+		case zk.EventNodeCreated:
+			eventType = EventNodeCreated
+		case zk.EventNodeDeleted:
+			eventType = EventNodeDeleted
+		case zk.EventNodeDataChanged:
+			eventType = EventNodeDataChanged
+		case zk.EventNodeChildrenChanged:
+			eventType = EventNodeChildrenChanged
+		default:
+			eventType = EventNotWatching
+		}
+		event <- Event{eventType, e.Path, convertZookeeperError(e.Err)}
+	}()
+	return event
+}
+
+// Get Get the value and the version of the node
+func (backend *ZookeeperBackend) Get(path string) (value []byte, version int32, err error) {
+	value, stat, err := backend.conn.Get(path)
+	if err != nil {
+		return nil, 0, convertZookeeperError(err)
+	}
+	return value, stat.Version, nil
+}
+
+// GetW Get the value and the version of the node, and watch its change or deletion
+func (backend *ZookeeperBackend) GetW(path string) (value []byte, version int32, event <-chan Event, err error) {
+	value, stat, zkEvent, err := backend.conn.GetW(path)
+	if err != nil {
+		return nil, 0, nil, convertZookeeperError(err)
+	}
+	return value, stat.Version, convertZookeeperEvent(zkEvent), nil
+}
+
+// Exists Check whether the node exists
+func (backend *ZookeeperBackend) Exists(path string) (exists bool, err error) {
+	exists, _, err = backend.conn.Exists(path)
+	return exists, convertZookeeperError(err)
+}
+
+// ExistsW Check whether the node exists, and watch its creation, change or deletion
+func (backend *ZookeeperBackend) ExistsW(path string) (exists bool, event <-chan Event, err error) {
+	exists, _, zkEvent, err := backend.conn.ExistsW(path)
+	if err != nil {
+		return false, nil, convertZookeeperError(err)
+	}
+	return exists, convertZookeeperEvent(zkEvent), nil
+}
+
+// Create Create a persistent node, returns ErrNodeExists if it exists
+func (backend *ZookeeperBackend) Create(path string, value []byte) error {
+	_, err := backend.conn.Create(path, value, 0, zk.WorldACL(zk.PermAll))
+	return convertZookeeperError(err)
+}
+
+// CreateEphemeral Create a node removed when the Zookeeper session ends
+func (backend *ZookeeperBackend) CreateEphemeral(path string, value []byte) error {
+	_, err := backend.conn.Create(path, value, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return convertZookeeperError(err)
+}
+
+// Set Set the value of an existing node
+func (backend *ZookeeperBackend) Set(path string, value []byte, version int32) error {
+	_, err := backend.conn.Set(path, value, version)
+	return convertZookeeperError(err)
+}
+
+// Delete Delete the node
+func (backend *ZookeeperBackend) Delete(path string, version int32) error {
+	return convertZookeeperError(backend.conn.Delete(path, version))
+}
+
+// Children Get the names of the children of the node
+func (backend *ZookeeperBackend) Children(path string) (children []string, err error) {
+	children, _, err = backend.conn.Children(path)
+	return children, convertZookeeperError(err)
+}
+
+// ChildrenW Get the names of the children of the node, and watch a child being added or removed
+func (backend *ZookeeperBackend) ChildrenW(path string) (children []string, event <-chan Event, err error) {
+	children, _, zkEvent, err := backend.conn.ChildrenW(path)
+	if err != nil {
+		return nil, nil, convertZookeeperError(err)
+	}
+	return children, convertZookeeperEvent(zkEvent), nil
+}
+
+// Close Close the connection, the ephemeral nodes are removed
+func (backend *ZookeeperBackend) Close() {
+	backend.closeOnce.Do(func() {
+		close(backend.closed)
+		backend.conn.Close()
+	})
+}
@@ -21,9 +21,17 @@ foreach ($c['AvailableCoins'] as $coin) {
 
 $c['IntervalSeconds'] = (int)optionalTrim('IntervalSeconds', 10);
 
-$c['ZKBroker'] = commaSplitTrim('ZKBroker');
-if (empty($c['ZKBroker']) || in_array('', $c['ZKBroker'])) {
-    fatal('ZKBroker cannot be empty');
+$c['CoordinationBackend'] = optionalTrim('CoordinationBackend', 'zookeeper');
+if ($c['CoordinationBackend'] == 'etcd') {
+    $c['EtcdEndpoints'] = commaSplitTrim('EtcdEndpoints');
+    if (empty($c['EtcdEndpoints']) || in_array('', $c['EtcdEndpoints'])) {
+        fatal('EtcdEndpoints cannot be empty');
+    }
+} else {
+    $c['ZKBroker'] = commaSplitTrim('ZKBroker');
+    if (empty($c['ZKBroker']) || in_array('', $c['ZKBroker'])) {
+        fatal('ZKBroker cannot be empty');
+    }
 }
 
 $c['ZKSwitcherWatchDir'] = notNullTrim("ZKSwitcherWatchDir");
@@ -61,6 +69,12 @@ if ($c['EnableCronJob']) {
     $c['UserCoinMapURL'] = notNullTrim("UserCoinMapURL");
 }
 
+$c['ZKScheduleDir'] = optionalTrim('ZKScheduleDir');
+$c['EnableSchedule'] = isTrue('EnableSchedule');
+if ($c['EnableSchedule'] && empty($c['ZKScheduleDir'])) {
+    fatal('EnableSchedule requires ZKScheduleDir');
+}
+
 echo toJSON($c);
 
 $c['APIUser'] = '******';
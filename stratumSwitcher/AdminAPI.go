@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AdminAPIResponse Admin API response data structure
+type AdminAPIResponse struct {
+	ErrNo   int    `json:"err_no"`
+	ErrMsg  string `json:"err_msg"`
+	Success bool   `json:"success"`
+}
+
+// AdminSessionInfo Information of a session in the admin API
+type AdminSessionInfo struct {
+	SessionID        string  `json:"session_id"`
+	WorkerName       string  `json:"worker_name"`
+	SubAccount       string  `json:"sub_account"`
+	Coin             string  `json:"coin"`
+	Upstream         string  `json:"upstream"`
+	ClientIP         string  `json:"client_ip"`
+	ClientIPPort     string  `json:"client_ip_port"`
+	Protocol         string  `json:"protocol"`
+	Transport        string  `json:"transport"`
+	VersionMask      string  `json:"version_mask"`
+	Difficulty       float64 `json:"difficulty,omitempty"`
+	SharesAccepted   uint64  `json:"shares_accepted"`
+	SharesRejected   uint64  `json:"shares_rejected"`
+	SharesStale      uint64  `json:"shares_stale"`
+	LastShareTime    int64   `json:"last_share_time,omitempty"`
+	ReconnectCounter uint32  `json:"reconnect_counter"`
+	UptimeSeconds    int64   `json:"uptime_seconds"`
+}
+
+// AdminSessionListResponse Response of /sessions
+type AdminSessionListResponse struct {
+	AdminAPIResponse
+	Sessions []AdminSessionInfo `json:"sessions"`
+}
+
+// HTTPRequestHandle HTTP request handler
+type HTTPRequestHandle func(http.ResponseWriter, *http.Request)
+
+// runAdminAPIServer Start the admin API server
+func (manager *StratumSessionManager) runAdminAPIServer(conf ConfigData) {
+	if len(conf.AdminAPIUser) == 0 || len(conf.AdminAPIPassword) == 0 {
+		glog.Error("Admin API disabled: AdminAPIUser and AdminAPIPassword cannot be empty")
+		return
+	}
+
+	basicAuth := func(f HTTPRequestHandle) HTTPRequestHandle {
+		return adminBasicAuth(conf.AdminAPIUser, conf.AdminAPIPassword, f)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", basicAuth(manager.listSessionsHandle))
+	mux.HandleFunc("/session/disconnect", basicAuth(manager.disconnectSessionHandle))
+	mux.HandleFunc("/session/switch", basicAuth(manager.switchSessionHandle))
+	mux.HandleFunc("/drain/start", basicAuth(manager.startDrainHandle))
+	mux.HandleFunc("/drain/status", basicAuth(manager.drainStatusHandle))
+	mux.HandleFunc("/workers", basicAuth(manager.workerHashrateHandle))
+	mux.HandleFunc("/hashrate", basicAuth(manager.hashrateHandle))
+
+	glog.Info("Admin API enabled: ", conf.AdminAPIListenAddr)
+	err := http.ListenAndServe(conf.AdminAPIListenAddr, mux)
+	if err != nil {
+		glog.Error("Admin API listener failed: ", err)
+	}
+}
+
+// adminBasicAuth Perform Basic authentication
+func adminBasicAuth(apiUser string, apiPasswd string, f HTTPRequestHandle) HTTPRequestHandle {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, passwd, ok := r.BasicAuth()
+
+		// Check if the username and password are correct
+		if ok && subtle.ConstantTimeCompare([]byte(apiUser), []byte(user)) == 1 && subtle.ConstantTimeCompare([]byte(apiPasswd), []byte(passwd)) == 1 {
+			f(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`<h1>401 - Unauthorized</h1>`))
+	}
+}
+
+// getRegisteredSession Find a session in normal proxy state by the session_id parameter (hex)
+func (manager *StratumSessionManager) getRegisteredSession(req *http.Request) (session *StratumSession, apiErr *StratumError) {
+	sessionIDStr := req.FormValue("session_id")
+	if len(sessionIDStr) < 1 {
+		apiErr = AdminAPIErrSessionIDIsEmpty
+		return
+	}
+	sessionID, err := strconv.ParseUint(sessionIDStr, 16, 32)
+	if err != nil {
+		apiErr = AdminAPIErrSessionIDInvalid
+		return
+	}
+
+	manager.lock.Lock()
+	session, ok := manager.sessions[uint32(sessionID)]
+	manager.lock.Unlock()
+
+	if !ok {
+		apiErr = AdminAPIErrSessionNotFound
+	}
+	return
+}
+
+// listSessionsHandle List the sessions in normal proxy state.
+// Optional filters: subaccount, coin, ip (IP or CIDR), protocol, transport
+func (manager *StratumSessionManager) listSessionsHandle(w http.ResponseWriter, req *http.Request) {
+	subaccount := req.FormValue("subaccount")
+	coin := req.FormValue("coin")
+	protocol := req.FormValue("protocol")
+	transport := req.FormValue("transport")
+
+	var ipNet *net.IPNet
+	if ipStr := req.FormValue("ip"); ipStr != "" {
+		var err error
+		_, ipNet, err = net.ParseCIDR(ipStr)
+		if err != nil {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				writeAdminAPIError(w, AdminAPIErrIPInvalid)
+				return
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+	}
+
+	now := time.Now()
+	response := AdminSessionListResponse{AdminAPIResponse{0, "", true}, []AdminSessionInfo{}}
+
+	manager.lock.Lock()
+	for _, session := range manager.sessions {
+		// The fields are not changed after the session registered (the upstream is changed when reconnecting, after unregistered),
+		// the coin and the reconnect counter are copied when registered.
+		if subaccount != "" && session.subaccountName != subaccount {
+			continue
+		}
+		if coin != "" && session.metricKey.coin != coin {
+			continue
+		}
+		if protocol != "" && session.metricKey.protocol != protocol {
+			continue
+		}
+		if transport != "" && session.metricKey.transport != transport {
+			continue
+		}
+		clientIP := session.getClientIP()
+		if ipNet != nil && !ipNet.Contains(net.ParseIP(clientIP)) {
+			continue
+		}
+
+		shares := session.shares.Get(now)
+		var lastShareTime int64
+		if !shares.LastShareTime.IsZero() {
+			lastShareTime = shares.LastShareTime.Unix()
+		}
+
+		response.Sessions = append(response.Sessions, AdminSessionInfo{
+			SessionID:        Uint32ToHex(session.sessionID),
+			WorkerName:       session.fullWorkerName,
+			SubAccount:       session.subaccountName,
+			Coin:             session.metricKey.coin,
+			Upstream:         session.serverURL,
+			ClientIP:         clientIP,
+			ClientIPPort:     session.clientIPPort,
+			Protocol:         session.metricKey.protocol,
+			Transport:        session.metricKey.transport,
+			VersionMask:      session.getVersionMaskStr(),
+			Difficulty:       session.getDifficulty(),
+			SharesAccepted:   shares.Accepted,
+			SharesRejected:   shares.Rejected,
+			SharesStale:      shares.Stale,
+			LastShareTime:    lastShareTime,
+			ReconnectCounter: session.registeredReconnectCounter,
+			UptimeSeconds:    int64(now.Sub(session.startTime).Seconds()),
+		})
+	}
+	manager.lock.Unlock()
+
+	sort.Slice(response.Sessions, func(i, j int) bool {
+		return response.Sessions[i].SessionID < response.Sessions[j].SessionID
+	})
+
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// disconnectSessionHandle Disconnect a session, the miner will reconnect
+func (manager *StratumSessionManager) disconnectSessionHandle(w http.ResponseWriter, req *http.Request) {
+	session, apiErr := manager.getRegisteredSession(req)
+	if apiErr != nil {
+		writeAdminAPIError(w, apiErr)
+		return
+	}
+
+	glog.Info("[admin-disconnect] ", session.clientIPPort, "; ", session.fullWorkerName, "; ", Uint32ToHex(session.sessionID))
+	session.setStopReason("admin_disconnect")
+	session.Stop()
+	writeAdminAPISuccess(w)
+}
+
+// switchSessionHandle Switch a session to another coin without changing zookeeper.
+// The session keeps the coin until the value in zookeeper changes.
+func (manager *StratumSessionManager) switchSessionHandle(w http.ResponseWriter, req *http.Request) {
+	coin := req.FormValue("coin")
+	if len(coin) < 1 {
+		writeAdminAPIError(w, AdminAPIErrCoinIsEmpty)
+		return
+	}
+	if _, ok := manager.getStratumServerInfo(coin); !ok {
+		writeAdminAPIError(w, StratumErrStratumServerNotFound)
+		return
+	}
+
+	session, apiErr := manager.getRegisteredSession(req)
+	if apiErr != nil {
+		writeAdminAPIError(w, apiErr)
+		return
+	}
+	if session.isBTCAgent {
+		// BTCAgent sessions cannot be switched seamlessly, see the coin watcher in proxyStratum
+		writeAdminAPIError(w, AdminAPIErrSwitchBTCAgent)
+		return
+	}
+
+	oldCoin := session.getMiningCoin()
+	glog.Info("[admin-switch] ", session.clientIPPort, "; ", session.fullWorkerName, "; ", oldCoin, " -> ", coin)
+
+	err := session.switchCoinType(coin, session.getReconnectCounter())
+	if err == ErrUpstreamUnhealthy {
+		writeAdminAPIError(w, AdminAPIErrUpstreamUnhealthy)
+		return
+	}
+	if err != nil {
+		glog.Warning("[admin-switch] failed: ", session.fullWorkerName, "; ", err)
+		writeAdminAPIError(w, AdminAPIErrSwitchFailed)
+		return
+	}
+	writeAdminAPISuccess(w)
+}
+
+// startDrainHandle Start the drain mode. Optional parameters: duration_seconds, waves
+func (manager *StratumSessionManager) startDrainHandle(w http.ResponseWriter, req *http.Request) {
+	durationSeconds, _ := strconv.Atoi(req.FormValue("duration_seconds"))
+	waves, _ := strconv.Atoi(req.FormValue("waves"))
+
+	if !manager.drainer.Start(durationSeconds, waves) {
+		writeAdminAPIError(w, AdminAPIErrDrainStarted)
+		return
+	}
+	glog.Info("[admin-drain] started")
+	manager.drainStatusHandle(w, req)
+}
+
+// drainStatusHandle Get the progress of the drain mode
+func (manager *StratumSessionManager) drainStatusHandle(w http.ResponseWriter, req *http.Request) {
+	response := struct {
+		AdminAPIResponse
+		Drain DrainStatus `json:"drain"`
+	}{AdminAPIResponse{0, "", true}, manager.drainer.Status()}
+
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+func writeAdminAPISuccess(w http.ResponseWriter) {
+	response := AdminAPIResponse{0, "", true}
+	responseJSON, _ := json.Marshal(response)
+
+	w.Write(responseJSON)
+}
+
+func writeAdminAPIError(w http.ResponseWriter, apiErr *StratumError) {
+	response := AdminAPIResponse{apiErr.ErrNo, apiErr.ErrMsg, false}
+	responseJSON, _ := json.Marshal(response)
+
+	w.Write(responseJSON)
+}
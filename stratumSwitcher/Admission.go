@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// Maximum rejections logged per second, the others are only counted
+const maxAdmissionLogsPerSecond = 10
+
+// Interval of retrying to watch the IP list node in zookeeper
+const zkIPListNodeRetryIntervalSeconds = 10
+
+// IPListConfig The content of AdmissionConfig.IPListFile and AdmissionConfig.ZKIPListNode, CIDRs or IPs
+type IPListConfig struct {
+	// Exempted from the per-IP and per-subnet connection limits
+	Allow []string
+	// Connections are closed at once
+	Deny []string
+}
+
+// ipList Parsed IP allow and deny lists
+type ipList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseIPNet Parse a CIDR, or an IP as a /32 (IPv4) or /128 (IPv6) CIDR
+func parseIPNet(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		if strings.Contains(source, ":") {
+			source += "/128"
+		} else {
+			source += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(source)
+	return ipNet, err
+}
+
+// add Add the CIDRs or IPs of the JSON IPListConfig to the lists
+func (list *ipList) add(listJSON []byte) (err error) {
+	var conf IPListConfig
+	err = json.Unmarshal(listJSON, &conf)
+	if err != nil {
+		return
+	}
+	for _, source := range conf.Allow {
+		ipNet, err := parseIPNet(source)
+		if err != nil {
+			return err
+		}
+		list.allow = append(list.allow, ipNet)
+	}
+	for _, source := range conf.Deny {
+		ipNet, err := parseIPNet(source)
+		if err != nil {
+			return err
+		}
+		list.deny = append(list.deny, ipNet)
+	}
+	return
+}
+
+// ipNetsContain Whether one of the networks contains the IP
+func ipNetsContain(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP The IP of the remote address, nil if it is not an IP address
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// subnetKey The /24 (IPv4) or /64 (IPv6) subnet of the IP
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Admission Admission control of the connections accepted by all listeners
+type Admission struct {
+	conf AdmissionConfig
+	// Rejections by reason
+	rejections *MetricCounterVec
+	// Sessions which have not sent their worker name yet
+	pendingAuthorize int64
+
+	lock sync.Mutex
+	list *ipList
+	// Connections by client IP and by subnet
+	ipConns     map[string]int
+	subnetConns map[string]int
+	// Token bucket of the accept rate limit
+	acceptTokens   float64
+	lastAcceptTime time.Time
+	// Rejections logged and not logged in the second logSecond
+	logSecond      int64
+	loggedThisSec  int
+	suppressedLogs int
+}
+
+// NewAdmission Create an Admission, the rejections are counted in rejections by reason
+func NewAdmission(conf AdmissionConfig, rejections *MetricCounterVec) (admission *Admission) {
+	admission = new(Admission)
+	admission.conf = conf
+	admission.rejections = rejections
+	admission.list = new(ipList)
+	admission.ipConns = make(map[string]int)
+	admission.subnetConns = make(map[string]int)
+	admission.acceptTokens = admission.acceptBurst()
+	admission.lastAcceptTime = time.Now()
+	return
+}
+
+// acceptBurst Connections accepted at once before the rate limit applies, one second of connections
+func (admission *Admission) acceptBurst() float64 {
+	if admission.conf.MaxAcceptsPerSecond < 1 {
+		return 1
+	}
+	return admission.conf.MaxAcceptsPerSecond
+}
+
+// setIPList Replace the IP allow and deny lists
+func (admission *Admission) setIPList(list *ipList) {
+	admission.lock.Lock()
+	admission.list = list
+	admission.lock.Unlock()
+}
+
+// reject Count and log a rejection
+func (admission *Admission) reject(addr string, reason string) {
+	admission.rejections.Inc(reason)
+
+	now := time.Now().Unix()
+	admission.lock.Lock()
+	if now != admission.logSecond {
+		if admission.suppressedLogs > 0 {
+			glog.Warning("[admission] ", admission.suppressedLogs, " rejections not logged")
+		}
+		admission.logSecond = now
+		admission.loggedThisSec = 0
+		admission.suppressedLogs = 0
+	}
+	logIt := admission.loggedThisSec < maxAdmissionLogsPerSecond
+	if logIt {
+		admission.loggedThisSec++
+	} else {
+		admission.suppressedLogs++
+	}
+	admission.lock.Unlock()
+
+	if logIt {
+		glog.Warning("[admission] connection rejected: ", addr, "; ", reason)
+	}
+}
+
+// takeAcceptToken Take a token of the accept rate limit
+func (admission *Admission) takeAcceptToken(now time.Time) bool {
+	if admission.conf.MaxAcceptsPerSecond <= 0 {
+		return true
+	}
+
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	admission.acceptTokens += now.Sub(admission.lastAcceptTime).Seconds() * admission.conf.MaxAcceptsPerSecond
+	if burst := admission.acceptBurst(); admission.acceptTokens > burst {
+		admission.acceptTokens = burst
+	}
+	admission.lastAcceptTime = now
+	if admission.acceptTokens < 1 {
+		return false
+	}
+	admission.acceptTokens--
+	return true
+}
+
+// AllowAccept Apply the accept rate limit to a connection just accepted, the connection is closed if it is rejected
+func (admission *Admission) AllowAccept(conn net.Conn) bool {
+	if admission.takeAcceptToken(time.Now()) {
+		return true
+	}
+	conn.Close()
+	admission.reject(conn.RemoteAddr().String(), "rate_limit")
+	return false
+}
+
+// Admit Apply the IP lists and the connection limits to the client of the connection.
+// The connection is closed if it is rejected, otherwise it is returned wrapped so that closing it releases its slots.
+func (admission *Admission) Admit(conn net.Conn) (net.Conn, bool) {
+	ip := remoteIP(conn.RemoteAddr())
+	if ip == nil {
+		return conn, true
+	}
+
+	counted, reason := admission.acquire(ip)
+	if reason != "" {
+		conn.Close()
+		admission.reject(conn.RemoteAddr().String(), reason)
+		return nil, false
+	}
+	if !counted {
+		return conn, true
+	}
+	return &admittedConn{Conn: conn, admission: admission, ip: ip.String(), subnet: subnetKey(ip)}, true
+}
+
+// acquire Take the slots of the IP and its subnet. counted is false if no slot is taken
+// (the IP is in the allow list or there is no connection limit), reason is set if the IP is rejected.
+func (admission *Admission) acquire(ip net.IP) (counted bool, reason string) {
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	if ipNetsContain(admission.list.deny, ip) {
+		return false, "denied"
+	}
+	if ipNetsContain(admission.list.allow, ip) {
+		return false, ""
+	}
+	if admission.conf.MaxConnectionsPerIP <= 0 && admission.conf.MaxConnectionsPerSubnet <= 0 {
+		return false, ""
+	}
+
+	ipKey, subnet := ip.String(), subnetKey(ip)
+	if admission.conf.MaxConnectionsPerIP > 0 && admission.ipConns[ipKey] >= admission.conf.MaxConnectionsPerIP {
+		return false, "ip_limit"
+	}
+	if admission.conf.MaxConnectionsPerSubnet > 0 && admission.subnetConns[subnet] >= admission.conf.MaxConnectionsPerSubnet {
+		return false, "subnet_limit"
+	}
+	admission.ipConns[ipKey]++
+	admission.subnetConns[subnet]++
+	return true, ""
+}
+
+// release Release the slots of the IP and its subnet
+func (admission *Admission) release(ipKey string, subnet string) {
+	admission.lock.Lock()
+	defer admission.lock.Unlock()
+
+	admission.ipConns[ipKey]--
+	if admission.ipConns[ipKey] <= 0 {
+		delete(admission.ipConns, ipKey)
+	}
+	admission.subnetConns[subnet]--
+	if admission.subnetConns[subnet] <= 0 {
+		delete(admission.subnetConns, subnet)
+	}
+}
+
+// EnterPendingAuthorize Take a slot of the sessions waiting for their worker name, false if MaxPendingAuthorize is reached.
+// LeavePendingAuthorize must be called if the slot is taken.
+func (admission *Admission) EnterPendingAuthorize(addr string) bool {
+	pending := atomic.AddInt64(&admission.pendingAuthorize, 1)
+	if admission.conf.MaxPendingAuthorize > 0 && pending > int64(admission.conf.MaxPendingAuthorize) {
+		atomic.AddInt64(&admission.pendingAuthorize, -1)
+		admission.reject(addr, "pending_authorize")
+		return false
+	}
+	return true
+}
+
+// LeavePendingAuthorize Release the slot taken by EnterPendingAuthorize
+func (admission *Admission) LeavePendingAuthorize() {
+	atomic.AddInt64(&admission.pendingAuthorize, -1)
+}
+
+// PendingAuthorize Sessions waiting for their worker name
+func (admission *Admission) PendingAuthorize() int64 {
+	return atomic.LoadInt64(&admission.pendingAuthorize)
+}
+
+// admittedConn A connection holding the slots of its client IP and subnet until it is closed
+type admittedConn struct {
+	net.Conn
+	admission *Admission
+	ip        string
+	subnet    string
+	once      sync.Once
+}
+
+// Close Close the connection and release its slots
+func (conn *admittedConn) Close() error {
+	conn.once.Do(func() {
+		conn.admission.release(conn.ip, conn.subnet)
+	})
+	return conn.Conn.Close()
+}
+
+// loadIPList Load the IP lists from IPListFile and ZKIPListNode (if configured)
+func (manager *StratumSessionManager) loadIPList() (list *ipList, err error) {
+	list = new(ipList)
+	conf := manager.admission.conf
+
+	if conf.IPListFile != "" {
+		listJSON, err := ioutil.ReadFile(conf.IPListFile)
+		if err != nil {
+			return nil, err
+		}
+		err = list.add(listJSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.ZKIPListNode != "" {
+		listJSON, _, err := manager.zookeeperManager.backend.Get(conf.ZKIPListNode)
+		if err == coordination.ErrNoNode {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(listJSON) > 0 {
+			err = list.add(listJSON)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// reloadIPList Reload the IP lists, the old lists are kept if the new ones cannot be loaded
+func (manager *StratumSessionManager) reloadIPList() {
+	list, err := manager.loadIPList()
+	if err != nil {
+		glog.Error("[admission] load IP list failed, keep the old one: ", err)
+		return
+	}
+	manager.admission.setIPList(list)
+	glog.Info("[admission] IP list loaded, allow: ", len(list.allow), ", deny: ", len(list.deny))
+}
+
+// watchIPListNode Reload the IP lists when the zookeeper node is changed
+func (manager *StratumSessionManager) watchIPListNode() {
+	node := manager.admission.conf.ZKIPListNode
+	glog.Info("[admission] watching IP list node: ", node)
+	for {
+		_, event, err := manager.zookeeperManager.backend.ExistsW(node)
+		if err != nil {
+			glog.Error("[admission] watch IP list node failed: ", node, "; ", err)
+			time.Sleep(zkIPListNodeRetryIntervalSeconds * time.Second)
+			continue
+		}
+
+		e := <-event
+		if e.Type == coordination.EventNodeCreated || e.Type == coordination.EventNodeDataChanged || e.Type == coordination.EventNodeDeleted {
+			glog.Info("[admission] IP list node changed: ", node, "; ", e.Type)
+			manager.reloadIPList()
+		}
+	}
+}
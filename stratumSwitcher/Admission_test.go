@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn A connection from the address
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *addrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *addrConn) Close() error {
+	return nil
+}
+
+func newAddrConn(addr string) net.Conn {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return &addrConn{remoteAddr: tcpAddr}
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	admission := NewAdmission(AdmissionConfig{Enable: true, MaxConnectionsPerIP: 2, MaxConnectionsPerSubnet: 3},
+		NewMetricCounterVec("rejected_connections_total", "", "reason"))
+	list := new(ipList)
+	err := list.add([]byte(`{"Allow":["10.0.0.0/8"],"Deny":["192.168.1.100","2001:db8::/32"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admission.setIPList(list)
+
+	admit := func(addr string) net.Conn {
+		conn, ok := admission.Admit(newAddrConn(addr))
+		if !ok {
+			return nil
+		}
+		return conn
+	}
+
+	a1 := admit("192.168.1.1:1000")
+	a2 := admit("192.168.1.1:1001")
+	if a1 == nil || a2 == nil {
+		t.Fatal("connections under the limits rejected")
+	}
+	if admit("192.168.1.1:1002") != nil {
+		t.Error("per-IP limit not applied")
+	}
+	b1 := admit("192.168.1.2:1000")
+	if b1 == nil {
+		t.Fatal("connection under the limits rejected")
+	}
+	if admit("192.168.1.3:1000") != nil {
+		t.Error("per-subnet limit not applied")
+	}
+	if admit("192.168.2.1:1000") == nil {
+		t.Error("connection of another subnet rejected")
+	}
+	if admit("192.168.1.100:1000") != nil || admit("[2001:db8::1]:1000") != nil {
+		t.Error("denied IP admitted")
+	}
+	for i := 0; i < 5; i++ {
+		if admit("10.0.0.1:1000") == nil {
+			t.Error("allowed IP rejected")
+		}
+	}
+
+	// Closing twice releases the slots once
+	a1.Close()
+	a1.Close()
+	if admit("192.168.1.3:1000") == nil {
+		t.Error("slot of the closed connection not released")
+	}
+	if admit("192.168.1.1:1002") != nil {
+		t.Error("per-subnet limit not applied after the release")
+	}
+
+	rejections := admission.rejections.values
+	if rejections[`{reason="ip_limit"}`] != 1 || rejections[`{reason="subnet_limit"}`] != 2 || rejections[`{reason="denied"}`] != 2 {
+		t.Error("unexpected rejections: ", rejections)
+	}
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	admission := NewAdmission(AdmissionConfig{Enable: true, MaxAcceptsPerSecond: 10},
+		NewMetricCounterVec("rejected_connections_total", "", "reason"))
+
+	now := time.Now()
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if admission.takeAcceptToken(now) {
+			accepted++
+		}
+	}
+	if accepted != 10 {
+		t.Error("burst of 10 expected, accepted: ", accepted)
+	}
+
+	if !admission.takeAcceptToken(now.Add(100 * time.Millisecond)) {
+		t.Error("token not refilled")
+	}
+	if admission.takeAcceptToken(now.Add(100 * time.Millisecond)) {
+		t.Error("rate limit not applied")
+	}
+}
+
+func TestAdmissionPendingAuthorize(t *testing.T) {
+	admission := NewAdmission(AdmissionConfig{Enable: true, MaxPendingAuthorize: 2},
+		NewMetricCounterVec("rejected_connections_total", "", "reason"))
+
+	if !admission.EnterPendingAuthorize("a") || !admission.EnterPendingAuthorize("b") {
+		t.Fatal("sessions under the limit rejected")
+	}
+	if admission.EnterPendingAuthorize("c") {
+		t.Error("pending authorize limit not applied")
+	}
+	admission.LeavePendingAuthorize()
+	if !admission.EnterPendingAuthorize("c") {
+		t.Error("slot not released")
+	}
+	if admission.PendingAuthorize() != 2 {
+		t.Error("2 pending sessions expected, got: ", admission.PendingAuthorize())
+	}
+}
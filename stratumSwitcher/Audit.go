@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Events waiting to be written to a destination, the new events are dropped when it is full
+const eventQueueSize = 10000
+
+// Maximum events written to a destination at once
+const eventBatchSize = 100
+
+// Default size of the audit log file before it is rotated
+const defaultAuditLogMaxFileSizeMB = 100
+
+// Default number of rotated audit log files kept
+const defaultAuditLogMaxBackups = 10
+
+// AuditEvent A record of the audit log of the session lifecycle
+type AuditEvent struct {
+	Time string `json:"time"`
+	// connect, authorize, switch, reconnect or disconnect
+	Event      string `json:"event"`
+	ServerID   uint8  `json:"server_id"`
+	SessionID  string `json:"session_id"`
+	ClientIP   string `json:"client_ip"`
+	Transport  string `json:"transport"`
+	Worker     string `json:"worker,omitempty"`
+	SubAccount string `json:"sub_account,omitempty"`
+	Coin       string `json:"coin,omitempty"`
+	OldCoin    string `json:"old_coin,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+	// success or failure (authorize, switch and reconnect)
+	Result string `json:"result,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Duration of the step, or of the session for disconnect
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// eventSink A destination of the JSON events written in the background
+type eventSink interface {
+	writeEvents(events [][]byte) error
+}
+
+// startEventWriter Write the events sent to the returned queue to the sink in the background, in batches
+func startEventWriter(name string, sink eventSink) chan<- []byte {
+	queue := make(chan []byte, eventQueueSize)
+	go func() {
+		for event := range queue {
+			events := [][]byte{event}
+			for len(events) < eventBatchSize && len(queue) > 0 {
+				events = append(events, <-queue)
+			}
+			err := sink.writeEvents(events)
+			if err != nil {
+				glog.Error("write ", len(events), " events to ", name, " failed: ", err)
+			}
+		}
+	}()
+	return queue
+}
+
+// AuditLogger Writes the audit events as JSON lines to a rotating file and/or a Kafka topic.
+// The events are written in the background, Log never blocks the sessions.
+type AuditLogger struct {
+	queues  []chan<- []byte
+	dropped *MetricCounterVec
+	sinks   []string
+}
+
+// NewAuditLogger Create an AuditLogger of the configured destinations, the dropped events are counted in dropped by destination
+func NewAuditLogger(conf AuditLogConfig, dropped *MetricCounterVec) (logger *AuditLogger, err error) {
+	logger = new(AuditLogger)
+	logger.dropped = dropped
+
+	if conf.File != "" {
+		var file *rotatingFile
+		file, err = newRotatingFile(conf.File, conf.MaxFileSizeMB, conf.MaxBackups)
+		if err != nil {
+			return
+		}
+		logger.addSink("file", file)
+	}
+
+	if len(conf.KafkaBrokers) > 0 {
+		var producer KafkaProducer
+		producer, err = newKafkaProducer(conf.KafkaBrokers, conf.KafkaTopic)
+		if err != nil {
+			return
+		}
+		logger.addSink("kafka", kafkaEventSink{producer})
+	}
+	return
+}
+
+// addSink Add a destination and start its writer
+func (logger *AuditLogger) addSink(name string, sink eventSink) {
+	logger.queues = append(logger.queues, startEventWriter("audit "+name, sink))
+	logger.sinks = append(logger.sinks, name)
+}
+
+// Log Write an event, the time is set if it is empty
+func (logger *AuditLogger) Log(event *AuditEvent) {
+	if event.Time == "" {
+		event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		glog.Error("[audit] encode event failed: ", err)
+		return
+	}
+
+	for i, queue := range logger.queues {
+		select {
+		case queue <- line:
+		default:
+			logger.dropped.Inc(logger.sinks[i])
+		}
+	}
+}
+
+// rotatingFile An append-only file renamed to path.1 (path.1 to path.2, ...) when it exceeds maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// newRotatingFile Open the file for appending, zero values are replaced with the defaults
+func newRotatingFile(path string, maxSizeMB int, maxBackups int) (file *rotatingFile, err error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultAuditLogMaxFileSizeMB
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAuditLogMaxBackups
+	}
+
+	file = &rotatingFile{path: path, maxSize: int64(maxSizeMB) << 20, maxBackups: maxBackups}
+	err = file.open()
+	return
+}
+
+// open Open the file for appending
+func (file *rotatingFile) open() error {
+	f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	file.file = f
+	file.size = info.Size()
+	return nil
+}
+
+// rotate Shift the backups, the oldest is removed, and open a new file
+func (file *rotatingFile) rotate() error {
+	file.file.Close()
+	for i := file.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", file.path, i), fmt.Sprintf("%s.%d", file.path, i+1))
+	}
+	os.Rename(file.path, file.path+".1")
+	return file.open()
+}
+
+func (file *rotatingFile) writeEvents(events [][]byte) error {
+	for _, event := range events {
+		if file.size > 0 && file.size+int64(len(event))+1 > file.maxSize {
+			err := file.rotate()
+			if err != nil {
+				return err
+			}
+		}
+		n, err := file.file.Write(append(event, '\n'))
+		file.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newAuditEvent An audit event with the fields of the session.
+// The session lock may be held by the caller, the fields are read without it.
+func (session *StratumSession) newAuditEvent(event string) *AuditEvent {
+	return &AuditEvent{
+		Event:      event,
+		SessionID:  session.sessionIDString,
+		ClientIP:   session.clientIPPort,
+		Transport:  session.getTransport(),
+		Worker:     session.fullWorkerName,
+		SubAccount: session.subaccountName,
+		Coin:       session.miningCoin,
+		Upstream:   session.serverURL,
+	}
+}
+
+// audit Write the audit event of the session if the audit log is enabled
+func (session *StratumSession) audit(event *AuditEvent) {
+	manager := session.manager
+	if manager == nil || manager.auditLogger == nil {
+		return
+	}
+	event.ServerID = manager.serverID
+	manager.auditLogger.Log(event)
+}
+
+// newAuditResultEvent An audit event of a step of the session started at startTime, failed if err is not nil
+func (session *StratumSession) newAuditResultEvent(event string, err error, startTime time.Time) *AuditEvent {
+	auditEvent := session.newAuditEvent(event)
+	auditEvent.Result = "success"
+	if err != nil {
+		auditEvent.Result = "failure"
+		auditEvent.Reason = auditErrorReason(err)
+		auditEvent.Error = err.Error()
+	}
+	auditEvent.DurationMs = durationMs(time.Since(startTime))
+	return auditEvent
+}
+
+// auditErrorReason The reason code of a failed connection to the server
+func auditErrorReason(err error) string {
+	switch err {
+	case StratumErrStratumServerNotFound:
+		return "server_not_found"
+	case StratumErrConnectStratumServerFailed:
+		return "server_connect_failed"
+	default:
+		return "server_authorize_failed"
+	}
+}
+
+// durationMs The duration in milliseconds
+func durationMs(duration time.Duration) int64 {
+	return int64(duration / time.Millisecond)
+}
+
+// setStopReason Record why the session is stopped, written to the disconnect event of the audit log
+func (session *StratumSession) setStopReason(reason string) {
+	session.stopReason.Store(reason)
+}
+
+// getStopReason The reason of the stop, "closed" if it is not recorded
+func (session *StratumSession) getStopReason() string {
+	if reason, ok := session.stopReason.Load().(string); ok {
+		return reason
+	}
+	return "closed"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stratumSwitcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	file, err := newRotatingFile(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 events of 400 KiB in each file of 1 MB, the oldest events are removed by the rotation
+	event := []byte(strings.Repeat("x", 400*1024))
+	for i := 0; i < 7; i++ {
+		err = file.writeEvents([][]byte{event})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 2*int64(len(event)+1) {
+			t.Error(name, ": unexpected size ", info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("too many backups kept")
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(event)+1) {
+		t.Error("unexpected size of the current file: ", err)
+	}
+}
+
+// auditEventRecorder An audit destination keeping the events
+type auditEventRecorder struct {
+	events chan []byte
+}
+
+func (recorder *auditEventRecorder) writeEvents(events [][]byte) error {
+	for _, event := range events {
+		recorder.events <- event
+	}
+	return nil
+}
+
+func TestSessionAuditEvents(t *testing.T) {
+	recorder := &auditEventRecorder{make(chan []byte, 10)}
+	logger := &AuditLogger{dropped: NewMetricCounterVec("audit_events_dropped_total", "", "sink")}
+	logger.addSink("recorder", recorder)
+
+	session := &StratumSession{
+		manager:         &StratumSessionManager{serverID: 3, auditLogger: logger},
+		sessionIDString: "0300003f",
+		clientIPPort:    "192.168.0.1:3333",
+		fullWorkerName:  "user.worker",
+		subaccountName:  "user",
+		miningCoin:      "bcc",
+		serverURL:       "10.0.0.1:3333",
+	}
+
+	event := session.newAuditResultEvent("switch", StratumErrConnectStratumServerFailed, time.Now().Add(-time.Second))
+	event.OldCoin = "btc"
+	session.audit(event)
+
+	var got AuditEvent
+	select {
+	case line := <-recorder.events:
+		err := json.Unmarshal(line, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not written")
+	}
+
+	expected := AuditEvent{
+		Time:       got.Time,
+		Event:      "switch",
+		ServerID:   3,
+		SessionID:  "0300003f",
+		ClientIP:   "192.168.0.1:3333",
+		Transport:  "tcp",
+		Worker:     "user.worker",
+		SubAccount: "user",
+		Coin:       "bcc",
+		OldCoin:    "btc",
+		Upstream:   "10.0.0.1:3333",
+		Result:     "failure",
+		Reason:     "server_connect_failed",
+		Error:      StratumErrConnectStratumServerFailed.Error(),
+		DurationMs: got.DurationMs,
+	}
+	if got != expected {
+		t.Errorf("unexpected event: %+v", got)
+	}
+	if got.Time == "" || got.DurationMs < 1000 {
+		t.Errorf("time or duration not set: %+v", got)
+	}
+
+	session.setStopReason("drain")
+	if session.getStopReason() != "drain" {
+		t.Error("stop reason not recorded")
+	}
+}
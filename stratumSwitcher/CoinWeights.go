@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+)
+
+// CoinWeights Relative weights of the currencies of a sub-account, e.g. {"btc":70,"bcc":30}
+type CoinWeights map[string]float64
+
+// ParseCoinWeights Parse the value of the zookeeper node of a sub-account or worker.
+// The value is a bare currency name, or a JSON object mapping currencies to their weights.
+func ParseCoinWeights(value []byte) (weights CoinWeights, err error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || value[0] != '{' {
+		weights = CoinWeights{string(value): 1}
+		return
+	}
+
+	err = json.Unmarshal(value, &weights)
+	if err != nil {
+		return nil, err
+	}
+
+	totalWeight := 0.0
+	for _, weight := range weights {
+		if weight < 0 {
+			return nil, ErrInvalidCoinWeights
+		}
+		totalWeight += weight
+	}
+	if totalWeight <= 0 {
+		return nil, ErrInvalidCoinWeights
+	}
+	return
+}
+
+// SelectCoin Choose the currency of a session with weighted rendezvous hashing.
+// The choice only depends on the session id and the weights, and when the weights change
+// only the sessions needed to reach the new split move to another currency.
+func (weights CoinWeights) SelectCoin(sessionID uint32) (coin string) {
+	bestScore := math.Inf(-1)
+	for candidate, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		// -weight / ln(u) with u uniform in (0,1) is an exponential race won with probability weight/total
+		score := -weight / math.Log(sessionCoinHash(sessionID, candidate))
+		if score > bestScore || (score == bestScore && candidate < coin) {
+			bestScore = score
+			coin = candidate
+		}
+	}
+	return
+}
+
+// sessionCoinHash Hash of the session id and the currency, uniform in (0,1)
+func sessionCoinHash(sessionID uint32, coin string) float64 {
+	hasher := fnv.New64a()
+	binary.Write(hasher, binary.BigEndian, sessionID)
+	hasher.Write([]byte(coin))
+
+	// splitmix64 finalizer, the ids of the sessions differ only in a few bits
+	h := hasher.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return (float64(h>>11) + 0.5) / (1 << 53)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseCoinWeights(t *testing.T) {
+	weights, err := ParseCoinWeights([]byte("btc"))
+	if err != nil || len(weights) != 1 || weights["btc"] != 1 {
+		t.Error("bare coin: ", weights, ", ", err)
+	}
+
+	weights, err = ParseCoinWeights([]byte(` {"btc":70,"bcc":30.5}`))
+	if err != nil || weights["btc"] != 70 || weights["bcc"] != 30.5 {
+		t.Error("weights: ", weights, ", ", err)
+	}
+
+	for _, value := range []string{`{"btc":-1,"bcc":2}`, `{"btc":0}`, `{}`, `{"btc":"70"}`, `{"btc"`} {
+		if _, err = ParseCoinWeights([]byte(value)); err == nil {
+			t.Error("no error: ", value)
+		}
+	}
+}
+
+func TestCoinWeightsSelectCoin(t *testing.T) {
+	const sessions = 20000
+	before := CoinWeights{"btc": 70, "bcc": 30, "bsv": 0}
+	after := CoinWeights{"btc": 60, "bcc": 40}
+
+	counts := make(map[string]int)
+	moved := 0
+	for id := uint32(0); id < sessions; id++ {
+		// Session ids of one server share the high byte
+		sessionID := 0x05000000 | id
+		coin := before.SelectCoin(sessionID)
+		if coin != before.SelectCoin(sessionID) {
+			t.Fatal("not deterministic: ", Uint32ToHex(sessionID))
+		}
+		counts[coin]++
+
+		newCoin := after.SelectCoin(sessionID)
+		if newCoin != coin {
+			moved++
+			// Only the sessions of the currency losing weight move
+			if coin != "btc" || newCoin != "bcc" {
+				t.Error("unexpected move: ", coin, " -> ", newCoin)
+			}
+		}
+	}
+
+	if counts["bsv"] != 0 {
+		t.Error("sessions on a coin without weight: ", counts["bsv"])
+	}
+	if share := float64(counts["btc"]) / sessions; math.Abs(share-0.7) > 0.02 {
+		t.Error("share of btc: ", share)
+	}
+	if share := float64(moved) / sessions; math.Abs(share-0.1) > 0.02 {
+		t.Error("share of moved sessions: ", share)
+	}
+}
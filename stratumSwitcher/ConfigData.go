@@ -43,9 +43,14 @@ type ConfigData struct {
 	ChainType                    string
 	ListenAddr                   string
 	StratumServerMap             StratumServerInfoMap
+	CoordinationBackend          string // "zookeeper" (default) or "etcd"
 	ZKBroker                     []string
+	EtcdEndpoints                []string
 	ZKServerIDAssignDir          string // ends with a slash
 	ZKSwitcherWatchDir           string // ends with a slash
+	EnableWorkerCoinRoute        bool
+	KeepDifficultyOnSwitch       bool
+	ParseStratumStream           bool
 	EnableUserAutoReg            bool
 	ZKAutoRegWatchDir            string // ends with a slash
 	AutoRegMaxWaitUsers          int64
@@ -53,6 +58,122 @@ type ConfigData struct {
 	ZKUserCaseInsensitiveIndex   string // ends with a slash
 	EnableHTTPDebug              bool
 	HTTPDebugListenAddr          string
+	StratumV2                    StratumV2Config
+	TLS                          TLSConfig
+	ProxyProtocol                ProxyProtocolConfig
+	Admission                    AdmissionConfig
+	AuditLog                     AuditLogConfig
+	SwitchNotify                 SwitchNotifyConfig
+	EnableMetrics                bool
+	MetricsListenAddr            string
+	EnableAdminAPI               bool
+	AdminAPIListenAddr           string
+	AdminAPIUser                 string
+	AdminAPIPassword             string
+	DrainDurationSeconds         int
+	DrainWaves                   int
+	UpstreamProbe                UpstreamProbeConfig
+	SwitchPacing                 SwitchPacingConfig
+	FallbackCoin                 string
+	ZKConfigNode                 string
+
+	// Path of the file loaded by LoadFromFile
+	filePath string
+}
+
+// UpstreamProbeConfig Configuration of the active health check of upstream sservers.
+// If disabled, the upstreams are only checked by connecting to them.
+type UpstreamProbeConfig struct {
+	Enable          bool
+	IntervalSeconds int
+	TimeoutSeconds  int
+	// Worker of the canary sub-account authorized by the probes, e.g. "canary.probe".
+	// The coin suffix is added if the first authorization fails, like the miners.
+	CanaryWorkerName string
+	CanaryPassword   string
+}
+
+// SwitchPacingConfig Pacing of the coin switches from zookeeper. When many sub-accounts are switched
+// at once, their sessions reconnect to the new sserver at the configured rate instead of all together.
+type SwitchPacingConfig struct {
+	Enable bool
+	// Switches per second to each upstream sserver, default 100
+	RatePerUpstream float64
+	// Maximum random delay added to each switch, default 1000
+	JitterMilliseconds int
+}
+
+// ProxyProtocolConfig Configuration of the PROXY protocol (v1 and v2) support of all listeners
+type ProxyProtocolConfig struct {
+	Enable bool
+	// CIDRs or IPs of the load balancers. Connections from them must start with a PROXY protocol header,
+	// other connections are handled as direct connections from miners.
+	TrustedSources []string
+}
+
+// AdmissionConfig Admission control of the connections accepted by all listeners, a limit of 0 is disabled.
+// The limits apply to the client IP after the PROXY protocol header.
+type AdmissionConfig struct {
+	Enable bool
+	// Connections per client IP
+	MaxConnectionsPerIP int
+	// Connections per /24 (IPv4) or /64 (IPv6) subnet
+	MaxConnectionsPerSubnet int
+	// Connections accepted per second by all listeners, with bursts up to one second of connections
+	MaxAcceptsPerSecond float64
+	// Sessions connected but not authorized yet (waiting for mining.authorize or eth_submitLogin)
+	MaxPendingAuthorize int
+	// JSON file {"Allow":[...],"Deny":[...]} of CIDRs or IPs, reloaded on SIGHUP.
+	// The allowed IPs are exempted from the per-IP and per-subnet limits, the denied IPs are rejected.
+	IPListFile string
+	// Zookeeper node with the same JSON as IPListFile, merged with it and reloaded when the node is changed
+	ZKIPListNode string
+}
+
+// AuditLogConfig JSON-lines log of the session lifecycle events (connect, authorize, switch, reconnect and disconnect),
+// written to a rotating file and/or a Kafka topic
+type AuditLogConfig struct {
+	Enable bool
+	// Path of the log file, empty to disable the file
+	File string
+	// The file is rotated when it exceeds the size, default 100
+	MaxFileSizeMB int
+	// Rotated files kept as File.1 ... File.N, default 10
+	MaxBackups int
+	// Kafka brokers and topic, empty to disable Kafka. Requires a build with -tags kafka
+	KafkaBrokers []string
+	KafkaTopic   string
+}
+
+// SwitchNotifyConfig Publish the result of each coin switch of a session to a Kafka topic, in the format of
+// the sserver messages consumed by chainSwitcher. Requires a build with -tags kafka
+type SwitchNotifyConfig struct {
+	Enable       bool
+	KafkaBrokers []string
+	KafkaTopic   string
+}
+
+// TLSConfig Configuration of the TLS listener (Stratum over TLS)
+type TLSConfig struct {
+	Enable     bool
+	ListenAddr string
+	// PEM encoded certificate (chain) and private key, reloaded on SIGHUP
+	CertFile string
+	KeyFile  string
+	// Optional PEM encoded CA certificates. If set, miners must present a client certificate signed by one of them.
+	ClientCAFile string
+}
+
+// StratumV2Config Configuration of the Stratum V2 listener
+type StratumV2Config struct {
+	Enable     bool
+	ListenAddr string
+	// secp256k1 private key (32 bytes hex) of the pool authority,
+	// used to sign the static key of the Noise handshake (BIP340 Schnorr signature).
+	// The miners should be configured with the corresponding x-only public key.
+	AuthorityPrivateKey string
+	// Validity of the signed static key, the static key is regenerated at each startup
+	CertValiditySeconds uint32
 }
 
 // LoadFromFile Load configuration from file
@@ -64,6 +185,12 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 		return
 	}
 
+	conf.filePath = file
+	return conf.LoadFromJSON(configJSON)
+}
+
+// LoadFromJSON Load configuration from JSON, the fields not in the JSON are not changed
+func (conf *ConfigData) LoadFromJSON(configJSON []byte) (err error) {
 	err = json.Unmarshal(configJSON, conf)
 
 	// If the zookeeper path does not end with "/", add
@@ -88,7 +215,21 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 			v.UserSuffix = k
 			conf.StratumServerMap[k] = v
 		}
-		glog.Info("Chain: ", k, ", UserSuffix: ", conf.StratumServerMap[k].UserSuffix)
+		// The single URL is the only upstream
+		if len(v.Upstreams) == 0 {
+			v.Upstreams = []StratumUpstreamInfo{{URL: v.URL, Weight: 1}}
+			conf.StratumServerMap[k] = v
+		} else if v.URL != "" {
+			glog.Warning("Chain: ", k, ", URL is ignored because Upstreams is set")
+		}
+		switch v.ClientIPFormat {
+		case "", ClientIPFormatUint32, ClientIPFormatString:
+		default:
+			glog.Warning("Chain: ", k, ", unknown ClientIPFormat: ", v.ClientIPFormat, ", use ", ClientIPFormatUint32)
+			v.ClientIPFormat = ClientIPFormatUint32
+			conf.StratumServerMap[k] = v
+		}
+		glog.Info("Chain: ", k, ", UserSuffix: ", conf.StratumServerMap[k].UserSuffix, ", Upstreams: ", len(conf.StratumServerMap[k].Upstreams))
 	}
 
 	return
@@ -117,11 +258,22 @@ type StratumSessionData struct {
 	ClientConnFD uintptr
 	ServerConnFD uintptr
 
+	// Client IP address and port (may come from the PROXY protocol header)
+	ClientIPPort string `json:",omitempty"`
+	// Start time of the session (unix timestamp)
+	StartTime int64 `json:",omitempty"`
+	// The upstream sserver connected
+	ServerURL string `json:",omitempty"`
+
 	StratumSubscribeRequest *JSONRPCRequest
 	StratumAuthorizeRequest *JSONRPCRequest
 
 	// Bitcoin AsicBoost mining version mask
 	VersionMask uint32 `json:",omitempty"`
+	// The client has sent mining.extranonce.subscribe
+	ExtranonceSubscribed bool `json:",omitempty"`
+	// The last difficulty sent to the client
+	Difficulty float64 `json:",omitempty"`
 }
 
 // RuntimeData runtime data
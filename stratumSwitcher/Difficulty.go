@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// Lines longer than this cannot be mining.set_difficulty and are not buffered by difficultyTrackingWriter
+const maxDifficultyLineLength = 256
+
+var setDifficultyMethod = []byte(`"mining.set_difficulty"`)
+
+// difficultyTrackingWriter Wraps the writer to the miner and records the difficulty of the mining.set_difficulty passing through
+type difficultyTrackingWriter struct {
+	w       io.Writer
+	session *StratumSession
+	// Incomplete line of the last writes
+	line []byte
+	// The current line is too long to be mining.set_difficulty
+	skipLine bool
+}
+
+// newDifficultyTrackingWriter Wraps the writer to the miner if the difficulty is kept on switch
+func (session *StratumSession) newDifficultyTrackingWriter(w io.Writer) io.Writer {
+	if !session.manager.keepDifficultyOnSwitch {
+		return w
+	}
+	return &difficultyTrackingWriter{w: w, session: session}
+}
+
+func (w *difficultyTrackingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.scan(p[:n])
+	return
+}
+
+// scan Split the written bytes into lines, the lines may be split between writes
+func (w *difficultyTrackingWriter) scan(p []byte) {
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		segment := p
+		if end >= 0 {
+			segment = p[:end]
+		}
+
+		if !w.skipLine {
+			if len(w.line)+len(segment) > maxDifficultyLineLength {
+				w.skipLine = true
+				w.line = w.line[:0]
+			} else {
+				w.line = append(w.line, segment...)
+			}
+		}
+		if end < 0 {
+			return
+		}
+
+		if !w.skipLine {
+			w.session.recordDifficulty(w.line)
+		}
+		w.line = w.line[:0]
+		w.skipLine = false
+		p = p[end+1:]
+	}
+}
+
+// recordDifficulty Record the difficulty if the line sent to the miner is mining.set_difficulty
+func (session *StratumSession) recordDifficulty(line []byte) {
+	if !bytes.Contains(line, setDifficultyMethod) {
+		return
+	}
+
+	notify, err := NewJSONRPCRequest(line)
+	if err != nil || notify.Method != "mining.set_difficulty" || len(notify.Params) < 1 {
+		return
+	}
+	if difficulty, ok := notify.Params[0].(float64); ok && difficulty > 0 {
+		session.setDifficulty(difficulty)
+	}
+}
+
+// getDifficulty The last difficulty sent to the miner, 0 if unknown (thread safe)
+func (session *StratumSession) getDifficulty() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&session.difficulty))
+}
+
+// setDifficulty Set the last difficulty sent to the miner (thread safe)
+func (session *StratumSession) setDifficulty(difficulty float64) {
+	atomic.StoreUint64(&session.difficulty, math.Float64bits(difficulty))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDifficultyTrackingWriter(t *testing.T) {
+	session := &StratumSession{manager: &StratumSessionManager{keepDifficultyOnSwitch: true}}
+	var out bytes.Buffer
+	w := session.newDifficultyTrackingWriter(&out)
+
+	stream := `{"id":null,"method":"mining.set_difficulty","params":[4096]}` + "\n" +
+		`{"id":null,"method":"mining.notify","params":["1","` + strings.Repeat("0", 512) + `",true]}` + "\n" +
+		`{"id":null,"method":"mining.set_difficulty","params":[16384]}` + "\n" +
+		`{"id":null,"method":"mining.set_difficulty","params":[32768]}`
+
+	// Lines split between writes
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		w.Write([]byte(stream[i:end]))
+	}
+
+	if out.String() != stream {
+		t.Error("stream changed by the writer")
+	}
+	// The last line is incomplete
+	if session.getDifficulty() != 16384 {
+		t.Error("difficulty: ", session.getDifficulty())
+	}
+	w.Write([]byte("\n"))
+	if session.getDifficulty() != 32768 {
+		t.Error("difficulty after the line ends: ", session.getDifficulty())
+	}
+
+	// A long line containing the method is not mistaken for mining.set_difficulty
+	w.Write([]byte(`{"id":1,"method":"client.show_message","params":["` + strings.Repeat(" ", 300) + `\"mining.set_difficulty\"",1]}` + "\n"))
+	if session.getDifficulty() != 32768 {
+		t.Error("difficulty of a long line: ", session.getDifficulty())
+	}
+}
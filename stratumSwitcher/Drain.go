@@ -0,0 +1,160 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Default duration of the drain
+const defaultDrainDurationSeconds = 600
+
+// Default number of disconnection waves of the drain
+const defaultDrainWaves = 10
+
+// Interval of closing the sessions registered after the last wave (sessions in authentication or reconnection)
+const drainStragglerIntervalSeconds = 10
+
+// DrainStatus Progress of the drain
+type DrainStatus struct {
+	Draining          bool   `json:"draining"`
+	Finished          bool   `json:"finished"`
+	StartTime         int64  `json:"start_time"`
+	DurationSeconds   int    `json:"duration_seconds"`
+	Waves             int    `json:"waves"`
+	CurrentWave       int    `json:"current_wave"`
+	InitialSessions   int    `json:"initial_sessions"`
+	ClosedSessions    int    `json:"closed_sessions"`
+	RemainingSessions int    `json:"remaining_sessions"`
+	ServerIDNode      string `json:"server_id_node"`
+}
+
+// Drainer Takes the switcher out of rotation: close the listeners, release the server id
+// and disconnect the sessions in waves, so that the miners move to other switchers gradually.
+type Drainer struct {
+	manager *StratumSessionManager
+
+	lock   sync.Mutex
+	status DrainStatus
+}
+
+// NewDrainer Create a Drainer
+func NewDrainer(manager *StratumSessionManager) (drainer *Drainer) {
+	drainer = new(Drainer)
+	drainer.manager = manager
+	return
+}
+
+// IsDraining Whether the drain has been started
+func (drainer *Drainer) IsDraining() bool {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+	return drainer.status.Draining
+}
+
+// Status Get the progress of the drain
+func (drainer *Drainer) Status() DrainStatus {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+
+	status := drainer.status
+	if status.Draining {
+		status.RemainingSessions = drainer.manager.registeredSessionCount()
+	}
+	return status
+}
+
+// Start Start the drain, returns false if it is already started.
+// Zero durationSeconds or waves means the value in the configuration.
+func (drainer *Drainer) Start(durationSeconds int, waves int) bool {
+	drainer.lock.Lock()
+	defer drainer.lock.Unlock()
+
+	if drainer.status.Draining {
+		return false
+	}
+
+	if durationSeconds <= 0 {
+		durationSeconds = drainer.manager.drainDurationSeconds
+	}
+	if waves <= 0 {
+		waves = drainer.manager.drainWaves
+	}
+
+	drainer.status.Draining = true
+	drainer.status.StartTime = time.Now().Unix()
+	drainer.status.DurationSeconds = durationSeconds
+	drainer.status.Waves = waves
+
+	go drainer.run()
+	return true
+}
+
+func (drainer *Drainer) run() {
+	manager := drainer.manager
+	status := drainer.Status()
+
+	glog.Info("[drain] start, duration: ", status.DurationSeconds, "s, waves: ", status.Waves)
+
+	// Stop accepting new connections
+	manager.closeListeners()
+
+	// Release the server id, the switcher is no longer listed in zookeeper
+	serverIDNode := manager.releaseServerIDFromZK()
+
+	initialSessions := manager.registeredSessionCount()
+	drainer.lock.Lock()
+	drainer.status.InitialSessions = initialSessions
+	drainer.status.ServerIDNode = serverIDNode
+	drainer.lock.Unlock()
+
+	glog.Info("[drain] listeners closed, sessions: ", initialSessions)
+
+	interval := time.Duration(status.DurationSeconds) * time.Second / time.Duration(status.Waves)
+	for wave := 1; wave <= status.Waves; wave++ {
+		time.Sleep(interval)
+
+		// Close an equal share of the remaining sessions, so that the sessions registered later
+		// (in authentication or reconnection when the drain started) are also spread over the waves.
+		sessions := manager.registeredSessions()
+		wavesLeft := status.Waves - wave + 1
+		closeNum := (len(sessions) + wavesLeft - 1) / wavesLeft
+		for _, session := range sessions[:closeNum] {
+			session.setStopReason("drain")
+			go session.Stop()
+		}
+
+		drainer.lock.Lock()
+		drainer.status.CurrentWave = wave
+		drainer.status.ClosedSessions += closeNum
+		drainer.lock.Unlock()
+
+		glog.Info("[drain] wave ", wave, "/", status.Waves, ": closed ", closeNum, " sessions, remaining: ", len(sessions)-closeNum)
+	}
+
+	// Close the sessions registered after the last wave
+	for {
+		time.Sleep(drainStragglerIntervalSeconds * time.Second)
+
+		sessions := manager.registeredSessions()
+		if len(sessions) == 0 {
+			break
+		}
+		for _, session := range sessions {
+			session.setStopReason("drain")
+			session.Stop()
+		}
+		drainer.lock.Lock()
+		drainer.status.ClosedSessions += len(sessions)
+		drainer.lock.Unlock()
+
+		glog.Info("[drain] closed ", len(sessions), " sessions registered after the last wave")
+	}
+
+	drainer.lock.Lock()
+	drainer.status.Finished = true
+	drainer.lock.Unlock()
+
+	glog.Info("[drain] finished, the process can be stopped")
+}
@@ -48,6 +48,24 @@ var (
 	ErrAuthorizeFailed = errors.New("Authorize Failed")
 	// ErrTooMuchPendingAutoRegReq Too many pending auto-registration requests
 	ErrTooMuchPendingAutoRegReq = errors.New("Too much pending auto reg request")
+	// ErrUpstreamUnhealthy All upstream sservers of the currency are unhealthy
+	ErrUpstreamUnhealthy = errors.New("Upstream Unhealthy")
+	// ErrProbeSubscribeFailed The upstream probe is not subscribed
+	ErrProbeSubscribeFailed = errors.New("Probe Subscribe Failed")
+	// ErrProbeAuthorizeFailed The canary worker of the upstream probe is not authorized
+	ErrProbeAuthorizeFailed = errors.New("Probe Authorize Failed")
+	// ErrNoUpstreams No upstream sserver configured for the currency
+	ErrNoUpstreams = errors.New("No Upstreams")
+	// ErrKafkaNotBuilt The switcher is built without Kafka support
+	ErrKafkaNotBuilt = errors.New("Kafka Support Not Built, Rebuild with -tags kafka")
+	// ErrTLSClientCAEmpty No certificate found in the TLS client CA file
+	ErrTLSClientCAEmpty = errors.New("No Certificate Found in TLS Client CA File")
+	// ErrProxyProtocolHeaderInvalid The PROXY protocol header from a trusted source is missing or malformed
+	ErrProxyProtocolHeaderInvalid = errors.New("Invalid PROXY Protocol Header")
+	// ErrSessionNotRunning The session is stopped or reconnected by another goroutine
+	ErrSessionNotRunning = errors.New("Session Not Running")
+	// ErrInvalidCoinWeights The weights of the currencies are negative or all zero
+	ErrInvalidCoinWeights = errors.New("Invalid Coin Weights")
 )
 
 var (
@@ -61,6 +79,15 @@ var (
 	StratumErrWorkerNameMustBeString = NewStratumError(104, "Worker Name Must be a String")
 	// StratumErrWorkerNameStartWrong Miner name starts incorrectly
 	StratumErrWorkerNameStartWrong = NewStratumError(105, "Sub-account Name Cannot be Empty")
+	// StratumErrUnsupportedProtocol The protocol of mining.hello is not supported
+	StratumErrUnsupportedProtocol = NewStratumError(106, "Unsupported Protocol")
+
+	// StratumErrJobNotFound The submit is of a job not sent to the miner
+	StratumErrJobNotFound = NewStratumError(21, "Job not found (=stale)")
+	// StratumErrDuplicateShare The submit has been submitted
+	StratumErrDuplicateShare = NewStratumError(22, "Duplicate share")
+	// StratumErrIllegalParams The params of the submit are malformed
+	StratumErrIllegalParams = NewStratumError(27, "Illegal params")
 
 	// StratumErrStratumServerNotFound The Stratum Server of the corresponding currency could not be found
 	StratumErrStratumServerNotFound = NewStratumError(301, "Stratum Server Not Found")
@@ -71,6 +98,29 @@ var (
 	StratumErrUnknownChainType = NewStratumError(500, "Unknown Chain Type")
 )
 
+var (
+	// AdminAPIErrSessionIDIsEmpty session_id is empty
+	AdminAPIErrSessionIDIsEmpty = NewStratumError(601, "session_id is empty")
+	// AdminAPIErrSessionIDInvalid session_id is not a hex number
+	AdminAPIErrSessionIDInvalid = NewStratumError(602, "session_id invalid")
+	// AdminAPIErrSessionNotFound The session does not exist or is not in normal proxy state
+	AdminAPIErrSessionNotFound = NewStratumError(603, "session not found")
+	// AdminAPIErrCoinIsEmpty coin is empty
+	AdminAPIErrCoinIsEmpty = NewStratumError(604, "coin is empty")
+	// AdminAPIErrIPInvalid ip is neither an IP nor a CIDR
+	AdminAPIErrIPInvalid = NewStratumError(605, "ip invalid")
+	// AdminAPIErrSwitchBTCAgent BTCAgent sessions cannot be switched
+	AdminAPIErrSwitchBTCAgent = NewStratumError(606, "BTCAgent session cannot be switched")
+	// AdminAPIErrSwitchFailed The session cannot be switched
+	AdminAPIErrSwitchFailed = NewStratumError(607, "switch failed")
+	// AdminAPIErrDrainStarted The drain has already been started
+	AdminAPIErrDrainStarted = NewStratumError(608, "drain already started")
+	// AdminAPIErrUpstreamUnhealthy All upstreams of the target currency are unhealthy
+	AdminAPIErrUpstreamUnhealthy = NewStratumError(609, "upstream unhealthy")
+	// AdminAPIErrLineProxyDisabled The shares are only counted in the line-aware proxy mode
+	AdminAPIErrLineProxyDisabled = NewStratumError(610, "ParseStratumStream disabled")
+)
+
 var (
 	// ErrReadFailed IO read error
 	ErrReadFailed = errors.New("Read Failed")
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EthereumStratum/2.0.0 (EIP-1571), not related to the Bitcoin Stratum V2 of StratumV2Conn
+// <https://github.com/ethereum/EIPs/blob/master/EIPS/eip-1571.md>
+//
+// The miner sends mining.hello before mining.subscribe. The params of mining.hello (and of mining.set from the server)
+// are an object, and the responses have neither the "jsonrpc" member nor a null "error" or "result".
+// Like the other protocols, the switcher answers mining.hello and mining.subscribe itself, and the protocol,
+// the session ID and the miner IP are passed to sserver in mining.subscribe, same as NiceHash Ethereum Stratum:
+//	{"id":"subscribe","method":"mining.subscribe","params":["ethminer-0.19.0","EthereumStratum/2.0.0","01003f",3232235521]}
+
+// EthereumStratum/2.0.0 protocol version
+const ethereumStratumV2Version = "EthereumStratum/2.0.0"
+
+// The protocol prefix of EthereumStratum/2.x.x
+const ethereumStratumV2Prefix = "ethereumstratum/2."
+
+// Idle time before the miner is disconnected, sent in the response of mining.hello.
+// The miner sends mining.noop if it has nothing to submit in this time.
+const ethereumStratumV2TimeoutSeconds = 180
+
+// Errors of the miner before it is disconnected, sent in the response of mining.hello
+const ethereumStratumV2MaxErrors = 5
+
+// ethereumStratumV2Hello The mining.hello request, its params is an object
+type ethereumStratumV2Hello struct {
+	ID     interface{} `json:"id"`
+	Method string      `json:"method"`
+	Params struct {
+		Agent string `json:"agent"`
+		Host  string `json:"host"`
+		Port  string `json:"port"`
+		Proto string `json:"proto"`
+	} `json:"params"`
+}
+
+// parseEthereumStratumV2Hello Decode mining.hello, which cannot be decoded by NewJSONRPCRequest, as a request
+// with the params ["agent", "proto"]. ok is false if the line is not mining.hello.
+func parseEthereumStratumV2Hello(rpcJSON []byte) (request *JSONRPCRequest, ok bool) {
+	var hello ethereumStratumV2Hello
+	err := json.Unmarshal(rpcJSON, &hello)
+	if err != nil || hello.Method != "mining.hello" {
+		return nil, false
+	}
+	request = &JSONRPCRequest{ID: hello.ID, Method: hello.Method, Params: JSONRPCArray{hello.Params.Agent, hello.Params.Proto}}
+	return request, true
+}
+
+// isEthereumStratumV2Protocol Whether the protocol param is EthereumStratum/2.x.x
+func isEthereumStratumV2Protocol(protocol interface{}) bool {
+	protocolStr, ok := protocol.(string)
+	return ok && strings.HasPrefix(strings.ToLower(protocolStr), ethereumStratumV2Prefix)
+}
+
+func (session *StratumSession) parseHelloRequest(request *JSONRPCRequest) (result interface{}, err *StratumError) {
+	// request:
+	//		{"id":0,"method":"mining.hello","params":{"agent":"ethminer-0.19.0","host":"eth.pool.com","port":"d05","proto":"EthereumStratum/2.0.0"}}
+	// response:
+	//		{"id":0,"result":{"encoding":"plain","maxerrors":"5","node":"stratumSwitcher","proto":"EthereumStratum/2.0.0","resume":"0","timeout":"b4"}}
+
+	if session.manager.chainType != ChainTypeEthereum {
+		// ignore like the other unimplemented methods
+		return
+	}
+
+	// The miner expects the responses of EthereumStratum/2.0.0, including the error below
+	session.jsonRPCVersion = jsonRPCVersionEthereumStratumV2
+
+	if len(request.Params) < 2 {
+		err = StratumErrTooFewParams
+		return
+	}
+	if !isEthereumStratumV2Protocol(request.Params[1]) {
+		err = StratumErrUnsupportedProtocol
+		return
+	}
+
+	session.protocolType = ProtocolEthereumStratumV2
+	session.helloAgent, _ = request.Params[0].(string)
+
+	// The session cannot be resumed after a disconnection, the sserver of the session may have changed
+	result = JSONRPCObj{
+		"proto":     ethereumStratumV2Version,
+		"encoding":  "plain",
+		"resume":    "0",
+		"timeout":   fmt.Sprintf("%x", ethereumStratumV2TimeoutSeconds),
+		"maxerrors": fmt.Sprintf("%x", ethereumStratumV2MaxErrors),
+		"node":      "stratumSwitcher"}
+	return
+}
+
+func (session *StratumSession) parseEthereumStratumV2SubscribeRequest(request *JSONRPCRequest) (result interface{}, err *StratumError) {
+	// request:
+	//		{"id":1,"method":"mining.subscribe","params":[]}
+	//		{"id":1,"method":"mining.subscribe","params":["s-12345"]} (resume the session s-12345)
+	// response:
+	//		{"id":1,"result":"01003f"}
+	//
+	// The miner always gets a new session. sserver sends the extranonce in mining.set, it is the session ID
+	// passed in mining.subscribe (checked in the subscribe response of sserver), so it is kept after a currency switch.
+
+	// After mining.hello, the params of the miner are replaced with the agent and the protocol forwarded to sserver.
+	// The request saved before a hot update already has them.
+	if session.protocolType == ProtocolEthereumStratumV2 {
+		request.SetParam(session.helloAgent, ethereumStratumV2Version)
+	}
+
+	session.protocolType = ProtocolEthereumStratumV2
+	session.jsonRPCVersion = jsonRPCVersionEthereumStratumV2
+
+	result = session.sessionIDString
+	return
+}
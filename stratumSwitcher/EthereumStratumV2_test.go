@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// playTranscript Play a golden transcript of the handshake of an EthereumStratum/2.0.0 miner.
+// Each line is "<from> -> <to>: <JSON>" between the miner, the switcher and sserver, lines starting with "#" are comments.
+// The lines to the switcher are written, the lines from the switcher are read and compared.
+// authorized is whether the switcher authorized the miner to sserver at the end of the transcript.
+func playTranscript(t *testing.T, path string) (session *StratumSession, authorized bool) {
+	transcript, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switcherClientConn, minerConn := net.Pipe()
+	switcherServerConn, sserverConn := net.Pipe()
+	deadline := time.Now().Add(5 * time.Second)
+	minerConn.SetDeadline(deadline)
+	sserverConn.SetDeadline(deadline)
+
+	session = &StratumSession{
+		manager:         &StratumSessionManager{serverID: 3, chainType: ChainTypeEthereum},
+		protocolType:    ProtocolEthereumProxy,
+		jsonRPCVersion:  1,
+		runningStat:     StatRunning,
+		sessionID:       0x0001003f,
+		sessionIDString: "01003f",
+		clientIPPort:    "192.168.0.1:51234",
+		clientConn:      switcherClientConn,
+		clientReader:    bufio.NewReader(switcherClientConn),
+		serverConn:      switcherServerConn,
+		serverReader:    bufio.NewReader(switcherServerConn),
+		miningCoin:      "eth",
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := session.stratumFindWorkerName()
+		if err == nil {
+			_, err = session.serverSubscribeAndAuthorize()
+		}
+		done <- err
+	}()
+
+	minerReader := bufio.NewReader(minerConn)
+	sserverReader := bufio.NewReader(sserverConn)
+	for i, line := range strings.Split(string(transcript), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pos := strings.Index(line, ": ")
+		if pos < 0 {
+			t.Fatal(path, ":", i+1, ": malformed line")
+		}
+		direction, message := line[:pos], line[pos+2:]
+
+		var got string
+		switch direction {
+		case "miner -> switcher":
+			_, err = minerConn.Write([]byte(message + "\n"))
+		case "sserver -> switcher":
+			_, err = sserverConn.Write([]byte(message + "\n"))
+		case "switcher -> miner":
+			got, err = minerReader.ReadString('\n')
+		case "switcher -> sserver":
+			got, err = sserverReader.ReadString('\n')
+		default:
+			err = errors.New("unknown direction: " + direction)
+		}
+		if err != nil {
+			t.Fatal(path, ":", i+1, ": ", err)
+		}
+		if strings.HasPrefix(direction, "switcher") && strings.TrimSpace(got) != message {
+			t.Error(path, ":", i+1, ": unexpected message: ", strings.TrimSpace(got))
+		}
+	}
+
+	// The handshake is either finished or waiting for the miner or sserver
+	select {
+	case err = <-done:
+	case <-time.After(100 * time.Millisecond):
+		minerConn.Close()
+		sserverConn.Close()
+		err = <-done
+	}
+	return session, err == nil
+}
+
+func TestEthereumStratumV2Handshake(t *testing.T) {
+	transcripts := []struct {
+		name       string
+		authorized bool
+	}{
+		{"hello_subscribe_authorize", true},
+		{"resume_session", true},
+		{"authorize_before_subscribe", true},
+		{"server_authorize_failed", false},
+		{"session_id_mismatch", false},
+		{"unsupported_protocol", false},
+	}
+
+	for _, transcript := range transcripts {
+		path := filepath.Join("testdata", "ethereum_stratum_v2", transcript.name+".txt")
+		session, authorized := playTranscript(t, path)
+		if authorized != transcript.authorized {
+			t.Error(transcript.name, ": authorized: ", authorized)
+		}
+		if authorized && (session.protocolType != ProtocolEthereumStratumV2 || session.fullWorkerName != "user.worker") {
+			t.Error(transcript.name, ": unexpected session: ", session.protocolType.ToString(), "; ", session.fullWorkerName)
+		}
+	}
+}
+
+func TestEthereumStratumV2Resume(t *testing.T) {
+	session, authorized := playTranscript(t, filepath.Join("testdata", "ethereum_stratum_v2", "hello_subscribe_authorize.txt"))
+	if !authorized {
+		t.Fatal("handshake failed")
+	}
+
+	// The requests saved for the hot update are handled by the new process without mining.hello
+	resumed := &StratumSession{
+		manager:         session.manager,
+		protocolType:    session.getDefaultStratumProtocol(),
+		jsonRPCVersion:  1,
+		sessionIDString: session.sessionIDString,
+	}
+	stat := StatConnected
+	_, stratumErr := resumed.stratumHandleRequest(session.stratumSubscribeRequest, &stat)
+	if stratumErr == nil {
+		_, stratumErr = resumed.stratumHandleRequest(session.stratumAuthorizeRequest, &stat)
+	}
+	if stratumErr != nil || stat != StatAuthorized {
+		t.Fatal("resume failed: ", stratumErr)
+	}
+	if resumed.protocolType != ProtocolEthereumStratumV2 || resumed.jsonRPCVersion != jsonRPCVersionEthereumStratumV2 {
+		t.Error("protocol not detected: ", resumed.protocolType.ToString())
+	}
+	if len(resumed.stratumSubscribeRequest.Params) < 2 || resumed.stratumSubscribeRequest.Params[0] != "ethminer-0.19.0" {
+		t.Error("user agent not kept: ", resumed.stratumSubscribeRequest.Params)
+	}
+}
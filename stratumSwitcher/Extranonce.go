@@ -0,0 +1,91 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Size of the extranonce2 told to the Bitcoin Stratum client
+const extraNonce2Size = 8
+
+// Maximum lines of the new server forwarded while waiting for its first job after a switch
+const maxLinesBeforeFirstJob = 16
+
+// Timeout for the first job of the new server after a switch, the submits of the client wait for proxyStratum meanwhile
+const firstJobTimeoutSeconds = 3
+
+// supportsSetExtranonce Whether the protocol of the session has mining.set_extranonce
+func (session *StratumSession) supportsSetExtranonce() bool {
+	return session.protocolType == ProtocolBitcoinStratum || session.protocolType == ProtocolEthereumStratumNiceHash
+}
+
+// getExtranonceParams The params of mining.set_extranonce, same as the extranonce in the subscribe response to the client.
+// sserver is given the session ID of the switcher in mining.subscribe and keeps it, so the extranonce never changes
+// across switches and the message only tells the client to resync with the new server.
+func (session *StratumSession) getExtranonceParams() JSONRPCArray {
+	if session.protocolType == ProtocolEthereumStratumNiceHash {
+		extraNonce := session.sessionIDString
+		if session.isNiceHashClient {
+			extraNonce = extraNonce[0:4]
+		}
+		// {"id":null,"method":"mining.set_extranonce","params":["01003f"]}
+		return JSONRPCArray{extraNonce}
+	}
+	// {"id":null,"method":"mining.set_extranonce","params":["0100003f",8]}
+	return JSONRPCArray{session.sessionIDString, extraNonce2Size}
+}
+
+// sendExtranonceAndCleanJob Tell the client subscribed to mining.extranonce.subscribe that the server has changed.
+// mining.set_extranonce is sent first, then the lines of the new server are forwarded until its first mining.notify,
+// which is forwarded with clean_jobs set so the client drops the jobs of the old server instead of submitting stale shares.
+// The wait for the first job is bounded by firstJobTimeoutSeconds. The lines after it are forwarded by proxyStratum.
+func (session *StratumSession) sendExtranonceAndCleanJob() (err error) {
+	notify := JSONRPCRequest{nil, "mining.set_extranonce", session.getExtranonceParams(), ""}
+	_, err = session.writeJSONNotifyToClient(&notify)
+	if err != nil {
+		return
+	}
+
+	session.serverConn.SetReadDeadline(time.Now().Add(firstJobTimeoutSeconds * time.Second))
+	defer session.serverConn.SetReadDeadline(time.Time{})
+
+	for i := 0; i < maxLinesBeforeFirstJob; i++ {
+		var line []byte
+		line, err = session.serverReader.ReadBytes('\n')
+		if err != nil {
+			// The incomplete line is consumed from serverReader, the rest of it will be copied by proxyStratum
+			if len(line) > 0 {
+				session.clientConn.Write(line)
+			}
+			return
+		}
+
+		job, jsonErr := NewJSONRPCRequest(line)
+		if jsonErr != nil || job.Method != "mining.notify" || len(job.Params) < 1 {
+			if session.manager.keepDifficultyOnSwitch {
+				session.recordDifficulty(line)
+			}
+			_, err = session.clientConn.Write(line)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// clean_jobs is the last param of the job in both Bitcoin Stratum and NiceHash Ethereum Stratum
+		last := len(job.Params) - 1
+		if cleanJobs, ok := job.Params[last].(bool); ok && !cleanJobs {
+			job.Params[last] = true
+			_, err = session.writeJSONNotifyToClient(job)
+		} else {
+			_, err = session.clientConn.Write(line)
+		}
+		session.recordJob(job)
+		if err == nil && glog.V(3) {
+			glog.Info("Clean Job Sent after Switch: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+		}
+		return
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendExtranonceAndCleanJob(t *testing.T) {
+	switcherClientConn, minerConn := net.Pipe()
+	switcherServerConn, sserverConn := net.Pipe()
+	defer minerConn.Close()
+	defer sserverConn.Close()
+
+	session := &StratumSession{
+		manager:         &StratumSessionManager{keepDifficultyOnSwitch: true},
+		protocolType:    ProtocolBitcoinStratum,
+		sessionIDString: "0100003f",
+		clientConn:      switcherClientConn,
+		serverConn:      switcherServerConn,
+		serverReader:    bufio.NewReader(switcherServerConn),
+	}
+
+	go func() {
+		sserverConn.Write([]byte(`{"id":null,"method":"mining.set_difficulty","params":[8192]}` + "\n" +
+			`{"id":null,"method":"mining.notify","params":["1","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",false]}` + "\n" +
+			`{"id":null,"method":"mining.notify","params":["2","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",false]}` + "\n"))
+	}()
+
+	e := make(chan error, 1)
+	go func() {
+		e <- session.sendExtranonceAndCleanJob()
+	}()
+
+	minerReader := bufio.NewReader(minerConn)
+	expected := []string{
+		`{"id":null,"method":"mining.set_extranonce","params":["0100003f",8]}`,
+		`{"id":null,"method":"mining.set_difficulty","params":[8192]}`,
+		`{"id":null,"method":"mining.notify","params":["1","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",true]}`,
+	}
+	for _, line := range expected {
+		got, err := minerReader.ReadString('\n')
+		if err != nil {
+			t.Fatal("read from switcher failed: ", err)
+		}
+		if strings.TrimSpace(got) != line {
+			t.Error("unexpected line: ", got, ", expected: ", line)
+		}
+	}
+	if err := <-e; err != nil {
+		t.Error("sendExtranonceAndCleanJob: ", err)
+	}
+
+	if session.getDifficulty() != 8192 {
+		t.Error("difficulty of the new server not recorded: ", session.getDifficulty())
+	}
+
+	// The second job is left for proxyStratum
+	if session.serverReader.Buffered() == 0 {
+		t.Error("second job consumed")
+	}
+}
+
+func TestSendExtranonceAndCleanJobTimeout(t *testing.T) {
+	switcherClientConn, minerConn := net.Pipe()
+	switcherServerConn, sserverConn := net.Pipe()
+	defer minerConn.Close()
+	defer sserverConn.Close()
+
+	session := &StratumSession{
+		manager:         &StratumSessionManager{},
+		protocolType:    ProtocolBitcoinStratum,
+		sessionIDString: "0100003f",
+		clientConn:      switcherClientConn,
+		serverConn:      switcherServerConn,
+		serverReader:    bufio.NewReader(switcherServerConn),
+	}
+
+	e := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		e <- session.sendExtranonceAndCleanJob()
+	}()
+	minerReader := bufio.NewReader(minerConn)
+	if _, err := minerReader.ReadString('\n'); err != nil {
+		t.Fatal("read from switcher failed: ", err)
+	}
+
+	// sserver sends no job, the switch goes on after the short timeout
+	err := <-e
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("sendExtranonceAndCleanJob: ", err)
+	}
+	if elapsed := time.Since(start); elapsed >= readServerResponseTimeoutSeconds*time.Second {
+		t.Error("waited for the first job: ", elapsed)
+	}
+
+	// The read deadline is reset for proxyStratum
+	go sserverConn.Write([]byte(`{"id":null,"method":"mining.notify","params":["1"]}` + "\n"))
+	if _, err := session.serverReader.ReadString('\n'); err != nil {
+		t.Error("read from sserver after the timeout: ", err)
+	}
+}
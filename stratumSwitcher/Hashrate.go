@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Width of the buckets of the hashrate windows
+const hashrateBucketSeconds = 10
+
+// Buckets covering the longest hashrate window, and the current bucket
+const hashrateBuckets = 15*60/hashrateBucketSeconds + 1
+
+// Hashes of a share of difficulty 1, the same for Bitcoin, Decred and the EthereumStratum/1.0.0 of NiceHash
+const hashesPerDifficulty = 1 << 32
+
+// hashrateWindows The rolling windows of the hashrate estimation
+var hashrateWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// shareWindow The difficulty of the accepted shares of a currency over the longest hashrate window
+type shareWindow struct {
+	coin string
+	// Index (unix time / hashrateBucketSeconds) and total difficulty of each bucket
+	slots      [hashrateBuckets]int64
+	difficulty [hashrateBuckets]float64
+}
+
+// add Add an accepted share, the shares of another currency are forgotten
+func (window *shareWindow) add(coin string, difficulty float64, now time.Time) {
+	if coin != window.coin {
+		*window = shareWindow{coin: coin}
+	}
+
+	slot := now.Unix() / hashrateBucketSeconds
+	i := slot % hashrateBuckets
+	if window.slots[i] != slot {
+		window.slots[i] = slot
+		window.difficulty[i] = 0
+	}
+	window.difficulty[i] += difficulty
+}
+
+// hashrate The hashes per second of the shares in the complete buckets of the window of duration before now.
+// The current bucket is only partly filled, it is counted once it is complete.
+func (window *shareWindow) hashrate(duration time.Duration, now time.Time) float64 {
+	slot := now.Unix() / hashrateBucketSeconds
+	first := slot - int64(duration/time.Second)/hashrateBucketSeconds - 1
+
+	var difficulty float64
+	for i := range window.slots {
+		if window.slots[i] > first && window.slots[i] < slot {
+			difficulty += window.difficulty[i]
+		}
+	}
+	return difficulty * hashesPerDifficulty / duration.Seconds()
+}
+
+// canEstimateHashrate Whether the hashrate of the sessions of the protocol can be estimated from the difficulty of their shares.
+// Except NiceHash, the Ethereum protocols send the target of the shares with the jobs instead of mining.set_difficulty,
+// so the difficulty of their shares is unknown.
+func canEstimateHashrate(chainType ChainType, protocolType ProtocolType) bool {
+	if chainType != ChainTypeEthereum {
+		return true
+	}
+	return protocolType == ProtocolEthereumStratumNiceHash
+}
+
+// HashrateInfo Shares and estimated hashrate (hashes per second) of a worker, a sub-account or a currency.
+// The shares of the UnestimatedSessions are counted, but not their hashrate.
+type HashrateInfo struct {
+	WorkerName          string  `json:"worker_name,omitempty"`
+	SubAccount          string  `json:"sub_account,omitempty"`
+	Coin                string  `json:"coin"`
+	Workers             int     `json:"workers,omitempty"`
+	Sessions            int     `json:"sessions"`
+	UnestimatedSessions int     `json:"unestimated_sessions,omitempty"`
+	SharesAccepted      uint64  `json:"shares_accepted"`
+	SharesRejected      uint64  `json:"shares_rejected"`
+	SharesStale         uint64  `json:"shares_stale"`
+	Hashrate1m          float64 `json:"hashrate_1m"`
+	Hashrate5m          float64 `json:"hashrate_5m"`
+	Hashrate15m         float64 `json:"hashrate_15m"`
+	LastShareTime       int64   `json:"last_share_time,omitempty"`
+
+	workerNames map[string]bool
+}
+
+// add Add the shares of a session, and its hashrate if it can be estimated
+func (info *HashrateInfo) add(workerName string, shares ShareCounts, estimated bool) {
+	info.Sessions++
+	info.SharesAccepted += shares.Accepted
+	info.SharesRejected += shares.Rejected
+	info.SharesStale += shares.Stale
+	if estimated {
+		info.Hashrate1m += shares.Hashrates[0]
+		info.Hashrate5m += shares.Hashrates[1]
+		info.Hashrate15m += shares.Hashrates[2]
+	} else {
+		info.UnestimatedSessions++
+	}
+	if !shares.LastShareTime.IsZero() && shares.LastShareTime.Unix() > info.LastShareTime {
+		info.LastShareTime = shares.LastShareTime.Unix()
+	}
+
+	if info.workerNames != nil {
+		info.workerNames[workerName] = true
+		info.Workers = len(info.workerNames)
+	}
+}
+
+// HashrateResponse Response of /hashrate
+type HashrateResponse struct {
+	AdminAPIResponse
+	SubAccounts []*HashrateInfo `json:"sub_accounts"`
+	Coins       []*HashrateInfo `json:"coins"`
+}
+
+// WorkerHashrateResponse Response of /workers
+type WorkerHashrateResponse struct {
+	AdminAPIResponse
+	Workers []*HashrateInfo `json:"workers"`
+}
+
+// sessionShares The shares of a session in normal proxy state
+type sessionShares struct {
+	workerName string
+	subAccount string
+	coin       string
+	shares     ShareCounts
+	// Whether the hashrate of the session can be estimated
+	estimated bool
+}
+
+// getSessionShares Get the shares of the sessions in normal proxy state, filtered by sub-account and coin if not empty
+func (manager *StratumSessionManager) getSessionShares(subaccount string, coin string) (sessions []sessionShares) {
+	now := time.Now()
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for _, session := range manager.sessions {
+		if subaccount != "" && session.subaccountName != subaccount {
+			continue
+		}
+		if coin != "" && session.metricKey.coin != coin {
+			continue
+		}
+		sessions = append(sessions, sessionShares{
+			session.fullWorkerName, session.subaccountName, session.metricKey.coin, session.shares.Get(now),
+			canEstimateHashrate(manager.chainType, session.protocolType)})
+	}
+	return
+}
+
+// sortedHashrateInfos The values of the map sorted by the key
+func sortedHashrateInfos(infos map[string]*HashrateInfo) []*HashrateInfo {
+	keys := make([]string, 0, len(infos))
+	for key := range infos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*HashrateInfo, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, infos[key])
+	}
+	return sorted
+}
+
+// workerHashrateHandle The shares and hashrate of each worker. Optional filters: subaccount, coin
+func (manager *StratumSessionManager) workerHashrateHandle(w http.ResponseWriter, req *http.Request) {
+	if !manager.parseStratumStream {
+		writeAdminAPIError(w, AdminAPIErrLineProxyDisabled)
+		return
+	}
+
+	workers := make(map[string]*HashrateInfo)
+	for _, session := range manager.getSessionShares(req.FormValue("subaccount"), req.FormValue("coin")) {
+		key := session.workerName + "/" + session.coin
+		info, ok := workers[key]
+		if !ok {
+			info = &HashrateInfo{WorkerName: session.workerName, SubAccount: session.subAccount, Coin: session.coin}
+			workers[key] = info
+		}
+		info.add(session.workerName, session.shares, session.estimated)
+	}
+
+	response := WorkerHashrateResponse{AdminAPIResponse{0, "", true}, sortedHashrateInfos(workers)}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// hashrateHandle The shares and hashrate aggregated per sub-account and coin, and per coin. Optional filters: subaccount, coin
+func (manager *StratumSessionManager) hashrateHandle(w http.ResponseWriter, req *http.Request) {
+	if !manager.parseStratumStream {
+		writeAdminAPIError(w, AdminAPIErrLineProxyDisabled)
+		return
+	}
+
+	subAccounts := make(map[string]*HashrateInfo)
+	coins := make(map[string]*HashrateInfo)
+	for _, session := range manager.getSessionShares(req.FormValue("subaccount"), req.FormValue("coin")) {
+		key := session.subAccount + "/" + session.coin
+		info, ok := subAccounts[key]
+		if !ok {
+			info = &HashrateInfo{SubAccount: session.subAccount, Coin: session.coin, workerNames: make(map[string]bool)}
+			subAccounts[key] = info
+		}
+		info.add(session.workerName, session.shares, session.estimated)
+
+		info, ok = coins[session.coin]
+		if !ok {
+			info = &HashrateInfo{Coin: session.coin, workerNames: make(map[string]bool)}
+			coins[session.coin] = info
+		}
+		info.add(session.workerName, session.shares, session.estimated)
+	}
+
+	response := HashrateResponse{AdminAPIResponse{0, "", true}, sortedHashrateInfos(subAccounts), sortedHashrateInfos(coins)}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
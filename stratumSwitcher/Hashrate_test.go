@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShareWindow(t *testing.T) {
+	var window shareWindow
+	start := time.Unix(1760601600, 0)
+
+	// One share of difficulty 60 every second for 15 minutes
+	for i := 0; i < 900; i++ {
+		window.add("btc", 60, start.Add(time.Duration(i)*time.Second))
+	}
+	// The bucket of the last share is complete
+	now := start.Add(905 * time.Second)
+	for _, duration := range hashrateWindows {
+		hashrate := window.hashrate(duration, now)
+		if hashrate != 60*hashesPerDifficulty {
+			t.Error("hashrate of ", duration, ": ", hashrate)
+		}
+	}
+
+	// Nothing submitted in the last 5 minutes
+	later := now.Add(5 * time.Minute)
+	if hashrate := window.hashrate(time.Minute, later); hashrate != 0 {
+		t.Error("hashrate after the shares: ", hashrate)
+	}
+	if hashrate := window.hashrate(15*time.Minute, later); hashrate != 40*hashesPerDifficulty {
+		t.Error("hashrate of 15m after the shares: ", hashrate)
+	}
+
+	// The shares of the previous currency are forgotten
+	window.add("bcc", 60, now)
+	if hashrate := window.hashrate(15*time.Minute, now.Add(hashrateBucketSeconds*time.Second)); hashrate != 60.0*hashesPerDifficulty/(15*60) {
+		t.Error("hashrate after the switch: ", hashrate)
+	}
+}
+
+func TestShareWindowPartialBucket(t *testing.T) {
+	var window shareWindow
+	start := time.Unix(1760601600, 0)
+
+	// One share of difficulty 1 every second for 20 minutes, then 5 seconds of the next bucket
+	end := 20*60 + 5
+	for i := 0; i < end; i++ {
+		window.add("btc", 1, start.Add(time.Duration(i)*time.Second))
+	}
+
+	// The partly filled bucket does not lower the hashrate
+	now := start.Add(time.Duration(end)*time.Second - 500*time.Millisecond)
+	for _, duration := range hashrateWindows {
+		if hashrate := window.hashrate(duration, now); hashrate != hashesPerDifficulty {
+			t.Error("hashrate of ", duration, " in the middle of a bucket: ", hashrate)
+		}
+	}
+}
+
+func TestHashrateHandle(t *testing.T) {
+	manager := &StratumSessionManager{parseStratumStream: true, sessions: make(map[uint32]*StratumSession)}
+	// The shares are in a complete bucket
+	now := time.Now().Add(-hashrateBucketSeconds * time.Second)
+
+	add := func(sessionID uint32, workerName string, subaccount string, coin string, accepted int) {
+		session := &StratumSession{fullWorkerName: workerName, subaccountName: subaccount}
+		session.metricKey.coin = coin
+		for i := 0; i < accepted; i++ {
+			session.shares.addAccepted(coin, 1, now)
+		}
+		manager.sessions[sessionID] = session
+	}
+	add(1, "alice.a", "alice", "btc", 60)
+	add(2, "alice.a", "alice", "btc", 60)
+	add(3, "alice.b", "alice", "bcc", 60)
+	add(4, "bob.a", "bob", "btc", 60)
+
+	recorder := httptest.NewRecorder()
+	manager.hashrateHandle(recorder, httptest.NewRequest("GET", "/hashrate", nil))
+	var response HashrateResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.SubAccounts) != 3 || len(response.Coins) != 2 {
+		t.Fatal("response: ", recorder.Body.String())
+	}
+	alice := response.SubAccounts[1]
+	if alice.SubAccount != "alice" || alice.Coin != "btc" || alice.Workers != 1 || alice.Sessions != 2 || alice.SharesAccepted != 120 ||
+		alice.Hashrate1m != 2*hashesPerDifficulty {
+		t.Error("alice on btc: ", *alice)
+	}
+	btc := response.Coins[1]
+	if btc.Coin != "btc" || btc.Workers != 2 || btc.Sessions != 3 || btc.Hashrate1m != 3*hashesPerDifficulty {
+		t.Error("btc: ", *btc)
+	}
+
+	recorder = httptest.NewRecorder()
+	manager.workerHashrateHandle(recorder, httptest.NewRequest("GET", "/workers?subaccount=alice", nil))
+	var workers WorkerHashrateResponse
+	json.Unmarshal(recorder.Body.Bytes(), &workers)
+	if len(workers.Workers) != 2 || workers.Workers[0].WorkerName != "alice.a" || workers.Workers[0].Sessions != 2 {
+		t.Error("workers: ", recorder.Body.String())
+	}
+}
+
+func TestHashrateUnestimated(t *testing.T) {
+	manager := &StratumSessionManager{parseStratumStream: true, sessions: make(map[uint32]*StratumSession), chainType: ChainTypeEthereum}
+	// The shares are in a complete bucket
+	now := time.Now().Add(-hashrateBucketSeconds * time.Second)
+
+	protocols := []ProtocolType{ProtocolEthereumStratumNiceHash, ProtocolEthereumProxy, ProtocolEthereumStratumV2, ProtocolEthereumStratum}
+	for i, protocol := range protocols {
+		session := &StratumSession{fullWorkerName: "alice.a", subaccountName: "alice", protocolType: protocol}
+		session.metricKey.coin = "eth"
+		for j := 0; j < 60; j++ {
+			session.shares.addAccepted("eth", 1, now)
+		}
+		manager.sessions[uint32(i)] = session
+	}
+
+	recorder := httptest.NewRecorder()
+	manager.hashrateHandle(recorder, httptest.NewRequest("GET", "/hashrate", nil))
+	var response HashrateResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the NiceHash session has a difficulty
+	if len(response.Coins) != 1 {
+		t.Fatal("response: ", recorder.Body.String())
+	}
+	eth := response.Coins[0]
+	if eth.Sessions != 4 || eth.UnestimatedSessions != 3 || eth.SharesAccepted != 240 || eth.Hashrate1m != hashesPerDifficulty {
+		t.Error("eth: ", *eth)
+	}
+}
@@ -21,6 +21,9 @@ type JSONRPCResponse struct {
 	Error  interface{} `json:"error"`
 }
 
+// jsonRPCVersionEthereumStratumV2 The responses of EthereumStratum/2.0.0: json-rpc 2.0 without the "jsonrpc" member
+const jsonRPCVersionEthereumStratumV2 = 3
+
 // JSONRPC2Error error object of json-rpc 2.0
 type JSONRPC2Error struct {
 	Code    int         `json:"code"`
@@ -36,6 +39,17 @@ func NewJSONRPC2Error(v1Err interface{}) (err *JSONRPC2Error) {
 
 	errArr, ok := v1Err.(JSONRPCArray)
 	if !ok {
+		// The error of a response from the server, [code, message, data] or {"code":..., "message":...}
+		switch v1Err.(type) {
+		case []interface{}, map[string]interface{}:
+			err = new(JSONRPC2Error)
+			err.Code, err.Message = getStratumErrorCode(v1Err)
+			return
+		}
+		return nil
+	}
+	// ToJSONRPCArray of a nil *StratumError
+	if errArr == nil {
 		return nil
 	}
 
@@ -61,7 +75,7 @@ func NewJSONRPC2Error(v1Err interface{}) (err *JSONRPC2Error) {
 // JSONRPC2Response response message of json-rpc 2.0
 type JSONRPC2Response struct {
 	ID      interface{}    `json:"id"`
-	JSONRPC string         `json:"jsonrpc"`
+	JSONRPC string         `json:"jsonrpc,omitempty"`
 	Result  interface{}    `json:"result,omitempty"`
 	Error   *JSONRPC2Error `json:"error,omitempty"`
 }
@@ -118,5 +132,8 @@ func (rpcData *JSONRPCResponse) ToJSONBytes(version int) ([]byte, error) {
 	}
 
 	rpc2Data := JSONRPC2Response{rpcData.ID, "2.0", rpcData.Result, NewJSONRPC2Error(rpcData.Error)}
+	if version == jsonRPCVersionEthereumStratumV2 {
+		rpc2Data.JSONRPC = ""
+	}
 	return json.Marshal(rpc2Data)
 }
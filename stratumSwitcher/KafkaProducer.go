@@ -0,0 +1,23 @@
+package main
+
+// KafkaProducer Publishes messages to a Kafka topic
+type KafkaProducer interface {
+	// WriteMessages Publish the messages, blocks until they are written or failed
+	WriteMessages(values ...[]byte) error
+	Close() error
+}
+
+// newKafkaProducer Create a KafkaProducer of the topic.
+// Kafka support is optional (build with -tags kafka), without it the producer cannot be created.
+var newKafkaProducer = func(brokers []string, topic string) (KafkaProducer, error) {
+	return nil, ErrKafkaNotBuilt
+}
+
+// kafkaEventSink Publishes each event as a message of the Kafka topic
+type kafkaEventSink struct {
+	producer KafkaProducer
+}
+
+func (sink kafkaEventSink) writeEvents(events [][]byte) error {
+	return sink.producer.WriteMessages(events...)
+}
@@ -0,0 +1,43 @@
+//go:build kafka
+// +build kafka
+
+package main
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	newKafkaProducer = newKafkaWriterProducer
+}
+
+// kafkaWriterProducer KafkaProducer of github.com/segmentio/kafka-go, the same client as chainSwitcher
+type kafkaWriterProducer struct {
+	writer *kafka.Writer
+}
+
+// newKafkaWriterProducer Create a KafkaProducer with a kafka.Writer
+func newKafkaWriterProducer(brokers []string, topic string) (KafkaProducer, error) {
+	writer := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  brokers,
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	})
+	return &kafkaWriterProducer{writer}, nil
+}
+
+// WriteMessages Publish the messages
+func (producer *kafkaWriterProducer) WriteMessages(values ...[]byte) error {
+	messages := make([]kafka.Message, len(values))
+	for i, value := range values {
+		messages[i].Value = value
+	}
+	return producer.writer.WriteMessages(context.Background(), messages...)
+}
+
+// Close Flush and close the writer
+func (producer *kafkaWriterProducer) Close() error {
+	return producer.writer.Close()
+}
@@ -0,0 +1,20 @@
+//go:build kafka
+// +build kafka
+
+package main
+
+import "testing"
+
+func TestKafkaWriterProducer(t *testing.T) {
+	// The producer of kafka-go replaces the one returning ErrKafkaNotBuilt
+	producer, err := newKafkaProducer([]string{"127.0.0.1:9092"}, "BtcManProcessor")
+	if err != nil {
+		t.Fatal("create producer: ", err)
+	}
+	if _, ok := producer.(*kafkaWriterProducer); !ok {
+		t.Errorf("producer: %T", producer)
+	}
+	if err = producer.Close(); err != nil {
+		t.Error("close: ", err)
+	}
+}
@@ -44,5 +44,30 @@ func main() {
 		glog.Fatal("create session manager failed: ", err)
 		return
 	}
+
+	// Health of the upstreams and the queue of the paced switches on the HTTP debug listener
+	if configData.EnableHTTPDebug {
+		http.HandleFunc("/upstreams", sessionManager.upstreamStatusHandle)
+		http.HandleFunc("/switch-queue", sessionManager.switchQueueHandle)
+	}
+
+	// Enable Prometheus metrics
+	if configData.EnableMetrics {
+		go func() {
+			glog.Info("Prometheus metrics enabled: ", configData.MetricsListenAddr)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", sessionManager.ServeMetrics)
+			err := http.ListenAndServe(configData.MetricsListenAddr, mux)
+			if err != nil {
+				glog.Error("Prometheus metrics listener failed: ", err)
+			}
+		}()
+	}
+
+	// Enable admin API
+	if configData.EnableAdminAPI {
+		go sessionManager.runAdminAPIServer(configData)
+	}
+
 	sessionManager.Run(runtimeData)
 }
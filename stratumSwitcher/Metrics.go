@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus metrics of stratumSwitcher, in the text exposition format
+// <https://prometheus.io/docs/instrumenting/exposition_formats/>
+
+// The prefix of all metric names
+const metricsNamespace = "stratum_switcher_"
+
+// Buckets of the coin switch latency histogram (seconds)
+var coinSwitchLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// formatMetricLabels Format label pairs as {name="value",...}
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// formatMetricValue Format a sample value
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeMetricHeader Write the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, metricType)
+}
+
+// MetricSample A sample of a gauge collected at scrape time
+type MetricSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// writeGauge Write a gauge with its samples
+func writeGauge(w io.Writer, name string, help string, labelNames []string, samples []MetricSample) {
+	writeMetricHeader(w, name, "gauge", help)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s%s %s\n", metricsNamespace, name, formatMetricLabels(labelNames, sample.LabelValues), formatMetricValue(sample.Value))
+	}
+}
+
+// MetricCounterVec A counter partitioned by labels
+type MetricCounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewMetricCounterVec Create a counter
+func NewMetricCounterVec(name string, help string, labelNames ...string) *MetricCounterVec {
+	counter := new(MetricCounterVec)
+	counter.name = name
+	counter.help = help
+	counter.labelNames = labelNames
+	counter.values = make(map[string]float64)
+	return counter
+}
+
+// Add Add value to the counter with the label values
+func (counter *MetricCounterVec) Add(value float64, labelValues ...string) {
+	labels := formatMetricLabels(counter.labelNames, labelValues)
+	counter.lock.Lock()
+	counter.values[labels] += value
+	counter.lock.Unlock()
+}
+
+// Inc Increase the counter with the label values by 1
+func (counter *MetricCounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Write Write the counter in the text format
+func (counter *MetricCounterVec) Write(w io.Writer) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	writeMetricHeader(w, counter.name, "counter", counter.help)
+	for _, labels := range sortedMetricKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s%s %s\n", metricsNamespace, counter.name, labels, formatMetricValue(counter.values[labels]))
+	}
+}
+
+// metricHistogramValue Buckets of a histogram with the same labels
+type metricHistogramValue struct {
+	labelValues  []string
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+// MetricHistogramVec A histogram partitioned by labels
+type MetricHistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	values map[string]*metricHistogramValue
+}
+
+// NewMetricHistogramVec Create a histogram, buckets are upper bounds in increasing order
+func NewMetricHistogramVec(name string, help string, buckets []float64, labelNames ...string) *MetricHistogramVec {
+	histogram := new(MetricHistogramVec)
+	histogram.name = name
+	histogram.help = help
+	histogram.labelNames = labelNames
+	histogram.buckets = buckets
+	histogram.values = make(map[string]*metricHistogramValue)
+	return histogram
+}
+
+// Observe Add an observation to the histogram with the label values
+func (histogram *MetricHistogramVec) Observe(value float64, labelValues ...string) {
+	labels := formatMetricLabels(histogram.labelNames, labelValues)
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	v, ok := histogram.values[labels]
+	if !ok {
+		v = &metricHistogramValue{labelValues: labelValues, bucketCounts: make([]uint64, len(histogram.buckets))}
+		histogram.values[labels] = v
+	}
+	for i, upperBound := range histogram.buckets {
+		if value <= upperBound {
+			v.bucketCounts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// Write Write the histogram in the text format
+func (histogram *MetricHistogramVec) Write(w io.Writer) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	writeMetricHeader(w, histogram.name, "histogram", histogram.help)
+	bucketLabelNames := append(append([]string{}, histogram.labelNames...), "le")
+
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := histogram.values[key]
+		for i, upperBound := range histogram.buckets {
+			labels := formatMetricLabels(bucketLabelNames, append(append([]string{}, v.labelValues...), formatMetricValue(upperBound)))
+			fmt.Fprintf(w, "%s%s_bucket%s %d\n", metricsNamespace, histogram.name, labels, v.bucketCounts[i])
+		}
+		labels := formatMetricLabels(bucketLabelNames, append(append([]string{}, v.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s%s_bucket%s %d\n", metricsNamespace, histogram.name, labels, v.count)
+		fmt.Fprintf(w, "%s%s_sum%s %s\n", metricsNamespace, histogram.name, key, formatMetricValue(v.sum))
+		fmt.Fprintf(w, "%s%s_count%s %d\n", metricsNamespace, histogram.name, key, v.count)
+	}
+}
+
+func sortedMetricKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricCountingWriter A writer that counts the bytes written successfully
+type metricCountingWriter struct {
+	writer  io.Writer
+	counter *uint64
+}
+
+func (w *metricCountingWriter) Write(b []byte) (n int, err error) {
+	n, err = w.writer.Write(b)
+	atomic.AddUint64(w.counter, uint64(n))
+	return
+}
+
+// SwitcherMetrics Event metrics of stratumSwitcher (the state metrics are collected at scrape time)
+type SwitcherMetrics struct {
+	// Bytes proxied from miners to servers / from servers to miners
+	upstreamBytes   uint64
+	downstreamBytes uint64
+
+	coinSwitches               *MetricCounterVec
+	coinSwitchLatency          *MetricHistogramVec
+	reconnectAttempts          *MetricCounterVec
+	reconnectFailures          *MetricCounterVec
+	shares                     *MetricCounterVec
+	filteredSubmits            *MetricCounterVec
+	rejectedConnections        *MetricCounterVec
+	droppedAuditEvents         *MetricCounterVec
+	droppedSwitchNotifications *MetricCounterVec
+}
+
+// NewSwitcherMetrics Create the metrics
+func NewSwitcherMetrics() (metrics *SwitcherMetrics) {
+	metrics = new(SwitcherMetrics)
+	metrics.coinSwitches = NewMetricCounterVec("coin_switches_total",
+		"Coin switches of sessions.", "from", "to", "result")
+	metrics.coinSwitchLatency = NewMetricHistogramVec("coin_switch_duration_seconds",
+		"Time from the switch command to the session mining the new coin.", coinSwitchLatencyBuckets, "coin")
+	metrics.reconnectAttempts = NewMetricCounterVec("reconnect_attempts_total",
+		"Attempts to connect a session to a Stratum server after a coin switch or a server disconnection.", "coin")
+	metrics.reconnectFailures = NewMetricCounterVec("reconnect_failures_total",
+		"Sessions closed because all reconnection attempts failed.", "coin")
+	metrics.shares = NewMetricCounterVec("shares_total",
+		"Shares submitted by miners by the response of the server, counted in the line-aware proxy mode.", "coin", "result")
+	metrics.filteredSubmits = NewMetricCounterVec("filtered_submits_total",
+		"Submits dropped by the submit filter before reaching the server.", "coin", "reason")
+	metrics.rejectedConnections = NewMetricCounterVec("rejected_connections_total",
+		"Connections rejected by the admission control.", "reason")
+	metrics.droppedAuditEvents = NewMetricCounterVec("audit_events_dropped_total",
+		"Audit events dropped because their destination is too slow.", "sink")
+	metrics.droppedSwitchNotifications = NewMetricCounterVec("switch_notifications_dropped_total",
+		"Coin switch results not published to Kafka because it is too slow.")
+	return
+}
+
+// ObserveCoinSwitch Record the result of a coin switch
+func (metrics *SwitcherMetrics) ObserveCoinSwitch(oldCoin string, newCoin string, success bool, latency time.Duration) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	metrics.coinSwitches.Inc(oldCoin, newCoin, result)
+	if success {
+		metrics.coinSwitchLatency.Observe(latency.Seconds(), newCoin)
+	}
+}
+
+// UpstreamWriter Wraps the writer to the server to count proxied bytes
+func (metrics *SwitcherMetrics) UpstreamWriter(w io.Writer) io.Writer {
+	return &metricCountingWriter{w, &metrics.upstreamBytes}
+}
+
+// DownstreamWriter Wraps the writer to the miner to count proxied bytes
+func (metrics *SwitcherMetrics) DownstreamWriter(w io.Writer) io.Writer {
+	return &metricCountingWriter{w, &metrics.downstreamBytes}
+}
+
+// Write Write the event metrics in the text format
+func (metrics *SwitcherMetrics) Write(w io.Writer) {
+	writeMetricHeader(w, "proxied_bytes_total", "counter", "Bytes proxied between miners and Stratum servers.")
+	fmt.Fprintf(w, "%sproxied_bytes_total{direction=\"upstream\"} %d\n", metricsNamespace, atomic.LoadUint64(&metrics.upstreamBytes))
+	fmt.Fprintf(w, "%sproxied_bytes_total{direction=\"downstream\"} %d\n", metricsNamespace, atomic.LoadUint64(&metrics.downstreamBytes))
+
+	metrics.coinSwitches.Write(w)
+	metrics.coinSwitchLatency.Write(w)
+	metrics.reconnectAttempts.Write(w)
+	metrics.reconnectFailures.Write(w)
+	metrics.shares.Write(w)
+	metrics.filteredSubmits.Write(w)
+	metrics.rejectedConnections.Write(w)
+	metrics.droppedAuditEvents.Write(w)
+	metrics.droppedSwitchNotifications.Write(w)
+}
+
+// sessionMetricKey The labels of the active session gauge
+type sessionMetricKey struct {
+	coin      string
+	protocol  string
+	transport string
+}
+
+// ServeMetrics HTTP handler of /metrics
+func (manager *StratumSessionManager) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	// active sessions
+	var sessionSamples []MetricSample
+	manager.lock.Lock()
+	for key, count := range manager.sessionCounts {
+		if count > 0 {
+			sessionSamples = append(sessionSamples, MetricSample{[]string{key.coin, key.protocol, key.transport}, float64(count)})
+		}
+	}
+	manager.lock.Unlock()
+	sort.Slice(sessionSamples, func(i, j int) bool {
+		return strings.Join(sessionSamples[i].LabelValues, ",") < strings.Join(sessionSamples[j].LabelValues, ",")
+	})
+	writeGauge(&buf, "sessions", "Sessions proxied to a Stratum server.",
+		[]string{"coin", "protocol", "transport"}, sessionSamples)
+
+	// session IDs
+	used, capacity := manager.sessionIDManager.Usage()
+	writeGauge(&buf, "session_ids_used", "Allocated session IDs, including sessions not authorized yet.",
+		nil, []MetricSample{{nil, float64(used)}})
+	writeGauge(&buf, "session_ids_capacity", "Total number of session IDs.",
+		nil, []MetricSample{{nil, float64(capacity)}})
+
+	// auto registration
+	allowUsers := atomic.LoadInt64(&manager.autoRegAllowUsers)
+	writeGauge(&buf, "autoreg_pending_users", "Sub-accounts waiting for auto registration.",
+		nil, []MetricSample{{nil, float64(manager.getAutoRegMaxWaitUsers() - allowUsers)}})
+	writeGauge(&buf, "autoreg_max_pending_users", "Maximum of sub-accounts waiting for auto registration (AutoRegMaxWaitUsers).",
+		nil, []MetricSample{{nil, float64(manager.getAutoRegMaxWaitUsers())}})
+
+	// admission control
+	if manager.admission != nil {
+		writeGauge(&buf, "pending_authorize_sessions", "Sessions connected but not authorized yet.",
+			nil, []MetricSample{{nil, float64(manager.admission.PendingAuthorize())}})
+	}
+
+	// zookeeper
+	nodeWatchers, watcherChannels := manager.zookeeperManager.WatcherCount()
+	writeGauge(&buf, "zk_node_watchers", "Zookeeper nodes being watched.",
+		nil, []MetricSample{{nil, float64(nodeWatchers)}})
+	writeGauge(&buf, "zk_watcher_channels", "Sessions waiting for events of the watched Zookeeper nodes.",
+		nil, []MetricSample{{nil, float64(watcherChannels)}})
+
+	// upstreams
+	var upstreamSamples []MetricSample
+	for coin, pool := range manager.getUpstreamPools() {
+		for _, upstream := range pool.Status() {
+			healthy := 0.0
+			if upstream.Healthy {
+				healthy = 1
+			}
+			upstreamSamples = append(upstreamSamples, MetricSample{[]string{coin, upstream.URL}, healthy})
+		}
+	}
+	sort.Slice(upstreamSamples, func(i, j int) bool {
+		a, b := upstreamSamples[i].LabelValues, upstreamSamples[j].LabelValues
+		return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+	})
+	writeGauge(&buf, "upstream_healthy", "Whether the upstream Stratum server is healthy.",
+		[]string{"coin", "url"}, upstreamSamples)
+
+	// switch pacing
+	if manager.switchPacer != nil {
+		var queueSamples []MetricSample
+		for upstream, depth := range manager.switchPacer.QueueDepths() {
+			queueSamples = append(queueSamples, MetricSample{[]string{upstream}, float64(depth)})
+		}
+		sort.Slice(queueSamples, func(i, j int) bool {
+			return queueSamples[i].LabelValues[0] < queueSamples[j].LabelValues[0]
+		})
+		writeGauge(&buf, "switch_queue_depth", "Sessions waiting for their turn to switch to the upstream.",
+			[]string{"upstream"}, queueSamples)
+	}
+
+	// drain
+	drainStatus := manager.drainer.Status()
+	draining := 0.0
+	if drainStatus.Draining {
+		draining = 1
+	}
+	writeGauge(&buf, "draining", "Whether the switcher is in drain mode.",
+		nil, []MetricSample{{nil, draining}})
+	writeGauge(&buf, "drain_closed_sessions", "Sessions closed by the drain.",
+		nil, []MetricSample{{nil, float64(drainStatus.ClosedSessions)}})
+
+	manager.metrics.Write(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSwitcherMetricsFormat(t *testing.T) {
+	metrics := NewSwitcherMetrics()
+	metrics.ObserveCoinSwitch("btc", "bch", true, 300*time.Millisecond)
+	metrics.ObserveCoinSwitch("btc", "bch", true, 2*time.Second)
+	metrics.ObserveCoinSwitch("bch", "btc", false, time.Second)
+	metrics.reconnectAttempts.Inc(`a"b`)
+	metrics.UpstreamWriter(&bytes.Buffer{}).Write([]byte("12345"))
+
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	output := buf.String()
+
+	expectedLines := []string{
+		`# TYPE stratum_switcher_coin_switches_total counter`,
+		`stratum_switcher_coin_switches_total{from="btc",to="bch",result="success"} 2`,
+		`stratum_switcher_coin_switches_total{from="bch",to="btc",result="failure"} 1`,
+		`# TYPE stratum_switcher_coin_switch_duration_seconds histogram`,
+		`stratum_switcher_coin_switch_duration_seconds_bucket{coin="bch",le="0.25"} 0`,
+		`stratum_switcher_coin_switch_duration_seconds_bucket{coin="bch",le="0.5"} 1`,
+		`stratum_switcher_coin_switch_duration_seconds_bucket{coin="bch",le="2.5"} 2`,
+		`stratum_switcher_coin_switch_duration_seconds_bucket{coin="bch",le="+Inf"} 2`,
+		`stratum_switcher_coin_switch_duration_seconds_sum{coin="bch"} 2.3`,
+		`stratum_switcher_coin_switch_duration_seconds_count{coin="bch"} 2`,
+		`stratum_switcher_reconnect_attempts_total{coin="a\"b"} 1`,
+		`stratum_switcher_proxied_bytes_total{direction="upstream"} 5`,
+		`stratum_switcher_proxied_bytes_total{direction="downstream"} 0`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("line not found: %s\n%s", line, output)
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ellswift"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise protocol framework used by Stratum V2 for the encrypted connection
+// <https://noiseprotocol.org/noise.html>
+//
+// The switcher implements the NX handshake of the Stratum V2 specification, which is also the one of
+// the Stratum V2 reference implementation (SRI) and the miner firmware built on it: secp256k1 keys
+// sent in their ElligatorSwift encoding (BIP324), the ChaCha20-Poly1305 cipher and SHA-256.
+//
+//	-> e
+//	<- e, ee, s, es, SIGNATURE_NOISE_MESSAGE
+const noiseProtocolName = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+
+// Length of an ElligatorSwift encoded public key
+const noiseEllSwiftLen = 64
+
+// Length of the AEAD authentication tag
+const noiseMACLen = 16
+
+// Maximum length of a Noise transport message (including the MAC)
+const noiseMaxMessageLen = 65535
+
+// Length of the encrypted Stratum V2 frame header
+const noiseEncryptedHeaderLen = stratumV2FrameHeaderLen + noiseMACLen
+
+// Length of SIGNATURE_NOISE_MESSAGE: version(U16) + valid_from(U32) + not_valid_after(U32) + signature(64 bytes)
+const noiseSignatureMessageLen = 2 + 4 + 4 + schnorr.SignatureSize
+
+// Handshake timeout of the Noise connection
+const noiseHandshakeTimeoutSeconds = 15
+
+// Default validity of the signed static key
+const noiseDefaultCertValiditySeconds = 365 * 24 * 3600
+
+// The tag of the BIP324 shared secret
+var noiseEllSwiftECDHTag = []byte("bip324_ellswift_xonly_ecdh")
+
+var (
+	// ErrNoiseDecryptFailed Failed to decrypt a Noise message
+	ErrNoiseDecryptFailed = errors.New("Noise Decrypt Failed")
+	// ErrNoiseNonceExhausted Nonce of the Noise cipher state is exhausted
+	ErrNoiseNonceExhausted = errors.New("Noise Nonce Exhausted")
+	// ErrNoiseInvalidCertificate The server certificate in the handshake is invalid
+	ErrNoiseInvalidCertificate = errors.New("Noise Invalid Certificate")
+)
+
+//////////////////////////////// DH functions ////////////////////////////////
+
+// noiseKeyPair A DH key pair, the public key is in the encoding sent in the handshake
+type noiseKeyPair struct {
+	private interface{}
+	public  []byte
+}
+
+// noiseDH The DH functions of a Noise handshake
+type noiseDH interface {
+	generateKeyPair() (noiseKeyPair, error)
+	publicKeyLen() int
+	// dh returns the shared secret of the local key pair and the remote public key,
+	// initiator is whether the local key pair is the one of the initiator
+	dh(local noiseKeyPair, remotePublic []byte, initiator bool) ([]byte, error)
+}
+
+// noiseEllSwiftDH secp256k1 keys in their ElligatorSwift encoding. Like BIP324, the shared secret is the tagged hash
+// of the initiator's public key, the responder's public key and the x coordinate of the ECDH point.
+type noiseEllSwiftDH struct{}
+
+func (noiseEllSwiftDH) generateKeyPair() (keyPair noiseKeyPair, err error) {
+	private, public, err := ellswift.EllswiftCreate()
+	if err != nil {
+		return
+	}
+	keyPair.private = private
+	keyPair.public = public[:]
+	return
+}
+
+func (noiseEllSwiftDH) publicKeyLen() int {
+	return noiseEllSwiftLen
+}
+
+func (noiseEllSwiftDH) dh(local noiseKeyPair, remotePublic []byte, initiator bool) (secret []byte, err error) {
+	var ours, theirs [noiseEllSwiftLen]byte
+	copy(ours[:], local.public)
+	copy(theirs[:], remotePublic)
+	hash, err := ellswift.V2Ecdh(local.private.(*btcec.PrivateKey), theirs, ours, initiator)
+	if err != nil {
+		return
+	}
+	secret = hash[:]
+	return
+}
+
+// noiseEllSwiftXOnly Decode an ElligatorSwift encoded public key to its x-only (BIP340) form
+func noiseEllSwiftXOnly(public []byte) (xOnly []byte, err error) {
+	var u, t btcec.FieldVal
+	if u.SetByteSlice(public[:32]) {
+		u.Normalize()
+	}
+	if t.SetByteSlice(public[32:noiseEllSwiftLen]) {
+		t.Normalize()
+	}
+	x, err := ellswift.XSwiftEC(&u, &t)
+	if err != nil {
+		return
+	}
+	xOnly = x.Bytes()[:]
+	return
+}
+
+//////////////////////////////// CipherState ////////////////////////////////
+
+// noiseCipherState CipherState object of Noise
+type noiseCipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipherState(key []byte) *noiseCipherState {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		// the key is always 32 bytes, cannot happen
+		panic(err)
+	}
+	return &noiseCipherState{aead: aead}
+}
+
+// nonceBytes ChaChaPoly nonce: 32 bits of zeros followed by the little-endian encoding of n
+func (cs *noiseCipherState) nonceBytes() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	return nonce
+}
+
+func (cs *noiseCipherState) encrypt(ad []byte, plaintext []byte) ([]byte, error) {
+	if cs.nonce == ^uint64(0) {
+		return nil, ErrNoiseNonceExhausted
+	}
+	ciphertext := cs.aead.Seal(nil, cs.nonceBytes(), plaintext, ad)
+	cs.nonce++
+	return ciphertext, nil
+}
+
+func (cs *noiseCipherState) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	if cs.nonce == ^uint64(0) {
+		return nil, ErrNoiseNonceExhausted
+	}
+	plaintext, err := cs.aead.Open(nil, cs.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseDecryptFailed
+	}
+	cs.nonce++
+	return plaintext, nil
+}
+
+//////////////////////////////// SymmetricState ////////////////////////////////
+
+// noiseSymmetricState SymmetricState object of Noise
+type noiseSymmetricState struct {
+	ck []byte
+	h  []byte
+	cs *noiseCipherState
+}
+
+func newNoiseSymmetricState(protocolName string) *noiseSymmetricState {
+	ss := new(noiseSymmetricState)
+	if len(protocolName) <= sha256.Size {
+		// pad the protocol name with zeros
+		ss.h = make([]byte, sha256.Size)
+		copy(ss.h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		ss.h = sum[:]
+	}
+	ss.ck = append([]byte{}, ss.h...)
+	// empty prologue
+	ss.mixHash(nil)
+	return ss
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) {
+	var key []byte
+	ss.ck, key = noiseHKDF(ss.ck, ikm)
+	ss.cs = newNoiseCipherState(key)
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+	if ss.cs == nil {
+		ciphertext = plaintext
+	} else {
+		ciphertext, err = ss.cs.encrypt(ss.h, plaintext)
+		if err != nil {
+			return
+		}
+	}
+	ss.mixHash(ciphertext)
+	return
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	if ss.cs == nil {
+		plaintext = ciphertext
+	} else {
+		plaintext, err = ss.cs.decrypt(ss.h, ciphertext)
+		if err != nil {
+			return
+		}
+	}
+	ss.mixHash(ciphertext)
+	return
+}
+
+// split returns the cipher states for initiator->responder and responder->initiator
+func (ss *noiseSymmetricState) split() (c1 *noiseCipherState, c2 *noiseCipherState) {
+	k1, k2 := noiseHKDF(ss.ck, nil)
+	return newNoiseCipherState(k1), newNoiseCipherState(k2)
+}
+
+// noiseHKDF HKDF with two outputs
+func noiseHKDF(chainingKey []byte, ikm []byte) (out1 []byte, out2 []byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 = mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 = mac.Sum(nil)
+	return
+}
+
+//////////////////////////////// Handshake ////////////////////////////////
+
+// noiseHandshake The NX handshake with its protocol name and DH functions
+type noiseHandshake struct {
+	protocolName string
+	dh           noiseDH
+}
+
+// stratumV2NoiseHandshake The handshake of Stratum V2
+var stratumV2NoiseHandshake = &noiseHandshake{noiseProtocolName, noiseEllSwiftDH{}}
+
+// respond Perform the responder side of the handshake with the static key and the payload of the second message.
+// Returns the cipher states for receiving and sending.
+func (hs *noiseHandshake) respond(rw io.ReadWriter, static noiseKeyPair, payload []byte) (recv *noiseCipherState, send *noiseCipherState, err error) {
+	ss := newNoiseSymmetricState(hs.protocolName)
+
+	// -> e
+	remoteEphemeral := make([]byte, hs.dh.publicKeyLen())
+	_, err = io.ReadFull(rw, remoteEphemeral)
+	if err != nil {
+		return
+	}
+	ss.mixHash(remoteEphemeral)
+	// empty payload
+	ss.mixHash(nil)
+
+	// <- e, ee, s, es, payload
+	ephemeral, err := hs.dh.generateKeyPair()
+	if err != nil {
+		return
+	}
+	message := append([]byte{}, ephemeral.public...)
+	ss.mixHash(ephemeral.public)
+
+	dh, err := hs.dh.dh(ephemeral, remoteEphemeral, false)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh)
+
+	encryptedStatic, err := ss.encryptAndHash(static.public)
+	if err != nil {
+		return
+	}
+	message = append(message, encryptedStatic...)
+
+	dh, err = hs.dh.dh(static, remoteEphemeral, false)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh)
+
+	encryptedPayload, err := ss.encryptAndHash(payload)
+	if err != nil {
+		return
+	}
+	message = append(message, encryptedPayload...)
+
+	_, err = rw.Write(message)
+	if err != nil {
+		return
+	}
+
+	recv, send = ss.split()
+	return
+}
+
+// initiate Perform the initiator side of the handshake, the payload of the second message is payloadLen bytes.
+// Returns the cipher states for sending and receiving, the static key of the responder and the payload.
+func (hs *noiseHandshake) initiate(rw io.ReadWriter, payloadLen int) (send *noiseCipherState, recv *noiseCipherState, remoteStatic []byte, payload []byte, err error) {
+	ss := newNoiseSymmetricState(hs.protocolName)
+
+	// -> e
+	ephemeral, err := hs.dh.generateKeyPair()
+	if err != nil {
+		return
+	}
+	ss.mixHash(ephemeral.public)
+	ss.mixHash(nil)
+	_, err = rw.Write(ephemeral.public)
+	if err != nil {
+		return
+	}
+
+	// <- e, ee, s, es, payload
+	keyLen := hs.dh.publicKeyLen()
+	message := make([]byte, keyLen+keyLen+noiseMACLen+payloadLen+noiseMACLen)
+	_, err = io.ReadFull(rw, message)
+	if err != nil {
+		return
+	}
+
+	remoteEphemeral := message[:keyLen]
+	ss.mixHash(remoteEphemeral)
+
+	dh, err := hs.dh.dh(ephemeral, remoteEphemeral, true)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh)
+
+	remoteStatic, err = ss.decryptAndHash(message[keyLen : keyLen*2+noiseMACLen])
+	if err != nil {
+		return
+	}
+
+	dh, err = hs.dh.dh(ephemeral, remoteStatic, true)
+	if err != nil {
+		return
+	}
+	ss.mixKey(dh)
+
+	payload, err = ss.decryptAndHash(message[keyLen*2+noiseMACLen:])
+	if err != nil {
+		return
+	}
+
+	send, recv = ss.split()
+	return
+}
+
+//////////////////////////////// Certificate ////////////////////////////////
+
+// NoiseCertificate The static key of the switcher and its signature from the pool authority
+type NoiseCertificate struct {
+	staticKey     noiseKeyPair
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     []byte
+}
+
+// noiseCertificateHash The hash signed by the authority: SHA-256 of version, valid_from, not_valid_after
+// and the x-only static public key
+func noiseCertificateHash(version uint16, validFrom uint32, notValidAfter uint32, staticXOnly []byte) []byte {
+	w := new(sv2Writer)
+	w.u16(version).u32(validFrom).u32(notValidAfter)
+	w.buf = append(w.buf, staticXOnly...)
+	hash := sha256.Sum256(w.buf)
+	return hash[:]
+}
+
+// NewNoiseCertificate Generate a static key and sign it with the authority key (BIP340 Schnorr signature)
+func NewNoiseCertificate(authorityKey *btcec.PrivateKey, validity time.Duration) (cert *NoiseCertificate, err error) {
+	cert = new(NoiseCertificate)
+	cert.staticKey, err = noiseEllSwiftDH{}.generateKeyPair()
+	if err != nil {
+		return
+	}
+	staticXOnly := schnorr.SerializePubKey(cert.staticKey.private.(*btcec.PrivateKey).PubKey())
+
+	now := time.Now()
+	cert.ValidFrom = uint32(now.Add(-time.Hour).Unix())
+	cert.NotValidAfter = uint32(now.Add(validity).Unix())
+	signature, err := schnorr.Sign(authorityKey, noiseCertificateHash(cert.Version, cert.ValidFrom, cert.NotValidAfter, staticXOnly))
+	if err != nil {
+		return
+	}
+	cert.Signature = signature.Serialize()
+	return
+}
+
+// newNoiseCertificateFromConfig Create the certificate with the authority key in the configuration
+func newNoiseCertificateFromConfig(conf StratumV2Config) (cert *NoiseCertificate, err error) {
+	keyBytes, err := hex.DecodeString(conf.AuthorityPrivateKey)
+	if err != nil {
+		return
+	}
+	if len(keyBytes) != btcec.PrivKeyBytesLen {
+		err = errors.New("AuthorityPrivateKey should be 32 bytes")
+		return
+	}
+	authorityKey, authorityPublicKey := btcec.PrivKeyFromBytes(keyBytes)
+
+	validity := conf.CertValiditySeconds
+	if validity == 0 {
+		validity = noiseDefaultCertValiditySeconds
+	}
+
+	cert, err = NewNoiseCertificate(authorityKey, time.Duration(validity)*time.Second)
+	if err != nil {
+		return
+	}
+
+	glog.Info("Stratum V2 authority public key: ", hex.EncodeToString(schnorr.SerializePubKey(authorityPublicKey)))
+	return
+}
+
+// signatureNoiseMessage Encode SIGNATURE_NOISE_MESSAGE
+func (cert *NoiseCertificate) signatureNoiseMessage() []byte {
+	w := new(sv2Writer)
+	w.u16(cert.Version).u32(cert.ValidFrom).u32(cert.NotValidAfter)
+	w.buf = append(w.buf, cert.Signature...)
+	return w.buf
+}
+
+// verifyNoiseCertificate Verify SIGNATURE_NOISE_MESSAGE of the remote static key (used by the initiator)
+func verifyNoiseCertificate(authorityPublicKey *btcec.PublicKey, staticXOnly []byte, message []byte) error {
+	if len(message) != noiseSignatureMessageLen {
+		return ErrNoiseInvalidCertificate
+	}
+	r := sv2Reader{buf: message}
+	version := r.u16()
+	validFrom := r.u32()
+	notValidAfter := r.u32()
+	signature, err := schnorr.ParseSignature(r.take(schnorr.SignatureSize))
+	if err != nil {
+		return ErrNoiseInvalidCertificate
+	}
+
+	now := uint32(time.Now().Unix())
+	if now < validFrom || now > notValidAfter {
+		return ErrNoiseInvalidCertificate
+	}
+	if !signature.Verify(noiseCertificateHash(version, validFrom, notValidAfter, staticXOnly), authorityPublicKey) {
+		return ErrNoiseInvalidCertificate
+	}
+	return nil
+}
+
+//////////////////////////////// NoiseConn ////////////////////////////////
+
+// NoiseConn Encrypted Stratum V2 connection, transfers Stratum V2 frames
+type NoiseConn struct {
+	conn net.Conn
+
+	readLock   sync.Mutex
+	writeLock  sync.Mutex
+	sendCipher *noiseCipherState
+	recvCipher *noiseCipherState
+
+	// Maximum payload length of the frames read from the peer
+	maxPayloadLen int
+}
+
+// NewNoiseResponderConn Perform the responder side of the handshake
+func NewNoiseResponderConn(conn net.Conn, cert *NoiseCertificate) (noiseConn *NoiseConn, err error) {
+	conn.SetDeadline(time.Now().Add(noiseHandshakeTimeoutSeconds * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	noiseConn = new(NoiseConn)
+	noiseConn.conn = conn
+	noiseConn.recvCipher, noiseConn.sendCipher, err = stratumV2NoiseHandshake.respond(conn, cert.staticKey, cert.signatureNoiseMessage())
+	if err != nil {
+		noiseConn = nil
+		return
+	}
+	// The client is not authenticated in NX, do not let it make the switcher allocate large buffers
+	noiseConn.maxPayloadLen = stratumV2MaxMinerPayloadLen
+	return
+}
+
+// NewNoiseInitiatorConn Perform the initiator side of the handshake and verify the certificate of the responder
+// (the switcher does not dial Stratum V2 servers, this is used by tests and tools)
+func NewNoiseInitiatorConn(conn net.Conn, authorityPublicKey *btcec.PublicKey) (noiseConn *NoiseConn, err error) {
+	send, recv, remoteStatic, signatureMessage, err := stratumV2NoiseHandshake.initiate(conn, noiseSignatureMessageLen)
+	if err != nil {
+		return
+	}
+	staticXOnly, err := noiseEllSwiftXOnly(remoteStatic)
+	if err != nil {
+		return
+	}
+	err = verifyNoiseCertificate(authorityPublicKey, staticXOnly, signatureMessage)
+	if err != nil {
+		return
+	}
+
+	noiseConn = new(NoiseConn)
+	noiseConn.conn = conn
+	noiseConn.sendCipher, noiseConn.recvCipher = send, recv
+	noiseConn.maxPayloadLen = stratumV2MaxPayloadLen
+	return
+}
+
+// ReadFrame Read and decrypt a Stratum V2 frame
+func (noiseConn *NoiseConn) ReadFrame() (frame *StratumV2Frame, err error) {
+	noiseConn.readLock.Lock()
+	defer noiseConn.readLock.Unlock()
+
+	encryptedHeader := make([]byte, noiseEncryptedHeaderLen)
+	_, err = io.ReadFull(noiseConn.conn, encryptedHeader)
+	if err != nil {
+		return
+	}
+	header, err := noiseConn.recvCipher.decrypt(nil, encryptedHeader)
+	if err != nil {
+		return
+	}
+	frame, payloadLen, err := parseStratumV2FrameHeader(header)
+	if err != nil {
+		return
+	}
+	if payloadLen > noiseConn.maxPayloadLen {
+		err = ErrStratumV2FrameTooLong
+		return
+	}
+
+	// The payload is encrypted in chunks, each of them is a Noise transport message.
+	// The buffer grows only as the chunks are decrypted.
+	for remain := payloadLen; remain > 0; {
+		chunkLen := remain
+		if chunkLen > noiseMaxMessageLen-noiseMACLen {
+			chunkLen = noiseMaxMessageLen - noiseMACLen
+		}
+		encryptedChunk := make([]byte, chunkLen+noiseMACLen)
+		_, err = io.ReadFull(noiseConn.conn, encryptedChunk)
+		if err != nil {
+			return
+		}
+		var chunk []byte
+		chunk, err = noiseConn.recvCipher.decrypt(nil, encryptedChunk)
+		if err != nil {
+			return
+		}
+		frame.Payload = append(frame.Payload, chunk...)
+		remain -= chunkLen
+	}
+	return
+}
+
+// WriteFrame Encrypt and write a Stratum V2 frame
+func (noiseConn *NoiseConn) WriteFrame(frame *StratumV2Frame) (err error) {
+	header, err := frame.EncodeHeader()
+	if err != nil {
+		return
+	}
+
+	noiseConn.writeLock.Lock()
+	defer noiseConn.writeLock.Unlock()
+
+	message, err := noiseConn.sendCipher.encrypt(nil, header)
+	if err != nil {
+		return
+	}
+	payload := frame.Payload
+	for len(payload) > 0 {
+		chunkLen := len(payload)
+		if chunkLen > noiseMaxMessageLen-noiseMACLen {
+			chunkLen = noiseMaxMessageLen - noiseMACLen
+		}
+		var chunk []byte
+		chunk, err = noiseConn.sendCipher.encrypt(nil, payload[:chunkLen])
+		if err != nil {
+			return
+		}
+		message = append(message, chunk...)
+		payload = payload[chunkLen:]
+	}
+
+	_, err = noiseConn.conn.Write(message)
+	return
+}
+
+// Close Close the underlying connection
+func (noiseConn *NoiseConn) Close() error {
+	return noiseConn.conn.Close()
+}
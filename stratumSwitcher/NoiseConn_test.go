@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// noiseTestX25519DH X25519 with the ephemeral key given by a test vector
+type noiseTestX25519DH struct {
+	ephemeral string
+}
+
+func noiseTestX25519KeyPair(privateHex string) (keyPair noiseKeyPair, err error) {
+	private, err := ecdh.X25519().NewPrivateKey(mustDecodeHex(privateHex))
+	if err != nil {
+		return
+	}
+	return noiseKeyPair{private, private.PublicKey().Bytes()}, nil
+}
+
+func (dh *noiseTestX25519DH) generateKeyPair() (noiseKeyPair, error) {
+	return noiseTestX25519KeyPair(dh.ephemeral)
+}
+
+func (dh *noiseTestX25519DH) publicKeyLen() int {
+	return 32
+}
+
+func (dh *noiseTestX25519DH) dh(local noiseKeyPair, remotePublic []byte, initiator bool) ([]byte, error) {
+	remote, err := ecdh.X25519().NewPublicKey(remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	return local.private.(*ecdh.PrivateKey).ECDH(remote)
+}
+
+// noiseTestConn Reads the given message and records the written one
+type noiseTestConn struct {
+	*bytes.Reader
+	written bytes.Buffer
+}
+
+func (conn *noiseTestConn) Write(b []byte) (int, error) {
+	return conn.written.Write(b)
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestNoiseHandshakeVector Check the handshake and the cipher states with the Noise_NX_25519_ChaChaPoly_SHA256
+// test vector of the Noise protocol (cacophony). Only the DH functions differ from the Stratum V2 handshake.
+func TestNoiseHandshakeVector(t *testing.T) {
+	const (
+		protocolName   = "Noise_NX_25519_ChaChaPoly_SHA256"
+		respStatic     = "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20"
+		initEphemeral  = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+		respEphemeral  = "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60"
+		msg0Ciphertext = "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"
+		msg1Ciphertext = "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d4846686b5f4e8c51a605bcb276206a6df60ae938b905adaf29a2dae4a4951bbd9ac64830ab64f2329646560b930979ff52da8dda7c0677c502dba13c078b5afd1bf11"
+		msg2Payload    = "79656c6c6f777375626d6172696e65"
+		msg2Ciphertext = "92613cda6ccb2936449efb8ff870b5a4536f5734a4e31056d38101230762e8"
+		msg3Payload    = "7375626d6172696e6579656c6c6f77"
+		msg3Ciphertext = "ed89355072429afe6c3442ba7af66f6647499291bab58d40f6a392e79ff80a"
+	)
+
+	static, err := noiseTestX25519KeyPair(respStatic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := &noiseHandshake{protocolName, &noiseTestX25519DH{respEphemeral}}
+	responderConn := &noiseTestConn{Reader: bytes.NewReader(mustDecodeHex(msg0Ciphertext))}
+	responderRecv, responderSend, err := responder.respond(responderConn, static, nil)
+	if err != nil {
+		t.Fatal("responder handshake failed: ", err)
+	}
+	if hex.EncodeToString(responderConn.written.Bytes()) != msg1Ciphertext {
+		t.Error("wrong message 1: ", hex.EncodeToString(responderConn.written.Bytes()))
+	}
+
+	initiator := &noiseHandshake{protocolName, &noiseTestX25519DH{initEphemeral}}
+	initiatorConn := &noiseTestConn{Reader: bytes.NewReader(mustDecodeHex(msg1Ciphertext))}
+	initiatorSend, initiatorRecv, remoteStatic, payload, err := initiator.initiate(initiatorConn, 0)
+	if err != nil {
+		t.Fatal("initiator handshake failed: ", err)
+	}
+	if hex.EncodeToString(initiatorConn.written.Bytes()) != msg0Ciphertext {
+		t.Error("wrong message 0: ", hex.EncodeToString(initiatorConn.written.Bytes()))
+	}
+	if !bytes.Equal(remoteStatic, static.public) || len(payload) != 0 {
+		t.Error("wrong static key or payload of the responder")
+	}
+
+	// transport messages
+	transports := []struct {
+		send, recv *noiseCipherState
+		payload    string
+		ciphertext string
+	}{
+		{initiatorSend, responderRecv, msg2Payload, msg2Ciphertext},
+		{responderSend, initiatorRecv, msg3Payload, msg3Ciphertext},
+	}
+	for i, transport := range transports {
+		ciphertext, err := transport.send.encrypt(nil, mustDecodeHex(transport.payload))
+		if err != nil || hex.EncodeToString(ciphertext) != transport.ciphertext {
+			t.Error("wrong transport message ", i+2, ": ", hex.EncodeToString(ciphertext), err)
+		}
+		plaintext, err := transport.recv.decrypt(nil, ciphertext)
+		if err != nil || hex.EncodeToString(plaintext) != transport.payload {
+			t.Error("transport message ", i+2, " decrypt failed: ", err)
+		}
+	}
+}
+
+// TestNoiseEllSwiftDH Check the DH of the Stratum V2 handshake with the ElligatorSwift decoding vectors of BIP324.
+// With the private key 1, the ECDH point is the decoded public key itself.
+func TestNoiseEllSwiftDH(t *testing.T) {
+	vectors := []struct {
+		ellswift string
+		x        string
+	}{
+		{
+			"00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+			"edd1fd3e327ce90cc7a3542614289aee9682003e9cf7dcc9cf2ca9743be5aa0c",
+		},
+		{
+			"000000000000000000000000000000000000000000000000000000000000000001d3475bf7655b0fb2d852921035b2ef607f49069b97454e6795251062741771",
+			"b5da00b73cd6560520e7c364086e7cd23a34bf60d0e707be9fc34d4cd5fdfa2c",
+		},
+		{
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffff0e5be52372dd6e894b2a326fc3605a6e8f3c69c710bf27d630dfe2004988b78eb6eab36",
+			"64bf84dd5e03670fdb24c0f5d3c2c365736f51db6c92d95010716ad2d36134c8",
+		},
+	}
+
+	one := make([]byte, 32)
+	one[31] = 1
+	private, _ := btcec.PrivKeyFromBytes(one)
+	local := noiseKeyPair{private, bytes.Repeat([]byte{0xaa}, noiseEllSwiftLen)}
+	tag := sha256.Sum256(noiseEllSwiftECDHTag)
+
+	for _, vector := range vectors {
+		remote := mustDecodeHex(vector.ellswift)
+		x := mustDecodeHex(vector.x)
+
+		xOnly, err := noiseEllSwiftXOnly(remote)
+		if err != nil || !bytes.Equal(xOnly, x) {
+			t.Error("wrong decoded x: ", hex.EncodeToString(xOnly), err)
+		}
+
+		for _, initiator := range []bool{true, false} {
+			// the initiator's public key comes first
+			h := sha256.New()
+			h.Write(tag[:])
+			h.Write(tag[:])
+			if initiator {
+				h.Write(local.public)
+				h.Write(remote)
+			} else {
+				h.Write(remote)
+				h.Write(local.public)
+			}
+			h.Write(x)
+
+			secret, err := noiseEllSwiftDH{}.dh(local, remote, initiator)
+			if err != nil || !bytes.Equal(secret, h.Sum(nil)) {
+				t.Error("wrong shared secret: ", hex.EncodeToString(secret), ", initiator: ", initiator, err)
+			}
+		}
+	}
+}
+
+func TestNoiseStratumV2Handshake(t *testing.T) {
+	authorityKey, _ := btcec.NewPrivateKey()
+	cert, err := NewNoiseCertificate(authorityKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second handshake message is 234 bytes: e (64) + encrypted s (64 + 16) + encrypted SIGNATURE_NOISE_MESSAGE (74 + 16)
+	ephemeral, _ := noiseEllSwiftDH{}.generateKeyPair()
+	conn := &noiseTestConn{Reader: bytes.NewReader(ephemeral.public)}
+	_, _, err = stratumV2NoiseHandshake.respond(conn, cert.staticKey, cert.signatureNoiseMessage())
+	if err != nil || conn.written.Len() != 234 {
+		t.Error("wrong handshake message: ", conn.written.Len(), err)
+	}
+
+	// The certificate is rejected with another authority key
+	otherKey, _ := btcec.NewPrivateKey()
+	authorities := []struct {
+		publicKey *btcec.PublicKey
+		valid     bool
+	}{
+		{authorityKey.PubKey(), true},
+		{otherKey.PubKey(), false},
+	}
+	for _, authority := range authorities {
+		minerConn, switcherConn := net.Pipe()
+		go NewNoiseResponderConn(switcherConn, cert)
+		_, err = NewNoiseInitiatorConn(minerConn, authority.publicKey)
+		if (err == nil) != authority.valid {
+			t.Error("handshake with the authority key ", hex.EncodeToString(authority.publicKey.SerializeCompressed()), ": ", err)
+		}
+		minerConn.Close()
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Default interval of the upstream probes
+const defaultProbeIntervalSeconds = 30
+
+// Default timeout of an upstream probe
+const defaultProbeTimeoutSeconds = 10
+
+// UpstreamProber Checks the upstream sservers with a synthetic subscribe and authorize of a canary account
+type UpstreamProber struct {
+	manager *StratumSessionManager
+	conf    UpstreamProbeConfig
+	// Session id reserved for the probes
+	sessionID uint32
+}
+
+// NewUpstreamProber Create an UpstreamProber, a session id is reserved for the probes
+func NewUpstreamProber(manager *StratumSessionManager, conf UpstreamProbeConfig) (prober *UpstreamProber, err error) {
+	prober = new(UpstreamProber)
+	prober.manager = manager
+	prober.conf = conf
+	if prober.conf.IntervalSeconds <= 0 {
+		prober.conf.IntervalSeconds = defaultProbeIntervalSeconds
+	}
+	if prober.conf.TimeoutSeconds <= 0 {
+		prober.conf.TimeoutSeconds = defaultProbeTimeoutSeconds
+	}
+	prober.sessionID, err = manager.sessionIDManager.AllocSessionID()
+	if err != nil {
+		return
+	}
+	glog.Info("[probe] enabled, interval: ", prober.conf.IntervalSeconds, "s, canary: ", prober.conf.CanaryWorkerName)
+	return
+}
+
+// probe Connect to the upstream, subscribe and authorize the canary worker.
+// Returns the time from connecting to the authorize response.
+func (prober *UpstreamProber) probe(coin string, url string) (latency time.Duration, err error) {
+	startTime := time.Now()
+	timeout := time.Duration(prober.conf.TimeoutSeconds) * time.Second
+
+	conn, err := net.DialTimeout("tcp", url, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(startTime.Add(timeout))
+	reader := bufio.NewReaderSize(conn, bufioReaderBufSize)
+
+	sessionIDString := Uint32ToHex(prober.sessionID)
+	subscribe := JSONRPCRequest{"subscribe", "mining.subscribe", JSONRPCArray{"stratumSwitcher-probe", sessionIDString, 0}, ""}
+	if prober.manager.chainType == ChainTypeEthereum {
+		subscribe.Params = JSONRPCArray{"stratumSwitcher-probe", "EthereumStratum/1.0.0", sessionIDString[2:8], 0}
+	}
+	err = writeJSONRequest(conn, &subscribe)
+	if err != nil {
+		return
+	}
+
+	// Authorize without the coin suffix first, like the sessions do
+	workerName := prober.conf.CanaryWorkerName
+	authorize := JSONRPCRequest{"auth", "mining.authorize", JSONRPCArray{workerName, prober.conf.CanaryPassword}, ""}
+	err = writeJSONRequest(conn, &authorize)
+	if err != nil {
+		return
+	}
+
+	subscribed := false
+	withSuffix := false
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil {
+			err = readErr
+			return
+		}
+
+		response, parseErr := NewJSONRPCResponse(line)
+		if parseErr != nil || response.ID == nil {
+			// notifications
+			continue
+		}
+
+		switch response.ID {
+		case "subscribe":
+			if response.Error != nil || response.Result == nil {
+				err = ErrProbeSubscribeFailed
+				return
+			}
+			subscribed = true
+
+		case "auth":
+			if success, ok := response.Result.(bool); ok && success {
+				if !subscribed {
+					err = ErrProbeSubscribeFailed
+					return
+				}
+				latency = time.Since(startTime)
+				return
+			}
+			if withSuffix {
+				err = ErrProbeAuthorizeFailed
+				return
+			}
+			// Authorize with the coin suffix
+			withSuffix = true
+			authorize.Params[0] = prober.workerNameWithSuffix(coin)
+			err = writeJSONRequest(conn, &authorize)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// workerNameWithSuffix The canary worker name with the user suffix of the coin
+func (prober *UpstreamProber) workerNameWithSuffix(coin string) string {
+	suffix := coin
+	if serverInfo, ok := prober.manager.getStratumServerInfo(coin); ok {
+		suffix = serverInfo.UserSuffix
+	}
+	workerName := prober.conf.CanaryWorkerName
+	dotPos := strings.Index(workerName, ".")
+	if dotPos < 0 {
+		return workerName + "_" + suffix
+	}
+	return workerName[:dotPos] + "_" + suffix + workerName[dotPos:]
+}
+
+// writeJSONRequest Write a JSON-RPC request line
+func writeJSONRequest(conn net.Conn, request *JSONRPCRequest) (err error) {
+	bytes, err := request.ToJSONBytes()
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(append(bytes, '\n'))
+	return
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// runFakeSServer Accept one connection, answer mining.subscribe and authorize only the given worker
+func runFakeSServer(t *testing.T, listener net.Listener, authorizedWorker string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		request, err := NewJSONRPCRequest(line)
+		if err != nil {
+			t.Errorf("invalid request: %s", line)
+			return
+		}
+		response := JSONRPCResponse{ID: request.ID}
+		switch request.Method {
+		case "mining.subscribe":
+			response.Result = JSONRPCArray{JSONRPCArray{}, request.Params[1]}
+		case "mining.authorize":
+			response.Result = request.Params[0] == authorizedWorker
+		}
+		bytes, _ := response.ToJSONBytes(1)
+		conn.Write(append(bytes, '\n'))
+	}
+}
+
+func TestUpstreamProberProbe(t *testing.T) {
+	manager := &StratumSessionManager{
+		chainType:            ChainTypeBitcoin,
+		stratumServerInfoMap: StratumServerInfoMap{"btc": {UserSuffix: "btc"}},
+	}
+	prober := &UpstreamProber{manager, UpstreamProbeConfig{TimeoutSeconds: 5, CanaryWorkerName: "canary.probe"}, 0x01000001}
+
+	for _, tc := range []struct {
+		authorizedWorker string
+		expectedErr      error
+	}{
+		{"canary.probe", nil},
+		{"canary_btc.probe", nil},
+		{"other", ErrProbeAuthorizeFailed},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go runFakeSServer(t, listener, tc.authorizedWorker)
+
+		_, err = prober.probe("btc", listener.Addr().String())
+		if err != tc.expectedErr {
+			t.Errorf("probe with authorized worker %s: err = %v, want %v", tc.authorizedWorker, err, tc.expectedErr)
+		}
+		listener.Close()
+	}
+}
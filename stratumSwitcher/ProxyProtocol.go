@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol (HAProxy) support of the listeners
+// <https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt>
+
+// Timeout for reading the PROXY protocol header
+const proxyProtocolHeaderTimeoutSeconds = 10
+
+// Maximum length of a PROXY protocol v1 header, including "\r\n"
+const proxyProtocolV1MaxHeaderLen = 107
+
+// The signature of the PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConn A connection with the client address from the PROXY protocol header
+type ProxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr Returns the client address sent by the load balancer
+func (conn *ProxyProtocolConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// ProxyProtocolReader Reads the PROXY protocol header of connections from trusted sources
+type ProxyProtocolReader struct {
+	trustedSources []*net.IPNet
+}
+
+// NewProxyProtocolReader Create a ProxyProtocolReader, trustedSources are CIDRs or IPs of the load balancers
+func NewProxyProtocolReader(trustedSources []string) (reader *ProxyProtocolReader, err error) {
+	reader = new(ProxyProtocolReader)
+	for _, source := range trustedSources {
+		ipNet, err := parseIPNet(source)
+		if err != nil {
+			return nil, err
+		}
+		reader.trustedSources = append(reader.trustedSources, ipNet)
+	}
+	return
+}
+
+// isTrusted Whether the connection comes from a trusted load balancer
+func (reader *ProxyProtocolReader) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range reader.trustedSources {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept Read the PROXY protocol header if the connection comes from a trusted source.
+// The header is required from trusted sources, other connections are returned as is.
+func (reader *ProxyProtocolReader) Accept(conn net.Conn) (net.Conn, error) {
+	if !reader.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeoutSeconds * time.Second))
+	remoteAddr, err := readProxyProtocolHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// LOCAL command or UNKNOWN protocol: keep the address of the load balancer
+	if remoteAddr == nil {
+		return conn, nil
+	}
+	return &ProxyProtocolConn{conn, remoteAddr}, nil
+}
+
+// readProxyProtocolHeader Read a v1 or v2 header without reading beyond it.
+// Returns nil address if the header does not carry the client address.
+func readProxyProtocolHeader(r io.Reader) (addr net.Addr, err error) {
+	// "PROXY" or the first 5 bytes of the v2 signature
+	header := make([]byte, 5, proxyProtocolV1MaxHeaderLen)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+
+	if string(header) == "PROXY" {
+		// v1 ends with "\r\n", read it byte by byte to leave the following data in the socket
+		b := make([]byte, 1)
+		for len(header) < proxyProtocolV1MaxHeaderLen {
+			_, err = io.ReadFull(r, b)
+			if err != nil {
+				return
+			}
+			header = append(header, b[0])
+			if b[0] == '\n' {
+				return parseProxyProtocolV1Header(header)
+			}
+		}
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	}
+
+	if bytes.Equal(header, proxyProtocolV2Signature[:5]) {
+		return readProxyProtocolV2Header(r, header)
+	}
+
+	err = ErrProxyProtocolHeaderInvalid
+	return
+}
+
+// parseProxyProtocolV1Header Parse "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func parseProxyProtocolV1Header(header []byte) (addr net.Addr, err error) {
+	line := string(header)
+	if !strings.HasSuffix(line, "\r\n") {
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, convErr := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || convErr != nil {
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	}
+	addr = &net.TCPAddr{IP: ip, Port: int(port)}
+	return
+}
+
+// readProxyProtocolV2Header Read the rest of a binary header, prefix is the bytes already read
+func readProxyProtocolV2Header(r io.Reader, prefix []byte) (addr net.Addr, err error) {
+	// signature (12) + version/command (1) + family (1) + length (2)
+	header := make([]byte, 16)
+	copy(header, prefix)
+	_, err = io.ReadFull(r, header[len(prefix):])
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return
+	}
+
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	switch {
+	case command == 0:
+		// LOCAL: health check of the load balancer
+		return
+	case command != 1:
+		err = ErrProxyProtocolHeaderInvalid
+		return
+	case family == 1 && len(payload) >= 12:
+		// AF_INET: src_addr(4) dst_addr(4) src_port(2) dst_port(2)
+		addr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		return
+	case family == 2 && len(payload) >= 36:
+		// AF_INET6: src_addr(16) dst_addr(16) src_port(2) dst_port(2)
+		addr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		return
+	default:
+		// AF_UNSPEC, AF_UNIX: no usable address
+		return
+	}
+}
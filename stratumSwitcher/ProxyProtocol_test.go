@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2Header := func(command byte, family byte, payload []byte) []byte {
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		header = append(header, 0x20|command, family, 0, 0)
+		binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+		return append(header, payload...)
+	}
+	v4Payload := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x0d, 0x05}
+	v6Payload := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	v6Payload = append(v6Payload, 0x1f, 0x90, 0x0d, 0x05)
+
+	testCases := []struct {
+		header []byte
+		addr   string
+		valid  bool
+	}{
+		{[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 3333\r\n"), "192.168.0.1:56324", true},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 3333\r\n"), "[2001:db8::1]:8080", true},
+		{[]byte("PROXY UNKNOWN\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"), "", false},
+		{[]byte("PROXY TCP4 a.b.c.d 10.0.0.1 56324 3333\r\n"), "", false},
+		{v2Header(1, 0x11, v4Payload), "192.168.0.1:56324", true},
+		{v2Header(1, 0x21, v6Payload), "[2001:db8::1]:8080", true},
+		{v2Header(0, 0x00, nil), "", true},
+		// TLVs after the addresses are skipped
+		{v2Header(1, 0x11, append(v4Payload, 0x04, 0x00, 0x01, 0xff)), "192.168.0.1:56324", true},
+		{[]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"), "", false},
+	}
+
+	for i, testCase := range testCases {
+		following := []byte(`{"id":1}`)
+		reader := bytes.NewReader(append(append([]byte{}, testCase.header...), following...))
+		addr, err := readProxyProtocolHeader(reader)
+
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("case %d: error expected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		addrStr := ""
+		if addr != nil {
+			addrStr = addr.String()
+		}
+		if addrStr != testCase.addr {
+			t.Errorf("case %d: address expected: %s, got: %s", i, testCase.addr, addrStr)
+		}
+		// the data after the header must not be consumed
+		if rest, _ := ioutil.ReadAll(reader); !bytes.Equal(rest, following) {
+			t.Errorf("case %d: data after the header consumed: %s", i, string(rest))
+		}
+	}
+}
+
+func TestProxyProtocolTrustedSources(t *testing.T) {
+	reader, err := NewProxyProtocolReader([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+		"172.16.0.1":  false,
+	}
+	for ip, expected := range trusted {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		if reader.isTrusted(addr) != expected {
+			t.Errorf("isTrusted(%s) should be %v", ip, expected)
+		}
+	}
+
+	if _, err := NewProxyProtocolReader([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR should be rejected")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// Interval of retrying to watch the configuration node in zookeeper
+const zkConfigNodeRetryIntervalSeconds = 10
+
+// getStratumServerInfo Get the Stratum server information of the currency
+func (manager *StratumSessionManager) getStratumServerInfo(coin string) (serverInfo StratumServerInfo, ok bool) {
+	manager.configLock.RLock()
+	defer manager.configLock.RUnlock()
+
+	serverInfo, ok = manager.stratumServerInfoMap[coin]
+	return
+}
+
+// getUpstreamPool Get the upstream pool of the currency
+func (manager *StratumSessionManager) getUpstreamPool(coin string) (pool *UpstreamPool, ok bool) {
+	manager.configLock.RLock()
+	defer manager.configLock.RUnlock()
+
+	pool, ok = manager.upstreamPools[coin]
+	return
+}
+
+// resolveMiningCoin The currency mined for the currency in zookeeper: itself if it has a Stratum server,
+// otherwise FallbackCoin. ok is false if neither of them has a Stratum server.
+func (manager *StratumSessionManager) resolveMiningCoin(coin string) (miningCoin string, ok bool) {
+	manager.configLock.RLock()
+	defer manager.configLock.RUnlock()
+
+	if _, ok = manager.stratumServerInfoMap[coin]; ok {
+		return coin, true
+	}
+	if _, ok = manager.stratumServerInfoMap[manager.fallbackCoin]; ok {
+		return manager.fallbackCoin, true
+	}
+	return coin, false
+}
+
+// getUpstreamPools Get a copy of the upstream pools of all currencies
+func (manager *StratumSessionManager) getUpstreamPools() map[string]*UpstreamPool {
+	manager.configLock.RLock()
+	defer manager.configLock.RUnlock()
+
+	pools := make(map[string]*UpstreamPool, len(manager.upstreamPools))
+	for coin, pool := range manager.upstreamPools {
+		pools[coin] = pool
+	}
+	return pools
+}
+
+// isUserAutoRegEnabled Whether the sub-account automatic registration is enabled
+func (manager *StratumSessionManager) isUserAutoRegEnabled() bool {
+	manager.configLock.RLock()
+	defer manager.configLock.RUnlock()
+
+	return manager.enableUserAutoReg
+}
+
+// getAutoRegMaxWaitUsers Get AutoRegMaxWaitUsers
+func (manager *StratumSessionManager) getAutoRegMaxWaitUsers() int64 {
+	return atomic.LoadInt64(&manager.autoRegMaxWaitUsers)
+}
+
+// loadReloadableConfig Load the configuration file, then override it with the zookeeper node (if configured)
+func (manager *StratumSessionManager) loadReloadableConfig() (conf ConfigData, err error) {
+	err = conf.LoadFromFile(manager.configFilePath)
+	if err != nil || manager.zkConfigNode == "" {
+		return
+	}
+
+	data, _, err := manager.zookeeperManager.backend.Get(manager.zkConfigNode)
+	if err == coordination.ErrNoNode {
+		return conf, nil
+	}
+	if err != nil {
+		return
+	}
+	err = overrideConfig(&conf, data)
+	return
+}
+
+// overrideConfig Override the configuration with the JSON.
+// StratumServerMap is replaced as a whole if it is in the JSON.
+func overrideConfig(conf *ConfigData, configJSON []byte) (err error) {
+	if len(configJSON) == 0 {
+		return
+	}
+
+	fileServerMap := conf.StratumServerMap
+	conf.StratumServerMap = nil
+	err = conf.LoadFromJSON(configJSON)
+	if conf.StratumServerMap == nil {
+		conf.StratumServerMap = fileServerMap
+	}
+	return
+}
+
+// reloadConfig Reload the configuration and apply it
+func (manager *StratumSessionManager) reloadConfig() {
+	manager.reloadLock.Lock()
+	defer manager.reloadLock.Unlock()
+
+	conf, err := manager.loadReloadableConfig()
+	if err != nil {
+		glog.Error("[reload] load config failed, keep the old one: ", err)
+		return
+	}
+	manager.applyConfig(conf)
+}
+
+// applyConfig Apply the reloadable part of the configuration: StratumServerMap (currencies and upstreams),
+// EnableUserAutoReg, AutoRegMaxWaitUsers and FallbackCoin. Other fields require a restart.
+// The sessions of the removed currencies are switched to FallbackCoin.
+func (manager *StratumSessionManager) applyConfig(conf ConfigData) {
+	if len(conf.StratumServerMap) == 0 {
+		glog.Error("[reload] StratumServerMap is empty, keep the old config")
+		return
+	}
+
+	var removedCoins []string
+	var stoppedPools []*UpstreamPool
+	var startedPools []*UpstreamPool
+
+	manager.configLock.Lock()
+
+	pools := make(map[string]*UpstreamPool)
+	for coin, serverInfo := range conf.StratumServerMap {
+		oldPool, exists := manager.upstreamPools[coin]
+		if exists && oldPool.SameUpstreams(serverInfo.Upstreams) {
+			pools[coin] = oldPool
+			continue
+		}
+
+		pool := NewUpstreamPool(coin, serverInfo.Upstreams)
+		if exists {
+			pool.inheritStatus(oldPool)
+			stoppedPools = append(stoppedPools, oldPool)
+			glog.Info("[reload] upstreams changed: ", coin)
+		} else {
+			glog.Info("[reload] coin added: ", coin)
+		}
+		pools[coin] = pool
+		startedPools = append(startedPools, pool)
+	}
+	for coin, oldPool := range manager.upstreamPools {
+		if _, exists := pools[coin]; !exists {
+			removedCoins = append(removedCoins, coin)
+			stoppedPools = append(stoppedPools, oldPool)
+			glog.Info("[reload] coin removed: ", coin)
+		}
+	}
+
+	manager.stratumServerInfoMap = conf.StratumServerMap
+	manager.upstreamPools = pools
+	manager.fallbackCoin = conf.FallbackCoin
+	if manager.enableUserAutoReg != conf.EnableUserAutoReg {
+		glog.Info("[reload] EnableUserAutoReg: ", manager.enableUserAutoReg, " -> ", conf.EnableUserAutoReg)
+		manager.enableUserAutoReg = conf.EnableUserAutoReg
+	}
+
+	manager.configLock.Unlock()
+
+	// Keep the number of waiting users, only change the limit
+	oldMaxWaitUsers := atomic.SwapInt64(&manager.autoRegMaxWaitUsers, conf.AutoRegMaxWaitUsers)
+	if oldMaxWaitUsers != conf.AutoRegMaxWaitUsers {
+		atomic.AddInt64(&manager.autoRegAllowUsers, conf.AutoRegMaxWaitUsers-oldMaxWaitUsers)
+		glog.Info("[reload] AutoRegMaxWaitUsers: ", oldMaxWaitUsers, " -> ", conf.AutoRegMaxWaitUsers)
+	}
+
+	for _, pool := range stoppedPools {
+		pool.Stop()
+	}
+	for _, pool := range startedPools {
+		manager.startUpstreamHealthCheck(pool)
+	}
+
+	if len(removedCoins) > 0 {
+		manager.moveSessionsOfRemovedCoins(removedCoins, conf.FallbackCoin)
+	}
+	glog.Info("[reload] config applied, coins: ", len(pools))
+}
+
+// moveSessionsOfRemovedCoins Switch the sessions of the removed currencies to the fallback currency
+func (manager *StratumSessionManager) moveSessionsOfRemovedCoins(removedCoins []string, fallbackCoin string) {
+	removed := make(map[string]bool)
+	for _, coin := range removedCoins {
+		removed[coin] = true
+	}
+
+	if _, ok := manager.getStratumServerInfo(fallbackCoin); !ok {
+		glog.Warning("[reload] FallbackCoin ", fallbackCoin, " not found, the sessions of ", removedCoins,
+			" keep their connections until they reconnect")
+		return
+	}
+
+	for _, session := range manager.registeredSessions() {
+		if !removed[session.getMiningCoin()] {
+			continue
+		}
+		glog.Info("[reload] move session to ", fallbackCoin, ": ", session.fullWorkerName, "; ", session.getMiningCoin())
+		if session.isBTCAgent {
+			go session.tryStop(session.getReconnectCounter(), "coin_removed")
+		} else {
+			go manager.moveSession(session, fallbackCoin, session.getReconnectCounter())
+		}
+	}
+}
+
+// moveSession Switch the session of a removed currency to the fallback currency.
+// The session has no upstream to stay on, so the switch is retried until the fallback currency is healthy,
+// the session is stopped or switched by another goroutine, or the fallback currency is removed.
+func (manager *StratumSessionManager) moveSession(session *StratumSession, fallbackCoin string, currentReconnectCounter uint32) {
+	for {
+		err := session.switchCoinType(fallbackCoin, currentReconnectCounter)
+		if err != ErrUpstreamUnhealthy {
+			return
+		}
+		glog.Warning("[reload] upstream of ", fallbackCoin, " unhealthy, retry in ", manager.upstreamCheckIntervalSeconds, "s: ",
+			session.fullWorkerName)
+		time.Sleep(time.Duration(manager.upstreamCheckIntervalSeconds) * time.Second)
+
+		if _, ok := manager.getStratumServerInfo(fallbackCoin); !ok {
+			glog.Warning("[reload] FallbackCoin ", fallbackCoin, " removed, stop moving session: ", session.fullWorkerName)
+			return
+		}
+	}
+}
+
+// watchConfigNode Reload the configuration when the zookeeper node is changed
+func (manager *StratumSessionManager) watchConfigNode() {
+	glog.Info("[reload] watching config node: ", manager.zkConfigNode)
+	for {
+		_, event, err := manager.zookeeperManager.backend.ExistsW(manager.zkConfigNode)
+		if err != nil {
+			glog.Error("[reload] watch config node failed: ", manager.zkConfigNode, "; ", err)
+			time.Sleep(zkConfigNodeRetryIntervalSeconds * time.Second)
+			continue
+		}
+
+		e := <-event
+		if e.Type == coordination.EventNodeCreated || e.Type == coordination.EventNodeDataChanged || e.Type == coordination.EventNodeDeleted {
+			glog.Info("[reload] config node changed: ", manager.zkConfigNode, "; ", e.Type)
+			manager.reloadConfig()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	var conf ConfigData
+	conf.ZKServerIDAssignDir = "/swid/"
+	conf.ZKSwitcherWatchDir = "/switcher/"
+	conf.ZKAutoRegWatchDir = "/autoreg/"
+	err := conf.LoadFromJSON([]byte(`{
+		"StratumServerMap": {"btc": {"URL": "btc1:3333"}, "bch": {"URL": "bch1:3333"}},
+		"EnableUserAutoReg": true,
+		"AutoRegMaxWaitUsers": 10
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := &StratumSessionManager{
+		sessions:            make(StratumSessionMap),
+		upstreamPools:       make(map[string]*UpstreamPool),
+		autoRegAllowUsers:   7, // 3 users waiting
+		autoRegMaxWaitUsers: 10,
+		upstreamCheck: func(coin string, url string) (time.Duration, error) {
+			return 0, nil
+		},
+		upstreamCheckIntervalSeconds: 3600,
+	}
+	manager.applyConfig(conf)
+	btcPool, _ := manager.getUpstreamPool("btc")
+
+	// The StratumServerMap in zookeeper replaces the one in the file
+	err = overrideConfig(&conf, []byte(`{
+		"StratumServerMap": {"btc": {"URL": "btc1:3333"}, "ltc": {"URL": "ltc1:3333"}},
+		"AutoRegMaxWaitUsers": 20,
+		"FallbackCoin": "btc"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.applyConfig(conf)
+
+	if _, ok := manager.getStratumServerInfo("bch"); ok {
+		t.Error("removed coin bch still exists")
+	}
+	if serverInfo, ok := manager.getStratumServerInfo("ltc"); !ok || serverInfo.UserSuffix != "ltc" {
+		t.Errorf("added coin ltc: %v, %v", serverInfo, ok)
+	}
+	if pool, _ := manager.getUpstreamPool("btc"); pool != btcPool {
+		t.Error("the upstream pool of the unchanged coin btc is replaced")
+	}
+	if !manager.isUserAutoRegEnabled() {
+		t.Error("EnableUserAutoReg not kept")
+	}
+	if manager.getAutoRegMaxWaitUsers() != 20 || manager.autoRegAllowUsers != 17 {
+		t.Errorf("AutoRegMaxWaitUsers: %d, allowed users: %d", manager.getAutoRegMaxWaitUsers(), manager.autoRegAllowUsers)
+	}
+	if manager.fallbackCoin != "btc" {
+		t.Errorf("FallbackCoin: %s", manager.fallbackCoin)
+	}
+}
+
+func TestResolveMiningCoin(t *testing.T) {
+	manager := &StratumSessionManager{
+		stratumServerInfoMap: StratumServerInfoMap{"btc": StratumServerInfo{}, "bch": StratumServerInfo{}},
+	}
+	tests := []struct {
+		fallbackCoin string
+		coin         string
+		miningCoin   string
+		ok           bool
+	}{
+		{"", "bch", "bch", true},
+		{"", "ltc", "ltc", false},
+		{"btc", "bch", "bch", true},
+		{"btc", "ltc", "btc", true},
+		{"doge", "ltc", "ltc", false},
+	}
+	for _, test := range tests {
+		manager.fallbackCoin = test.fallbackCoin
+		miningCoin, ok := manager.resolveMiningCoin(test.coin)
+		if miningCoin != test.miningCoin || ok != test.ok {
+			t.Errorf("resolveMiningCoin(%s) with FallbackCoin %s: %s, %v", test.coin, test.fallbackCoin, miningCoin, ok)
+		}
+	}
+}
+
+func TestMoveSessionRetry(t *testing.T) {
+	pool := NewUpstreamPool("btc", []StratumUpstreamInfo{{URL: "btc1:3333"}})
+	for i := 0; i < upstreamMaxFailures; i++ {
+		pool.MarkFailure("btc1:3333", errors.New("connection refused"))
+	}
+	manager := &StratumSessionManager{
+		stratumServerInfoMap:         StratumServerInfoMap{"btc": StratumServerInfo{}},
+		upstreamPools:                map[string]*UpstreamPool{"btc": pool},
+		upstreamCheckIntervalSeconds: 1,
+	}
+	session := &StratumSession{manager: manager, runningStat: StatRunning, miningCoin: "bch"}
+
+	done := make(chan struct{})
+	go func() {
+		manager.moveSession(session, "btc", 0)
+		close(done)
+	}()
+
+	// The session stays on the removed currency while the fallback currency is unhealthy
+	select {
+	case <-done:
+		t.Fatal("move abandoned while the fallback currency is unhealthy")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if session.getMiningCoin() != "bch" {
+		t.Error("session switched to an unhealthy currency")
+	}
+
+	// The retry ends with the session
+	session.setStat(StatStoped)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("move not retried")
+	}
+}
@@ -81,6 +81,14 @@ func (manager *SessionIDManager) IsFull() bool {
 	return manager.isFullWithoutLock()
 }
 
+// Usage Get the number of allocated session IDs and the total number of session IDs
+func (manager *SessionIDManager) Usage() (used uint32, capacity uint32) {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	return manager.count, manager.sessionIDMask + 1
+}
+
 // AllocSessionID Assign a session ID to the caller
 func (manager *SessionIDManager) AllocSessionID() (sessionID uint32, err error) {
 	defer manager.lock.Unlock()
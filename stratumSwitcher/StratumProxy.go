@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The buffer size of the line reader in the line-aware proxy mode, longer lines are forwarded without parsing
+const lineReaderBufSize = 16 * 1024
+
+// Maximum submits waiting for the response of the server, the oldest are forgotten when exceeded
+const maxPendingSubmits = 1024
+
+// The error code of the stale share in Stratum
+const stratumErrCodeStale = 21
+
+// StratumMessage A JSON-RPC line of the Stratum stream in the line-aware proxy mode
+type StratumMessage struct {
+	// The line received, including the line break
+	Line []byte
+	// A request or notification if Request is not nil, otherwise a response
+	Request  *JSONRPCRequest
+	Response *JSONRPCResponse
+
+	// Set by a hook after changing Request or Response, the message is encoded again before forwarding
+	Modified bool
+	// Set by a hook to drop the message
+	Drop bool
+	// Set by a hook of the miner's messages to drop the request and send the response to the miner instead
+	Reply *JSONRPCResponse
+}
+
+// StratumMessageHook Inspect, rewrite or drop a message in the line-aware proxy mode
+type StratumMessageHook func(session *StratumSession, message *StratumMessage)
+
+// AddClientMessageHook Add a hook of the messages from the miners, must be called before Run
+func (manager *StratumSessionManager) AddClientMessageHook(hook StratumMessageHook) {
+	manager.clientMessageHooks = append(manager.clientMessageHooks, hook)
+}
+
+// AddServerMessageHook Add a hook of the messages from the servers, must be called before Run
+func (manager *StratumSessionManager) AddServerMessageHook(hook StratumMessageHook) {
+	manager.serverMessageHooks = append(manager.serverMessageHooks, hook)
+}
+
+// isLineMode Whether the session is proxied in the line-aware mode.
+// BTCAgent sessions carry binary ex-messages and are always copied raw.
+func (session *StratumSession) isLineMode() bool {
+	return session.manager.parseStratumStream && !session.isBTCAgent
+}
+
+// newLineReader The reader of the line-aware proxy mode, the content buffered by reader during the handshake is read first
+func newLineReader(reader *bufio.Reader, conn net.Conn) *bufio.Reader {
+	if reader == nil {
+		return bufio.NewReaderSize(conn, lineReaderBufSize)
+	}
+	return bufio.NewReaderSize(reader, lineReaderBufSize)
+}
+
+// NewStratumMessage Decode a line, nil if it is not JSON-RPC
+func NewStratumMessage(line []byte) *StratumMessage {
+	request, err := NewJSONRPCRequest(line)
+	if err == nil && request.Method != "" {
+		return &StratumMessage{Line: line, Request: request}
+	}
+
+	response, err := NewJSONRPCResponse(line)
+	if err == nil && response.ID != nil {
+		return &StratumMessage{Line: line, Response: response}
+	}
+	return nil
+}
+
+// IsSubmit Whether the message is a share submitted by the miner
+func (message *StratumMessage) IsSubmit() bool {
+	return message.Request != nil && (message.Request.Method == "mining.submit" || message.Request.Method == "eth_submitWork")
+}
+
+// encode Encode the message again after it is modified by a hook
+func (message *StratumMessage) encode(jsonRPCVersion int) ([]byte, error) {
+	var bytes []byte
+	var err error
+	if message.Request != nil {
+		bytes, err = message.Request.ToJSONBytes()
+	} else {
+		bytes, err = message.Response.ToJSONBytes(jsonRPCVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes, '\n'), nil
+}
+
+// ShareCounters Shares of a session counted in the line-aware proxy mode
+type ShareCounters struct {
+	accepted uint64
+	rejected uint64
+	stale    uint64
+	// Unix time in nanoseconds of the last share submitted
+	lastShareTime int64
+
+	lock sync.Mutex
+	// Submits waiting for the response of the server, by JSON-RPC id
+	pendingSubmits map[string]pendingSubmit
+	// The accepted shares of the hashrate estimation
+	window shareWindow
+}
+
+// pendingSubmit A submit waiting for the response of the server
+type pendingSubmit struct {
+	time time.Time
+	// The difficulty of the miner when the share is submitted
+	difficulty float64
+}
+
+// ShareCounts A snapshot of ShareCounters
+type ShareCounts struct {
+	Accepted      uint64
+	Rejected      uint64
+	Stale         uint64
+	LastShareTime time.Time
+	// Estimated hashrate over each of hashrateWindows
+	Hashrates []float64
+}
+
+// submitKey The key of a JSON-RPC id in pendingSubmits
+func submitKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// addPending Record a submit waiting for the response of the server
+func (counters *ShareCounters) addPending(id interface{}, difficulty float64) {
+	now := time.Now()
+	atomic.StoreInt64(&counters.lastShareTime, now.UnixNano())
+
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	if counters.pendingSubmits == nil {
+		counters.pendingSubmits = make(map[string]pendingSubmit)
+	}
+	if len(counters.pendingSubmits) >= maxPendingSubmits {
+		// The server does not respond to some submits, forget the oldest
+		oldestKey, oldestTime := "", now
+		for key, submit := range counters.pendingSubmits {
+			if submit.time.Before(oldestTime) {
+				oldestKey, oldestTime = key, submit.time
+			}
+		}
+		delete(counters.pendingSubmits, oldestKey)
+	}
+	counters.pendingSubmits[submitKey(id)] = pendingSubmit{now, difficulty}
+}
+
+// takePending Remove the submit from the pending submits and return its difficulty, false if it is not a pending submit
+func (counters *ShareCounters) takePending(id interface{}) (difficulty float64, ok bool) {
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	key := submitKey(id)
+	submit, ok := counters.pendingSubmits[key]
+	if !ok {
+		return
+	}
+	delete(counters.pendingSubmits, key)
+	return submit.difficulty, true
+}
+
+// addAccepted Add an accepted share of the currency to the hashrate estimation
+func (counters *ShareCounters) addAccepted(coin string, difficulty float64, now time.Time) {
+	atomic.AddUint64(&counters.accepted, 1)
+
+	counters.lock.Lock()
+	counters.window.add(coin, difficulty, now)
+	counters.lock.Unlock()
+}
+
+// clearPending Forget the pending submits, the server connected after a switch will not respond to them
+func (counters *ShareCounters) clearPending() {
+	counters.lock.Lock()
+	counters.pendingSubmits = nil
+	counters.lock.Unlock()
+}
+
+// Get Get a snapshot of the counters and the hashrate at now (thread safe)
+func (counters *ShareCounters) Get(now time.Time) (counts ShareCounts) {
+	counts.Accepted = atomic.LoadUint64(&counters.accepted)
+	counts.Rejected = atomic.LoadUint64(&counters.rejected)
+	counts.Stale = atomic.LoadUint64(&counters.stale)
+	if lastShareTime := atomic.LoadInt64(&counters.lastShareTime); lastShareTime != 0 {
+		counts.LastShareTime = time.Unix(0, lastShareTime)
+	}
+
+	counters.lock.Lock()
+	defer counters.lock.Unlock()
+
+	counts.Hashrates = make([]float64, len(hashrateWindows))
+	for i, duration := range hashrateWindows {
+		counts.Hashrates[i] = counters.window.hashrate(duration, now)
+	}
+	return
+}
+
+// getStratumErrorCode Get the code and message of a Stratum error, [code, message, data] or {"code":..., "message":...}
+func getStratumErrorCode(stratumErr interface{}) (code int, message string) {
+	switch e := stratumErr.(type) {
+	case []interface{}:
+		if len(e) >= 1 {
+			if c, ok := e[0].(float64); ok {
+				code = int(c)
+			}
+		}
+		if len(e) >= 2 {
+			message, _ = e[1].(string)
+		}
+	case map[string]interface{}:
+		if c, ok := e["code"].(float64); ok {
+			code = int(c)
+		}
+		message, _ = e["message"].(string)
+	}
+	return
+}
+
+// getShareResult The result of a submit from the response of the server: "accepted", "rejected" or "stale"
+func getShareResult(response *JSONRPCResponse) string {
+	if response.Error == nil {
+		if accepted, ok := response.Result.(bool); ok && accepted {
+			return "accepted"
+		}
+		return "rejected"
+	}
+
+	code, message := getStratumErrorCode(response.Error)
+	if code == stratumErrCodeStale || strings.Contains(strings.ToLower(message), "stale") {
+		return "stale"
+	}
+	return "rejected"
+}
+
+// countShare Count the result of a share of the difficulty
+func (session *StratumSession) countShare(result string, difficulty float64) {
+	coin := session.getMiningCoin()
+	switch result {
+	case "accepted":
+		session.shares.addAccepted(coin, difficulty, time.Now())
+	case "stale":
+		atomic.AddUint64(&session.shares.stale, 1)
+	default:
+		atomic.AddUint64(&session.shares.rejected, 1)
+	}
+	session.manager.metrics.shares.Inc(coin, result)
+}
+
+// handleClientMessage Handle a message from the miner in the line-aware proxy mode
+func (session *StratumSession) handleClientMessage(message *StratumMessage) {
+	for _, hook := range session.manager.clientMessageHooks {
+		hook(session, message)
+		if message.Drop || message.Reply != nil {
+			return
+		}
+	}
+
+	if message.IsSubmit() {
+		session.shares.addPending(message.Request.ID, session.getDifficulty())
+	}
+}
+
+// handleServerMessage Handle a message from the server in the line-aware proxy mode
+func (session *StratumSession) handleServerMessage(message *StratumMessage) {
+	if message.Response != nil {
+		if difficulty, ok := session.shares.takePending(message.Response.ID); ok {
+			session.countShare(getShareResult(message.Response), difficulty)
+		}
+	}
+	if message.Request != nil && message.Request.Method == "mining.set_difficulty" && len(message.Request.Params) >= 1 {
+		if difficulty, ok := message.Request.Params[0].(float64); ok && difficulty > 0 {
+			session.setDifficulty(difficulty)
+		}
+	}
+
+	for _, hook := range session.manager.serverMessageHooks {
+		hook(session, message)
+		if message.Drop {
+			return
+		}
+	}
+}
+
+// writeResponseLineToClient Write the response to the miner in one write, so it is not interleaved with the lines from the server
+func (session *StratumSession) writeResponseLineToClient(response *JSONRPCResponse) (int, error) {
+	bytes, err := response.ToJSONBytes(session.jsonRPCVersion)
+	if err != nil {
+		return 0, err
+	}
+	return session.clientConn.Write(append(bytes, '\n'))
+}
+
+// proxyLines Copy the lines from src to dst, passing each JSON-RPC message to handle.
+// Like IOCopyBuffer, err is ErrReadFailed or ErrWriteFailed. When the write failed, pending is the line not written
+// followed by the content still buffered in src, which are forwarded without parsing after the reconnection.
+func (session *StratumSession) proxyLines(dst io.Writer, src *bufio.Reader, handle func(*StratumMessage)) (pending []byte, err error) {
+	// Continuing a line longer than the buffer, which is forwarded without parsing
+	longLine := false
+
+	for {
+		line, er := src.ReadSlice('\n')
+		if len(line) > 0 {
+			out := line
+			if er == nil && !longLine {
+				out = session.handleLine(line, handle)
+			}
+			longLine = er == bufio.ErrBufferFull
+
+			if len(out) > 0 {
+				_, ew := dst.Write(out)
+				if ew != nil {
+					buffered, _ := src.Peek(src.Buffered())
+					pending = append(append([]byte(nil), out...), buffered...)
+					err = ErrWriteFailed
+					return
+				}
+			}
+		}
+		if er != nil && er != bufio.ErrBufferFull {
+			err = ErrReadFailed
+			return
+		}
+	}
+}
+
+// handleLine Decode the line and handle it, return the bytes to forward
+func (session *StratumSession) handleLine(line []byte, handle func(*StratumMessage)) []byte {
+	message := NewStratumMessage(line)
+	if message == nil {
+		return line
+	}
+
+	handle(message)
+
+	if message.Reply != nil && message.Request != nil {
+		message.Reply.ID = message.Request.ID
+		session.writeResponseLineToClient(message.Reply)
+		return nil
+	}
+	if message.Drop {
+		return nil
+	}
+	if message.Modified {
+		bytes, err := message.encode(session.jsonRPCVersion)
+		if err == nil {
+			return bytes
+		}
+	}
+	return line
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyLines(t *testing.T) {
+	switcherClientConn, minerConn := net.Pipe()
+	defer minerConn.Close()
+
+	manager := &StratumSessionManager{parseStratumStream: true, metrics: NewSwitcherMetrics()}
+	session := &StratumSession{manager: manager, clientConn: switcherClientConn, jsonRPCVersion: 1, miningCoin: "btc"}
+
+	// Reply to the submits of job "bad" on behalf of the server, rewrite the worker name of the others
+	manager.AddClientMessageHook(func(session *StratumSession, message *StratumMessage) {
+		if !message.IsSubmit() || len(message.Request.Params) < 2 {
+			return
+		}
+		if message.Request.Params[1] == "bad" {
+			message.Reply = &JSONRPCResponse{Result: nil, Error: JSONRPCArray{21, "Job not found (=stale)", nil}}
+			return
+		}
+		message.Request.Params[0] = "rewritten"
+		message.Modified = true
+	})
+
+	longLine := `{"id":9,"method":"mining.submit","params":["` + strings.Repeat("x", lineReaderBufSize) + `"]}` + "\n"
+	clientStream := `{"id":1,"method":"mining.submit","params":["a.b","good","00","5f5e1000","00000001"]}` + "\n" +
+		`{"id":2,"method":"mining.submit","params":["a.b","bad","00","5f5e1000","00000001"]}` + "\n" +
+		"not json\n" +
+		longLine +
+		`{"id":3,"method":"mining.submit","params":["a.b","good","00","5f5e1000","00000002"]}` + "\n"
+
+	replies := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(minerConn).ReadString('\n')
+		replies <- line
+	}()
+
+	var upstream bytes.Buffer
+	_, err := session.proxyLines(&upstream, bufio.NewReaderSize(strings.NewReader(clientStream), lineReaderBufSize), session.handleClientMessage)
+	if err != ErrReadFailed {
+		t.Error("proxyLines: ", err)
+	}
+
+	expected := `{"id":1,"method":"mining.submit","params":["rewritten","good","00","5f5e1000","00000001"]}` + "\n" +
+		"not json\n" +
+		longLine +
+		`{"id":3,"method":"mining.submit","params":["rewritten","good","00","5f5e1000","00000002"]}` + "\n"
+	if upstream.String() != expected {
+		t.Error("forwarded to the server: ", upstream.String()[:200])
+	}
+	if reply := <-replies; reply != `{"id":2,"result":null,"error":[21,"Job not found (=stale)",null]}`+"\n" {
+		t.Error("reply to the miner: ", reply)
+	}
+
+	serverStream := `{"id":1,"result":true,"error":null}` + "\n" +
+		`{"id":null,"method":"mining.set_difficulty","params":[65536]}` + "\n" +
+		`{"id":3,"result":null,"error":[23,"Low difficulty",null]}` + "\n" +
+		// Not a pending submit
+		`{"id":4,"result":true,"error":null}` + "\n"
+	var downstream bytes.Buffer
+	session.proxyLines(&downstream, bufio.NewReader(strings.NewReader(serverStream)), session.handleServerMessage)
+	if downstream.String() != serverStream {
+		t.Error("forwarded to the miner: ", downstream.String())
+	}
+
+	shares := session.shares.Get(time.Now())
+	if shares.Accepted != 1 || shares.Rejected != 1 || shares.Stale != 0 || shares.LastShareTime.IsZero() {
+		t.Error("shares: ", shares)
+	}
+	if session.getDifficulty() != 65536 {
+		t.Error("difficulty: ", session.getDifficulty())
+	}
+
+	if result := getShareResult(&JSONRPCResponse{2, nil, []interface{}{21.0, "Job not found (=stale)", nil}}); result != "stale" {
+		t.Error("result of a stale share: ", result)
+	}
+	if result := getShareResult(&JSONRPCResponse{2, nil, map[string]interface{}{"code": 22.0, "message": "Duplicate share"}}); result != "rejected" {
+		t.Error("result of a duplicate share: ", result)
+	}
+}
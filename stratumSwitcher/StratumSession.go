@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,8 +13,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // Client type prefix of BTCAgent
@@ -66,10 +67,30 @@ const (
 	ProtocolEthereumStratumNiceHash
 	// ProtocolEthereumProxy Ethereum Stratum protocol implemented by EthProxy software
 	ProtocolEthereumProxy
+	// ProtocolEthereumStratumV2 EthereumStratum/2.0.0 (EIP-1571)
+	ProtocolEthereumStratumV2
 	// ProtocolUnknown Unknown protocol (cannot be processed)
 	ProtocolUnknown
 )
 
+// ToString convert to string
+func (protocolType ProtocolType) ToString() string {
+	switch protocolType {
+	case ProtocolBitcoinStratum:
+		return "bitcoin-stratum"
+	case ProtocolEthereumStratum:
+		return "ethereum-stratum"
+	case ProtocolEthereumStratumNiceHash:
+		return "ethereum-stratum-nicehash"
+	case ProtocolEthereumProxy:
+		return "ethereum-proxy"
+	case ProtocolEthereumStratumV2:
+		return "ethereum-stratum-v2"
+	default:
+		return "unknown"
+	}
+}
+
 // RunningStat Operating status
 type RunningStat uint8
 
@@ -105,15 +126,31 @@ type StratumSession struct {
 	isBTCAgent bool
 	// Is it a NiceHash client
 	isNiceHashClient bool
+	// Is it a Stratum V2 client (translated to Stratum V1 by StratumV2Conn)
+	isStratumV2 bool
+	// Is the client connected over TLS
+	isTLS bool
 	// JSON-RPC version
 	jsonRPCVersion int
+	// The user agent of mining.hello (EthereumStratum/2.0.0)
+	helloAgent string
 	// Bitcoin version mask(for AsicBoost)
 	versionMask uint32
+	// Has the client sent mining.extranonce.subscribe
+	extranonceSubscribed bool
+	// math.Float64bits of the last difficulty sent to the client, accessed atomically
+	difficulty uint64
+	// Shares counted in the line-aware proxy mode
+	shares ShareCounters
+	// Jobs and submits of the submit filter
+	submitFilter submitFilterState
 
 	// is it running
 	runningStat RunningStat
 	// Server reconnection counter
 	reconnectCounter uint32
+	// Why the session is stopped (string), written to the audit log
+	stopReason atomic.Value
 	// The lock to be added when changing runningStat and switchCoinCount
 	lock sync.Mutex
 
@@ -125,6 +162,8 @@ type StratumSession struct {
 
 	serverConn   net.Conn
 	serverReader *bufio.Reader
+	// The upstream sserver connected
+	serverURL string
 
 	// sessionID Session ID, also used as Extranonce1 when mining machine
 	sessionID       uint32
@@ -139,10 +178,28 @@ type StratumSession struct {
 
 	// The currency mined by the user
 	miningCoin string
+	// The currency read from zookeeper, differs from miningCoin after a switch by the admin API
+	// or if the currency has no Stratum server and FallbackCoin is mined
+	zkMiningCoin string
+	// The value of the node of the sub-account and of the per-worker route (empty if the worker has no route) in zookeeper,
+	// a currency or the weights of several currencies
+	zkAccountMiningCoin string
+	zkWorkerMiningCoin  string
+	// Start time of the session
+	startTime time.Time
 	// Monitored Zookeeper paths
 	zkWatchPath string
 	// Monitored Zookeeper events
-	zkWatchEvent <-chan zk.Event
+	zkWatchEvent <-chan coordination.Event
+	// Monitored per-worker route, empty if disabled or the miner name cannot be a node name
+	zkWorkerWatchPath string
+	// Events of the per-worker route, nil if it is not monitored
+	zkWorkerWatchEvent <-chan coordination.Event
+
+	// Labels of the session in the metrics, set when registered (protected by manager.lock)
+	metricKey sessionMetricKey
+	// reconnectCounter when registered (protected by manager.lock)
+	registeredReconnectCounter uint32
 }
 
 // NewStratumSession Create a new Stratum session
@@ -154,11 +211,14 @@ func NewStratumSession(manager *StratumSessionManager, clientConn net.Conn, sess
 	session.runningStat = StatStoped
 	session.manager = manager
 	session.sessionID = sessionID
+	session.startTime = time.Now()
 
 	session.clientConn = clientConn
 	session.clientReader = bufio.NewReaderSize(clientConn, bufioReaderBufSize)
 
 	session.clientIPPort = clientConn.RemoteAddr().String()
+	_, session.isStratumV2 = clientConn.(*StratumV2Conn)
+	_, session.isTLS = clientConn.(*tls.Conn)
 
 	switch manager.chainType {
 	case ChainTypeBitcoin:
@@ -213,6 +273,14 @@ func (session *StratumSession) getStatNonLock() RunningStat {
 	return session.runningStat
 }
 
+// getMiningCoin Get the currency mined by the user (thread safe)
+func (session *StratumSession) getMiningCoin() string {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	return session.miningCoin
+}
+
 // getReconnectCounter Get currency switch count (thread safe)
 func (session *StratumSession) getReconnectCounter() uint32 {
 	session.lock.Lock()
@@ -221,6 +289,24 @@ func (session *StratumSession) getReconnectCounter() uint32 {
 	return session.reconnectCounter
 }
 
+// isResumable Whether the session can be passed to the new process in a zero downtime upgrade.
+// Only plain TCP connections can be passed, the encryption state of TLS and Stratum V2 sessions cannot.
+func (session *StratumSession) isResumable() bool {
+	return !session.isStratumV2 && !session.isTLS
+}
+
+// getTransport Get the transport of the client connection: "tcp", "tls" or "stratum-v2"
+func (session *StratumSession) getTransport() string {
+	switch {
+	case session.isStratumV2:
+		return "stratum-v2"
+	case session.isTLS:
+		return "tls"
+	default:
+		return "tcp"
+	}
+}
+
 // Run Start a Stratum session
 func (session *StratumSession) Run() {
 	session.lock.Lock()
@@ -233,11 +319,14 @@ func (session *StratumSession) Run() {
 	session.runningStat = StatRunning
 	session.lock.Unlock()
 
+	session.audit(session.newAuditEvent("connect"))
+
 	session.protocolType = session.protocolDetect()
 
 	// In fact, there is currently only one protocol, the Stratum protocol.
 	// BTCAgent also walks the Stratum protocol before the authentication is completed
 	if session.protocolType == ProtocolUnknown {
+		session.setStopReason("unknown_protocol")
 		session.Stop()
 		return
 	}
@@ -267,6 +356,8 @@ func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn
 
 	// restore version bit
 	session.versionMask = sessionData.VersionMask
+	session.extranonceSubscribed = sessionData.ExtranonceSubscribed
+	session.setDifficulty(sessionData.Difficulty)
 
 	if sessionData.StratumSubscribeRequest != nil {
 		_, stratumErr := session.stratumHandleRequest(sessionData.StratumSubscribeRequest, &stat)
@@ -308,6 +399,10 @@ func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn
 
 	glog.Info("Resume Session Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
 
+	event := session.newAuditEvent("connect")
+	event.Reason = "resumed"
+	session.audit(event)
+
 	// Then switch to pure proxy mode
 	session.proxyStratum()
 }
@@ -332,6 +427,11 @@ func (session *StratumSession) Stop() {
 		session.clientConn.Close()
 	}
 
+	event := session.newAuditEvent("disconnect")
+	event.Reason = session.getStopReason()
+	event.DurationMs = durationMs(time.Since(session.startTime))
+	session.audit(event)
+
 	session.manager.ReleaseStratumSession(session)
 	session.manager = nil
 
@@ -377,7 +477,7 @@ func (session *StratumSession) getDefaultStratumProtocol() ProtocolType {
 		return ProtocolBitcoinStratum
 	case ChainTypeEthereum:
 		// This is the default protocol. The protocol may change after further detection.
-		// The difference between ProtocolEthereumProxy and the other two Ethereum protocols is that
+		// The difference between ProtocolEthereumProxy and the other Ethereum protocols is that
 		// ProtocolEthereumProxy is no "mining.subscribe" phase, so it is set as default to simplify the detection.
 		return ProtocolEthereumProxy
 	default:
@@ -388,23 +488,46 @@ func (session *StratumSession) getDefaultStratumProtocol() ProtocolType {
 func (session *StratumSession) runProxyStratum() {
 	var err error
 
+	admission := session.manager.admission
+	if admission != nil && !admission.EnterPendingAuthorize(session.clientIPPort) {
+		session.setStopReason("pending_authorize_limit")
+		session.Stop()
+		return
+	}
+
 	err = session.stratumFindWorkerName()
 
+	if admission != nil {
+		admission.LeavePendingAuthorize()
+	}
+
 	if err != nil {
+		session.setStopReason("no_worker_name")
 		session.Stop()
 		return
 	}
 
-	err = session.findMiningCoin(session.manager.enableUserAutoReg)
+	err = session.findMiningCoin(session.manager.isUserAutoRegEnabled())
 
 	if err != nil {
+		event := session.newAuditEvent("authorize")
+		event.Result = "failure"
+		event.Reason = "coin_not_found"
+		event.Error = err.Error()
+		event.DurationMs = durationMs(time.Since(session.startTime))
+		session.audit(event)
+
+		session.setStopReason("coin_not_found")
 		session.Stop()
 		return
 	}
 
 	err = session.connectStratumServer()
 
+	session.audit(session.newAuditResultEvent("authorize", err, session.startTime))
+
 	if err != nil {
+		session.setStopReason(auditErrorReason(err))
 		session.Stop()
 		return
 	}
@@ -432,10 +555,15 @@ func (session *StratumSession) parseSubscribeRequest(request *JSONRPCRequest) (r
 			}
 		}
 
-		result = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", session.sessionIDString}, JSONRPCArray{"mining.notify", session.sessionIDString}}, session.sessionIDString, 8}
+		result = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", session.sessionIDString}, JSONRPCArray{"mining.notify", session.sessionIDString}}, session.sessionIDString, extraNonce2Size}
 		return
 
 	case ChainTypeEthereum:
+		// EthereumStratum/2.0.0 after mining.hello, or its subscribe request saved before a hot update
+		if session.protocolType == ProtocolEthereumStratumV2 || (len(request.Params) >= 2 && isEthereumStratumV2Protocol(request.Params[1])) {
+			return session.parseEthereumStratumV2SubscribeRequest(request)
+		}
+
 		// only ProtocolEthereumStratum and ProtocolEthereumStratumNiceHash has the "mining.subscribe" phase
 		session.protocolType = ProtocolEthereumStratum
 
@@ -586,6 +714,14 @@ func (session *StratumSession) parseConfigureRequest(request *JSONRPCRequest) (r
 
 func (session *StratumSession) stratumHandleRequest(request *JSONRPCRequest, stat *AuthorizeStat) (result interface{}, err *StratumError) {
 	switch request.Method {
+	case "mining.hello":
+		if *stat != StatConnected {
+			err = StratumErrDuplicateSubscribed
+			return
+		}
+		result, err = session.parseHelloRequest(request)
+		return
+
 	case "mining.subscribe":
 		if *stat != StatConnected {
 			err = StratumErrDuplicateSubscribed
@@ -622,6 +758,14 @@ func (session *StratumSession) stratumHandleRequest(request *JSONRPCRequest, sta
 		}
 		return
 
+	case "mining.extranonce.subscribe":
+		// The client will be sent mining.set_extranonce and a clean job after the currency switch
+		if session.supportsSetExtranonce() {
+			session.extranonceSubscribed = true
+			result = true
+		}
+		return
+
 	default:
 		// ignore unimplemented methods
 		return
@@ -647,6 +791,12 @@ func (session *StratumSession) stratumFindWorkerName() error {
 			}
 
 			request, err := NewJSONRPCRequest(requestJSON)
+			// The params of mining.hello (EthereumStratum/2.0.0) is an object
+			if err != nil {
+				if hello, ok := parseEthereumStratumV2Hello(requestJSON); ok {
+					request, err = hello, nil
+				}
+			}
 
 			// ignore the json decode error
 			if err != nil {
@@ -721,12 +871,79 @@ func (session *StratumSession) findMiningCoin(autoReg bool) error {
 		return err
 	}
 
-	session.miningCoin = string(data)
+	session.zkAccountMiningCoin = string(data)
 	session.zkWatchEvent = event
 
+	// The per-worker route takes precedence over the currency of the sub-account
+	session.zkWorkerWatchPath = ""
+	session.zkWorkerMiningCoin = ""
+	session.zkWorkerWatchEvent = nil
+	if workerName := session.getWorkerRouteName(); workerName != "" {
+		session.zkWorkerWatchPath = session.zkWatchPath + "/" + workerName
+		err = session.readWorkerRoute()
+		if err != nil {
+			glog.Error("FindMiningCoin Failed: " + session.zkWorkerWatchPath + "; " + err.Error())
+			return err
+		}
+	}
+
+	session.zkMiningCoin, err = session.getZKMiningCoin()
+	if err != nil {
+		glog.Error("FindMiningCoin Failed: ", session.zkWatchPath, "; ", err)
+		return err
+	}
+	// Mine FallbackCoin if the currency has no Stratum server, connectStratumServer reports the error if it has none either
+	session.miningCoin, _ = session.manager.resolveMiningCoin(session.zkMiningCoin)
+	if session.miningCoin != session.zkMiningCoin {
+		glog.Warning("Stratum Server Not Found, mine FallbackCoin: ", session.zkWatchPath, "; ", session.zkMiningCoin, " -> ", session.miningCoin)
+	}
+
 	return nil
 }
 
+// getWorkerRouteName The node name of the per-worker route of the session, empty if it is not monitored
+func (session *StratumSession) getWorkerRouteName() string {
+	if !session.manager.enableWorkerCoinRoute || len(session.minerNameWithDot) < 2 {
+		return ""
+	}
+	workerName := session.minerNameWithDot[1:]
+	// "/" would be a sub-node, "." and ".." are not valid node names
+	if strings.Contains(workerName, "/") || workerName == "." || workerName == ".." {
+		return ""
+	}
+	return workerName
+}
+
+// readWorkerRoute Read the per-worker route from zookeeper and watch its creation, change or deletion
+func (session *StratumSession) readWorkerRoute() error {
+	data, exists, event, err := session.manager.zookeeperManager.GetOptionalW(session.zkWorkerWatchPath, session.sessionID)
+	if err != nil {
+		return err
+	}
+
+	session.zkWorkerWatchEvent = event
+	session.zkWorkerMiningCoin = ""
+	if exists {
+		session.zkWorkerMiningCoin = string(data)
+	}
+	return nil
+}
+
+// getZKMiningCoin The currency in zookeeper: the per-worker route if any, otherwise the currency of the sub-account.
+// If the node has weights, the currency of the session is chosen by its session id.
+func (session *StratumSession) getZKMiningCoin() (string, error) {
+	value := session.zkAccountMiningCoin
+	if session.zkWorkerMiningCoin != "" {
+		value = session.zkWorkerMiningCoin
+	}
+
+	weights, err := ParseCoinWeights([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return weights.SelectCoin(session.sessionID), nil
+}
+
 func (session *StratumSession) tryAutoReg() error {
 	glog.Info("Try to auto register sub-account, worker: ", session.fullWorkerName)
 
@@ -774,7 +991,7 @@ func (session *StratumSession) connectStratumServer() error {
 	// Get current running status
 	runningStat := session.getStatNonLock()
 	// Find the server corresponding to the currency
-	serverInfo, ok := session.manager.stratumServerInfoMap[session.miningCoin]
+	pool, ok := session.manager.getUpstreamPool(session.miningCoin)
 
 	var rpcID interface{}
 	if session.stratumAuthorizeRequest != nil {
@@ -791,26 +1008,42 @@ func (session *StratumSession) connectStratumServer() error {
 		return StratumErrStratumServerNotFound
 	}
 
-	// connect to the server
-	serverConn, err := net.Dial("tcp", serverInfo.URL)
+	// connect to the server and authorize, fail over to the next upstream
+	for _, url := range pool.Candidates(session.sessionID) {
+		serverConn, err := net.DialTimeout("tcp", url, upstreamDialTimeout)
+		if err != nil {
+			glog.Error("Connect Stratum Server Failed: ", session.miningCoin, "; ", url, "; ", err)
+			pool.MarkFailure(url, err)
+			continue
+		}
 
-	if err != nil {
-		glog.Error("Connect Stratum Server Failed: ", session.miningCoin, "; ", serverInfo.URL, "; ", err)
-		if runningStat != StatReconnecting {
-			response := JSONRPCResponse{rpcID, nil, StratumErrConnectStratumServerFailed.ToJSONRPCArray(session.manager.serverID)}
-			session.writeJSONResponseToClient(&response)
+		if glog.V(3) {
+			glog.Info("Connect Stratum Server Success: ", session.miningCoin, "; ", url)
 		}
-		return StratumErrConnectStratumServerFailed
-	}
 
-	if glog.V(3) {
-		glog.Info("Connect Stratum Server Success: ", session.miningCoin, "; ", serverInfo.URL)
-	}
+		session.serverURL = url
+		session.serverConn = serverConn
+		session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
 
-	session.serverConn = serverConn
-	session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
+		upstreamFailed, err := session.serverSubscribeAndAuthorize()
+		if err == nil {
+			pool.MarkSuccess(url)
+			return nil
+		}
+		if !upstreamFailed {
+			// The miner has got the response of the server (e.g. the authorization is rejected)
+			return err
+		}
+		glog.Error("Stratum Server Handshake Failed: ", session.miningCoin, "; ", url, "; ", err)
+		serverConn.Close()
+		pool.MarkFailure(url, err)
+	}
 
-	return session.serverSubscribeAndAuthorize()
+	if runningStat != StatReconnecting {
+		response := JSONRPCResponse{rpcID, nil, StratumErrConnectStratumServerFailed.ToJSONRPCArray(session.manager.serverID)}
+		session.writeJSONResponseToClient(&response)
+	}
+	return StratumErrConnectStratumServerFailed
 }
 
 // send mining.configure
@@ -831,6 +1064,22 @@ func (session *StratumSession) sendMiningConfigureToServer() (err error) {
 	return
 }
 
+// send mining.suggest_difficulty, so the vardiff of the new server resumes from the difficulty before the switch
+func (session *StratumSession) sendMiningSuggestDifficultyToServer() (err error) {
+	difficulty := session.getDifficulty()
+	if !session.manager.keepDifficultyOnSwitch || difficulty <= 0 {
+		return
+	}
+
+	request := JSONRPCRequest{
+		"suggest_difficulty",
+		"mining.suggest_difficulty",
+		JSONRPCArray{difficulty},
+		""}
+	_, err = session.writeJSONRequestToServer(&request)
+	return
+}
+
 // send mining.subscribe
 func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string, protocol string, err error) {
 	userAgent = "stratumSwitcher"
@@ -856,17 +1105,18 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 		}
 
 		// In order to ensure the correct display of "Recently Submitted IP" on the web side, pass the IP of the miner as the third parameter to Stratum Server
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		clientIP := session.getClientIPParam()
 		// Do not use session.sessionIDString directly, because in DCR currency, it has already been padded and reversed.
 		sessionIDString := Uint32ToHex(session.sessionID)
-		session.stratumSubscribeRequest.SetParam(userAgent, sessionIDString, clientIPLong)
+		session.stratumSubscribeRequest.SetParam(userAgent, sessionIDString, clientIP)
 
 	case ProtocolEthereumStratum:
 		fallthrough
 	case ProtocolEthereumStratumNiceHash:
 		fallthrough
 	case ProtocolEthereumProxy:
+		fallthrough
+	case ProtocolEthereumStratumV2:
 		// Get the original parameter 1 (user agent) and parameter 2 (protocol, may exist)
 		if len(session.stratumSubscribeRequest.Params) >= 1 {
 			userAgent, _ = session.stratumSubscribeRequest.Params[0].(string)
@@ -878,12 +1128,11 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 			glog.Info("UserAgent: ", userAgent, "; Protocol: ", protocol)
 		}
 
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		clientIP := session.getClientIPParam()
 
 		// Session ID is passed as the third parameter
 		// The miner IP is passed as the fourth parameter
-		session.stratumSubscribeRequest.SetParam(userAgent, protocol, session.sessionIDString, clientIPLong)
+		session.stratumSubscribeRequest.SetParam(userAgent, protocol, session.sessionIDString, clientIP)
 
 	default:
 		glog.Fatal("Unimplemented Stratum Protocol: ", session.protocolType)
@@ -900,9 +1149,35 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 	return
 }
 
+// getClientIP Get the IP address of the client (without port and brackets)
+func (session *StratumSession) getClientIP() string {
+	host, _, err := net.SplitHostPort(session.clientIPPort)
+	if err != nil {
+		return session.clientIPPort
+	}
+	return host
+}
+
+// getClientIPParam Get the miner IP in the format accepted by the server of the current currency
+func (session *StratumSession) getClientIPParam() interface{} {
+	clientIP := session.getClientIP()
+
+	serverInfo, _ := session.manager.getStratumServerInfo(session.miningCoin)
+	if serverInfo.ClientIPFormat == ClientIPFormatString {
+		// IPv4-mapped IPv6 addresses are passed as IPv4
+		if ip := net.ParseIP(clientIP); ip != nil {
+			return ip.String()
+		}
+		return clientIP
+	}
+
+	// The old format can only carry IPv4, IPv6 miners are passed as 0
+	return IP2Long(clientIP)
+}
+
 // Sub-account name suffix added when obtaining authentication
 func (session *StratumSession) getUserSuffix() string {
-	serverInfo, ok := session.manager.stratumServerInfoMap[session.miningCoin]
+	serverInfo, ok := session.manager.getStratumServerInfo(session.miningCoin)
 	if !ok {
 		return session.miningCoin
 	}
@@ -939,8 +1214,11 @@ func (session *StratumSession) sendMiningAuthorizeToServer(withSuffix bool) (aut
 	return
 }
 
-func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
+// serverSubscribeAndAuthorize Subscribe and authorize to the server. upstreamFailed is whether the error is
+// a failure of the server before anything is sent to the miner, so the next upstream can be tried.
+func (session *StratumSession) serverSubscribeAndAuthorize() (upstreamFailed bool, err error) {
 	// send request
+	upstreamFailed = true
 	err = session.sendMiningConfigureToServer()
 	if err != nil {
 		return
@@ -949,13 +1227,22 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 	if err != nil {
 		return
 	}
+	err = session.sendMiningSuggestDifficultyToServer()
+	if err != nil {
+		return
+	}
 	authWorkerName, authWorkerPasswd, err := session.sendMiningAuthorizeToServer(false)
 	if err != nil {
 		return
 	}
 
 	// receive response
-	e := make(chan error, 1)
+	type authorizeResult struct {
+		err            error
+		upstreamFailed bool
+	}
+	e := make(chan authorizeResult, 1)
+	serverReader := session.serverReader
 	go func() {
 		defer close(e)
 
@@ -967,10 +1254,10 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 
 		// The end of the cycle indicates that the authentication is complete
 		for authMsgCounter < 2 {
-			json, err := session.serverReader.ReadBytes('\n')
+			json, err := serverReader.ReadBytes('\n')
 
 			if err != nil {
-				e <- errors.New("read line failed: " + err.Error())
+				e <- authorizeResult{errors.New("read line failed: " + err.Error()), true}
 				return
 			}
 
@@ -980,7 +1267,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 			if err == nil && response.ID != nil {
 				err = session.stratumHandleServerResponse(response, &authMsgCounter, &authSuccess, &authResponse)
 				if err != nil {
-					e <- err
+					e <- authorizeResult{err, true}
 					return
 				}
 
@@ -988,7 +1275,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 				if !authSuccess && authMsgCounter == 1 {
 					authWorkerName, authWorkerPasswd, err = session.sendMiningAuthorizeToServer(true)
 					if err != nil {
-						e <- err
+						e <- authorizeResult{err, true}
 						return
 					}
 				}
@@ -1003,7 +1290,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 			if err == nil {
 				err = session.stratumHandleServerNotify(notify, &allowedVersionMask)
 				if err != nil {
-					e <- err
+					e <- authorizeResult{err, true}
 					return
 				}
 				continue
@@ -1017,7 +1304,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 		authResponse.ID = session.stratumAuthorizeRequest.ID
 		_, err = session.writeJSONResponseToClient(&authResponse)
 		if err != nil {
-			e <- err
+			e <- authorizeResult{err, false}
 			return
 		}
 
@@ -1031,7 +1318,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 				""}
 			_, err = session.writeJSONNotifyToClient(&notify)
 			if err != nil {
-				e <- err
+				e <- authorizeResult{err, false}
 				return
 			}
 		}
@@ -1040,31 +1327,36 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 			err = errors.New("Authorize Failed for Server")
 		}
 		// Send the authentication result, nil means success
-		e <- err
+		e <- authorizeResult{err, false}
 		return
 	}()
 
+	var result authorizeResult
 	select {
-	case err = <-e:
-		if err != nil {
-			if glog.V(2) {
-				glog.Warning("Authorize Failed: ", session.clientIPPort, "; ", session.miningCoin, "; ",
-					authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, ";",
-					session.getVersionMaskStr(), "; ", protocol, "; ", err)
-			}
-		} else {
-			if glog.V(2) {
-				glog.Info("Authorize Success: ", session.clientIPPort, "; ", session.miningCoin, "; ",
-					authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, "; ",
-					session.getVersionMaskStr(), "; ", protocol)
-			}
-		}
-
+	case result = <-e:
 	case <-time.After(readServerResponseTimeoutSeconds * time.Second):
-		err = errors.New("Authorize Timeout")
-		glog.Warning(err)
+		// Stop the goroutine before returning, it must not read the server or write the miner after that
+		session.serverConn.Close()
+		result = <-e
+		if result.upstreamFailed {
+			result.err = errors.New("Authorize Timeout")
+		}
 	}
 
+	upstreamFailed, err = result.upstreamFailed, result.err
+	if err != nil {
+		if glog.V(2) {
+			glog.Warning("Authorize Failed: ", session.clientIPPort, "; ", session.miningCoin, "; ",
+				authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, ";",
+				session.getVersionMaskStr(), "; ", protocol, "; ", err)
+		}
+	} else {
+		if glog.V(2) {
+			glog.Info("Authorize Success: ", session.clientIPPort, "; ", session.miningCoin, "; ",
+				authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, "; ",
+				session.getVersionMaskStr(), "; ", protocol)
+		}
+	}
 	return
 }
 
@@ -1093,7 +1385,7 @@ func (session *StratumSession) stratumHandleServerResponse(response *JSONRPCResp
 	}
 
 	switch id {
-	case "configure":
+	case "configure", "suggest_difficulty":
 		// ignore
 
 	case "subscribe":
@@ -1115,6 +1407,11 @@ func (session *StratumSession) stratumHandleServerResponse(response *JSONRPCResp
 
 // Handling server authentication responses
 func (session *StratumSession) stratumHandleServerAuthorizeResponse(response *JSONRPCResponse) bool {
+	if session.protocolType == ProtocolEthereumStratumV2 {
+		// The result is the worker ID used in mining.submit: {"id":"auth","result":"w-1"}
+		return response.Error == nil && response.Result != nil && response.Result != false
+	}
+
 	success, ok := response.Result.(bool)
 	return ok && success
 }
@@ -1189,6 +1486,20 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 			return ErrSessionIDInconformity
 		}
 
+	case ProtocolEthereumStratumV2:
+		// {"id":"subscribe","result":"01003f"}
+		sessionID, ok := response.Result.(string)
+		if !ok {
+			glog.Warning("Parse Subscribe Response Failed: result is not a string")
+			return ErrParseSubscribeResponseFailed
+		}
+
+		// The sessionID returned by the server is inconsistent with the currently saved session ID. All shares mined at this time will be invalid and the connection will be disconnected.
+		if sessionID != session.sessionIDString {
+			glog.Warning("Session ID Mismatched:  ", sessionID, " != ", session.sessionIDString)
+			return ErrSessionIDInconformity
+		}
+
 	case ProtocolEthereumStratum:
 		fallthrough
 	case ProtocolEthereumProxy:
@@ -1217,34 +1528,49 @@ func (session *StratumSession) proxyStratum() {
 
 	// Register for a session
 	session.manager.RegisterStratumSession(session)
+	metrics := session.manager.metrics
+
+	lineMode := session.isLineMode()
 
 	// From server to client
 	go func() {
 		// Record the current currency switch count
 		currentReconnectCounter := session.getReconnectCounter()
+		var err error
 
-		if session.serverReader != nil {
-			bufLen := session.serverReader.Buffered()
-			// Write the remaining content in bufio to the peer
-			if bufLen > 0 {
-				buf := make([]byte, bufLen)
-				session.serverReader.Read(buf)
-				session.clientConn.Write(buf)
-			}
-			// release bufio
+		if lineMode {
+			// Parse the messages from the server
+			serverReader := newLineReader(session.serverReader, session.serverConn)
 			session.serverReader = nil
+			_, err = session.proxyLines(metrics.DownstreamWriter(session.clientConn), serverReader, session.handleServerMessage)
+		} else {
+			clientWriter := session.newDifficultyTrackingWriter(session.clientConn)
+
+			if session.serverReader != nil {
+				bufLen := session.serverReader.Buffered()
+				// Write the remaining content in bufio to the peer
+				if bufLen > 0 {
+					buf := make([]byte, bufLen)
+					session.serverReader.Read(buf)
+					clientWriter.Write(buf)
+				}
+				// release bufio
+				session.serverReader = nil
+			}
+			// simple streaming replication
+			buffer := make([]byte, bufioReaderBufSize)
+			_, err = IOCopyBuffer(metrics.DownstreamWriter(clientWriter), session.serverConn, buffer)
 		}
-		// simple streaming replication
-		buffer := make([]byte, bufioReaderBufSize)
-		_, err := IOCopyBuffer(session.clientConn, session.serverConn, buffer)
 		// Streaming replication ends, indicating that one of the parties has closed the connection
 		// Do not reconnect to the BTCAgent application
 		if err == ErrReadFailed && !session.isBTCAgent {
 			// 服务器关闭了连接，尝试重连
 			session.tryReconnect(currentReconnectCounter)
+		} else if err == ErrReadFailed {
+			session.tryStop(currentReconnectCounter, "server_disconnected")
 		} else {
 			// The client closed the connection, ending the session
-			session.tryStop(currentReconnectCounter)
+			session.tryStop(currentReconnectCounter, "client_disconnected")
 		}
 		if glog.V(3) {
 			glog.Info("DownStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
@@ -1256,20 +1582,33 @@ func (session *StratumSession) proxyStratum() {
 		// Record the current currency switch count
 		currentReconnectCounter := session.getReconnectCounter()
 
-		if session.clientReader != nil {
-			bufLen := session.clientReader.Buffered()
-			// Write the remaining content in bufio to the peer
-			if bufLen > 0 {
-				buf := make([]byte, bufLen)
-				session.clientReader.Read(buf)
-				session.serverConn.Write(buf)
-			}
-			// release bufio
+		// Content not written to the server when the write failed
+		var pending []byte
+		var err error
+
+		if lineMode {
+			// Parse the messages from the miner
+			clientReader := newLineReader(session.clientReader, session.clientConn)
 			session.clientReader = nil
+			pending, err = session.proxyLines(metrics.UpstreamWriter(session.serverConn), clientReader, session.handleClientMessage)
+		} else {
+			if session.clientReader != nil {
+				bufLen := session.clientReader.Buffered()
+				// Write the remaining content in bufio to the peer
+				if bufLen > 0 {
+					buf := make([]byte, bufLen)
+					session.clientReader.Read(buf)
+					session.serverConn.Write(buf)
+				}
+				// release bufio
+				session.clientReader = nil
+			}
+			// simple streaming replication
+			buffer := make([]byte, bufioReaderBufSize)
+			var bufferLen int
+			bufferLen, err = IOCopyBuffer(metrics.UpstreamWriter(session.serverConn), session.clientConn, buffer)
+			pending = buffer[0:bufferLen]
 		}
-		// simple streaming replication
-		buffer := make([]byte, bufioReaderBufSize)
-		bufferLen, err := IOCopyBuffer(session.serverConn, session.clientConn, buffer)
 		// Streaming replication ends, indicating that one of the parties has closed the connection
 		// Do not reconnect to the BTCAgent application
 		if err == ErrWriteFailed && !session.isBTCAgent {
@@ -1277,12 +1616,14 @@ func (session *StratumSession) proxyStratum() {
 			session.tryReconnect(currentReconnectCounter)
 			// getStat() will lock until the reconnection succeeds or the reconnection is abandoned
 			// If the reconnection is successful, try to forward the content in the cache to the new server
-			if bufferLen > 0 && session.getStat() == StatRunning {
-				session.serverConn.Write(buffer[0:bufferLen])
+			if len(pending) > 0 && session.getStat() == StatRunning {
+				session.serverConn.Write(pending)
 			}
+		} else if err == ErrWriteFailed {
+			session.tryStop(currentReconnectCounter, "server_disconnected")
 		} else {
 			// The client closed the connection, ending the session
-			session.tryStop(currentReconnectCounter)
+			session.tryStop(currentReconnectCounter, "client_disconnected")
 		}
 		if glog.V(3) {
 			glog.Info("UpStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
@@ -1290,22 +1631,57 @@ func (session *StratumSession) proxyStratum() {
 	}()
 
 	// Monitor switching instructions from zookeeper and do Stratum switching
-	go func() {
-		// Record the current currency switch count
-		currentReconnectCounter := session.getReconnectCounter()
+	go session.watchMiningCoin()
+}
 
-		for {
-			<-session.zkWatchEvent
+// watchMiningCoin Monitor switching instructions from zookeeper and do Stratum switching until the session is switched or stopped
+func (session *StratumSession) watchMiningCoin() {
+	// Record the current currency switch count
+	currentReconnectCounter := session.getReconnectCounter()
+	// session.manager is reset when the session is stopped, which may happen while the session waits for its turn
+	manager := session.manager
+	pacer := manager.switchPacer
+	// Retry of a switch refused because the upstream of the new currency is unhealthy
+	var retrySwitch <-chan time.Time
+	// Turn of the session in the queue of the switch pacer, and the upstream of the queue
+	var pacedSwitch <-chan time.Time
+	var pacedUpstream string
+	cancelPacedSwitch := func() {
+		if pacedSwitch != nil {
+			pacer.Dequeue(pacedUpstream)
+			pacedSwitch = nil
+		}
+	}
 
-			if !session.IsRunning() {
-				break
-			}
+	for {
+		accountChanged := false
+		workerChanged := false
+		paced := false
+		select {
+		case <-session.zkWatchEvent:
+			accountChanged = true
+		case <-session.zkWorkerWatchEvent:
+			workerChanged = true
+		case <-retrySwitch:
+		case <-pacedSwitch:
+			paced = true
+			cancelPacedSwitch()
+		}
+		fromZK := accountChanged || workerChanged
+		retrySwitch = nil
 
-			if currentReconnectCounter != session.getReconnectCounter() {
-				break
-			}
+		if !session.IsRunning() {
+			break
+		}
 
-			data, event, err := session.manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+		if currentReconnectCounter != session.getReconnectCounter() {
+			break
+		}
+
+		newMiningCoin := session.zkMiningCoin
+		lastZKMiningCoin := session.zkMiningCoin
+		if accountChanged {
+			data, event, err := manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
 
 			if err != nil {
 				glog.Error("Read From Zookeeper Failed, sleep ", zookeeperConnAliveTimeout, "s: ", session.zkWatchPath, "; ", err)
@@ -1314,49 +1690,110 @@ func (session *StratumSession) proxyStratum() {
 			}
 
 			session.zkWatchEvent = event
-			newMiningCoin := string(data)
+			session.zkAccountMiningCoin = string(data)
+		}
+		if workerChanged {
+			err := session.readWorkerRoute()
 
-			// If the currency has not changed, continue monitoring
-			if newMiningCoin == session.miningCoin {
-				if glog.V(3) {
-					glog.Info("Mining Coin Not Changed: ", session.fullWorkerName, ": ", session.miningCoin, " -> ", newMiningCoin)
-				}
+			if err != nil {
+				glog.Error("Read From Zookeeper Failed, sleep ", zookeeperConnAliveTimeout, "s: ", session.zkWorkerWatchPath, "; ", err)
+				time.Sleep(zookeeperConnAliveTimeout * time.Second)
 				continue
 			}
-
-			// If the Stratum server corresponding to the currency does not exist, ignore the event and continue monitoring
-			_, exists := session.manager.stratumServerInfoMap[newMiningCoin]
-			if !exists {
-				glog.Error("Stratum Server Not Found for New Mining Coin: ", newMiningCoin)
+		}
+		if fromZK {
+			coin, err := session.getZKMiningCoin()
+			if err != nil {
+				glog.Error("Invalid Mining Coin in Zookeeper: ", session.fullWorkerName, "; ", session.zkWatchPath, "; ", err)
 				continue
 			}
+			newMiningCoin = coin
+			session.zkMiningCoin = newMiningCoin
+		}
+		currentMiningCoin := session.getMiningCoin()
 
-			// Currency changed
-			if glog.V(2) {
-				glog.Info("Mining Coin Changed: ", session.fullWorkerName, "; ", session.miningCoin, " -> ", newMiningCoin, "; ", currentReconnectCounter)
+		// If the currency has not changed, continue monitoring.
+		// A session switched by the admin API keeps its currency until the value in zookeeper changes.
+		if newMiningCoin == currentMiningCoin || (fromZK && newMiningCoin == lastZKMiningCoin) {
+			if glog.V(3) {
+				glog.Info("Mining Coin Not Changed: ", session.fullWorkerName, ": ", currentMiningCoin, " -> ", newMiningCoin)
+			}
+			// Switched back before the turn of the session
+			if newMiningCoin == currentMiningCoin {
+				cancelPacedSwitch()
 			}
+			continue
+		}
 
-			// perform currency switch
-			if session.isBTCAgent {
-				// Because BTCAgent sessions are stateful (a connection contains multiple AgentSessions,
-				// Corresponding to multiple miners), so there is no way to safely switch BTCAgent sessions seamlessly,
-				// Only the disconnect method can be used.
-				session.tryStop(currentReconnectCounter)
-			} else {
-				// Common connection, direct currency switch
-				session.switchCoinType(newMiningCoin, currentReconnectCounter)
+		// If the Stratum server corresponding to the currency does not exist, mine FallbackCoin.
+		// If it does not exist either, ignore the event and continue monitoring.
+		fallbackCoin, exists := manager.resolveMiningCoin(newMiningCoin)
+		if !exists {
+			glog.Error("Stratum Server Not Found for New Mining Coin: ", newMiningCoin)
+			continue
+		}
+		if fallbackCoin != newMiningCoin {
+			glog.Warning("Stratum Server Not Found for New Mining Coin, mine FallbackCoin: ", session.fullWorkerName, "; ",
+				newMiningCoin, " -> ", fallbackCoin)
+			newMiningCoin = fallbackCoin
+			if newMiningCoin == currentMiningCoin {
+				cancelPacedSwitch()
+				continue
 			}
-			break
 		}
 
-		if glog.V(3) {
-			glog.Info("CoinWatcher: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+		// Currency changed
+		if glog.V(2) {
+			glog.Info("Mining Coin Changed: ", session.fullWorkerName, "; ", currentMiningCoin, " -> ", newMiningCoin, "; ", currentReconnectCounter)
 		}
-	}()
+
+		// Keep the miner on the current upstream until the new currency is healthy
+		if !manager.isCoinHealthy(newMiningCoin) {
+			glog.Warning("Upstream Unhealthy for New Mining Coin, retry in ", upstreamHealthCheckIntervalSeconds, "s: ",
+				session.fullWorkerName, "; ", currentMiningCoin, " -> ", newMiningCoin)
+			retrySwitch = time.After(upstreamHealthCheckIntervalSeconds * time.Second)
+			cancelPacedSwitch()
+			continue
+		}
+
+		// Keep the miner on the current currency until its turn, the currency in zookeeper is read again then
+		if pacer != nil && !paced {
+			if pacedSwitch == nil {
+				pacedUpstream = manager.getSwitchUpstream(newMiningCoin, session.sessionID)
+				delay := pacer.Enqueue(pacedUpstream)
+				pacedSwitch = time.After(delay)
+				if glog.V(3) {
+					glog.Info("Switch Paced: ", session.fullWorkerName, "; ", currentMiningCoin, " -> ", newMiningCoin, "; ", pacedUpstream, "; ", delay)
+				}
+			}
+			continue
+		}
+
+		// perform currency switch
+		if session.isBTCAgent {
+			// Because BTCAgent sessions are stateful (a connection contains multiple AgentSessions,
+			// Corresponding to multiple miners), so there is no way to safely switch BTCAgent sessions seamlessly,
+			// Only the disconnect method can be used.
+			session.tryStop(currentReconnectCounter, "coin_switched")
+		} else {
+			// Common connection, direct currency switch
+			err := session.switchCoinType(newMiningCoin, currentReconnectCounter)
+			if err == ErrUpstreamUnhealthy {
+				retrySwitch = time.After(upstreamHealthCheckIntervalSeconds * time.Second)
+				continue
+			}
+		}
+		break
+	}
+	cancelPacedSwitch()
+
+	if glog.V(3) {
+		glog.Info("CoinWatcher: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+	}
 }
 
-// Check if a reconnection has occurred, if not, stop the session
-func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
+// Check if a reconnection has occurred, if not, stop the session for the reason
+func (session *StratumSession) tryStop(currentReconnectCounter uint32, reason string) bool {
 	session.lock.Lock()
 	defer session.lock.Unlock()
 
@@ -1368,6 +1805,7 @@ func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
 	// Determine if it has been reconnected
 	if currentReconnectCounter == session.reconnectCounter {
 		//未发生重连，尝试停止
+		session.setStopReason(reason)
 		go session.Stop()
 		return true
 	}
@@ -1397,7 +1835,9 @@ func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool
 			glog.Info("Reconnect Server: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
 		}
 
-		session.reconnectStratumServer(retryTimeWhenServerDown)
+		startTime := time.Now()
+		err := session.reconnectStratumServer(retryTimeWhenServerDown)
+		session.audit(session.newAuditResultEvent("reconnect", err, startTime))
 		return true
 	}
 
@@ -1405,9 +1845,8 @@ func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool
 	return false
 }
 
-func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) {
-	// Set new currency
-	session.miningCoin = newMiningCoin
+func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) (err error) {
+	startTime := time.Now()
 
 	// Lock the session to prevent it from being stopped by other threads
 	session.lock.Lock()
@@ -1416,24 +1855,46 @@ func (session *StratumSession) switchCoinType(newMiningCoin string, currentRecon
 	// Session not running, abandon operation
 	if session.runningStat != StatRunning {
 		glog.Warning("SwitchCoinType: session not running")
-		return
+		return ErrSessionNotRunning
 	}
 	// The session has been reconnected by another thread, giving up the operation
 	if currentReconnectCounter != session.reconnectCounter {
 		glog.Warning("SwitchCoinType: session reconnected by other goroutine")
-		return
+		return ErrSessionNotRunning
+	}
+	// Keep the miner on the current upstream if the new currency cannot be mined
+	if !session.manager.isCoinHealthy(newMiningCoin) {
+		glog.Warning("SwitchCoinType: upstream of ", newMiningCoin, " unhealthy, keep ", session.fullWorkerName, " on ", session.miningCoin)
+		return ErrUpstreamUnhealthy
 	}
+	// session.manager will be reset if the session is stopped
+	metrics := session.manager.metrics
+
+	// Set new currency
+	oldMiningCoin := session.miningCoin
+	session.miningCoin = newMiningCoin
+
 	// Session not reconnected, operational
 	// The status is set to "reconnecting to the server", and the reconnection counter is incremented by one
 	session.setStatNonLock(StatReconnecting)
 	session.reconnectCounter++
 
 	// reconnect server
-	session.reconnectStratumServer(retryTimeWhenServerDown)
+	err = session.reconnectStratumServer(retryTimeWhenServerDown)
+	latency := time.Since(startTime)
+	metrics.ObserveCoinSwitch(oldMiningCoin, newMiningCoin, err == nil, latency)
+	session.notifySwitch(oldMiningCoin, err == nil, latency)
+
+	event := session.newAuditResultEvent("switch", err, startTime)
+	event.OldCoin = oldMiningCoin
+	session.audit(event)
+	return
 }
 
 // reconnectStratumServer reconnect server
-func (session *StratumSession) reconnectStratumServer(retryTime int) {
+func (session *StratumSession) reconnectStratumServer(retryTime int) (err error) {
+	metrics := session.manager.metrics
+
 	// remove session registration
 	session.manager.UnRegisterStratumSession(session)
 
@@ -1453,15 +1914,19 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	session.serverConn.Close()
 	session.serverConn = nil
 
+	// The new server will not respond to the submits sent to the original server, nor accept its jobs
+	session.shares.clearPending()
+	session.submitFilter.reset()
+
 	// recreate clientReader
 	if session.clientReader == nil {
 		session.clientReader = bufio.NewReaderSize(session.clientConn, bufioReaderBufSize)
 	}
 
 	// connect to the server
-	var err error
 	// At least try it once, so start with -1
 	for i := -1; i < retryTime; i++ {
+		metrics.reconnectAttempts.Inc(session.miningCoin)
 		err = session.connectStratumServer()
 		if err == nil {
 			break
@@ -1473,10 +1938,21 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 		if glog.V(2) {
 			glog.Info("Reconnect Server Failed: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin, "; ", err)
 		}
+		metrics.reconnectFailures.Inc(session.miningCoin)
+		session.setStopReason("reconnect_failed")
 		go session.Stop()
 		return
 	}
 
+	// Tell the client to drop the jobs of the old server
+	if session.extranonceSubscribed {
+		err = session.sendExtranonceAndCleanJob()
+		if err != nil {
+			glog.Warning("Send Extranonce and Clean Job Failed: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin, "; ", err)
+			err = nil
+		}
+	}
+
 	// back to running
 	session.setStatNonLock(StatRunning)
 
@@ -1486,6 +1962,7 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	if glog.V(2) {
 		glog.Info("Reconnect Server Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
 	}
+	return
 }
 
 func peekWithTimeout(reader *bufio.Reader, len int, timeout time.Duration) ([]byte, error) {
@@ -1,23 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
-	"github.com/willf/bitset"
+)
+
+// Formats of the miner IP passed to the Stratum server in mining.subscribe
+const (
+	// ClientIPFormatUint32 IPv4 address as an integer (default, 0 for IPv6 miners)
+	ClientIPFormatUint32 = "uint32"
+	// ClientIPFormatString textual IPv4 or IPv6 address, e.g. "192.168.0.1" or "2001:db8::1"
+	ClientIPFormatString = "string"
 )
 
 // StratumServerInfo Information on Stratum Servers
 type StratumServerInfo struct {
 	URL        string
 	UserSuffix string
+	// Ordered upstream sservers with failover. If empty, URL is the only upstream.
+	Upstreams []StratumUpstreamInfo `json:",omitempty"`
+	// Format of the miner IP passed in mining.subscribe, ClientIPFormatUint32 (default) or ClientIPFormatString.
+	// Only set it to "string" for the sservers that support it.
+	ClientIPFormat string `json:",omitempty"`
+	// Drop the invalid submits before they reach the sserver (only with ParseStratumStream)
+	SubmitFilter SubmitFilterConfig
 }
 
 // StratumServerInfoMap Hash table of information for Stratum servers
@@ -34,13 +49,42 @@ type StratumSessionManager struct {
 	sessions StratumSessionMap
 	// Session ID Manager
 	sessionIDManager *SessionIDManager
+	// The lock of the configuration that can be reloaded: stratumServerInfoMap, upstreamPools,
+	// enableUserAutoReg, autoRegMaxWaitUsers and fallbackCoin
+	configLock sync.RWMutex
+	// Serializes the configuration reloads
+	reloadLock sync.Mutex
+	// Path of the configuration file, reloaded on SIGHUP
+	configFilePath string
+	// Zookeeper node overriding the reloadable configuration (optional)
+	zkConfigNode string
 	// Stratum Server List
 	stratumServerInfoMap StratumServerInfoMap
+	// Upstream sservers of each currency
+	upstreamPools map[string]*UpstreamPool
+	// The currency of the sessions whose currency is removed by a reload
+	fallbackCoin string
+	// Active health check of the upstreams
+	upstreamProbeConfig          UpstreamProbeConfig
+	upstreamCheck                upstreamCheckFunc
+	upstreamCheckIntervalSeconds int
+	// Pacing of the coin switches from zookeeper, nil if disabled
+	switchPacer *SwitchPacer
 	// Zookeeper Manager
 	zookeeperManager *ZookeeperManager
 	// zookeeperSwitcherWatchDir The zookeeper directory path monitored by the switch service
 	// The specific monitoring path is zookeeperSwitcherWatchDir/sub account name
 	zookeeperSwitcherWatchDir string
+	// enableWorkerCoinRoute Whether to watch the per-worker route zookeeperSwitcherWatchDir/sub account name/miner name,
+	// which takes precedence over the currency of the sub-account
+	enableWorkerCoinRoute bool
+	// parseStratumStream Whether to parse the proxied Stratum stream line by line instead of copying raw bytes
+	parseStratumStream bool
+	// Hooks of the messages from the miners and from the servers in the line-aware proxy mode
+	clientMessageHooks []StratumMessageHook
+	serverMessageHooks []StratumMessageHook
+	// keepDifficultyOnSwitch Whether to track the difficulty sent to the miner and suggest it to the new server after a switch
+	keepDifficultyOnSwitch bool
 	// enableUserAutoReg Whether to open the sub-account automatic registration function
 	enableUserAutoReg bool
 	// zookeeperAutoRegWatchDir Zookeeper directory path for automatic registration service monitoring
@@ -48,6 +92,8 @@ type StratumSessionManager struct {
 	zookeeperAutoRegWatchDir string
 	// The number of auto-registered users currently allowed (1 minus 1 for registration, add back after completion, and 0 to reject auto-registration to prevent DDoS)
 	autoRegAllowUsers int64
+	// The initial value of autoRegAllowUsers (AutoRegMaxWaitUsers)
+	autoRegMaxWaitUsers int64
 	// stratum The server is not case sensitive to the sub-account name
 	stratumServerCaseInsensitive bool
 	// Case-insensitive username index (nullable, only used when stratumServerCaseInsensitive == false)
@@ -56,12 +102,51 @@ type StratumSessionManager struct {
 	tcpListenAddr string
 	// TCP listener object
 	tcpListener net.Listener
+	// Stratum V2 listener configuration
+	stratumV2Config StratumV2Config
+	// Stratum V2 TCP listener object
+	stratumV2Listener net.Listener
+	// Signed static key of the Noise handshake
+	noiseCertificate *NoiseCertificate
+	// TLS listener configuration
+	tlsConfig TLSConfig
+	// TLS TCP listener object
+	tlsListener net.Listener
+	// Certificates of the TLS listener
+	tlsCertificateReloader *TLSCertificateReloader
+	// PROXY protocol header reader (nil if disabled)
+	proxyProtocolReader *ProxyProtocolReader
+	// Admission control of the connections (nil if disabled)
+	admission *Admission
+	// Audit log of the session lifecycle events (nil if disabled)
+	auditLogger *AuditLogger
+	// Publisher of the coin switch results to Kafka (nil if disabled)
+	switchNotifier *SwitchNotifier
 	// Upgrading objects without downtime
 	upgradable *Upgradable
 	// blockchain type
 	chainType ChainType
 	// serverID to display in error messages
 	serverID uint8
+	// Number of registered sessions by coin, protocol and transport (protected by lock)
+	sessionCounts map[sessionMetricKey]int
+	// Prometheus metrics
+	metrics *SwitcherMetrics
+	// The lock of serverIDNodePath, serverIDNodeData, serverIDReleased and serverIDLost
+	serverIDLock sync.Mutex
+	// The zookeeper node of the assigned server id (empty if ServerID is configured)
+	serverIDNodePath string
+	// The value of the server id node
+	serverIDNodeData []byte
+	// The server id node is deleted by the drain, it is not reclaimed
+	serverIDReleased bool
+	// The server id is taken by another switcher after the zookeeper session expired,
+	// the listeners are closed and no new session is started
+	serverIDLost bool
+	// Drain mode
+	drainer              *Drainer
+	drainDurationSeconds int
+	drainWaves           int
 }
 
 // NewStratumSessionManager Create Stratum Session Manager
@@ -91,21 +176,110 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 
 	manager.serverID = conf.ServerID
 	manager.sessions = make(StratumSessionMap)
+	manager.sessionCounts = make(map[sessionMetricKey]int)
+	manager.metrics = NewSwitcherMetrics()
+	manager.drainer = NewDrainer(manager)
+	manager.drainDurationSeconds = conf.DrainDurationSeconds
+	if manager.drainDurationSeconds <= 0 {
+		manager.drainDurationSeconds = defaultDrainDurationSeconds
+	}
+	manager.drainWaves = conf.DrainWaves
+	if manager.drainWaves <= 0 {
+		manager.drainWaves = defaultDrainWaves
+	}
 	manager.stratumServerInfoMap = conf.StratumServerMap
+	manager.upstreamPools = make(map[string]*UpstreamPool)
+	for coin, serverInfo := range manager.stratumServerInfoMap {
+		manager.upstreamPools[coin] = NewUpstreamPool(coin, serverInfo.Upstreams)
+	}
 	manager.zookeeperSwitcherWatchDir = conf.ZKSwitcherWatchDir
+	manager.enableWorkerCoinRoute = conf.EnableWorkerCoinRoute
+	manager.keepDifficultyOnSwitch = conf.KeepDifficultyOnSwitch
+	manager.parseStratumStream = conf.ParseStratumStream
+	manager.AddClientMessageHook(filterSubmit)
+	manager.AddServerMessageHook(recordJobHook)
 	manager.enableUserAutoReg = conf.EnableUserAutoReg
+	manager.fallbackCoin = conf.FallbackCoin
+	manager.configFilePath = conf.filePath
+	manager.zkConfigNode = conf.ZKConfigNode
 	manager.zookeeperAutoRegWatchDir = conf.ZKAutoRegWatchDir
 	manager.autoRegAllowUsers = conf.AutoRegMaxWaitUsers
+	manager.autoRegMaxWaitUsers = conf.AutoRegMaxWaitUsers
 	manager.stratumServerCaseInsensitive = conf.StratumServerCaseInsensitive
 	manager.zkUserCaseInsensitiveIndex = conf.ZKUserCaseInsensitiveIndex
 	manager.tcpListenAddr = conf.ListenAddr
 	manager.chainType = chainType
+	manager.stratumV2Config = conf.StratumV2
+	manager.tlsConfig = conf.TLS
+	manager.upstreamProbeConfig = conf.UpstreamProbe
+	if conf.SwitchPacing.Enable {
+		manager.switchPacer = NewSwitchPacer(conf.SwitchPacing)
+	}
+
+	if manager.stratumV2Config.Enable {
+		if manager.chainType != ChainTypeBitcoin {
+			err = errors.New("Stratum V2 is only available for ChainType bitcoin")
+			return
+		}
+		manager.noiseCertificate, err = newNoiseCertificateFromConfig(manager.stratumV2Config)
+		if err != nil {
+			err = errors.New("Cannot create Stratum V2 certificate: " + err.Error())
+			return
+		}
+	}
+
+	if manager.tlsConfig.Enable {
+		manager.tlsCertificateReloader, err = NewTLSCertificateReloader(manager.tlsConfig)
+		if err != nil {
+			err = errors.New("Cannot load TLS certificate: " + err.Error())
+			return
+		}
+	}
 
-	manager.zookeeperManager, err = NewZookeeperManager(conf.ZKBroker)
+	if conf.AuditLog.Enable {
+		manager.auditLogger, err = NewAuditLogger(conf.AuditLog, manager.metrics.droppedAuditEvents)
+		if err != nil {
+			err = errors.New("Cannot open audit log: " + err.Error())
+			return
+		}
+	}
+
+	if conf.SwitchNotify.Enable {
+		manager.switchNotifier, err = NewSwitchNotifier(conf.SwitchNotify, manager.metrics.droppedSwitchNotifications)
+		if err != nil {
+			err = errors.New("Cannot create Kafka producer of SwitchNotify: " + err.Error())
+			return
+		}
+	}
+
+	if conf.ProxyProtocol.Enable {
+		manager.proxyProtocolReader, err = NewProxyProtocolReader(conf.ProxyProtocol.TrustedSources)
+		if err != nil {
+			err = errors.New("Invalid PROXY protocol trusted source: " + err.Error())
+			return
+		}
+	}
+
+	manager.zookeeperManager, err = NewZookeeperManager(coordination.Config{
+		Backend:       conf.CoordinationBackend,
+		ZKBroker:      conf.ZKBroker,
+		EtcdEndpoints: conf.EtcdEndpoints,
+	})
 	if err != nil {
 		return
 	}
 
+	if conf.Admission.Enable {
+		manager.admission = NewAdmission(conf.Admission, manager.metrics.rejectedConnections)
+		var list *ipList
+		list, err = manager.loadIPList()
+		if err != nil {
+			err = errors.New("Cannot load IP list: " + err.Error())
+			return
+		}
+		manager.admission.setIPList(list)
+	}
+
 	if manager.serverID == 0 {
 		// try to assign id from zookeeper
 		manager.serverID, err = manager.AssignServerIDFromZK(conf.ZKServerIDAssignDir, runtimeData.ServerID)
@@ -115,6 +289,9 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 		}
 	}
 
+	// Reclaim the server id and watch the nodes again when the zookeeper session expires
+	go manager.zookeeperManager.watchSession(manager.reclaimServerIDFromZK)
+
 	manager.sessionIDManager, err = NewSessionIDManager(manager.serverID, indexBits)
 	if err != nil {
 		return
@@ -131,30 +308,6 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 
 // AssignServerIDFromZK Assign server ID from Zookeeper
 func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, oldServerID uint8) (serverID uint8, err error) {
-	manager.zookeeperManager.createZookeeperPath(assignDir)
-
-	parent := assignDir[:len(assignDir)-1]
-	var children []string
-	children, _, err = manager.zookeeperManager.zookeeperConn.Children(parent)
-	if err != nil {
-		return
-	}
-
-	childrenSet := bitset.New(256)
-	childrenSet.Set(0) // id 0 not assignable
-	// Record the assigned id into the bitset
-	for _, idStr := range children {
-		idInt, convErr := strconv.Atoi(idStr)
-		if convErr != nil {
-			glog.Warning("AssignServerIDFromZK: strconv.Atoi(", idStr, ") failed. errmsg: ", convErr)
-			continue
-		}
-		if idInt < 1 || idInt > 255 {
-			glog.Warning("AssignServerIDFromZK: found out of range id in zk: ", idStr)
-			continue
-		}
-		childrenSet.Set(uint(idInt))
-	}
 
 	// Construct the meta information written to the allocation node
 	type SwitcherMetaData struct {
@@ -168,7 +321,7 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 	data.ChainType = manager.chainType.ToString()
 	data.HostName, _ = os.Hostname()
 	data.ListenAddr = manager.tcpListenAddr
-	for coin := range manager.stratumServerInfoMap {
+	for coin := range manager.getUpstreamPools() {
 		data.Coins = append(data.Coins, coin)
 	}
 	if ips, err := net.InterfaceAddrs(); err == nil {
@@ -179,26 +332,120 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 
 	dataJSON, _ := json.Marshal(data)
 
-	// Find and try assignable id
-	idIndex := uint(oldServerID)
+	// Find and try assignable id (id 0 not assignable), starting from the old one
+	newID, nodePath, err := coordination.AssignEphemeralID(manager.zookeeperManager.backend, assignDir, 1, 255, int(oldServerID), dataJSON)
+	if err != nil {
+		return
+	}
+
+	glog.Info("AssignServerIDFromZK: got server id ", newID, " (", nodePath, ")")
+	serverID = uint8(newID)
+
+	manager.serverIDLock.Lock()
+	manager.serverIDNodePath = nodePath
+	manager.serverIDNodeData = dataJSON
+	manager.serverIDLock.Unlock()
+	return
+}
+
+// reclaimServerIDFromZK Create the node of the assigned server id again after the zookeeper session expired.
+// The server id cannot change while running, so it retries until the node is created.
+// If another switcher took the id, the switcher stops accepting connections until it is restarted.
+func (manager *StratumSessionManager) reclaimServerIDFromZK() {
 	for {
-		newID, success := childrenSet.NextClear(idIndex)
-		if !success {
-			err = errors.New("server id is full")
+		manager.serverIDLock.Lock()
+		if manager.serverIDNodePath == "" || manager.serverIDReleased {
+			manager.serverIDLock.Unlock()
+			return
+		}
+
+		backend := manager.zookeeperManager.backend
+		err := backend.CreateEphemeral(manager.serverIDNodePath, manager.serverIDNodeData)
+		if err == coordination.ErrNodeExists {
+			// The node of the expired session may still be there (etcd), or another switcher took the id
+			value, _, getErr := backend.Get(manager.serverIDNodePath)
+			if getErr == nil && !bytes.Equal(value, manager.serverIDNodeData) {
+				// The session ids of new sessions would be the same as the ones of the other switcher
+				glog.Error("Reclaim server id failed, it is used by another switcher, stop accepting connections: ",
+					manager.serverIDNodePath, "; ", string(value))
+				manager.serverIDLost = true
+				manager.serverIDLock.Unlock()
+				manager.closeListeners()
+				return
+			}
+			glog.Info("Reclaim server id, the node still exists: ", manager.serverIDNodePath)
+			err = nil
+		} else if err == nil {
+			glog.Info("Reclaim server id: ", manager.serverIDNodePath)
+		}
+		manager.serverIDLock.Unlock()
+
+		if err == nil {
 			return
 		}
+		glog.Warning("Reclaim server id failed, retry in ", zookeeperConnAliveTimeout, "s: ", err)
+		time.Sleep(zookeeperConnAliveTimeout * time.Second)
+	}
+}
 
-		nodePath := assignDir + strconv.Itoa(int(newID))
-		_, err = manager.zookeeperManager.zookeeperConn.Create(nodePath, dataJSON, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+// serveConn Read the PROXY protocol header (if enabled) of an accepted connection and apply the admission control, then run the session
+func (manager *StratumSessionManager) serveConn(conn net.Conn, runSession func(net.Conn)) {
+	if manager.admission != nil && !manager.admission.AllowAccept(conn) {
+		return
+	}
+
+	if manager.proxyProtocolReader != nil {
+		proxyConn, err := manager.proxyProtocolReader.Accept(conn)
 		if err != nil {
-			glog.Warning("AssignServerIDFromZK: create ", nodePath, " failed. errmsg: ", err)
-			continue
+			conn.Close()
+			glog.Warning("Read PROXY protocol header failed: ", conn.RemoteAddr(), "; ", err)
+			return
 		}
+		conn = proxyConn
+	}
 
-		glog.Info("AssignServerIDFromZK: got server id ", newID, " (", nodePath, ")")
-		serverID = uint8(newID)
+	if manager.admission != nil {
+		var ok bool
+		conn, ok = manager.admission.Admit(conn)
+		if !ok {
+			return
+		}
+	}
+
+	if manager.isServerIDLost() {
+		conn.Close()
+		glog.Warning("Server id used by another switcher, connection refused: ", conn.RemoteAddr())
 		return
 	}
+
+	runSession(conn)
+}
+
+// isServerIDLost Whether the server id is taken by another switcher
+func (manager *StratumSessionManager) isServerIDLost() bool {
+	manager.serverIDLock.Lock()
+	defer manager.serverIDLock.Unlock()
+
+	return manager.serverIDLost
+}
+
+// releaseServerIDFromZK Delete the node of the assigned server id, returns the path of the node
+func (manager *StratumSessionManager) releaseServerIDFromZK() string {
+	manager.serverIDLock.Lock()
+	defer manager.serverIDLock.Unlock()
+
+	if manager.serverIDNodePath == "" {
+		return ""
+	}
+
+	manager.serverIDReleased = true
+	err := manager.zookeeperManager.backend.Delete(manager.serverIDNodePath, -1)
+	if err != nil {
+		glog.Error("Release server id failed: ", manager.serverIDNodePath, "; ", err)
+	} else {
+		glog.Info("Release server id: ", manager.serverIDNodePath)
+	}
+	return manager.serverIDNodePath
 }
 
 // RunStratumSession Run a Stratum session
@@ -216,6 +463,30 @@ func (manager *StratumSessionManager) RunStratumSession(conn net.Conn) {
 	session.Run()
 }
 
+// RunStratumV2Session Run a Stratum V2 session (translated to Stratum V1 before proxying)
+func (manager *StratumSessionManager) RunStratumV2Session(conn net.Conn) {
+	noiseConn, err := NewNoiseResponderConn(conn, manager.noiseCertificate)
+	if err != nil {
+		conn.Close()
+		glog.Warning("Stratum V2 handshake failed: ", conn.RemoteAddr(), "; ", err)
+		return
+	}
+
+	manager.RunStratumSession(NewStratumV2Conn(conn, noiseConn))
+}
+
+// RunTLSSession Run a Stratum session over TLS
+func (manager *StratumSessionManager) RunTLSSession(conn net.Conn) {
+	tlsConn, err := NewTLSServerConn(conn, manager.tlsCertificateReloader.ServerConfig())
+	if err != nil {
+		conn.Close()
+		glog.Warning("TLS handshake failed: ", conn.RemoteAddr(), "; ", err)
+		return
+	}
+
+	manager.RunStratumSession(tlsConn)
+}
+
 // ResumeStratumSession Resume a Stratum session
 func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSessionData) {
 	clientConn, clientErr := newConnFromFd(sessionData.ClientConnFD)
@@ -248,6 +519,16 @@ func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSe
 	}
 
 	session := NewStratumSession(manager, clientConn, sessionData.SessionID)
+	if sessionData.ClientIPPort != "" {
+		session.clientIPPort = sessionData.ClientIPPort
+	}
+	if sessionData.StartTime > 0 {
+		session.startTime = time.Unix(sessionData.StartTime, 0)
+	}
+	session.serverURL = sessionData.ServerURL
+	if session.serverURL == "" {
+		session.serverURL = serverConn.RemoteAddr().String()
+	}
 	session.Resume(sessionData, serverConn)
 }
 
@@ -255,31 +536,74 @@ func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSe
 func (manager *StratumSessionManager) RegisterStratumSession(session *StratumSession) {
 	manager.lock.Lock()
 	manager.sessions[session.sessionID] = session
+	session.metricKey = sessionMetricKey{session.miningCoin, session.protocolType.ToString(), session.getTransport()}
+	session.registeredReconnectCounter = session.reconnectCounter
+	manager.sessionCounts[session.metricKey]++
 	manager.lock.Unlock()
 }
 
+// registeredSessions Get the sessions in normal proxy state
+func (manager *StratumSessionManager) registeredSessions() (sessions []*StratumSession) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	sessions = make([]*StratumSession, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session)
+	}
+	return
+}
+
+// registeredSessionCount Get the number of sessions in normal proxy state
+func (manager *StratumSessionManager) registeredSessionCount() int {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	return len(manager.sessions)
+}
+
+// deleteSessionNonLock Delete a registered session (lock-free, for calls inside locked functions)
+func (manager *StratumSessionManager) deleteSessionNonLock(session *StratumSession) {
+	if _, ok := manager.sessions[session.sessionID]; !ok {
+		return
+	}
+	delete(manager.sessions, session.sessionID)
+	manager.sessionCounts[session.metricKey]--
+	if manager.sessionCounts[session.metricKey] <= 0 {
+		delete(manager.sessionCounts, session.metricKey)
+	}
+}
+
 // UnRegisterStratumSession Unregister Stratum session (called when Stratum session is reconnected)
 func (manager *StratumSessionManager) UnRegisterStratumSession(session *StratumSession) {
 	manager.lock.Lock()
 	// delete a registered session
-	delete(manager.sessions, session.sessionID)
+	manager.deleteSessionNonLock(session)
 	manager.lock.Unlock()
 
 	// Remove currency monitoring from Zookeeper manager
-	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	manager.releaseCoinWatches(session)
 }
 
 // ReleaseStratumSession Release Stratum session (called when Stratum session is stopped)
 func (manager *StratumSessionManager) ReleaseStratumSession(session *StratumSession) {
 	manager.lock.Lock()
 	// delete a registered session
-	delete(manager.sessions, session.sessionID)
+	manager.deleteSessionNonLock(session)
 	manager.lock.Unlock()
 
 	// release session id
 	manager.sessionIDManager.FreeSessionID(session.sessionID)
 	// Remove currency monitoring from Zookeeper manager
+	manager.releaseCoinWatches(session)
+}
+
+// releaseCoinWatches Release the watches of the currency of the sub-account and of the per-worker route
+func (manager *StratumSessionManager) releaseCoinWatches(session *StratumSession) {
 	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	if session.zkWorkerWatchPath != "" {
+		manager.zookeeperManager.ReleaseOptionalW(session.zkWorkerWatchPath, session.sessionID)
+	}
 }
 
 // Run Start running the StratumSwitcher service
@@ -302,16 +626,148 @@ func (manager *StratumSessionManager) Run(runtimeData RuntimeData) {
 		return
 	}
 
+	// All listeners are created here, before the goroutines that may close them (closeListeners)
+	// and before their accepting goroutines are started
+	if manager.stratumV2Config.Enable {
+		glog.Info("Listen TCP ", manager.stratumV2Config.ListenAddr, " (Stratum V2)")
+		manager.stratumV2Listener, err = net.Listen("tcp", manager.stratumV2Config.ListenAddr)
+
+		if err != nil {
+			glog.Fatal("listen failed: ", err)
+			return
+		}
+	}
+
+	if manager.tlsConfig.Enable {
+		glog.Info("Listen TCP ", manager.tlsConfig.ListenAddr, " (TLS)")
+		manager.tlsListener, err = net.Listen("tcp", manager.tlsConfig.ListenAddr)
+
+		if err != nil {
+			glog.Fatal("listen failed: ", err)
+			return
+		}
+	}
+
 	manager.Upgradable()
 
+	if manager.upstreamProbeConfig.Enable {
+		// Reserve the session id of the probes after the sessions are resumed
+		prober, err := NewUpstreamProber(manager, manager.upstreamProbeConfig)
+		if err != nil {
+			glog.Fatal("create upstream prober failed: ", err)
+			return
+		}
+		manager.upstreamCheck = prober.probe
+		manager.upstreamCheckIntervalSeconds = prober.conf.IntervalSeconds
+	} else {
+		manager.upstreamCheck = checkUpstreamConnect
+		manager.upstreamCheckIntervalSeconds = upstreamHealthCheckIntervalSeconds
+	}
+	for _, pool := range manager.getUpstreamPools() {
+		manager.startUpstreamHealthCheck(pool)
+	}
+
+	if manager.zkConfigNode != "" {
+		// Apply the configuration in zookeeper before accepting connections
+		manager.reloadConfig()
+		go manager.watchConfigNode()
+	}
+
+	if manager.admission != nil && manager.admission.conf.ZKIPListNode != "" {
+		go manager.watchIPListNode()
+	}
+
+	if manager.stratumV2Config.Enable {
+		go manager.runStratumV2Listener()
+	}
+
+	if manager.tlsConfig.Enable {
+		go manager.runTLSListener()
+	}
+
+	go signalHUPListener(manager.reload)
+
+	go signalUSR1Listener(func() {
+		if !manager.drainer.Start(0, 0) {
+			glog.Warning("Drain has already been started")
+		}
+	})
+
 	for {
 		conn, err := manager.tcpListener.Accept()
 
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			continue
+		}
+
+		go manager.serveConn(conn, manager.RunStratumSession)
+	}
+
+	// The listener is closed by the drain, keep running until all sessions are closed
+	// and the process is stopped by the operator.
+	select {}
+}
+
+// closeListeners Stop accepting new connections
+func (manager *StratumSessionManager) closeListeners() {
+	for _, listener := range []net.Listener{manager.tcpListener, manager.tlsListener, manager.stratumV2Listener} {
+		if listener != nil {
+			glog.Info("Close listener ", listener.Addr())
+			listener.Close()
+		}
+	}
+}
+
+// runStratumV2Listener Accept Stratum V2 connections
+func (manager *StratumSessionManager) runStratumV2Listener() {
+	for {
+		conn, err := manager.stratumV2Listener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
-		go manager.RunStratumSession(conn)
+		go manager.serveConn(conn, manager.RunStratumV2Session)
+	}
+}
+
+// runTLSListener Accept Stratum over TLS connections
+func (manager *StratumSessionManager) runTLSListener() {
+	for {
+		conn, err := manager.tlsListener.Accept()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go manager.serveConn(conn, manager.RunTLSSession)
+	}
+}
+
+// reload Reload the resources that can be changed at runtime (SIGHUP)
+func (manager *StratumSessionManager) reload() {
+	manager.reloadConfig()
+
+	if manager.admission != nil {
+		manager.reloadIPList()
+	}
+
+	if manager.tlsCertificateReloader != nil {
+		err := manager.tlsCertificateReloader.Reload()
+		if err != nil {
+			glog.Error("Reload TLS certificate failed, keep the old one: ", err)
+		} else {
+			glog.Info("TLS certificate reloaded: ", manager.tlsConfig.CertFile)
+		}
 	}
 }
 
@@ -342,7 +798,7 @@ func (manager *StratumSessionManager) GetRegularSubaccountName(subAccountName st
 	}
 
 	path := manager.zkUserCaseInsensitiveIndex + strings.ToLower(subAccountName)
-	regularNameBytes, _, err := manager.zookeeperManager.zookeeperConn.Get(path)
+	regularNameBytes, _, err := manager.zookeeperManager.backend.Get(path)
 	if err != nil {
 		if glog.V(3) {
 			glog.Info("GetRegularSubaccountName failed. user: ", subAccountName, ", errmsg: ", err)
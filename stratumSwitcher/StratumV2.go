@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Stratum V2 protocol definitions
+// <https://github.com/stratum-mining/sv2-spec>
+
+// The length of the Stratum V2 frame header: extension_type(U16) + msg_type(U8) + msg_length(U24)
+const stratumV2FrameHeaderLen = 6
+
+// Maximum length of a Stratum V2 message payload (U24)
+const stratumV2MaxPayloadLen = 0xffffff
+
+// Maximum length of a message payload accepted from miners. The largest message sent by miners is
+// SetupConnection (about 1.3 KB with all strings at their maximum length).
+const stratumV2MaxMinerPayloadLen = 4096
+
+// The bit of extension_type indicating that the message is a channel message
+const stratumV2ChannelMsgBit = 0x8000
+
+// Stratum V2 protocol version supported by the switcher
+const stratumV2ProtocolVersion = 2
+
+// Stratum V2 sub-protocol: mining protocol
+const stratumV2ProtocolMining = 0
+
+// Stratum V2 message types used by the switcher
+const (
+	sv2MsgSetupConnection                  = 0x00
+	sv2MsgSetupConnectionSuccess           = 0x01
+	sv2MsgSetupConnectionError             = 0x02
+	sv2MsgOpenStandardMiningChannel        = 0x10
+	sv2MsgOpenStandardMiningChannelSuccess = 0x11
+	sv2MsgOpenMiningChannelError           = 0x12
+	sv2MsgOpenExtendedMiningChannel        = 0x13
+	sv2MsgNewMiningJob                     = 0x15
+	sv2MsgUpdateChannel                    = 0x16
+	sv2MsgCloseChannel                     = 0x18
+	sv2MsgSubmitSharesStandard             = 0x1a
+	sv2MsgSubmitSharesSuccess              = 0x1c
+	sv2MsgSubmitSharesError                = 0x1d
+	sv2MsgSetNewPrevHash                   = 0x20
+	sv2MsgSetTarget                        = 0x21
+)
+
+var (
+	// ErrStratumV2FrameTooShort Stratum V2 message is shorter than its fields
+	ErrStratumV2FrameTooShort = errors.New("Stratum V2 Frame Too Short")
+	// ErrStratumV2FrameTooLong Stratum V2 message is longer than the U24 limit or the limit of the connection
+	ErrStratumV2FrameTooLong = errors.New("Stratum V2 Frame Too Long")
+)
+
+// StratumV2Frame A Stratum V2 message frame
+type StratumV2Frame struct {
+	ExtensionType uint16
+	MsgType       uint8
+	Payload       []byte
+}
+
+// isChannelMsg Whether the message type carries a channel_id as its first field
+func stratumV2IsChannelMsg(msgType uint8) bool {
+	switch msgType {
+	case sv2MsgNewMiningJob, sv2MsgUpdateChannel, sv2MsgCloseChannel,
+		sv2MsgSubmitSharesStandard, sv2MsgSubmitSharesSuccess, sv2MsgSubmitSharesError,
+		sv2MsgSetNewPrevHash, sv2MsgSetTarget:
+		return true
+	}
+	return false
+}
+
+// NewStratumV2Frame Create a frame of the mining protocol
+func NewStratumV2Frame(msgType uint8, payload []byte) *StratumV2Frame {
+	frame := new(StratumV2Frame)
+	frame.MsgType = msgType
+	frame.Payload = payload
+	if stratumV2IsChannelMsg(msgType) {
+		frame.ExtensionType = stratumV2ChannelMsgBit
+	}
+	return frame
+}
+
+// EncodeHeader Encode the frame header
+func (frame *StratumV2Frame) EncodeHeader() (header []byte, err error) {
+	if len(frame.Payload) > stratumV2MaxPayloadLen {
+		err = ErrStratumV2FrameTooLong
+		return
+	}
+	header = make([]byte, stratumV2FrameHeaderLen)
+	binary.LittleEndian.PutUint16(header[0:2], frame.ExtensionType)
+	header[2] = frame.MsgType
+	putUint24(header[3:6], uint32(len(frame.Payload)))
+	return
+}
+
+// parseStratumV2FrameHeader Parse the frame header, returns the frame without payload and the length of payload
+func parseStratumV2FrameHeader(header []byte) (frame *StratumV2Frame, payloadLen int, err error) {
+	if len(header) < stratumV2FrameHeaderLen {
+		err = ErrStratumV2FrameTooShort
+		return
+	}
+	frame = new(StratumV2Frame)
+	frame.ExtensionType = binary.LittleEndian.Uint16(header[0:2])
+	frame.MsgType = header[2]
+	payloadLen = int(uint24(header[3:6]))
+	return
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+//////////////////////////////// Binary encoding ////////////////////////////////
+
+// sv2Writer Encoder of Stratum V2 data types (all integers are little endian)
+type sv2Writer struct {
+	buf []byte
+}
+
+func (w *sv2Writer) u8(v uint8) *sv2Writer {
+	w.buf = append(w.buf, v)
+	return w
+}
+
+func (w *sv2Writer) u16(v uint16) *sv2Writer {
+	w.buf = append(w.buf, byte(v), byte(v>>8))
+	return w
+}
+
+func (w *sv2Writer) u32(v uint32) *sv2Writer {
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	return w
+}
+
+func (w *sv2Writer) u64(v uint64) *sv2Writer {
+	w.u32(uint32(v))
+	w.u32(uint32(v >> 32))
+	return w
+}
+
+func (w *sv2Writer) f32(v float32) *sv2Writer {
+	return w.u32(math.Float32bits(v))
+}
+
+// u256 writes 32 bytes as is
+func (w *sv2Writer) u256(v []byte) *sv2Writer {
+	var b [32]byte
+	copy(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+	return w
+}
+
+// str0255 writes STR0_255 / B0_255 (u8 length prefixed)
+func (w *sv2Writer) str0255(v string) *sv2Writer {
+	if len(v) > 255 {
+		v = v[:255]
+	}
+	w.buf = append(w.buf, byte(len(v)))
+	w.buf = append(w.buf, v...)
+	return w
+}
+
+// b032 writes B0_32 (u8 length prefixed)
+func (w *sv2Writer) b032(v []byte) *sv2Writer {
+	if len(v) > 32 {
+		v = v[:32]
+	}
+	w.buf = append(w.buf, byte(len(v)))
+	w.buf = append(w.buf, v...)
+	return w
+}
+
+// optionU32 writes OPTION[U32] (a SEQ0_1 of U32)
+func (w *sv2Writer) optionU32(v uint32, present bool) *sv2Writer {
+	if !present {
+		return w.u8(0)
+	}
+	return w.u8(1).u32(v)
+}
+
+// sv2Reader Decoder of Stratum V2 data types
+type sv2Reader struct {
+	buf []byte
+	err error
+}
+
+func (r *sv2Reader) take(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.buf) < n {
+		r.err = ErrStratumV2FrameTooShort
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *sv2Reader) u8() uint8 {
+	return r.take(1)[0]
+}
+
+func (r *sv2Reader) u16() uint16 {
+	return binary.LittleEndian.Uint16(r.take(2))
+}
+
+func (r *sv2Reader) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *sv2Reader) f32() float32 {
+	return math.Float32frombits(r.u32())
+}
+
+func (r *sv2Reader) u256() []byte {
+	return r.take(32)
+}
+
+func (r *sv2Reader) str0255() string {
+	n := int(r.u8())
+	return string(r.take(n))
+}
+
+//////////////////////////////// Messages ////////////////////////////////
+
+// StratumV2SetupConnection SetupConnection message
+type StratumV2SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceID        string
+}
+
+// parseStratumV2SetupConnection Decode a SetupConnection message
+func parseStratumV2SetupConnection(payload []byte) (msg StratumV2SetupConnection, err error) {
+	r := sv2Reader{buf: payload}
+	msg.Protocol = r.u8()
+	msg.MinVersion = r.u16()
+	msg.MaxVersion = r.u16()
+	msg.Flags = r.u32()
+	msg.EndpointHost = r.str0255()
+	msg.EndpointPort = r.u16()
+	msg.Vendor = r.str0255()
+	msg.HardwareVersion = r.str0255()
+	msg.Firmware = r.str0255()
+	msg.DeviceID = r.str0255()
+	err = r.err
+	return
+}
+
+// Encode Encode a SetupConnection message
+func (msg *StratumV2SetupConnection) Encode() []byte {
+	w := new(sv2Writer)
+	w.u8(msg.Protocol).u16(msg.MinVersion).u16(msg.MaxVersion).u32(msg.Flags)
+	w.str0255(msg.EndpointHost).u16(msg.EndpointPort)
+	w.str0255(msg.Vendor).str0255(msg.HardwareVersion).str0255(msg.Firmware).str0255(msg.DeviceID)
+	return w.buf
+}
+
+// StratumV2OpenStandardMiningChannel OpenStandardMiningChannel message
+type StratumV2OpenStandardMiningChannel struct {
+	RequestID       uint32
+	UserIdentity    string
+	NominalHashRate float32
+	MaxTarget       []byte
+}
+
+// parseStratumV2OpenStandardMiningChannel Decode an OpenStandardMiningChannel message
+func parseStratumV2OpenStandardMiningChannel(payload []byte) (msg StratumV2OpenStandardMiningChannel, err error) {
+	r := sv2Reader{buf: payload}
+	msg.RequestID = r.u32()
+	msg.UserIdentity = r.str0255()
+	msg.NominalHashRate = r.f32()
+	msg.MaxTarget = r.u256()
+	err = r.err
+	return
+}
+
+// Encode Encode an OpenStandardMiningChannel message
+func (msg *StratumV2OpenStandardMiningChannel) Encode() []byte {
+	w := new(sv2Writer)
+	w.u32(msg.RequestID).str0255(msg.UserIdentity).f32(msg.NominalHashRate).u256(msg.MaxTarget)
+	return w.buf
+}
+
+// StratumV2SubmitSharesStandard SubmitSharesStandard message
+type StratumV2SubmitSharesStandard struct {
+	ChannelID      uint32
+	SequenceNumber uint32
+	JobID          uint32
+	Nonce          uint32
+	NTime          uint32
+	Version        uint32
+}
+
+// parseStratumV2SubmitSharesStandard Decode a SubmitSharesStandard message
+func parseStratumV2SubmitSharesStandard(payload []byte) (msg StratumV2SubmitSharesStandard, err error) {
+	r := sv2Reader{buf: payload}
+	msg.ChannelID = r.u32()
+	msg.SequenceNumber = r.u32()
+	msg.JobID = r.u32()
+	msg.Nonce = r.u32()
+	msg.NTime = r.u32()
+	msg.Version = r.u32()
+	err = r.err
+	return
+}
+
+// Encode Encode a SubmitSharesStandard message
+func (msg *StratumV2SubmitSharesStandard) Encode() []byte {
+	w := new(sv2Writer)
+	w.u32(msg.ChannelID).u32(msg.SequenceNumber).u32(msg.JobID).u32(msg.Nonce).u32(msg.NTime).u32(msg.Version)
+	return w.buf
+}
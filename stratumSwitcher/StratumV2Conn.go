@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The ID of the channel opened on a Stratum V2 connection (only one standard channel per connection)
+const stratumV2ChannelID = 1
+
+// Maximum number of jobs kept for share submission
+const stratumV2MaxJobs = 32
+
+// Version rolling mask requested from sserver for Stratum V2 miners (BIP320)
+const stratumV2VersionRollingMask = "1fffe000"
+
+// JSON-RPC IDs of the Stratum V1 requests generated by StratumV2Conn
+const (
+	sv2RPCIDConfigure = "sv2.configure"
+	sv2RPCIDSubscribe = "sv2.subscribe"
+	sv2RPCIDAuthorize = "sv2.authorize"
+)
+
+// The target of difficulty 1 (bdiff)
+var stratumV2Diff1Target, _ = new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+
+// ErrStratumV2ConnClosed The Stratum V2 connection has been closed by the miner
+var ErrStratumV2ConnClosed = errors.New("Stratum V2 Connection Closed")
+
+// stratumV2Job A Stratum V1 job translated to Stratum V2
+type stratumV2Job struct {
+	sv1JobID string
+	version  uint32
+}
+
+// stratumV1Message The union of Stratum V1 requests, notifications and responses
+type stratumV1Message struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Result interface{}   `json:"result"`
+	Error  interface{}   `json:"error"`
+}
+
+// StratumV2Conn Translates a Stratum V2 connection to a Stratum V1 byte stream.
+//
+// It implements net.Conn so that StratumSession can treat a Stratum V2 miner like
+// a Stratum V1 miner: Read() returns Stratum V1 JSON lines converted from the
+// miner's Stratum V2 messages, and Write() converts the Stratum V1 JSON lines
+// written by the session (or proxied from sserver) to Stratum V2 messages.
+type StratumV2Conn struct {
+	noiseConn *NoiseConn
+	rawConn   net.Conn
+
+	// Stratum V1 data waiting to be read by the session
+	readBuffer bytes.Buffer
+	// Incomplete Stratum V1 line written by the session
+	writeBuffer []byte
+	// The lock added when changing the translation state
+	lock sync.Mutex
+
+	setupDone        bool
+	userAgent        string
+	openRequestID    uint32
+	userIdentity     string
+	authorized       bool
+	channelOpened    bool
+	extraNonce1      []byte
+	extraNonce2Size  int
+	difficulty       float64
+	lastPrevHash     string
+	nextJobID        uint32
+	jobs             map[uint32]*stratumV2Job
+	jobIDs           []uint32
+	pendingSubmitIDs map[uint32]float64
+}
+
+// NewStratumV2Conn Create a Stratum V2 to V1 translating connection
+func NewStratumV2Conn(rawConn net.Conn, noiseConn *NoiseConn) (conn *StratumV2Conn) {
+	conn = new(StratumV2Conn)
+	conn.rawConn = rawConn
+	conn.noiseConn = noiseConn
+	conn.difficulty = 1
+	conn.nextJobID = 1
+	conn.jobs = make(map[uint32]*stratumV2Job)
+	conn.pendingSubmitIDs = make(map[uint32]float64)
+	return
+}
+
+// Read Read Stratum V1 data converted from Stratum V2 messages
+func (conn *StratumV2Conn) Read(b []byte) (n int, err error) {
+	for {
+		conn.lock.Lock()
+		if conn.readBuffer.Len() > 0 {
+			n, err = conn.readBuffer.Read(b)
+			conn.lock.Unlock()
+			return
+		}
+		conn.lock.Unlock()
+
+		var frame *StratumV2Frame
+		frame, err = conn.noiseConn.ReadFrame()
+		if err != nil {
+			return
+		}
+		err = conn.handleFrame(frame)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write Write Stratum V1 data to be converted to Stratum V2 messages
+func (conn *StratumV2Conn) Write(b []byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.writeBuffer = append(conn.writeBuffer, b...)
+	for {
+		pos := bytes.IndexByte(conn.writeBuffer, '\n')
+		if pos < 0 {
+			break
+		}
+		line := conn.writeBuffer[:pos]
+		conn.writeBuffer = conn.writeBuffer[pos+1:]
+
+		err = conn.handleStratumV1Line(line)
+		if err != nil {
+			return
+		}
+	}
+	n = len(b)
+	return
+}
+
+// Close Close the connection
+func (conn *StratumV2Conn) Close() error {
+	return conn.noiseConn.Close()
+}
+
+// LocalAddr Returns the local network address
+func (conn *StratumV2Conn) LocalAddr() net.Addr {
+	return conn.rawConn.LocalAddr()
+}
+
+// RemoteAddr Returns the remote network address
+func (conn *StratumV2Conn) RemoteAddr() net.Addr {
+	return conn.rawConn.RemoteAddr()
+}
+
+// SetDeadline Sets the read and write deadlines
+func (conn *StratumV2Conn) SetDeadline(t time.Time) error {
+	return conn.rawConn.SetDeadline(t)
+}
+
+// SetReadDeadline Sets the read deadline
+func (conn *StratumV2Conn) SetReadDeadline(t time.Time) error {
+	return conn.rawConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline Sets the write deadline
+func (conn *StratumV2Conn) SetWriteDeadline(t time.Time) error {
+	return conn.rawConn.SetWriteDeadline(t)
+}
+
+// writeStratumV1Request Queue a Stratum V1 request to be read by the session (should be called with the lock)
+func (conn *StratumV2Conn) writeStratumV1Request(id interface{}, method string, params ...interface{}) {
+	request := JSONRPCRequest{id, method, params, ""}
+	bytes, _ := request.ToJSONBytes()
+	conn.readBuffer.Write(bytes)
+	conn.readBuffer.WriteByte('\n')
+}
+
+//////////////////////////////// Stratum V2 -> V1 ////////////////////////////////
+
+func (conn *StratumV2Conn) handleFrame(frame *StratumV2Frame) (err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if frame.ExtensionType&^stratumV2ChannelMsgBit != 0 {
+		// extensions are not supported
+		if glog.V(3) {
+			glog.Info("[SV2] ignore message of extension ", frame.ExtensionType, ", type ", frame.MsgType)
+		}
+		return
+	}
+
+	switch frame.MsgType {
+	case sv2MsgSetupConnection:
+		return conn.handleSetupConnection(frame.Payload)
+	case sv2MsgOpenStandardMiningChannel:
+		return conn.handleOpenStandardMiningChannel(frame.Payload)
+	case sv2MsgOpenExtendedMiningChannel:
+		// request_id is the first field of the message
+		r := sv2Reader{buf: frame.Payload}
+		requestID := r.u32()
+		w := new(sv2Writer)
+		w.u32(requestID).str0255("unsupported-feature-flags")
+		return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgOpenMiningChannelError, w.buf))
+	case sv2MsgSubmitSharesStandard:
+		return conn.handleSubmitSharesStandard(frame.Payload)
+	case sv2MsgCloseChannel:
+		return ErrStratumV2ConnClosed
+	default:
+		// UpdateChannel and other messages need no translation
+		if glog.V(3) {
+			glog.Info("[SV2] ignore message type ", frame.MsgType)
+		}
+		return
+	}
+}
+
+func (conn *StratumV2Conn) handleSetupConnection(payload []byte) (err error) {
+	msg, err := parseStratumV2SetupConnection(payload)
+	if err != nil {
+		return
+	}
+
+	errCode := ""
+	if conn.setupDone {
+		errCode = "duplicate-setup-connection"
+	} else if msg.Protocol != stratumV2ProtocolMining {
+		errCode = "unsupported-protocol"
+	} else if msg.MinVersion > stratumV2ProtocolVersion || msg.MaxVersion < stratumV2ProtocolVersion {
+		errCode = "protocol-version-mismatch"
+	}
+
+	if errCode != "" {
+		w := new(sv2Writer)
+		w.u32(0).str0255(errCode)
+		conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnectionError, w.buf))
+		return errors.New("SetupConnection failed: " + errCode)
+	}
+
+	conn.setupDone = true
+	conn.userAgent = "sv2/" + msg.Vendor + "/" + msg.Firmware
+
+	w := new(sv2Writer)
+	w.u16(stratumV2ProtocolVersion).u32(0)
+	return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnectionSuccess, w.buf))
+}
+
+func (conn *StratumV2Conn) handleOpenStandardMiningChannel(payload []byte) (err error) {
+	msg, err := parseStratumV2OpenStandardMiningChannel(payload)
+	if err != nil {
+		return
+	}
+
+	if !conn.setupDone || conn.userIdentity != "" {
+		w := new(sv2Writer)
+		w.u32(msg.RequestID).str0255("max-channels-reached")
+		return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgOpenMiningChannelError, w.buf))
+	}
+
+	conn.openRequestID = msg.RequestID
+	conn.userIdentity = msg.UserIdentity
+
+	// Standard channels are header-only mining, the miner may roll version bits (BIP320)
+	conn.writeStratumV1Request(sv2RPCIDConfigure, "mining.configure",
+		JSONRPCArray{"version-rolling"},
+		JSONRPCObj{"version-rolling.mask": stratumV2VersionRollingMask})
+	conn.writeStratumV1Request(sv2RPCIDSubscribe, "mining.subscribe", conn.userAgent)
+	conn.writeStratumV1Request(sv2RPCIDAuthorize, "mining.authorize", msg.UserIdentity, "")
+	return
+}
+
+func (conn *StratumV2Conn) handleSubmitSharesStandard(payload []byte) (err error) {
+	msg, err := parseStratumV2SubmitSharesStandard(payload)
+	if err != nil {
+		return
+	}
+
+	job, ok := conn.jobs[msg.JobID]
+	if !conn.channelOpened || msg.ChannelID != stratumV2ChannelID || !ok {
+		w := new(sv2Writer)
+		w.u32(msg.ChannelID).u32(msg.SequenceNumber).str0255("invalid-job-id")
+		return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSubmitSharesError, w.buf))
+	}
+
+	params := JSONRPCArray{
+		conn.userIdentity,
+		job.sv1JobID,
+		hex.EncodeToString(make([]byte, conn.extraNonce2Size)),
+		fmt.Sprintf("%08x", msg.NTime),
+		fmt.Sprintf("%08x", msg.Nonce)}
+	if msg.Version != job.version {
+		params = append(params, fmt.Sprintf("%08x", msg.Version))
+	}
+
+	conn.pendingSubmitIDs[msg.SequenceNumber] = conn.difficulty
+	conn.writeStratumV1Request(msg.SequenceNumber, "mining.submit", params...)
+	return
+}
+
+//////////////////////////////// Stratum V1 -> V2 ////////////////////////////////
+
+func (conn *StratumV2Conn) handleStratumV1Line(line []byte) (err error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	var msg stratumV1Message
+	if json.Unmarshal(line, &msg) != nil {
+		if glog.V(3) {
+			glog.Info("[SV2] JSON decode failed: ", string(line))
+		}
+		return
+	}
+
+	if msg.Method != "" {
+		return conn.handleStratumV1Notify(&msg)
+	}
+	return conn.handleStratumV1Response(&msg)
+}
+
+func (conn *StratumV2Conn) handleStratumV1Response(msg *stratumV1Message) (err error) {
+	switch id := msg.ID.(type) {
+	case string:
+		switch id {
+		case sv2RPCIDSubscribe:
+			// result: [[["mining.set_difficulty", "xxx"], ["mining.notify", "xxx"]], extranonce1, extranonce2_size]
+			result, ok := msg.Result.([]interface{})
+			if !ok || len(result) < 3 {
+				return conn.openChannelError("unknown-user")
+			}
+			extraNonce1, _ := result[1].(string)
+			extraNonce2Size, _ := result[2].(float64)
+			conn.extraNonce1, err = hex.DecodeString(extraNonce1)
+			if err != nil {
+				return
+			}
+			conn.extraNonce2Size = int(extraNonce2Size)
+
+		case sv2RPCIDAuthorize:
+			success, _ := msg.Result.(bool)
+			if !success {
+				return conn.openChannelError("unknown-user")
+			}
+			// The channel will be opened when the first difficulty or job arrives
+			conn.authorized = true
+		}
+
+	case float64:
+		seq := uint32(id)
+		difficulty, ok := conn.pendingSubmitIDs[seq]
+		if !ok {
+			return
+		}
+		delete(conn.pendingSubmitIDs, seq)
+
+		success, _ := msg.Result.(bool)
+		w := new(sv2Writer)
+		if success && msg.Error == nil {
+			w.u32(stratumV2ChannelID).u32(seq).u32(1).u64(uint64(difficulty))
+			return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSubmitSharesSuccess, w.buf))
+		}
+		w.u32(stratumV2ChannelID).u32(seq).str0255(stratumV2SubmitErrorCode(msg.Error))
+		return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSubmitSharesError, w.buf))
+	}
+	return
+}
+
+func (conn *StratumV2Conn) handleStratumV1Notify(msg *stratumV1Message) (err error) {
+	switch msg.Method {
+	case "mining.set_difficulty":
+		if len(msg.Params) < 1 {
+			return
+		}
+		difficulty, ok := msg.Params[0].(float64)
+		if !ok || difficulty <= 0 {
+			return
+		}
+		conn.difficulty = difficulty
+		if !conn.channelOpened {
+			return conn.openChannel()
+		}
+		w := new(sv2Writer)
+		w.u32(stratumV2ChannelID).u256(stratumV2DifficultyToTarget(difficulty))
+		return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSetTarget, w.buf))
+
+	case "mining.notify":
+		if !conn.channelOpened {
+			err = conn.openChannel()
+			if err != nil {
+				return
+			}
+		}
+		return conn.handleMiningNotify(msg.Params)
+
+	default:
+		// mining.set_version_mask etc. need no translation
+		return
+	}
+}
+
+func (conn *StratumV2Conn) openChannel() (err error) {
+	if !conn.authorized {
+		return
+	}
+	conn.channelOpened = true
+
+	w := new(sv2Writer)
+	w.u32(conn.openRequestID).u32(stratumV2ChannelID).u256(stratumV2DifficultyToTarget(conn.difficulty))
+	w.b032(conn.extraNonce1).u32(0)
+	return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgOpenStandardMiningChannelSuccess, w.buf))
+}
+
+func (conn *StratumV2Conn) openChannelError(errCode string) error {
+	w := new(sv2Writer)
+	w.u32(conn.openRequestID).str0255(errCode)
+	return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgOpenMiningChannelError, w.buf))
+}
+
+// handleMiningNotify Convert mining.notify to NewMiningJob (and SetNewPrevHash)
+func (conn *StratumV2Conn) handleMiningNotify(params []interface{}) (err error) {
+	// params: [job_id, prevhash, coinb1, coinb2, merkle_branch, version, nbits, ntime, clean_jobs]
+	if len(params) < 9 {
+		glog.Warning("[SV2] mining.notify: too few params: ", params)
+		return
+	}
+	sv1JobID, _ := params[0].(string)
+	prevHash, _ := params[1].(string)
+	coinbase1, _ := params[2].(string)
+	coinbase2, _ := params[3].(string)
+	branches, _ := params[4].([]interface{})
+	versionHex, _ := params[5].(string)
+	nBitsHex, _ := params[6].(string)
+	nTimeHex, _ := params[7].(string)
+	cleanJobs, _ := params[8].(bool)
+
+	version, err1 := strconv.ParseUint(versionHex, 16, 32)
+	nBits, err2 := strconv.ParseUint(nBitsHex, 16, 32)
+	nTime, err3 := strconv.ParseUint(nTimeHex, 16, 32)
+	prevHashBytes, err4 := stratumV1PrevHashToBytes(prevHash)
+	merkleRoot, err5 := stratumV1MerkleRoot(coinbase1, conn.extraNonce1, make([]byte, conn.extraNonce2Size), coinbase2, branches)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+		glog.Warning("[SV2] mining.notify: wrong params: ", params)
+		return
+	}
+
+	jobID := conn.nextJobID
+	conn.nextJobID++
+	conn.jobs[jobID] = &stratumV2Job{sv1JobID, uint32(version)}
+	conn.jobIDs = append(conn.jobIDs, jobID)
+
+	newPrevHash := cleanJobs || prevHash != conn.lastPrevHash
+	if newPrevHash {
+		// Shares of the old jobs will be rejected by the miner itself
+		for _, id := range conn.jobIDs[:len(conn.jobIDs)-1] {
+			delete(conn.jobs, id)
+		}
+		conn.jobIDs = conn.jobIDs[len(conn.jobIDs)-1:]
+	} else if len(conn.jobIDs) > stratumV2MaxJobs {
+		delete(conn.jobs, conn.jobIDs[0])
+		conn.jobIDs = conn.jobIDs[1:]
+	}
+
+	// A future job (without min_ntime) is activated by the following SetNewPrevHash
+	w := new(sv2Writer)
+	w.u32(stratumV2ChannelID).u32(jobID).optionU32(uint32(nTime), !newPrevHash).u32(uint32(version)).b032(merkleRoot)
+	err = conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgNewMiningJob, w.buf))
+	if err != nil || !newPrevHash {
+		return
+	}
+
+	conn.lastPrevHash = prevHash
+	w = new(sv2Writer)
+	w.u32(stratumV2ChannelID).u32(jobID).u256(prevHashBytes).u32(uint32(nTime)).u32(uint32(nBits))
+	return conn.noiseConn.WriteFrame(NewStratumV2Frame(sv2MsgSetNewPrevHash, w.buf))
+}
+
+//////////////////////////////// Utils ////////////////////////////////
+
+// stratumV2SubmitErrorCode Convert a Stratum V1 error to the error code of SubmitShares.Error
+func stratumV2SubmitErrorCode(v1Err interface{}) string {
+	if errArr, ok := v1Err.([]interface{}); ok && len(errArr) >= 1 {
+		if code, ok := errArr[0].(float64); ok {
+			switch int(code) {
+			case 21:
+				return "stale-share"
+			case 23:
+				return "difficulty-too-low"
+			}
+		}
+	}
+	return "invalid-share"
+}
+
+// stratumV2DifficultyToTarget Convert the pool difficulty to the 256 bits little endian target
+func stratumV2DifficultyToTarget(difficulty float64) []byte {
+	target := new(big.Float).SetInt(stratumV2Diff1Target)
+	target.Quo(target, big.NewFloat(difficulty))
+	targetInt, _ := target.Int(nil)
+
+	bigEndian := targetInt.Bytes()
+	if len(bigEndian) > 32 {
+		bigEndian = bigEndian[len(bigEndian)-32:]
+	}
+	littleEndian := make([]byte, 32)
+	for i, b := range bigEndian {
+		littleEndian[len(bigEndian)-1-i] = b
+	}
+	return littleEndian
+}
+
+// stratumV1PrevHashToBytes Convert the prevhash of mining.notify (byte order of each 4 bytes word reversed) to the block header byte order
+func stratumV1PrevHashToBytes(prevHash string) (hash []byte, err error) {
+	hash, err = hex.DecodeString(prevHash)
+	if err != nil {
+		return
+	}
+	if len(hash) != 32 {
+		err = errors.New("prevhash should be 32 bytes")
+		return
+	}
+	for i := 0; i < 32; i += 4 {
+		hash[i], hash[i+1], hash[i+2], hash[i+3] = hash[i+3], hash[i+2], hash[i+1], hash[i]
+	}
+	return
+}
+
+// stratumV1MerkleRoot Compute the merkle root (block header byte order) of a mining.notify job
+func stratumV1MerkleRoot(coinbase1 string, extraNonce1 []byte, extraNonce2 []byte, coinbase2 string, branches []interface{}) (root []byte, err error) {
+	coinb1, err := hex.DecodeString(coinbase1)
+	if err != nil {
+		return
+	}
+	coinb2, err := hex.DecodeString(coinbase2)
+	if err != nil {
+		return
+	}
+
+	var coinbase []byte
+	coinbase = append(coinbase, coinb1...)
+	coinbase = append(coinbase, extraNonce1...)
+	coinbase = append(coinbase, extraNonce2...)
+	coinbase = append(coinbase, coinb2...)
+	root = sha256d(coinbase)
+
+	for _, branchI := range branches {
+		branchStr, ok := branchI.(string)
+		if !ok {
+			err = errors.New("merkle branch should be a string")
+			return
+		}
+		var branch []byte
+		branch, err = hex.DecodeString(branchStr)
+		if err != nil {
+			return
+		}
+		root = sha256d(append(root, branch...))
+	}
+	return
+}
+
+func sha256d(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
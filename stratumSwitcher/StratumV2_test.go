@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// newTestStratumV2Pair Create a connected pair of (miner side NoiseConn, switcher side StratumV2Conn)
+func newTestStratumV2Pair(t *testing.T) (miner *NoiseConn, switcher *StratumV2Conn) {
+	authorityKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorityPublicKey := authorityKey.PubKey()
+	cert, err := NewNoiseCertificate(authorityKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minerConn, switcherConn := net.Pipe()
+
+	type result struct {
+		conn *NoiseConn
+		err  error
+	}
+	responder := make(chan result, 1)
+	go func() {
+		conn, err := NewNoiseResponderConn(switcherConn, cert)
+		responder <- result{conn, err}
+	}()
+
+	miner, err = NewNoiseInitiatorConn(minerConn, authorityPublicKey)
+	if err != nil {
+		t.Fatal("initiator handshake failed: ", err)
+	}
+	r := <-responder
+	if r.err != nil {
+		t.Fatal("responder handshake failed: ", r.err)
+	}
+
+	switcher = NewStratumV2Conn(switcherConn, r.conn)
+	return
+}
+
+func writeFrameAsync(t *testing.T, conn *NoiseConn, msgType uint8, payload []byte) {
+	go func() {
+		err := conn.WriteFrame(NewStratumV2Frame(msgType, payload))
+		if err != nil {
+			t.Error("WriteFrame failed: ", err)
+		}
+	}()
+}
+
+func readFrameOfType(t *testing.T, conn *NoiseConn, msgType uint8) *StratumV2Frame {
+	frame, err := conn.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame failed: ", err)
+	}
+	if frame.MsgType != msgType {
+		t.Fatalf("message type expected: 0x%02x, got: 0x%02x", msgType, frame.MsgType)
+	}
+	return frame
+}
+
+func TestNoiseFrameRoundTrip(t *testing.T) {
+	miner, switcher := newTestStratumV2Pair(t)
+
+	// larger than one Noise message
+	payload := make([]byte, 70000)
+	rand.Read(payload)
+	writeFrameAsync(t, switcher.noiseConn, sv2MsgSetTarget, payload)
+
+	frame, err := miner.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame failed: ", err)
+	}
+	if frame.ExtensionType != stratumV2ChannelMsgBit || frame.MsgType != sv2MsgSetTarget {
+		t.Errorf("wrong frame header: %x %x", frame.ExtensionType, frame.MsgType)
+	}
+	if !bytes.Equal(frame.Payload, payload) {
+		t.Error("payload mismatched")
+	}
+}
+
+func TestNoiseFrameTooLong(t *testing.T) {
+	miner, switcher := newTestStratumV2Pair(t)
+
+	// The switcher rejects the frame by its header, before reading the payload
+	go miner.WriteFrame(NewStratumV2Frame(sv2MsgSetupConnection, make([]byte, stratumV2MaxMinerPayloadLen+1)))
+	_, err := switcher.noiseConn.ReadFrame()
+	if err != ErrStratumV2FrameTooLong {
+		t.Error("frame longer than the limit of miners accepted: ", err)
+	}
+	miner.Close()
+}
+
+func TestStratumV2ConnTranslation(t *testing.T) {
+	miner, switcher := newTestStratumV2Pair(t)
+
+	// Stratum V1 lines read by the session
+	lines := make(chan []byte, 16)
+	go func() {
+		switcherReader := bufio.NewReader(switcher)
+		for {
+			line, err := switcherReader.ReadBytes('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	readLine := func() []byte {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("read line timeout")
+			return nil
+		}
+	}
+
+	// SetupConnection
+	setup := StratumV2SetupConnection{Protocol: 0, MinVersion: 2, MaxVersion: 2, Vendor: "test", Firmware: "1.0"}
+	writeFrameAsync(t, miner, sv2MsgSetupConnection, setup.Encode())
+	readFrameOfType(t, miner, sv2MsgSetupConnectionSuccess)
+
+	// OpenStandardMiningChannel -> mining.configure, mining.subscribe, mining.authorize
+	open := StratumV2OpenStandardMiningChannel{RequestID: 7, UserIdentity: "user.worker1", MaxTarget: make([]byte, 32)}
+	writeFrameAsync(t, miner, sv2MsgOpenStandardMiningChannel, open.Encode())
+	for _, method := range []string{"mining.configure", "mining.subscribe", "mining.authorize"} {
+		line := readLine()
+		request, err := NewJSONRPCRequest(line)
+		if err != nil || request.Method != method {
+			t.Fatalf("expected %s, got: %s", method, string(line))
+		}
+	}
+
+	// responses and jobs from the session / sserver
+	go func() {
+		switcher.Write([]byte(`{"id":"sv2.subscribe","result":[[["mining.set_difficulty","ff000080"],["mining.notify","ff000080"]],"ff000080",8],"error":null}` + "\n"))
+		switcher.Write([]byte(`{"id":"sv2.authorize","result":true,"error":null}` + "\n"))
+		switcher.Write([]byte(`{"id":null,"method":"mining.set_difficulty","params":[1]}` + "\n{\"id\":null,\"method\":\"mining.notify\",\"params\":"))
+		switcher.Write([]byte(`["j1","4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000","01","02",[],"20000000","1d00ffff","5a5b5c5d",true]}` + "\n"))
+	}()
+
+	frame := readFrameOfType(t, miner, sv2MsgOpenStandardMiningChannelSuccess)
+	r := sv2Reader{buf: frame.Payload}
+	if r.u32() != 7 || r.u32() != stratumV2ChannelID {
+		t.Error("wrong request id or channel id")
+	}
+	if !bytes.Equal(r.u256(), stratumV2DifficultyToTarget(1)) {
+		t.Error("wrong target")
+	}
+
+	// NewMiningJob: channel_id U32, job_id U32, min_ntime OPTION[U32] (none, a future job), version U32,
+	// merkle_root B0_32 (the sha256d of coinb1 + extranonce1 + extranonce2 + coinb2, no branch)
+	frame = readFrameOfType(t, miner, sv2MsgNewMiningJob)
+	expectedJob := "01000000" + "01000000" + "00" + "00000020" +
+		"20" + "48112817bebf9e920141c3073a103b68383750db2f1be762e39ddbd0ecbf0f5c"
+	if hex.EncodeToString(frame.Payload) != expectedJob {
+		t.Error("wrong NewMiningJob: ", hex.EncodeToString(frame.Payload))
+	}
+	jobID := uint32(1)
+
+	frame = readFrameOfType(t, miner, sv2MsgSetNewPrevHash)
+	r = sv2Reader{buf: frame.Payload}
+	r.u32()
+	if r.u32() != jobID {
+		t.Error("SetNewPrevHash should activate the new job")
+	}
+	prevHash := r.u256()
+	if hex.EncodeToString(prevHash) != "f8b6164d19e2f65a2aae448f787fe66d61e57a48c0c6771b1e920b4400000000" {
+		t.Error("wrong prevhash: ", hex.EncodeToString(prevHash))
+	}
+	if r.u32() != 0x5a5b5c5d || r.u32() != 0x1d00ffff {
+		t.Error("wrong ntime or nbits")
+	}
+
+	// SubmitSharesStandard -> mining.submit
+	submit := StratumV2SubmitSharesStandard{stratumV2ChannelID, 3, jobID, 0x11223344, 0x5a5b5c5e, 0x20002000}
+	writeFrameAsync(t, miner, sv2MsgSubmitSharesStandard, submit.Encode())
+	line := readLine()
+	expected := `{"id":3,"method":"mining.submit","params":["user.worker1","j1","0000000000000000","5a5b5c5e","11223344","20002000"]}`
+	if strings.TrimSpace(string(line)) != expected {
+		t.Errorf("expected: %s, got: %s", expected, string(line))
+	}
+
+	go switcher.Write([]byte(`{"id":3,"result":true,"error":null}` + "\n"))
+	frame = readFrameOfType(t, miner, sv2MsgSubmitSharesSuccess)
+	r = sv2Reader{buf: frame.Payload}
+	if r.u32() != stratumV2ChannelID || r.u32() != 3 {
+		t.Error("wrong SubmitShares.Success")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Jobs remembered per session for the unknown job check
+const maxRecentJobs = 64
+
+// Maximum submits remembered per session for the duplicate check
+const maxRecentSubmits = 4096
+
+// SubmitFilterConfig Drop the invalid submits of a currency before they reach the sserver, only in the line-aware proxy mode
+type SubmitFilterConfig struct {
+	// Drop the submits with malformed params
+	DropMalformed bool
+	// Drop the submits of jobs never sent to the miner since the last clean job
+	DropUnknownJob bool
+	// Drop the exact duplicates of the submits in the last seconds, 0 to disable
+	DuplicateWindowSeconds int
+}
+
+// submitFilterState The jobs sent to a session and the submits of the session
+type submitFilterState struct {
+	lock sync.Mutex
+	// The job ids sent since the last clean job, at most maxRecentJobs
+	jobIDs []string
+	// A clean job has been sent since the session (re)connected, the older jobs are invalid
+	cleanJobSeen bool
+	// Time of the recent submits by their params
+	submits map[string]time.Time
+}
+
+// reset Forget the jobs and submits, the server connected after a switch does not know them
+func (state *submitFilterState) reset() {
+	state.lock.Lock()
+	state.jobIDs = nil
+	state.cleanJobSeen = false
+	state.submits = nil
+	state.lock.Unlock()
+}
+
+// addJob Record a job sent to the miner
+func (state *submitFilterState) addJob(jobID string, cleanJobs bool) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	if cleanJobs {
+		state.jobIDs = state.jobIDs[:0]
+		state.cleanJobSeen = true
+	}
+	if len(state.jobIDs) >= maxRecentJobs {
+		state.jobIDs = state.jobIDs[1:]
+	}
+	state.jobIDs = append(state.jobIDs, jobID)
+}
+
+// isUnknownJob Whether the job has not been sent to the miner.
+// Before the first clean job the jobs sent before the (re)connection may still be valid, so no job is unknown.
+func (state *submitFilterState) isUnknownJob(jobID string) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	if !state.cleanJobSeen {
+		return false
+	}
+	for _, id := range state.jobIDs {
+		if id == jobID {
+			return false
+		}
+	}
+	return true
+}
+
+// isDuplicate Record the submit and check whether it has been submitted in the window
+func (state *submitFilterState) isDuplicate(key string, window time.Duration, now time.Time) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	if submitTime, ok := state.submits[key]; ok && now.Sub(submitTime) < window {
+		return true
+	}
+
+	if state.submits == nil {
+		state.submits = make(map[string]time.Time)
+	}
+	if len(state.submits) >= maxRecentSubmits {
+		for k, submitTime := range state.submits {
+			if now.Sub(submitTime) >= window {
+				delete(state.submits, k)
+			}
+		}
+		if len(state.submits) >= maxRecentSubmits {
+			state.submits = make(map[string]time.Time)
+		}
+	}
+	state.submits[key] = now
+	return false
+}
+
+// hasJobIDs Whether the protocol of the session identifies the jobs in mining.notify and mining.submit
+func (session *StratumSession) hasJobIDs() bool {
+	return session.protocolType == ProtocolBitcoinStratum || session.protocolType == ProtocolEthereumStratumNiceHash
+}
+
+// recordJob Record the job of a mining.notify sent to the miner
+func (session *StratumSession) recordJob(notify *JSONRPCRequest) {
+	if notify.Method != "mining.notify" || len(notify.Params) < 2 || !session.hasJobIDs() {
+		return
+	}
+	jobID, ok := notify.Params[0].(string)
+	if !ok {
+		return
+	}
+	// clean_jobs is the last param of the job
+	cleanJobs, _ := notify.Params[len(notify.Params)-1].(bool)
+	session.submitFilter.addJob(jobID, cleanJobs)
+}
+
+// isHexString Whether the string is hex of an even length, with at most maxLen chars if maxLen > 0
+func isHexString(value interface{}, maxLen int) bool {
+	str, ok := value.(string)
+	if !ok || len(str) == 0 || (maxLen > 0 && len(str) > maxLen) {
+		return false
+	}
+	_, err := hex.DecodeString(str)
+	return err == nil
+}
+
+// isMalformedSubmit Check the params of a submit
+func (session *StratumSession) isMalformedSubmit(request *JSONRPCRequest) bool {
+	params := request.Params
+
+	if session.protocolType == ProtocolBitcoinStratum {
+		// ["worker", "job id", "extranonce2", "ntime", "nonce"(, "version bits")]
+		if len(params) < 5 || len(params) > 6 {
+			return true
+		}
+		for _, param := range params[:2] {
+			if _, ok := param.(string); !ok {
+				return true
+			}
+		}
+		if !isHexString(params[2], 0) || !isHexString(params[3], 8) || !isHexString(params[4], 8) {
+			return true
+		}
+		return len(params) == 6 && !isHexString(params[5], 8)
+	}
+
+	// Ethereum: ["worker", "job id", "nonce"], ["worker", "nonce", "header", "mix"] or ["nonce", "header", "mix"]
+	if len(params) < 3 {
+		return true
+	}
+	for _, param := range params {
+		if _, ok := param.(string); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSubmit The hook of the messages from the miner dropping the invalid submits configured in SubmitFilter
+func filterSubmit(session *StratumSession, message *StratumMessage) {
+	if !message.IsSubmit() {
+		return
+	}
+	coin := session.getMiningCoin()
+	serverInfo, ok := session.manager.getStratumServerInfo(coin)
+	if !ok {
+		return
+	}
+	conf := serverInfo.SubmitFilter
+	request := message.Request
+
+	var stratumErr *StratumError
+	var reason string
+	if conf.DropMalformed && session.isMalformedSubmit(request) {
+		stratumErr, reason = StratumErrIllegalParams, "malformed"
+	} else if conf.DropUnknownJob && session.hasJobIDs() && len(request.Params) >= 2 &&
+		session.submitFilter.isUnknownJob(toString(request.Params[1])) {
+		stratumErr, reason = StratumErrJobNotFound, "unknown_job"
+	} else if conf.DuplicateWindowSeconds > 0 {
+		key, _ := json.Marshal(request.Params)
+		window := time.Duration(conf.DuplicateWindowSeconds) * time.Second
+		if session.submitFilter.isDuplicate(string(key), window, time.Now()) {
+			stratumErr, reason = StratumErrDuplicateShare, "duplicate"
+		}
+	}
+	if stratumErr == nil {
+		return
+	}
+
+	if glog.V(3) {
+		glog.Info("Submit Filtered: ", reason, "; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", coin, "; ", string(message.Line))
+	}
+	session.manager.metrics.filteredSubmits.Inc(coin, reason)
+	if stratumErr == StratumErrJobNotFound {
+		session.countShare("stale", 0)
+	} else {
+		session.countShare("rejected", 0)
+	}
+	message.Reply = &JSONRPCResponse{Result: nil, Error: stratumErr.ToJSONRPCArray(session.manager.serverID)}
+}
+
+// recordJobHook The hook of the messages from the server recording the jobs for the unknown job check
+func recordJobHook(session *StratumSession, message *StratumMessage) {
+	if message.Request != nil {
+		session.recordJob(message.Request)
+	}
+}
+
+// toString The string param, empty if it is not a string
+func toString(value interface{}) string {
+	str, _ := value.(string)
+	return str
+}
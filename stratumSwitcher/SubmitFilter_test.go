@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterSubmit(t *testing.T) {
+	manager := &StratumSessionManager{
+		metrics: NewSwitcherMetrics(),
+		stratumServerInfoMap: StratumServerInfoMap{
+			"btc": {URL: "127.0.0.1:3333", SubmitFilter: SubmitFilterConfig{true, true, 60}},
+			"bcc": {URL: "127.0.0.1:3334"},
+		},
+	}
+	session := &StratumSession{manager: manager, protocolType: ProtocolBitcoinStratum, miningCoin: "btc"}
+
+	send := func(line string) *StratumMessage {
+		message := NewStratumMessage([]byte(line))
+		filterSubmit(session, message)
+		return message
+	}
+	notify := func(line string) {
+		recordJobHook(session, NewStratumMessage([]byte(line)))
+	}
+	expectError := func(message *StratumMessage, stratumErr *StratumError) {
+		t.Helper()
+		if stratumErr == nil {
+			if message.Reply != nil {
+				t.Error("submit filtered: ", string(message.Line), message.Reply.Error)
+			}
+			return
+		}
+		if message.Reply == nil {
+			t.Error("submit not filtered: ", string(message.Line))
+			return
+		}
+		if message.Reply.Error.(JSONRPCArray)[0] != stratumErr.ErrNo {
+			t.Error("error of ", string(message.Line), ": ", message.Reply.Error)
+		}
+	}
+
+	// No job is unknown before the first clean job
+	expectError(send(`{"id":1,"method":"mining.submit","params":["a.b","0","0000000000000000","5f5e1000","00000001"]}`), nil)
+
+	notify(`{"id":null,"method":"mining.notify","params":["1","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",true]}`)
+	notify(`{"id":null,"method":"mining.notify","params":["2","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",false]}`)
+
+	expectError(send(`{"id":2,"method":"mining.submit","params":["a.b","1","0000000000000000","5f5e1000","00000001"]}`), nil)
+	expectError(send(`{"id":3,"method":"mining.submit","params":["a.b","2","0000000000000000","5f5e1000","00000001","1fffe000"]}`), nil)
+	expectError(send(`{"id":4,"method":"mining.submit","params":["a.b","0","0000000000000000","5f5e1000","00000002"]}`), StratumErrJobNotFound)
+	expectError(send(`{"id":5,"method":"mining.submit","params":["a.b","1","0000000000000000","5f5e1000","00000001"]}`), StratumErrDuplicateShare)
+	expectError(send(`{"id":6,"method":"mining.submit","params":["a.b","1","0000000000000000","5f5e1000"]}`), StratumErrIllegalParams)
+	expectError(send(`{"id":7,"method":"mining.submit","params":["a.b","1","0000000000000000","5f5e1000","nonce!!!"]}`), StratumErrIllegalParams)
+	expectError(send(`{"id":8,"method":"mining.submit","params":["a.b","1",1,"5f5e1000","00000001"]}`), StratumErrIllegalParams)
+
+	// The old jobs are invalid after a clean job
+	notify(`{"id":null,"method":"mining.notify","params":["3","prev","c1","c2",[],"20000000","1d00ffff","5f5e1000",true]}`)
+	expectError(send(`{"id":9,"method":"mining.submit","params":["a.b","2","0000000000000000","5f5e1000","00000003"]}`), StratumErrJobNotFound)
+
+	shares := session.shares.Get(time.Now())
+	if shares.Stale != 2 || shares.Rejected != 4 {
+		t.Error("shares: ", shares)
+	}
+
+	// Not filtered without the config of the currency
+	session.miningCoin = "bcc"
+	expectError(send(`{"id":10,"method":"mining.submit","params":["a.b"]}`), nil)
+}
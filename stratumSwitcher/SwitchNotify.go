@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// SwitchNotifyMessage The result of a coin switch of a session published to Kafka.
+// The fields of KafkaMessage of chainSwitcher are kept, a switch of one connection is reported as
+// {"type":"switcher_response","action":"switch_chain","switched_users":1,"switched_connections":1,...}
+type SwitchNotifyMessage struct {
+	ID                  interface{}      `json:"id"`
+	Type                string           `json:"type"`
+	Action              string           `json:"action"`
+	CreatedAt           string           `json:"created_at"`
+	NewChainName        string           `json:"new_chain_name"`
+	OldChainName        string           `json:"old_chain_name"`
+	Result              bool             `json:"result"`
+	ServerID            int              `json:"server_id"`
+	SwitchedConnections int              `json:"switched_connections"`
+	SwitchedUsers       int              `json:"switched_users"`
+	Host                SwitchNotifyHost `json:"host"`
+
+	// The sub-account, the worker and the session switched
+	UserName   string `json:"user"`
+	WorkerName string `json:"worker"`
+	SessionID  string `json:"session_id"`
+	// Time from the switch command to the session mining the new coin (or the failure)
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// SwitchNotifyHost The host of the switcher, same as the host of the sserver messages
+type SwitchNotifyHost struct {
+	Hostname string              `json:"hostname"`
+	IP       map[string][]string `json:"ip"`
+}
+
+// SwitchNotifier Publishes the results of the coin switches to Kafka in the background
+type SwitchNotifier struct {
+	host    SwitchNotifyHost
+	queue   chan<- []byte
+	dropped *MetricCounterVec
+}
+
+// NewSwitchNotifier Create a SwitchNotifier, the messages dropped because Kafka is too slow are counted in dropped
+func NewSwitchNotifier(conf SwitchNotifyConfig, dropped *MetricCounterVec) (notifier *SwitchNotifier, err error) {
+	producer, err := newKafkaProducer(conf.KafkaBrokers, conf.KafkaTopic)
+	if err != nil {
+		return
+	}
+
+	notifier = new(SwitchNotifier)
+	notifier.host = getSwitchNotifyHost()
+	notifier.queue = startEventWriter("switch notify kafka", kafkaEventSink{producer})
+	notifier.dropped = dropped
+	return
+}
+
+// getSwitchNotifyHost The hostname and the IPs of each network interface
+func getSwitchNotifyHost() (host SwitchNotifyHost) {
+	host.Hostname, _ = os.Hostname()
+	host.IP = make(map[string][]string)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		glog.Warning("Get network interfaces failed: ", err)
+		return
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				host.IP[iface.Name] = append(host.IP[iface.Name], ipNet.IP.String())
+			}
+		}
+	}
+	return
+}
+
+// Publish Publish the message, the common fields are set
+func (notifier *SwitchNotifier) Publish(message *SwitchNotifyMessage) {
+	message.Type = "switcher_response"
+	message.Action = "switch_chain"
+	message.CreatedAt = time.Now().UTC().Format("2006-01-02 15:04:05")
+	message.SwitchedConnections = 1
+	message.SwitchedUsers = 1
+	message.Host = notifier.host
+
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		glog.Error("Encode switch notify message failed: ", err)
+		return
+	}
+
+	select {
+	case notifier.queue <- messageJSON:
+	default:
+		notifier.dropped.Inc()
+	}
+}
+
+// notifySwitch Publish the result of a coin switch of the session if SwitchNotify is enabled.
+// The session lock may be held by the caller, the fields are read without it.
+func (session *StratumSession) notifySwitch(oldCoin string, success bool, latency time.Duration) {
+	manager := session.manager
+	if manager == nil || manager.switchNotifier == nil {
+		return
+	}
+
+	manager.switchNotifier.Publish(&SwitchNotifyMessage{
+		NewChainName: session.miningCoin,
+		OldChainName: oldCoin,
+		Result:       success,
+		ServerID:     int(manager.serverID),
+		UserName:     session.subaccountName,
+		WorkerName:   session.fullWorkerName,
+		SessionID:    session.sessionIDString,
+		LatencyMs:    durationMs(latency),
+	})
+}
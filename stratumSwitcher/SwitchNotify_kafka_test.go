@@ -0,0 +1,14 @@
+//go:build kafka
+// +build kafka
+
+package main
+
+import "testing"
+
+func TestNewSwitchNotifierKafka(t *testing.T) {
+	conf := SwitchNotifyConfig{Enable: true, KafkaBrokers: []string{"127.0.0.1:9092"}, KafkaTopic: "BtcManProcessor"}
+	notifier, err := NewSwitchNotifier(conf, NewMetricCounterVec("switch_notifications_dropped_total", ""))
+	if err != nil || notifier == nil {
+		t.Fatal("create notifier: ", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNotifySwitch(t *testing.T) {
+	recorder := &auditEventRecorder{make(chan []byte, 10)}
+	notifier := &SwitchNotifier{
+		host:    SwitchNotifyHost{"switcher-1", map[string][]string{"eth0": {"10.0.0.5"}}},
+		queue:   startEventWriter("test", recorder),
+		dropped: NewMetricCounterVec("switch_notifications_dropped_total", ""),
+	}
+	session := &StratumSession{
+		manager:         &StratumSessionManager{serverID: 3, switchNotifier: notifier},
+		sessionIDString: "0300003f",
+		fullWorkerName:  "user.worker",
+		subaccountName:  "user",
+		miningCoin:      "bcc",
+	}
+
+	session.notifySwitch("btc", true, 1500*time.Millisecond)
+
+	var line []byte
+	select {
+	case line = <-recorder.events:
+	case <-time.After(time.Second):
+		t.Fatal("message not published")
+	}
+
+	// The fields of KafkaMessage in chainSwitcher
+	var message struct {
+		ID                  interface{} `json:"id"`
+		Type                string      `json:"type"`
+		Action              string      `json:"action"`
+		CreatedAt           string      `json:"created_at"`
+		NewChainName        string      `json:"new_chain_name"`
+		OldChainName        string      `json:"old_chain_name"`
+		Result              bool        `json:"result"`
+		ServerID            int         `json:"server_id"`
+		SwitchedConnections int         `json:"switched_connections"`
+		SwitchedUsers       int         `json:"switched_users"`
+		Host                struct {
+			Hostname string              `json:"hostname"`
+			IP       map[string][]string `json:"ip"`
+		} `json:"host"`
+		UserName  string `json:"user"`
+		LatencyMs int64  `json:"latency_ms"`
+	}
+	err := json.Unmarshal(line, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Type != "switcher_response" || message.Action != "switch_chain" || message.ID != nil {
+		t.Error("unexpected type: ", string(line))
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05", message.CreatedAt); err != nil {
+		t.Error("unexpected created_at: ", message.CreatedAt)
+	}
+	if message.OldChainName != "btc" || message.NewChainName != "bcc" || !message.Result || message.ServerID != 3 ||
+		message.SwitchedConnections != 1 || message.SwitchedUsers != 1 || message.UserName != "user" || message.LatencyMs != 1500 {
+		t.Error("unexpected message: ", string(line))
+	}
+	if message.Host.Hostname != "switcher-1" || len(message.Host.IP["eth0"]) != 1 {
+		t.Error("unexpected host: ", string(line))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default switches per second to each upstream sserver
+const defaultSwitchRatePerUpstream = 100
+
+// Default maximum random delay of a switch
+const defaultSwitchJitterMilliseconds = 1000
+
+// SwitchPacer Queues the coin switches per upstream sserver and gives each one its turn
+type SwitchPacer struct {
+	interval time.Duration
+	jitter   time.Duration
+
+	lock sync.Mutex
+	// Time of the next free slot of each upstream
+	nextSlots map[string]time.Time
+	// Sessions waiting for their turn on each upstream
+	queueDepths map[string]int
+}
+
+// NewSwitchPacer Create a SwitchPacer, zero values of the config are replaced with the defaults
+func NewSwitchPacer(conf SwitchPacingConfig) (pacer *SwitchPacer) {
+	if conf.RatePerUpstream <= 0 {
+		conf.RatePerUpstream = defaultSwitchRatePerUpstream
+	}
+	if conf.JitterMilliseconds <= 0 {
+		conf.JitterMilliseconds = defaultSwitchJitterMilliseconds
+	}
+
+	pacer = new(SwitchPacer)
+	pacer.interval = time.Duration(float64(time.Second) / conf.RatePerUpstream)
+	pacer.jitter = time.Duration(conf.JitterMilliseconds) * time.Millisecond
+	pacer.nextSlots = make(map[string]time.Time)
+	pacer.queueDepths = make(map[string]int)
+	return
+}
+
+// Enqueue Take the next slot of the upstream and return the delay before the switch.
+// Dequeue must be called when the switch is done or cancelled.
+func (pacer *SwitchPacer) Enqueue(upstream string) time.Duration {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	now := time.Now()
+	slot := pacer.nextSlots[upstream]
+	if slot.Before(now) {
+		slot = now
+	}
+	pacer.nextSlots[upstream] = slot.Add(pacer.interval)
+	pacer.queueDepths[upstream]++
+
+	return slot.Sub(now) + time.Duration(rand.Int63n(int64(pacer.jitter)))
+}
+
+// Dequeue Remove a session from the queue of the upstream
+func (pacer *SwitchPacer) Dequeue(upstream string) {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	pacer.queueDepths[upstream]--
+	if pacer.queueDepths[upstream] > 0 {
+		return
+	}
+	delete(pacer.queueDepths, upstream)
+	if pacer.nextSlots[upstream].Before(time.Now()) {
+		delete(pacer.nextSlots, upstream)
+	}
+}
+
+// QueueDepths Sessions waiting for their turn on each upstream
+func (pacer *SwitchPacer) QueueDepths() map[string]int {
+	pacer.lock.Lock()
+	defer pacer.lock.Unlock()
+
+	depths := make(map[string]int, len(pacer.queueDepths))
+	for upstream, depth := range pacer.queueDepths {
+		depths[upstream] = depth
+	}
+	return depths
+}
+
+// getSwitchUpstream The upstream the session will connect to after switching to the currency
+func (manager *StratumSessionManager) getSwitchUpstream(coin string, sessionID uint32) string {
+	pool, ok := manager.getUpstreamPool(coin)
+	if ok {
+		if urls := pool.Candidates(sessionID); len(urls) > 0 {
+			return urls[0]
+		}
+	}
+	return coin
+}
+
+// switchQueueHandle Show the sessions waiting for their turn to switch on each upstream
+func (manager *StratumSessionManager) switchQueueHandle(w http.ResponseWriter, req *http.Request) {
+	depths := make(map[string]int)
+	if manager.switchPacer != nil {
+		depths = manager.switchPacer.QueueDepths()
+	}
+
+	depthsJSON, _ := json.Marshal(depths)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(depthsJSON)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+)
+
+func TestSwitchPacer(t *testing.T) {
+	pacer := NewSwitchPacer(SwitchPacingConfig{Enable: true, RatePerUpstream: 10, JitterMilliseconds: 1})
+
+	// 10 switches per second: the turns of one upstream are 100ms apart
+	for i := 0; i < 5; i++ {
+		delay := pacer.Enqueue("10.0.0.1:3333")
+		expected := time.Duration(i) * 100 * time.Millisecond
+		if delay < expected-10*time.Millisecond || delay > expected+10*time.Millisecond {
+			t.Error("delay of switch ", i, ": ", delay)
+		}
+	}
+	// Other upstreams have their own queue
+	if delay := pacer.Enqueue("10.0.0.2:3333"); delay > 10*time.Millisecond {
+		t.Error("delay on another upstream: ", delay)
+	}
+
+	depths := pacer.QueueDepths()
+	if depths["10.0.0.1:3333"] != 5 || depths["10.0.0.2:3333"] != 1 {
+		t.Error("queue depths: ", depths)
+	}
+
+	pacer.Dequeue("10.0.0.2:3333")
+	for i := 0; i < 5; i++ {
+		pacer.Dequeue("10.0.0.1:3333")
+	}
+	if depths = pacer.QueueDepths(); len(depths) != 0 {
+		t.Error("queue depths after dequeue: ", depths)
+	}
+}
+
+// newTestPacedSession A session mining btc of the sub-account alice, watching the currency in zookeeper.
+// The switches to bch wait 500ms for their turn on the upstream sserver of bch.
+func newTestPacedSession(t *testing.T) (session *StratumSession, backend *coordination.MemoryBackend, bchURL string) {
+	bchURL, _ = startTestSServer(t, false, true)
+	backend = coordination.NewMemoryBackend()
+	coordination.CreatePath(backend, "/switcher/alice")
+	backend.Set("/switcher/alice", []byte("btc"), -1)
+
+	sessionIDManager, _ := NewSessionIDManager(1, 16)
+	manager := &StratumSessionManager{
+		sessions:             make(StratumSessionMap),
+		sessionCounts:        make(map[sessionMetricKey]int),
+		sessionIDManager:     sessionIDManager,
+		metrics:              NewSwitcherMetrics(),
+		zookeeperManager:     newZookeeperManagerWithBackend(backend),
+		stratumServerInfoMap: StratumServerInfoMap{"btc": StratumServerInfo{}, "bch": StratumServerInfo{}},
+		upstreamPools: map[string]*UpstreamPool{
+			"btc": NewUpstreamPool("btc", []StratumUpstreamInfo{{URL: "127.0.0.1:1"}}),
+			"bch": NewUpstreamPool("bch", []StratumUpstreamInfo{{URL: bchURL}}),
+		},
+		switchPacer: NewSwitchPacer(SwitchPacingConfig{Enable: true, RatePerUpstream: 2, JitterMilliseconds: 1}),
+	}
+	// Another session took the current slot
+	manager.switchPacer.Enqueue(bchURL)
+	manager.switchPacer.Dequeue(bchURL)
+
+	clientConn, minerConn := net.Pipe()
+	serverConn, sserverConn := net.Pipe()
+	go io.Copy(ioutil.Discard, minerConn)
+	go io.Copy(ioutil.Discard, sserverConn)
+	t.Cleanup(func() {
+		minerConn.Close()
+		sserverConn.Close()
+	})
+
+	session = &StratumSession{
+		manager:                 manager,
+		protocolType:            ProtocolBitcoinStratum,
+		runningStat:             StatRunning,
+		sessionID:               0x0001003f,
+		sessionIDString:         "0001003f",
+		clientIPPort:            "192.168.0.1:51234",
+		clientConn:              clientConn,
+		serverConn:              serverConn,
+		miningCoin:              "btc",
+		fullWorkerName:          "alice.worker",
+		subaccountName:          "alice",
+		zkWatchPath:             "/switcher/alice",
+		zkAccountMiningCoin:     "btc",
+		zkMiningCoin:            "btc",
+		stratumSubscribeRequest: &JSONRPCRequest{1, "mining.subscribe", JSONRPCArray{"cgminer/4.10.0"}, ""},
+		stratumAuthorizeRequest: &JSONRPCRequest{2, "mining.authorize", JSONRPCArray{"alice.worker", "x"}, ""},
+	}
+	_, session.zkWatchEvent, _ = manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+	manager.RegisterStratumSession(session)
+	return
+}
+
+func TestSwitchPacerCoinWatcher(t *testing.T) {
+	// The session keeps its currency until its turn
+	session, backend, bchURL := newTestPacedSession(t)
+	pacer := session.manager.switchPacer
+	go session.watchMiningCoin()
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+
+	time.Sleep(200 * time.Millisecond)
+	if coin := session.getMiningCoin(); coin != "btc" {
+		t.Error("switched before the turn: ", coin)
+	}
+	if depth := pacer.QueueDepths()[bchURL]; depth != 1 {
+		t.Error("queue depth before the turn: ", depth)
+	}
+	for i := 0; session.getMiningCoin() != "bch"; i++ {
+		if i > 100 {
+			t.Fatal("not switched at the turn")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depths := pacer.QueueDepths(); len(depths) != 0 {
+		t.Error("queue depths after the switch: ", depths)
+	}
+	session.Stop()
+
+	// Switching back cancels the turn
+	session, backend, bchURL = newTestPacedSession(t)
+	pacer = session.manager.switchPacer
+	go session.watchMiningCoin()
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+	time.Sleep(100 * time.Millisecond)
+	backend.Set("/switcher/alice", []byte("btc"), -1)
+
+	time.Sleep(100 * time.Millisecond)
+	if depths := pacer.QueueDepths(); len(depths) != 0 {
+		t.Error("queue depths after switching back: ", depths)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if coin := session.getMiningCoin(); coin != "btc" {
+		t.Error("switched after switching back: ", coin)
+	}
+	session.Stop()
+
+	// The session stops while waiting for its turn
+	session, backend, bchURL = newTestPacedSession(t)
+	pacer = session.manager.switchPacer
+	go session.watchMiningCoin()
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+	time.Sleep(100 * time.Millisecond)
+	if depth := pacer.QueueDepths()[bchURL]; depth != 1 {
+		t.Error("queue depth before the stop: ", depth)
+	}
+	session.Stop()
+
+	// Past the turn
+	time.Sleep(600 * time.Millisecond)
+	if depths := pacer.QueueDepths(); len(depths) != 0 {
+		t.Error("queue depths after the stop: ", depths)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TLS handshake timeout
+const tlsHandshakeTimeoutSeconds = 15
+
+// TLSCertificateReloader Holds the certificates of the TLS listener, they can be reloaded at runtime (SIGHUP)
+type TLSCertificateReloader struct {
+	conf TLSConfig
+
+	lock      sync.RWMutex
+	tlsConfig *tls.Config
+}
+
+// NewTLSCertificateReloader Create a TLSCertificateReloader and load the certificates
+func NewTLSCertificateReloader(conf TLSConfig) (reloader *TLSCertificateReloader, err error) {
+	reloader = new(TLSCertificateReloader)
+	reloader.conf = conf
+	err = reloader.Reload()
+	return
+}
+
+// Reload Reload the certificate, the key and the client CA from files.
+// The running configuration is kept if any of them cannot be loaded.
+// New connections use the new certificates, established sessions are not affected.
+func (reloader *TLSCertificateReloader) Reload() (err error) {
+	cert, err := tls.LoadX509KeyPair(reloader.conf.CertFile, reloader.conf.KeyFile)
+	if err != nil {
+		return
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if reloader.conf.ClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(reloader.conf.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return ErrTLSClientCAEmpty
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	reloader.lock.Lock()
+	reloader.tlsConfig = tlsConfig
+	reloader.lock.Unlock()
+	return
+}
+
+// getConfigForClient Returns the current configuration for each handshake
+func (reloader *TLSCertificateReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.tlsConfig, nil
+}
+
+// ServerConfig The tls.Config used by the listener, it always uses the last loaded certificates
+func (reloader *TLSCertificateReloader) ServerConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: reloader.getConfigForClient}
+}
+
+// NewTLSServerConn Perform the TLS handshake of an accepted connection
+func NewTLSServerConn(conn net.Conn, tlsConfig *tls.Config) (tlsConn *tls.Conn, err error) {
+	tlsConn = tls.Server(conn, tlsConfig)
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeoutSeconds * time.Second))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if glog.V(3) {
+		state := tlsConn.ConnectionState()
+		glog.Info("TLS handshake success: ", conn.RemoteAddr(), ", version: ", tls.VersionName(state.Version),
+			", cipher suite: ", tls.CipherSuiteName(state.CipherSuite))
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate Write a self-signed certificate and its key to certFile and keyFile
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// handshakeCommonName Do a TLS handshake with the reloader and returns the common name of the server certificate
+func handshakeCommonName(t *testing.T, reloader *TLSCertificateReloader) string {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go NewTLSServerConn(serverConn, reloader.ServerConfig())
+
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+	err := client.Handshake()
+	if err != nil {
+		t.Fatal("handshake failed: ", err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stratumSwitcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var conf TLSConfig
+	conf.CertFile = filepath.Join(dir, "cert.pem")
+	conf.KeyFile = filepath.Join(dir, "key.pem")
+
+	writeTestCertificate(t, conf.CertFile, conf.KeyFile, "old")
+	reloader, err := NewTLSCertificateReloader(conf)
+	if err != nil {
+		t.Fatal("load certificate failed: ", err)
+	}
+	if name := handshakeCommonName(t, reloader); name != "old" {
+		t.Error("wrong certificate: ", name)
+	}
+
+	writeTestCertificate(t, conf.CertFile, conf.KeyFile, "new")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal("reload certificate failed: ", err)
+	}
+	if name := handshakeCommonName(t, reloader); name != "new" {
+		t.Error("certificate not reloaded: ", name)
+	}
+
+	// a broken file keeps the running certificate
+	ioutil.WriteFile(conf.KeyFile, []byte("broken"), 0600)
+	if err := reloader.Reload(); err == nil {
+		t.Error("reload of a broken key should fail")
+	}
+	if name := handshakeCommonName(t, reloader); name != "new" {
+		t.Error("certificate changed by a failed reload: ", name)
+	}
+}
@@ -30,16 +30,29 @@ func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
 	runtimeData.Action = "upgrade"
 	runtimeData.ServerID = upgradable.sessionManager.serverID
 
+	// Sessions that cannot be passed to the new process (TLS, Stratum V2)
+	var drainSessions []*StratumSession
+
 	upgradable.sessionManager.lock.Lock()
 	err = func() error {
 		for _, session := range upgradable.sessionManager.sessions {
+			if !session.isResumable() {
+				drainSessions = append(drainSessions, session)
+				continue
+			}
+
 			var sessionData StratumSessionData
 
 			sessionData.SessionID = session.sessionID
 			sessionData.MiningCoin = session.miningCoin
+			sessionData.ClientIPPort = session.clientIPPort
+			sessionData.StartTime = session.startTime.Unix()
+			sessionData.ServerURL = session.serverURL
 			sessionData.StratumSubscribeRequest = session.stratumSubscribeRequest
 			sessionData.StratumAuthorizeRequest = session.stratumAuthorizeRequest
 			sessionData.VersionMask = session.versionMask
+			sessionData.ExtranonceSubscribed = session.extranonceSubscribed
+			sessionData.Difficulty = session.getDifficulty()
 
 			sessionData.ClientConnFD, err = getConnFd(session.clientConn)
 			if err != nil {
@@ -76,7 +89,15 @@ func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
 		return
 	}
 
-	upgradable.sessionManager.zookeeperManager.zookeeperConn.Close()
+	// The encryption state cannot be passed to the new process, close these sessions cleanly
+	// (TLS close_notify is sent to the miner) instead of dropping them at exec, the miners will reconnect.
+	for _, session := range drainSessions {
+		glog.Info("Upgrading: close session ", session.clientIPPort, "; ", session.fullWorkerName)
+		session.setStopReason("upgrade")
+		session.Stop()
+	}
+
+	upgradable.sessionManager.zookeeperManager.backend.Close()
 
 	var args []string
 	for _, arg := range os.Args[1:] {
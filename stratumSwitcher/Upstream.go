@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Timeout of connecting to an upstream sserver
+const upstreamDialTimeout = 5 * time.Second
+
+// Interval of the health check of upstream sservers
+const upstreamHealthCheckIntervalSeconds = 10
+
+// Consecutive failures before an upstream is marked unhealthy
+const upstreamMaxFailures = 3
+
+// StratumUpstreamInfo An upstream sserver of a coin
+type StratumUpstreamInfo struct {
+	URL string
+	// Lower value is preferred. Upstreams with the same priority share the sessions by weight.
+	Priority int
+	// Relative weight among the upstreams with the same priority, default 1
+	Weight int
+}
+
+// UpstreamStatus Health of an upstream sserver
+type UpstreamStatus struct {
+	URL       string `json:"url"`
+	Priority  int    `json:"priority"`
+	Weight    int    `json:"weight"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error"`
+	// Result of the last health check
+	LatencyMs     int64 `json:"latency_ms"`
+	LastCheckTime int64 `json:"last_check_time"`
+}
+
+// upstreamCheckFunc Checks an upstream of the coin, returns the latency
+type upstreamCheckFunc func(coin string, url string) (time.Duration, error)
+
+// UpstreamPool The ordered upstream sservers of a coin.
+// Sessions connect to the healthy upstream with the highest priority. They do not move back
+// when a preferred upstream recovers, but pick it again on their next reconnection.
+type UpstreamPool struct {
+	coin string
+
+	lock sync.RWMutex
+	// Sorted by priority
+	upstreams []*UpstreamStatus
+
+	// Closed when the pool is replaced by a configuration reload
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewUpstreamPool Create the upstream pool of a coin, all upstreams are healthy at the beginning
+func NewUpstreamPool(coin string, infos []StratumUpstreamInfo) (pool *UpstreamPool) {
+	pool = new(UpstreamPool)
+	pool.coin = coin
+	pool.stop = make(chan struct{})
+	for _, info := range infos {
+		weight := info.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.upstreams = append(pool.upstreams, &UpstreamStatus{
+			URL:      info.URL,
+			Priority: info.Priority,
+			Weight:   weight,
+			Healthy:  true,
+		})
+	}
+	sort.SliceStable(pool.upstreams, func(i, j int) bool {
+		return pool.upstreams[i].Priority < pool.upstreams[j].Priority
+	})
+	return
+}
+
+// Candidates Get the URLs in the order the session should try them: the healthy upstreams by priority,
+// then the unhealthy ones as a last resort. Among the healthy upstreams with the same priority,
+// the first one is chosen by weight with the session id, so the sessions are spread deterministically.
+func (pool *UpstreamPool) Candidates(sessionID uint32) (urls []string) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	var unhealthy []string
+	for begin := 0; begin < len(pool.upstreams); {
+		end := begin
+		totalWeight := 0
+		var group []*UpstreamStatus
+		for ; end < len(pool.upstreams) && pool.upstreams[end].Priority == pool.upstreams[begin].Priority; end++ {
+			upstream := pool.upstreams[end]
+			if upstream.Healthy {
+				group = append(group, upstream)
+				totalWeight += upstream.Weight
+			} else {
+				unhealthy = append(unhealthy, upstream.URL)
+			}
+		}
+		begin = end
+
+		if len(group) == 0 {
+			continue
+		}
+
+		// Rotate the group so that it starts from the upstream chosen by weight
+		first := 0
+		point := int(sessionID % uint32(totalWeight))
+		for i, upstream := range group {
+			if point < upstream.Weight {
+				first = i
+				break
+			}
+			point -= upstream.Weight
+		}
+		for i := range group {
+			urls = append(urls, group[(first+i)%len(group)].URL)
+		}
+	}
+
+	return append(urls, unhealthy...)
+}
+
+// SameUpstreams Whether the pool has exactly the upstreams
+func (pool *UpstreamPool) SameUpstreams(infos []StratumUpstreamInfo) bool {
+	other := NewUpstreamPool(pool.coin, infos)
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	if len(other.upstreams) != len(pool.upstreams) {
+		return false
+	}
+	for i, upstream := range pool.upstreams {
+		if upstream.URL != other.upstreams[i].URL ||
+			upstream.Priority != other.upstreams[i].Priority ||
+			upstream.Weight != other.upstreams[i].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+// inheritStatus Copy the health of the upstreams with the same URL from the old pool
+func (pool *UpstreamPool) inheritStatus(old *UpstreamPool) {
+	oldStatus := make(map[string]UpstreamStatus)
+	for _, upstream := range old.Status() {
+		oldStatus[upstream.URL] = upstream
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, upstream := range pool.upstreams {
+		if status, ok := oldStatus[upstream.URL]; ok {
+			upstream.Healthy = status.Healthy
+			upstream.Failures = status.Failures
+			upstream.LastError = status.LastError
+			upstream.LatencyMs = status.LatencyMs
+			upstream.LastCheckTime = status.LastCheckTime
+		}
+	}
+}
+
+// Stop Stop the health check of the pool
+func (pool *UpstreamPool) Stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.stop)
+	})
+}
+
+// MarkSuccess Record a successful connection to the upstream
+func (pool *UpstreamPool) MarkSuccess(url string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, upstream := range pool.upstreams {
+		if upstream.URL == url {
+			if !upstream.Healthy {
+				glog.Info("[upstream] recovered: ", pool.coin, "; ", url)
+			}
+			upstream.Healthy = true
+			upstream.Failures = 0
+			upstream.LastError = ""
+		}
+	}
+}
+
+// MarkFailure Record a failed connection to the upstream
+func (pool *UpstreamPool) MarkFailure(url string, err error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, upstream := range pool.upstreams {
+		if upstream.URL == url {
+			upstream.Failures++
+			upstream.LastError = err.Error()
+			if upstream.Healthy && upstream.Failures >= upstreamMaxFailures {
+				glog.Warning("[upstream] down: ", pool.coin, "; ", url, "; ", err)
+				upstream.Healthy = false
+			}
+		}
+	}
+}
+
+// IsHealthy Whether the coin has a healthy upstream
+func (pool *UpstreamPool) IsHealthy() bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for _, upstream := range pool.upstreams {
+		if upstream.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// recordCheck Record the result of a health check
+func (pool *UpstreamPool) recordCheck(url string, latency time.Duration, err error) {
+	if err != nil {
+		glog.Warning("[upstream] check failed: ", pool.coin, "; ", url, "; ", err)
+		pool.MarkFailure(url, err)
+	} else {
+		if glog.V(3) {
+			glog.Info("[upstream] check success: ", pool.coin, "; ", url, "; ", latency)
+		}
+		pool.MarkSuccess(url)
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for _, upstream := range pool.upstreams {
+		if upstream.URL == url {
+			upstream.LatencyMs = latency.Milliseconds()
+			upstream.LastCheckTime = time.Now().Unix()
+		}
+	}
+}
+
+// Status Get the health of the upstreams
+func (pool *UpstreamPool) Status() (status []UpstreamStatus) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for _, upstream := range pool.upstreams {
+		status = append(status, *upstream)
+	}
+	return
+}
+
+// checkUpstreamConnect Check an upstream by connecting to it
+func checkUpstreamConnect(coin string, url string) (latency time.Duration, err error) {
+	startTime := time.Now()
+	conn, err := net.DialTimeout("tcp", url, upstreamDialTimeout)
+	if err != nil {
+		return
+	}
+	conn.Close()
+	latency = time.Since(startTime)
+	return
+}
+
+// checkHealth Check every upstream
+func (pool *UpstreamPool) checkHealth(check upstreamCheckFunc) {
+	for _, upstream := range pool.Status() {
+		latency, err := check(pool.coin, upstream.URL)
+		pool.recordCheck(upstream.URL, latency, err)
+	}
+}
+
+// runHealthCheck Check the upstreams periodically
+func (pool *UpstreamPool) runHealthCheck(check upstreamCheckFunc, intervalSeconds int) {
+	for {
+		select {
+		case <-pool.stop:
+			return
+		case <-time.After(time.Duration(intervalSeconds) * time.Second):
+		}
+		pool.checkHealth(check)
+	}
+}
+
+// isCoinHealthy Whether the currency has a healthy upstream
+func (manager *StratumSessionManager) isCoinHealthy(coin string) bool {
+	pool, ok := manager.getUpstreamPool(coin)
+	return ok && pool.IsHealthy()
+}
+
+// upstreamStatusHandle Show the health of the upstreams of every currency
+func (manager *StratumSessionManager) upstreamStatusHandle(w http.ResponseWriter, req *http.Request) {
+	type CoinStatus struct {
+		Healthy   bool             `json:"healthy"`
+		Upstreams []UpstreamStatus `json:"upstreams"`
+	}
+	status := make(map[string]CoinStatus)
+	for coin, pool := range manager.getUpstreamPools() {
+		status[coin] = CoinStatus{pool.IsHealthy(), pool.Status()}
+	}
+
+	statusJSON, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(statusJSON)
+}
+
+// startUpstreamHealthCheck Start the health check of the pool with the check function of the manager
+func (manager *StratumSessionManager) startUpstreamHealthCheck(pool *UpstreamPool) {
+	go pool.runHealthCheck(manager.upstreamCheck, manager.upstreamCheckIntervalSeconds)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolCandidates(t *testing.T) {
+	pool := NewUpstreamPool("btc", []StratumUpstreamInfo{
+		{URL: "backup:3333", Priority: 1},
+		{URL: "a:3333", Priority: 0, Weight: 3},
+		{URL: "b:3333", Priority: 0, Weight: 1},
+	})
+
+	counts := map[string]int{}
+	for sessionID := uint32(0); sessionID < 400; sessionID++ {
+		urls := pool.Candidates(sessionID)
+		if len(urls) != 3 || urls[2] != "backup:3333" {
+			t.Fatalf("wrong candidates: %v", urls)
+		}
+		counts[urls[0]]++
+	}
+	if counts["a:3333"] != 300 || counts["b:3333"] != 100 {
+		t.Errorf("sessions not spread by weight: %v", counts)
+	}
+
+	// An unhealthy upstream is only tried as the last resort
+	for i := 0; i < upstreamMaxFailures; i++ {
+		pool.MarkFailure("a:3333", errors.New("connection refused"))
+	}
+	expected := []string{"b:3333", "backup:3333", "a:3333"}
+	if urls := pool.Candidates(0); !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Candidates() = %v, want %v", urls, expected)
+	}
+
+	pool.MarkSuccess("a:3333")
+	if urls := pool.Candidates(0); urls[0] != "a:3333" {
+		t.Errorf("recovered upstream not preferred: %v", urls)
+	}
+}
+
+// startTestSServer Start a fake sserver. It closes the connections without a response if broken,
+// otherwise it answers mining.subscribe and mining.authorize with the authorize result.
+func startTestSServer(t *testing.T, broken bool, authorized bool) (url string, connections *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	connections = new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(connections, 1)
+			if broken {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					var request JSONRPCRequest
+					json.Unmarshal(line, &request)
+					switch request.ID {
+					case "subscribe":
+						conn.Write([]byte(`{"id":"subscribe","result":[[["mining.notify","0001003f"]],"0001003f",8],"error":null}` + "\n"))
+					case "auth":
+						response, _ := json.Marshal(JSONRPCResponse{"auth", authorized, nil})
+						conn.Write(append(response, '\n'))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), connections
+}
+
+func TestConnectStratumServerFailover(t *testing.T) {
+	brokenURL, _ := startTestSServer(t, true, false)
+	goodURL, _ := startTestSServer(t, false, true)
+	rejectingURL, _ := startTestSServer(t, false, false)
+	unusedURL, unusedConnections := startTestSServer(t, false, true)
+
+	pools := []struct {
+		upstreams  []StratumUpstreamInfo
+		success    bool
+		serverURL  string
+		failedURLs []string
+	}{
+		// The upstream closing the connection in the handshake is skipped
+		{[]StratumUpstreamInfo{{URL: brokenURL, Priority: 0}, {URL: goodURL, Priority: 1}}, true, goodURL, []string{brokenURL}},
+		// The miner gets the rejection of the authorization, the upstream is not failed
+		{[]StratumUpstreamInfo{{URL: rejectingURL, Priority: 0}, {URL: unusedURL, Priority: 1}}, false, rejectingURL, nil},
+	}
+
+	for i, test := range pools {
+		pool := NewUpstreamPool("btc", test.upstreams)
+		minerConn, switcherConn := net.Pipe()
+		minerConn.SetDeadline(time.Now().Add(5 * time.Second))
+		session := &StratumSession{
+			manager:                 &StratumSessionManager{serverID: 1, upstreamPools: map[string]*UpstreamPool{"btc": pool}},
+			protocolType:            ProtocolBitcoinStratum,
+			runningStat:             StatRunning,
+			sessionID:               0x0001003f,
+			sessionIDString:         "0001003f",
+			clientIPPort:            "192.168.0.1:51234",
+			clientConn:              switcherConn,
+			miningCoin:              "btc",
+			fullWorkerName:          "user.worker",
+			stratumSubscribeRequest: &JSONRPCRequest{1, "mining.subscribe", JSONRPCArray{"cgminer/4.10.0"}, ""},
+			stratumAuthorizeRequest: &JSONRPCRequest{2, "mining.authorize", JSONRPCArray{"user.worker", "x"}, ""},
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- session.connectStratumServer()
+		}()
+		response, err := bufio.NewReader(minerConn).ReadString('\n')
+		if err != nil {
+			t.Fatal(i, ": read authorize response failed: ", err)
+		}
+		err = <-done
+
+		if (err == nil) != test.success || session.serverURL != test.serverURL {
+			t.Error(i, ": connect: ", err, "; ", session.serverURL)
+		}
+		if strings.Contains(response, `"result":true`) != test.success {
+			t.Error(i, ": wrong authorize response: ", response)
+		}
+		for _, status := range pool.Status() {
+			failed := status.Failures > 0
+			expected := false
+			for _, url := range test.failedURLs {
+				expected = expected || url == status.URL
+			}
+			if failed != expected {
+				t.Error(i, ": failures of ", status.URL, ": ", status.Failures)
+			}
+		}
+		session.serverConn.Close()
+		minerConn.Close()
+	}
+
+	if atomic.LoadInt32(unusedConnections) != 0 {
+		t.Error("the next upstream is tried after the authorization is rejected")
+	}
+}
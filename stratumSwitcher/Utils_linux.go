@@ -56,6 +56,13 @@ func execNewBin(binPath string, args []string) (err error) {
 }
 
 func getConnFd(conn net.Conn) (fd uintptr, err error) {
+	if ac, ok := conn.(*admittedConn); ok {
+		conn = ac.Conn
+	}
+	if pc, ok := conn.(*ProxyProtocolConn); ok {
+		conn = pc.Conn
+	}
+
 	tc, ok := conn.(*net.TCPConn)
 	if !ok {
 		return 0, errors.New("getConnFd: conn is not a TCPConn")
@@ -110,10 +117,28 @@ func newListenerFromFd(fd uintptr) (listener net.Listener, err error) {
 }
 
 func signalUSR2Listener(callback func()) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR2)
 	for {
 		<-c
 		callback()
 	}
 }
+
+func signalHUPListener(callback func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for {
+		<-c
+		callback()
+	}
+}
+
+func signalUSR1Listener(callback func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	for {
+		<-c
+		callback()
+	}
+}
@@ -59,3 +59,13 @@ func signalUSR2Listener(callback func()) {
 	glog.Info("Function signalUSR2Listener has not implement in Windows.")
 	return
 }
+
+func signalHUPListener(callback func()) {
+	glog.Info("Function signalHUPListener has not implement in Windows.")
+	return
+}
+
+func signalUSR1Listener(callback func()) {
+	glog.Info("Function signalUSR1Listener has not implement in Windows.")
+	return
+}
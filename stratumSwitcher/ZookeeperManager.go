@@ -1,13 +1,11 @@
 package main
 
 import (
-	"errors"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // zookeeper连接超时时间
@@ -17,7 +15,7 @@ const zookeeperConnectingTimeoutSeconds = 60
 const zookeeperConnAliveTimeout = 5
 
 // NodeWatcherChannels 节点监控者的channel
-type NodeWatcherChannels map[uint32]chan zk.Event
+type NodeWatcherChannels map[uint32]chan coordination.Event
 
 // NodeWatcher 节点监控器
 type NodeWatcher struct {
@@ -27,8 +25,12 @@ type NodeWatcher struct {
 	nodePath string
 	// 被监控节点的当前值
 	nodeValue []byte
+	// 是否为可选节点（节点可以不存在，其创建、修改与删除都会被监控）
+	optional bool
+	// 被监控节点是否存在（仅用于可选节点）
+	nodeExists bool
 	// 被监控的Zookeeper事件
-	zkWatchEvent <-chan zk.Event
+	zkWatchEvent <-chan coordination.Event
 	// 节点监控者的channel
 	watcherChannels NodeWatcherChannels
 }
@@ -41,6 +43,29 @@ func NewNodeWatcher(zookeeperManager *ZookeeperManager) *NodeWatcher {
 	return watcher
 }
 
+// watch 读取节点的当前值并设置Zookeeper监控
+func (watcher *NodeWatcher) watch() (err error) {
+	backend := watcher.zookeeperManager.backend
+
+	if !watcher.optional {
+		watcher.nodeValue, _, watcher.zkWatchEvent, err = backend.GetW(watcher.nodePath)
+		return
+	}
+
+	// 可选节点用 ExistsW 监控，以便同时监控节点的创建与删除
+	watcher.nodeExists, watcher.zkWatchEvent, err = backend.ExistsW(watcher.nodePath)
+	if err != nil || !watcher.nodeExists {
+		return
+	}
+	watcher.nodeValue, _, err = backend.Get(watcher.nodePath)
+	if err == coordination.ErrNoNode {
+		// 节点刚被删除，ExistsW 设置的监控会收到删除事件
+		watcher.nodeExists = false
+		err = nil
+	}
+	return
+}
+
 // Run 开始监控
 func (watcher *NodeWatcher) Run() {
 	go func() {
@@ -49,15 +74,20 @@ func (watcher *NodeWatcher) Run() {
 		watcher.zookeeperManager.lock.Lock()
 		defer watcher.zookeeperManager.lock.Unlock()
 
-		for _, eventChan := range watcher.watcherChannels {
-			eventChan <- event
-			close(eventChan)
-		}
-
+		watcher.notify(event)
 		watcher.zookeeperManager.removeNodeWatcher(watcher)
 	}()
 }
 
+// notify 把事件发给所有监控者并关闭其channel（需持有 ZookeeperManager.lock）
+func (watcher *NodeWatcher) notify(event coordination.Event) {
+	for _, eventChan := range watcher.watcherChannels {
+		eventChan <- event
+		close(eventChan)
+	}
+	watcher.watcherChannels = make(NodeWatcherChannels)
+}
+
 // NodeWatcherMap Zookeeper监控器Map
 type NodeWatcherMap map[string]*NodeWatcher
 
@@ -67,73 +97,73 @@ type ZookeeperManager struct {
 	lock sync.Mutex
 	// 监控器Map
 	watcherMap NodeWatcherMap
-	// Zookeeper连接
-	zookeeperConn *zk.Conn
+	// 可选节点的监控器Map
+	optionalWatcherMap NodeWatcherMap
+	// 协调服务后端（Zookeeper或etcd）
+	backend coordination.Backend
 }
 
-// NewZookeeperManager 新建Zookeeper管理器
-func NewZookeeperManager(brokers []string) (manager *ZookeeperManager, err error) {
-	manager = new(ZookeeperManager)
-	manager.watcherMap = make(NodeWatcherMap)
+// NewZookeeperManager 新建Zookeeper管理器，连接到配置的协调服务后端
+func NewZookeeperManager(conf coordination.Config) (manager *ZookeeperManager, err error) {
+	conf.SessionTimeout = zookeeperConnAliveTimeout * time.Second
+	conf.ConnectTimeout = zookeeperConnectingTimeoutSeconds * time.Second
 
-	// 建立到Zookeeper集群的连接
-	var event <-chan zk.Event
-	manager.zookeeperConn, event, err = zk.Connect(brokers, time.Duration(zookeeperConnAliveTimeout)*time.Second)
+	backend, err := coordination.NewBackend(conf)
 	if err != nil {
 		return
 	}
+	manager = newZookeeperManagerWithBackend(backend)
+	return
+}
 
-	zkConnected := make(chan bool, 1)
-
-	go func() {
-		glog.Info("Zookeeper: waiting for connecting to ", brokers, "...")
-		for {
-			e := <-event
-			glog.Info("Zookeeper: ", e)
-
-			if e.State == zk.StateConnected {
-				zkConnected <- true
-				return
-			}
-		}
-	}()
+// newZookeeperManagerWithBackend 用已连接的后端新建Zookeeper管理器
+func newZookeeperManagerWithBackend(backend coordination.Backend) (manager *ZookeeperManager) {
+	manager = new(ZookeeperManager)
+	manager.watcherMap = make(NodeWatcherMap)
+	manager.optionalWatcherMap = make(NodeWatcherMap)
+	manager.backend = backend
+	return
+}
 
-	select {
-	case <-zkConnected:
-		break
-	case <-time.After(zookeeperConnectingTimeoutSeconds * time.Second):
-		err = errors.New("Zookeeper: connecting timeout")
-		break
+// getWatcherMap 获取普通节点或可选节点的监控器Map
+func (manager *ZookeeperManager) getWatcherMap(optional bool) NodeWatcherMap {
+	if optional {
+		return manager.optionalWatcherMap
 	}
-
-	return
+	return manager.watcherMap
 }
 
-// removeNodeWatcher 移除监控节点
+// removeNodeWatcher 移除监控节点（若它已被重新设置的监控器替换则不移除）
 func (manager *ZookeeperManager) removeNodeWatcher(watcher *NodeWatcher) {
-	delete(manager.watcherMap, watcher.nodePath)
+	watcherMap := manager.getWatcherMap(watcher.optional)
+	if watcherMap[watcher.nodePath] != watcher {
+		return
+	}
+	delete(watcherMap, watcher.nodePath)
 	if glog.V(3) {
 		glog.Info("Zookeeper: release NodeWatcher: ", watcher.nodePath)
 	}
 }
 
-// GetW 获取Zookeeper节点的值并设置监控
-func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []byte, event <-chan zk.Event, err error) {
+// addWatcherChannel 获取或新建节点监控器，并为会话添加监控者channel
+func (manager *ZookeeperManager) addWatcherChannel(path string, optional bool, sessionID uint32) (watcher *NodeWatcher, event <-chan coordination.Event, err error) {
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
 
-	watcher, exists := manager.watcherMap[path]
+	watcherMap := manager.getWatcherMap(optional)
+	watcher, exists := watcherMap[path]
 
 	if !exists {
 		watcher = NewNodeWatcher(manager)
 		watcher.nodePath = path
-		watcher.nodeValue, _, watcher.zkWatchEvent, err = manager.zookeeperConn.GetW(path)
+		watcher.optional = optional
+		err = watcher.watch()
 
 		if err != nil {
 			return
 		}
 
-		manager.watcherMap[path] = watcher
+		watcherMap[path] = watcher
 		if glog.V(3) {
 			glog.Info("Zookeeper: add NodeWatcher: ", path)
 		}
@@ -141,29 +171,72 @@ func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []by
 		defer watcher.Run()
 	}
 
-	eventChan := make(chan zk.Event, 1)
+	eventChan := make(chan coordination.Event, 1)
 	watcher.watcherChannels[sessionID] = eventChan
 	if glog.V(3) {
 		glog.Info("Zookeeper: add WatcherChannel: ", path, "; ", Uint32ToHex(sessionID))
 	}
 
-	value = watcher.nodeValue
 	event = eventChan
 	return
 }
 
+// GetW 获取Zookeeper节点的值并设置监控
+func (manager *ZookeeperManager) GetW(path string, sessionID uint32) (value []byte, event <-chan coordination.Event, err error) {
+	watcher, event, err := manager.addWatcherChannel(path, false, sessionID)
+	if err != nil {
+		return
+	}
+	value = watcher.nodeValue
+	return
+}
+
+// GetOptionalW 获取可能不存在的Zookeeper节点的值并设置监控，节点的创建、修改与删除都会触发事件
+func (manager *ZookeeperManager) GetOptionalW(path string, sessionID uint32) (value []byte, exists bool, event <-chan coordination.Event, err error) {
+	watcher, event, err := manager.addWatcherChannel(path, true, sessionID)
+	if err != nil {
+		return
+	}
+	value = watcher.nodeValue
+	exists = watcher.nodeExists
+	return
+}
+
+// WatcherCount 获取被监控节点的数量与监控者channel的总数
+func (manager *ZookeeperManager) WatcherCount() (nodeWatchers int, watcherChannels int) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for _, watcherMap := range []NodeWatcherMap{manager.watcherMap, manager.optionalWatcherMap} {
+		nodeWatchers += len(watcherMap)
+		for _, watcher := range watcherMap {
+			watcherChannels += len(watcher.watcherChannels)
+		}
+	}
+	return
+}
+
 // Create 创建Zookeeper节点
 func (manager *ZookeeperManager) Create(path string, data []byte) (err error) {
-	_, err = manager.zookeeperConn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
-	return
+	return manager.backend.Create(path, data)
 }
 
 // ReleaseW 释放监控
 func (manager *ZookeeperManager) ReleaseW(path string, sessionID uint32) {
+	manager.releaseWatcherChannel(path, false, sessionID)
+}
+
+// ReleaseOptionalW 释放 GetOptionalW 设置的监控
+func (manager *ZookeeperManager) ReleaseOptionalW(path string, sessionID uint32) {
+	manager.releaseWatcherChannel(path, true, sessionID)
+}
+
+// releaseWatcherChannel 移除会话的监控者channel
+func (manager *ZookeeperManager) releaseWatcherChannel(path string, optional bool, sessionID uint32) {
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
 
-	watcher, exists := manager.watcherMap[path]
+	watcher, exists := manager.getWatcherMap(optional)[path]
 
 	if !exists {
 		return
@@ -192,37 +265,50 @@ func (manager *ZookeeperManager) ReleaseW(path string, sessionID uint32) {
 	*/
 }
 
-// 递归创建Zookeeper Node
-func (manager *ZookeeperManager) createZookeeperPath(path string) error {
-	pathTrimmed := strings.Trim(path, "/")
-	dirs := strings.Split(pathTrimmed, "/")
-
-	currPath := ""
+// rearmWatchers 会话过期重建后，重新设置所有节点的监控并读取节点的当前值。
+// 原监控者收到 EventNodeDataChanged 后会重新调用 GetW，从而读到过期期间写入的新值。
+func (manager *ZookeeperManager) rearmWatchers() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
 
-	for _, dir := range dirs {
-		currPath += "/" + dir
+	for _, watcherMap := range []NodeWatcherMap{manager.watcherMap, manager.optionalWatcherMap} {
+		for path, watcher := range watcherMap {
+			newWatcher := NewNodeWatcher(manager)
+			newWatcher.nodePath = path
+			newWatcher.optional = watcher.optional
+
+			err := newWatcher.watch()
+			if err != nil {
+				// 节点已被删除或仍无法读取，监控者会自行重试
+				glog.Warning("Zookeeper: rearm NodeWatcher failed: ", path, "; ", err)
+				watcher.notify(coordination.Event{Type: coordination.EventNotWatching, Path: path, Err: err})
+				delete(watcherMap, path)
+				continue
+			}
 
-		// 看看键是否存在
-		exists, _, err := manager.zookeeperConn.Exists(currPath)
+			watcherMap[path] = newWatcher
+			newWatcher.Run()
 
-		if err != nil {
-			return err
-		}
-
-		// 已存在，不需要创建
-		if exists {
-			continue
+			if glog.V(3) {
+				glog.Info("Zookeeper: rearm NodeWatcher: ", path, "; ", string(newWatcher.nodeValue))
+			}
+			watcher.notify(coordination.Event{Type: coordination.EventNodeDataChanged, Path: path})
 		}
+	}
+}
 
-		// 不存在，创建
-		_, err = manager.zookeeperConn.Create(currPath, []byte{}, 0, zk.WorldACL(zk.PermAll))
-
-		if err != nil {
-			return err
+// watchSession 监控会话事件。会话过期后 go-zookeeper 会自动建立新会话，
+// 新会话建立后调用 onRestored（重新注册临时节点），然后重新设置所有节点的监控。
+func (manager *ZookeeperManager) watchSession(onRestored func()) {
+	for event := range manager.backend.SessionEvents() {
+		switch event {
+		case coordination.SessionExpired:
+			glog.Warning("Zookeeper: session expired, waiting for a new session")
+		case coordination.SessionRestored:
+			nodeWatchers, _ := manager.WatcherCount()
+			glog.Info("Zookeeper: session restored, rearm ", nodeWatchers, " NodeWatchers")
+			onRestored()
+			manager.rearmWatchers()
 		}
-
-		glog.Info("Created zookeeper path: ", currPath)
 	}
-
-	return nil
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+)
+
+func TestZookeeperManagerGetW(t *testing.T) {
+	backend := coordination.NewMemoryBackend()
+	coordination.CreatePath(backend, "/switcher/alice")
+	backend.Set("/switcher/alice", []byte("btc"), -1)
+
+	zkManager := newZookeeperManagerWithBackend(backend)
+
+	value1, event1, err := zkManager.GetW("/switcher/alice", 1)
+	if err != nil || string(value1) != "btc" {
+		t.Fatal("GetW: ", string(value1), ", ", err)
+	}
+	// The second session shares the node watcher
+	value2, event2, _ := zkManager.GetW("/switcher/alice", 2)
+	if string(value2) != "btc" {
+		t.Error("GetW of the second session: ", string(value2))
+	}
+	if nodeWatchers, watcherChannels := zkManager.WatcherCount(); nodeWatchers != 1 || watcherChannels != 2 {
+		t.Error("WatcherCount: ", nodeWatchers, ", ", watcherChannels)
+	}
+
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+	for _, event := range []<-chan coordination.Event{event1, event2} {
+		select {
+		case e := <-event:
+			if e.Type != coordination.EventNodeDataChanged {
+				t.Error("event: ", e.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+	}
+
+	value1, _, _ = zkManager.GetW("/switcher/alice", 1)
+	if string(value1) != "bch" {
+		t.Error("GetW after change: ", string(value1))
+	}
+}
+
+func TestAssignServerIDFromZK(t *testing.T) {
+	manager := &StratumSessionManager{
+		zookeeperManager: newZookeeperManagerWithBackend(coordination.NewMemoryBackend()),
+		upstreamPools:    make(map[string]*UpstreamPool),
+	}
+
+	// The id of the previous process is kept
+	serverID, err := manager.AssignServerIDFromZK("/swid/", 3)
+	if err != nil || serverID != 3 || manager.serverIDNodePath != "/swid/3" {
+		t.Error("AssignServerIDFromZK: ", serverID, ", ", manager.serverIDNodePath, ", ", err)
+	}
+	serverID, _ = manager.AssignServerIDFromZK("/swid/", 3)
+	if serverID != 4 {
+		t.Error("AssignServerIDFromZK with a used id: ", serverID)
+	}
+	// 0 is not assignable
+	serverID, _ = manager.AssignServerIDFromZK("/swid/", 0)
+	if serverID != 1 {
+		t.Error("AssignServerIDFromZK without an old id: ", serverID)
+	}
+}
+
+func TestZookeeperManagerRearmWatchers(t *testing.T) {
+	backend := coordination.NewMemoryBackend()
+	coordination.CreatePath(backend, "/switcher/alice")
+	backend.Set("/switcher/alice", []byte("btc"), -1)
+
+	zkManager := newZookeeperManagerWithBackend(backend)
+	_, event, _ := zkManager.GetW("/switcher/alice", 1)
+
+	zkManager.rearmWatchers()
+	select {
+	case e := <-event:
+		if e.Type != coordination.EventNodeDataChanged {
+			t.Error("event after rearm: ", e.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event after rearm")
+	}
+
+	// The watch of the new NodeWatcher works, the old one does not remove it
+	_, event, _ = zkManager.GetW("/switcher/alice", 1)
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+	select {
+	case <-event:
+	case <-time.After(time.Second):
+		t.Fatal("no event from the rearmed NodeWatcher")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if nodeWatchers, _ := zkManager.WatcherCount(); nodeWatchers != 0 {
+		t.Error("NodeWatchers after the event: ", nodeWatchers)
+	}
+}
+
+func TestZookeeperSessionExpired(t *testing.T) {
+	backend := coordination.NewMemoryBackend()
+	coordination.CreatePath(backend, "/switcher/alice")
+	backend.Set("/switcher/alice", []byte("btc"), -1)
+
+	manager := &StratumSessionManager{
+		zookeeperManager: newZookeeperManagerWithBackend(backend),
+		upstreamPools:    make(map[string]*UpstreamPool),
+	}
+	manager.AssignServerIDFromZK("/swid/", 3)
+	go manager.zookeeperManager.watchSession(manager.reclaimServerIDFromZK)
+
+	_, event, _ := manager.zookeeperManager.GetW("/switcher/alice", 1)
+	backend.Expire()
+	// The switch command issued during the outage
+	backend.Set("/switcher/alice", []byte("bch"), -1)
+
+	// The session reads the node again on every event, like the coin watcher of StratumSession
+	value := []byte("btc")
+	for string(value) != "bch" {
+		select {
+		case <-event:
+		case <-time.After(time.Second):
+			t.Fatal("no event after the expiration, value: ", string(value))
+		}
+		value, event, _ = manager.zookeeperManager.GetW("/switcher/alice", 1)
+	}
+
+	// The server id is reclaimed
+	for i := 0; ; i++ {
+		if exists, _ := backend.Exists("/swid/3"); exists {
+			break
+		}
+		if i > 100 {
+			t.Fatal("server id not reclaimed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A released server id is not reclaimed
+	manager.releaseServerIDFromZK()
+	backend.Expire()
+	time.Sleep(50 * time.Millisecond)
+	if exists, _ := backend.Exists("/swid/3"); exists {
+		t.Error("released server id reclaimed")
+	}
+}
+
+func TestZookeeperManagerGetOptionalW(t *testing.T) {
+	backend := coordination.NewMemoryBackend()
+	coordination.CreatePath(backend, "/switcher/alice")
+
+	zkManager := newZookeeperManagerWithBackend(backend)
+
+	_, exists, event, err := zkManager.GetOptionalW("/switcher/alice/rig1", 1)
+	if err != nil || exists {
+		t.Fatal("GetOptionalW of a missing node: ", exists, ", ", err)
+	}
+
+	// The creation, change and deletion of the node are watched
+	backend.Create("/switcher/alice/rig1", []byte("bch"))
+	for _, expected := range []coordination.EventType{coordination.EventNodeCreated, coordination.EventNodeDataChanged, coordination.EventNodeDeleted} {
+		select {
+		case e := <-event:
+			if e.Type != expected {
+				t.Error("event: ", e.Type, ", expected: ", expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event, expected: ", expected)
+		}
+
+		var value []byte
+		value, exists, event, _ = zkManager.GetOptionalW("/switcher/alice/rig1", 1)
+		switch expected {
+		case coordination.EventNodeCreated:
+			if !exists || string(value) != "bch" {
+				t.Error("GetOptionalW after creation: ", exists, ", ", string(value))
+			}
+			backend.Set("/switcher/alice/rig1", []byte("btc"), -1)
+		case coordination.EventNodeDataChanged:
+			if !exists || string(value) != "btc" {
+				t.Error("GetOptionalW after change: ", exists, ", ", string(value))
+			}
+			backend.Delete("/switcher/alice/rig1", -1)
+		case coordination.EventNodeDeleted:
+			if exists {
+				t.Error("GetOptionalW after deletion: ", string(value))
+			}
+		}
+	}
+
+	zkManager.ReleaseOptionalW("/switcher/alice/rig1", 1)
+	if nodeWatchers, watcherChannels := zkManager.WatcherCount(); nodeWatchers != 1 || watcherChannels != 0 {
+		t.Error("WatcherCount after release: ", nodeWatchers, ", ", watcherChannels)
+	}
+}
+
+func TestZookeeperServerIDLost(t *testing.T) {
+	backend := coordination.NewMemoryBackend()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	manager := &StratumSessionManager{
+		zookeeperManager: newZookeeperManagerWithBackend(backend),
+		upstreamPools:    make(map[string]*UpstreamPool),
+		tcpListener:      listener,
+	}
+	manager.AssignServerIDFromZK("/swid/", 3)
+
+	// Another switcher takes the id during the outage
+	backend.Expire()
+	backend.Create("/swid/3", []byte(`{"HostName":"other"}`))
+	manager.reclaimServerIDFromZK()
+
+	if value, _, _ := backend.Get("/swid/3"); string(value) != `{"HostName":"other"}` {
+		t.Error("server id of the other switcher replaced: ", string(value))
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Error("listener not closed: ", err)
+	}
+
+	// The connections accepted before are not run
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	manager.serveConn(conn, func(net.Conn) {
+		t.Error("session started with the server id of another switcher")
+	})
+	if _, err := peer.Write([]byte("{}")); err == nil {
+		t.Error("connection not closed")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"unsafe"
 
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // #cgo CXXFLAGS: -std=c++11
@@ -162,12 +161,12 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 		// and ZKUserCaseInsensitiveIndex is not disabled (not empty)
 		// Write case-insensitive username index
 		zkIndexPath := configData.ZKUserCaseInsensitiveIndex + strings.ToLower(puname)
-		exists, _, err := zookeeperConn.Exists(zkIndexPath)
+		exists, err := coordinationBackend.Exists(zkIndexPath)
 		if err != nil {
 			glog.Error("zk.Exists(", zkIndexPath, ",", puname, ") Failed: ", err)
 		}
 		if !exists {
-			_, err = zookeeperConn.Create(zkIndexPath, []byte(puname), 0, zk.WorldACL(zk.PermAll))
+			err = coordinationBackend.Create(zkIndexPath, []byte(puname))
 			if err != nil {
 				glog.Error("zk.Create(", zkIndexPath, ",", puname, ") Failed: ", err)
 			}
@@ -178,7 +177,7 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 	zkPath := configData.ZKSwitcherWatchDir + puname
 
 	// see if the key exists
-	exists, _, err := zookeeperConn.Exists(zkPath)
+	exists, err := coordinationBackend.Exists(zkPath)
 
 	if err != nil {
 		glog.Error("zk.Exists(", zkPath, ") Failed: ", err)
@@ -194,7 +193,7 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 	}
 
 	// does not exist, create
-	_, err = zookeeperConn.Create(zkPath, []byte(coin), 0, zk.WorldACL(zk.PermAll))
+	err = coordinationBackend.Create(zkPath, []byte(coin))
 
 	if err != nil {
 		glog.Error("zk.Create(", zkPath, ",", coin, ") Failed: ", err)
@@ -6,8 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // Zookeeper connection timeout
@@ -30,8 +30,12 @@ type ConfigData struct {
 	// IntervalSeconds The time between each pull
 	IntervalSeconds uint
 
+	// CoordinationBackend Where the coin assignments are stored, "zookeeper" (default) or "etcd"
+	CoordinationBackend string
 	// Zookeeper cluster IP:port list
 	ZKBroker []string
+	// EtcdEndpoints etcd client URLs, like ["http://127.0.0.1:2379"] (only if CoordinationBackend is "etcd")
+	EtcdEndpoints []string
 	// ZKSwitcherWatchDir Zookeeper path monitored by Switcher, ending with a slash
 	ZKSwitcherWatchDir string
 
@@ -53,8 +57,8 @@ type ConfigData struct {
 	ListenAddr string
 }
 
-// zookeeperConn Zookeeper connection object
-var zookeeperConn *zk.Conn
+// coordinationBackend Zookeeper or etcd connection object
+var coordinationBackend coordination.Backend
 
 // Configuration Data
 var configData *ConfigData
@@ -93,18 +97,21 @@ func Main(configFilePath string) {
 		configData.ZKUserCaseInsensitiveIndex += "/"
 	}
 
-	// Establish a connection to the Zookeeper cluster
-	conn, _, err := zk.Connect(configData.ZKBroker, time.Duration(zookeeperConnTimeout)*time.Second)
+	// Establish a connection to the Zookeeper or etcd cluster
+	coordinationBackend, err = coordination.NewBackend(coordination.Config{
+		Backend:        configData.CoordinationBackend,
+		ZKBroker:       configData.ZKBroker,
+		EtcdEndpoints:  configData.EtcdEndpoints,
+		SessionTimeout: time.Duration(zookeeperConnTimeout) * time.Second,
+	})
 
 	if err != nil {
-		glog.Fatal("Connect Zookeeper Failed: ", err)
+		glog.Fatal("Connect Zookeeper/etcd Failed: ", err)
 		return
 	}
 
-	zookeeperConn = conn
-
 	// Check and create Zookeeper paths used by StratumSwitcher
-	err = createZookeeperPath(configData.ZKSwitcherWatchDir)
+	err = coordination.CreatePath(coordinationBackend, configData.ZKSwitcherWatchDir)
 
 	if err != nil {
 		glog.Fatal("Create Zookeeper Path Failed: ", err)
@@ -112,7 +119,7 @@ func Main(configFilePath string) {
 	}
 
 	if configData.EnableUserAutoReg {
-		err = createZookeeperPath(configData.ZKAutoRegWatchDir)
+		err = coordination.CreatePath(coordinationBackend, configData.ZKAutoRegWatchDir)
 
 		if err != nil {
 			glog.Fatal("Create Zookeeper Path Failed: ", err)
@@ -121,7 +128,7 @@ func Main(configFilePath string) {
 	}
 
 	if !configData.StratumServerCaseInsensitive && len(configData.ZKUserCaseInsensitiveIndex) > 0 {
-		err = createZookeeperPath(configData.ZKUserCaseInsensitiveIndex)
+		err = coordination.CreatePath(coordinationBackend, configData.ZKUserCaseInsensitiveIndex)
 
 		if err != nil {
 			glog.Fatal("Create Zookeeper Path Failed: ", err)
@@ -20,7 +20,7 @@ func RunUserAutoReg(config *ConfigData) {
 	glog.Info("UserAutoReg watch in zk: ", zkWatchDir)
 
 	for {
-		users, _, eventPool, err := zookeeperConn.ChildrenW(zkWatchDir)
+		users, eventPool, err := coordinationBackend.ChildrenW(zkWatchDir)
 
 		if err != nil {
 			glog.Error("zookeeper ChildrenW failed: ", err)
@@ -40,9 +40,9 @@ func RunUserAutoReg(config *ConfigData) {
 
 func regUser(user string, config *ConfigData) {
 	path := config.ZKAutoRegWatchDir + user
-	defer zookeeperConn.Delete(path, 0)
+	defer coordinationBackend.Delete(path, 0)
 
-	info, _, _ := zookeeperConn.Get(path)
+	info, _, _ := coordinationBackend.Get(path)
 	glog.Info("reg user: ", user, ", info: ", string(info))
 
 	// 构建要提交的内容
@@ -42,4 +42,22 @@ var (
 
 	// APIErrUserCoinsEmpty User currency array is empty
 	APIErrUserCoinsEmpty = NewAPIError(108, "usercoins is empty")
+
+	// APIErrWorkerIsEmpty worker is empty
+	APIErrWorkerIsEmpty = NewAPIError(109, "worker is empty")
+	// APIErrWorkerInvalid worker is illegal
+	APIErrWorkerInvalid = NewAPIError(110, "worker invalid")
+	// APIErrPunameIsInexistent The sub-account has no currency record yet
+	APIErrPunameIsInexistent = NewAPIError(111, "puname is inexistent")
+	// APIErrWeightsInvalid The weights are negative or all zero, or set together with coin
+	APIErrWeightsInvalid = NewAPIError(112, "weights invalid")
+
+	// APIErrCronInvalid The cron expression of the schedule cannot be parsed
+	APIErrCronInvalid = NewAPIError(113, "cron invalid")
+	// APIErrTimeZoneInvalid The time zone of the schedule is unknown
+	APIErrTimeZoneInvalid = NewAPIError(114, "timezone invalid")
+	// APIErrScheduleIDIsEmpty id is empty
+	APIErrScheduleIDIsEmpty = NewAPIError(115, "id is empty")
+	// APIErrScheduleIsInexistent The schedule does not exist
+	APIErrScheduleIsInexistent = NewAPIError(116, "schedule is inexistent")
 )
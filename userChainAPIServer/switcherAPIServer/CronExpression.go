@@ -0,0 +1,108 @@
+package switcherapiserver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCronExpressionInvalid The cron expression cannot be parsed
+var ErrCronExpressionInvalid = errors.New("invalid cron expression")
+
+// cronField Range of a field of the cron expression
+type cronField struct {
+	min int
+	max int
+}
+
+// The fields of the cron expression: minute, hour, day of month, month, day of week (0 or 7 is Sunday)
+var cronFields = []cronField{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// CronExpression A standard 5-field cron expression, like "0 22 * * 1-5".
+// Each field is "*", a number, a range "a-b", a list "a,b", and may have a step "*/n" or "a-b/n".
+type CronExpression struct {
+	// Bit i is set if the value i matches
+	fields [5]uint64
+	// The day of month or the day of week is "*"
+	dayOfMonthAny bool
+	dayOfWeekAny  bool
+}
+
+// ParseCronExpression Parse a 5-field cron expression
+func ParseCronExpression(expr string) (cron *CronExpression, err error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, ErrCronExpressionInvalid
+	}
+
+	cron = new(CronExpression)
+	for i, part := range parts {
+		cron.fields[i], err = parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 7 is also Sunday
+	if cron.fields[4]&(1<<7) != 0 {
+		cron.fields[4] |= 1
+	}
+	cron.dayOfMonthAny = strings.HasPrefix(parts[2], "*")
+	cron.dayOfWeekAny = strings.HasPrefix(parts[4], "*")
+	return
+}
+
+// parseCronField Parse a field of the cron expression to a bit set
+func parseCronField(part string, field cronField) (bits uint64, err error) {
+	for _, item := range strings.Split(part, ",") {
+		step := 1
+		if pos := strings.Index(item, "/"); pos >= 0 {
+			step, err = strconv.Atoi(item[pos+1:])
+			if err != nil || step < 1 {
+				return 0, ErrCronExpressionInvalid
+			}
+			item = item[:pos]
+		}
+
+		low, high := field.min, field.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, ErrCronExpressionInvalid
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, ErrCronExpressionInvalid
+				}
+			}
+		}
+		if low < field.min || high > field.max || low > high {
+			return 0, ErrCronExpressionInvalid
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return
+}
+
+// Match Whether the minute of t matches the expression.
+// Like cron, if both the day of month and the day of week are restricted, either of them matches.
+func (cron *CronExpression) Match(t time.Time) bool {
+	if cron.fields[0]&(1<<uint(t.Minute())) == 0 ||
+		cron.fields[1]&(1<<uint(t.Hour())) == 0 ||
+		cron.fields[3]&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dayOfMonth := cron.fields[2]&(1<<uint(t.Day())) != 0
+	dayOfWeek := cron.fields[4]&(1<<uint(t.Weekday())) != 0
+	if cron.dayOfMonthAny || cron.dayOfWeekAny {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -8,15 +8,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	initusercoin "github.com/BobZombiE69/btcpool-go-modules/userChainAPIServer/initUserCoin"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // SwitchUserCoins User and currency to switch
 type SwitchUserCoins struct {
-	Coin    string   `json:"coin"`
-	PUNames []string `json:"punames"`
+	Coin string `json:"coin"`
+	// Split the connections of the users between several currencies instead of Coin, e.g. {"btc":70,"bcc":30}
+	Weights map[string]float64 `json:"weights,omitempty"`
+	PUNames []string           `json:"punames"`
 }
 
 // SwitchMultiUserRequest Multi-user handover request data structure
@@ -80,9 +82,16 @@ func runAPIServer() {
 
 	http.HandleFunc("/switch", basicAuth(switchHandle))
 
+	http.HandleFunc("/switch/worker", basicAuth(switchWorkerHandle))
+	http.HandleFunc("/switch/worker/clear", basicAuth(clearWorkerHandle))
+
 	http.HandleFunc("/switch/multi-user", basicAuth(switchMultiUserHandle))
 	http.HandleFunc("/switch-multi-user", basicAuth(switchMultiUserHandle))
 
+	http.HandleFunc("/schedule/create", basicAuth(createScheduleHandle))
+	http.HandleFunc("/schedule/list", basicAuth(listScheduleHandle))
+	http.HandleFunc("/schedule/delete", basicAuth(deleteScheduleHandle))
+
 	http.HandleFunc("/subpool/get-coinbase", basicAuth(getCoinbaseHandle))
 	http.HandleFunc("/subpool-get-coinbase", basicAuth(getCoinbaseHandle))
 
@@ -161,7 +170,7 @@ func getCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 	reqNode := configData.ZKSubPoolUpdateBaseDir + reqData.Coin + "/" + reqData.SubPoolName
 	ackNode := reqNode + "/ack"
 
-	reqByte, stat, err := zookeeperConn.Get(reqNode)
+	reqByte, version, err := coordinationBackend.Get(reqNode)
 	if err != nil {
 		glog.Warning("[subpool-get] zk path '", reqNode, "' doesn't exists",
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -169,7 +178,7 @@ func getCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	exists, _, ack, err := zookeeperConn.ExistsW(ackNode)
+	exists, ack, err := coordinationBackend.ExistsW(ackNode)
 	if err != nil || !exists {
 		glog.Warning("[subpool-get] zk path '", ackNode, "' doesn't exists",
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -177,7 +186,7 @@ func getCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err = zookeeperConn.Set(reqNode, reqByte, stat.Version)
+	err = coordinationBackend.Set(reqNode, reqByte, version)
 	if err != nil {
 		glog.Warning("[subpool-get] data has been updated at query time! ", err.Error(),
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -187,7 +196,7 @@ func getCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 
 	select {
 	case <-ack:
-		ackJSON, _, err := zookeeperConn.Get(ackNode)
+		ackJSON, _, err := coordinationBackend.Get(ackNode)
 		if err != nil {
 			glog.Warning("[subpool-get] get ACK failed, ", err.Error(),
 				" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -268,7 +277,7 @@ func updateCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 	reqNode := configData.ZKSubPoolUpdateBaseDir + reqData.Coin + "/" + reqData.SubPoolName
 	ackNode := reqNode + "/ack"
 
-	exists, _, err := zookeeperConn.Exists(reqNode)
+	exists, err := coordinationBackend.Exists(reqNode)
 	if err != nil || !exists {
 		glog.Warning("[subpool-update] zk path '", reqNode, "' doesn't exists",
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -276,7 +285,7 @@ func updateCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	exists, _, ack, err := zookeeperConn.ExistsW(ackNode)
+	exists, ack, err := coordinationBackend.ExistsW(ackNode)
 	if err != nil || !exists {
 		glog.Warning("[subpool-update] zk path '", ackNode, "' doesn't exists",
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -285,7 +294,7 @@ func updateCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 	}
 
 	reqByte, _ := json.Marshal(reqData)
-	_, err = zookeeperConn.Set(reqNode, reqByte, -1)
+	err = coordinationBackend.Set(reqNode, reqByte, -1)
 	if err != nil {
 		glog.Warning("[subpool-update] set zk path '", reqNode, "' failed! ", err.Error(),
 			" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -295,7 +304,7 @@ func updateCoinbaseHandle(w http.ResponseWriter, req *http.Request) {
 
 	select {
 	case <-ack:
-		ackJSON, _, err := zookeeperConn.Get(ackNode)
+		ackJSON, _, err := coordinationBackend.Get(ackNode)
 		if err != nil {
 			glog.Warning("[subpool-update] get ACK failed, ", err.Error(),
 				" Coin: ", reqData.Coin, ", SubPool: ", reqData.SubPoolName)
@@ -349,6 +358,41 @@ func switchHandle(w http.ResponseWriter, req *http.Request) {
 	writeSuccess(w)
 }
 
+// switchWorkerHandle Handling currency switching requests of a single worker
+func switchWorkerHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	worker := req.FormValue("worker")
+	coin := req.FormValue("coin")
+
+	oldCoin, err := changeWorkerMiningCoin(puname, worker, coin)
+
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
+
+	glog.Info("[worker-switch] ", puname, ".", worker, ": ", oldCoin, " -> ", coin)
+	writeSuccess(w)
+}
+
+// clearWorkerHandle Remove the currency of a single worker, it mines the currency of its sub-account again
+func clearWorkerHandle(w http.ResponseWriter, req *http.Request) {
+	puname := req.FormValue("puname")
+	worker := req.FormValue("worker")
+
+	oldCoin, err := clearWorkerMiningCoin(puname, worker)
+
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
+
+	glog.Info("[worker-clear] ", puname, ".", worker, ": ", oldCoin, " -> (sub-account)")
+	writeSuccess(w)
+}
+
 // switchMultiUserHandle Handling multi-user currency switching requests
 func switchMultiUserHandle(w http.ResponseWriter, req *http.Request) {
 	var reqData SwitchMultiUserRequest
@@ -377,9 +421,19 @@ func switchMultiUserHandle(w http.ResponseWriter, req *http.Request) {
 
 	for _, usercoin := range reqData.UserCoins {
 		coin := usercoin.Coin
+		if usercoin.Weights != nil {
+			weightsJSON, _ := json.Marshal(usercoin.Weights)
+			coin = string(weightsJSON)
+		}
 
 		for _, puname := range usercoin.PUNames {
-			oldCoin, err := changeMiningCoin(puname, coin)
+			var oldCoin string
+			var err *APIError
+			if usercoin.Weights != nil {
+				oldCoin, err = changeMiningCoinWeights(puname, usercoin.Coin, usercoin.Weights)
+			} else {
+				oldCoin, err = changeMiningCoin(puname, coin)
+			}
 
 			if err != nil {
 				glog.Info(err, ": ", req.RequestURI, " {puname=", puname, ", coin=", coin, "}")
@@ -408,50 +462,126 @@ func writeError(w http.ResponseWriter, errNo int, errMsg string) {
 	w.Write(responseJSON)
 }
 
-func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIError) {
-	oldCoin = ""
-
+// checkPuname Check the sub-account name and return the name used in zookeeper
+func checkPuname(puname string) (string, *APIError) {
 	if len(puname) < 1 {
-		apiErr = APIErrPunameIsEmpty
-		return
+		return puname, APIErrPunameIsEmpty
 	}
 
 	if strings.Contains(puname, "/") {
-		apiErr = APIErrPunameInvalid
-		return
+		return puname, APIErrPunameInvalid
 	}
 
-	if len(coin) < 1 {
-		apiErr = APIErrCoinIsEmpty
-		return
+	if configData.StratumServerCaseInsensitive {
+		// stratum server is not case sensitive to sub-account names
+		// Simply convert the sub-account name to lowercase
+		puname = strings.ToLower(puname)
+	}
+	return puname, nil
+}
+
+// checkWorker Check the miner name, it is a child node of the sub-account in zookeeper
+func checkWorker(worker string) *APIError {
+	if len(worker) < 1 {
+		return APIErrWorkerIsEmpty
+	}
+
+	if strings.Contains(worker, "/") || worker == "." || worker == ".." {
+		return APIErrWorkerInvalid
 	}
+	return nil
+}
 
-	// Check if currency exists
-	exists := false
+// checkCoin Check if currency exists
+func checkCoin(coin string) *APIError {
+	if len(coin) < 1 {
+		return APIErrCoinIsEmpty
+	}
 
 	for _, availableCoin := range configData.AvailableCoins {
 		if availableCoin == coin {
-			exists = true
-			break
+			return nil
 		}
 	}
+	return APIErrCoinIsInexistent
+}
+
+func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIError) {
+	oldCoin = ""
+
+	puname, apiErr = checkPuname(puname)
+	if apiErr != nil {
+		return
+	}
 
-	if !exists {
-		apiErr = APIErrCoinIsInexistent
+	apiErr = checkCoin(coin)
+	if apiErr != nil {
 		return
 	}
 
-	if configData.StratumServerCaseInsensitive {
-		// stratum server is not case sensitive to sub-account names
-		// Simply convert the sub-account name to lowercase
-		puname = strings.ToLower(puname)
+	return writeMiningCoin(puname, coin, []string{coin})
+}
+
+// changeMiningCoinWeights Split the connections of the sub-account between several currencies by weight
+func changeMiningCoinWeights(puname string, coin string, weights map[string]float64) (oldCoin string, apiErr *APIError) {
+	puname, apiErr = checkPuname(puname)
+	if apiErr != nil {
+		return
+	}
+
+	if len(coin) > 0 {
+		apiErr = APIErrWeightsInvalid
+		return
+	}
+
+	value, coins, apiErr := encodeCoinWeights(weights)
+	if apiErr != nil {
+		return
+	}
+
+	return writeMiningCoin(puname, value, coins)
+}
+
+// encodeCoinWeights Check the weights and encode them as the value of the node of the sub-account.
+// Currencies with the weight 0 are removed, a single currency is written as a bare currency name.
+func encodeCoinWeights(weights map[string]float64) (value string, coins []string, apiErr *APIError) {
+	positiveWeights := make(map[string]float64)
+
+	for coin, weight := range weights {
+		apiErr = checkCoin(coin)
+		if apiErr != nil {
+			return
+		}
+		if weight < 0 {
+			apiErr = APIErrWeightsInvalid
+			return
+		}
+		if weight > 0 {
+			positiveWeights[coin] = weight
+			coins = append(coins, coin)
+		}
 	}
 
+	switch len(coins) {
+	case 0:
+		apiErr = APIErrWeightsInvalid
+	case 1:
+		value = coins[0]
+	default:
+		// The keys of a map are sorted by encoding/json
+		valueJSON, _ := json.Marshal(positiveWeights)
+		value = string(valueJSON)
+	}
+	return
+}
+
+// writeMiningCoin Write the currency or the weights of the currencies to the node of the sub-account
+func writeMiningCoin(puname string, value string, coins []string) (oldCoin string, apiErr *APIError) {
 	// stratumSwitcher monitor key
 	zkPath := configData.ZKSwitcherWatchDir + puname
 
 	// see if the key exists
-	exists, _, err := zookeeperConn.Exists(zkPath)
+	exists, err := coordinationBackend.Exists(zkPath)
 
 	if err != nil {
 		glog.Error("zk.Exists(", zkPath, ") Failed: ", err)
@@ -461,7 +591,7 @@ func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIEr
 
 	if exists {
 		// Read zookeeper to see what the original value is
-		oldCoinData, _, err := zookeeperConn.Get(zkPath)
+		oldCoinData, _, err := coordinationBackend.Get(zkPath)
 
 		if err != nil {
 			glog.Error("zk.Get(", zkPath, ") Failed: ", err)
@@ -479,50 +609,154 @@ func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIEr
 			return
 		}*/
 
-		// Check the update time of the sub-account name. If the sub-account name has just been created, it will be written with a delay of 15 seconds
+		apiErr = setMiningCoinNode(zkPath, puname, value, coins)
+		if apiErr != nil {
+			return
+		}
+
+	} else {
+		// does not exist, create it directly
+		err = coordinationBackend.Create(zkPath, []byte(value))
+
+		if err != nil {
+			glog.Error("zk.Create(", zkPath, ",", value, ") Failed: ", err)
+			apiErr = APIErrWriteRecordFailed
+			return
+		}
+	}
+
+	apiErr = nil
+	return
+}
+
+// setMiningCoinNode Write the currency or the weights of the currencies to an existing node.
+// If the sub-account name has just been created in one of the currencies, it will be written with a delay of 15 seconds.
+func setMiningCoinNode(zkPath string, puname string, value string, coins []string) *APIError {
+	safetyPeriod := initusercoin.GetSafetyPeriod()
+	nowTime := time.Now().Unix()
+
+	// Check the update time of the sub-account name
+	var sleepTime int64
+	for _, coin := range coins {
 		userUpdateTime := initusercoin.GetUserUpdateTime(puname, coin)
-		safetyPeriod := initusercoin.GetSafetyPeriod()
-		nowTime := time.Now().Unix()
+		if userUpdateTime <= 0 {
+			userUpdateTime = nowTime
+		}
+		if coinSleepTime := safetyPeriod - (nowTime - userUpdateTime); coinSleepTime > sleepTime {
+			sleepTime = coinSleepTime
+		}
+	}
 
-		if userUpdateTime != 0 && nowTime-userUpdateTime >= safetyPeriod {
-			// write new value
-			_, err = zookeeperConn.Set(zkPath, []byte(coin), -1)
+	if sleepTime <= 0 {
+		// write new value
+		err := coordinationBackend.Set(zkPath, []byte(value), -1)
 
-			if err != nil {
-				glog.Error("zk.Set(", zkPath, ",", coin, ") Failed: ", err)
-				apiErr = APIErrWriteRecordFailed
-				return
-			}
-		} else {
-			if userUpdateTime <= 0 {
-				userUpdateTime = nowTime
-			}
-			sleepTime := safetyPeriod - (nowTime - userUpdateTime)
-			glog.Info("Too new puname ", puname, ", delay ", sleepTime, "s")
+		if err != nil {
+			glog.Error("zk.Set(", zkPath, ",", value, ") Failed: ", err)
+			return APIErrWriteRecordFailed
+		}
+		return nil
+	}
+
+	glog.Info("Too new puname ", puname, ", delay ", sleepTime, "s")
 
-			go func() {
-				time.Sleep(time.Duration(sleepTime) * time.Second)
+	go func() {
+		time.Sleep(time.Duration(sleepTime) * time.Second)
 
-				// write new value
-				_, err = zookeeperConn.Set(zkPath, []byte(coin), -1)
+		// write new value
+		err := coordinationBackend.Set(zkPath, []byte(value), -1)
 
-				if err != nil {
-					glog.Error("zk.Set(", zkPath, ",", coin, ") Failed: ", err)
-				}
-			}()
+		if err != nil {
+			glog.Error("zk.Set(", zkPath, ",", value, ") Failed: ", err)
 		}
+	}()
+	return nil
+}
 
-	} else {
-		// does not exist, create it directly
-		_, err = zookeeperConn.Create(zkPath, []byte(coin), 0, zk.WorldACL(zk.PermAll))
+// changeWorkerMiningCoin Set the currency of a single worker, it takes precedence over the currency of the sub-account
+func changeWorkerMiningCoin(puname string, worker string, coin string) (oldCoin string, apiErr *APIError) {
+	puname, apiErr = checkPuname(puname)
+	if apiErr != nil {
+		return
+	}
+
+	apiErr = checkWorker(worker)
+	if apiErr != nil {
+		return
+	}
+
+	apiErr = checkCoin(coin)
+	if apiErr != nil {
+		return
+	}
+
+	// The worker node is a child of the node of the sub-account
+	accountPath := configData.ZKSwitcherWatchDir + puname
+	zkPath := accountPath + "/" + worker
+
+	accountCoin, _, err := coordinationBackend.Get(accountPath)
+	if err == coordination.ErrNoNode {
+		apiErr = APIErrPunameIsInexistent
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Get(", accountPath, ") Failed: ", err)
+		apiErr = APIErrReadRecordFailed
+		return
+	}
+
+	oldCoinData, _, err := coordinationBackend.Get(zkPath)
+	if err == coordination.ErrNoNode {
+		// The worker mined the currency of the sub-account, create its node directly
+		oldCoin = string(accountCoin)
+		err = coordinationBackend.Create(zkPath, []byte(coin))
 
 		if err != nil {
 			glog.Error("zk.Create(", zkPath, ",", coin, ") Failed: ", err)
 			apiErr = APIErrWriteRecordFailed
-			return
 		}
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Get(", zkPath, ") Failed: ", err)
+		apiErr = APIErrReadRecordFailed
+		return
 	}
 
-	apiErr = nil
+	oldCoin = string(oldCoinData)
+	apiErr = setMiningCoinNode(zkPath, puname, coin, []string{coin})
+	return
+}
+
+// clearWorkerMiningCoin Remove the currency of a single worker, removing a worker without one is not an error
+func clearWorkerMiningCoin(puname string, worker string) (oldCoin string, apiErr *APIError) {
+	puname, apiErr = checkPuname(puname)
+	if apiErr != nil {
+		return
+	}
+
+	apiErr = checkWorker(worker)
+	if apiErr != nil {
+		return
+	}
+
+	zkPath := configData.ZKSwitcherWatchDir + puname + "/" + worker
+
+	oldCoinData, _, err := coordinationBackend.Get(zkPath)
+	if err == coordination.ErrNoNode {
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Get(", zkPath, ") Failed: ", err)
+		apiErr = APIErrReadRecordFailed
+		return
+	}
+	oldCoin = string(oldCoinData)
+
+	err = coordinationBackend.Delete(zkPath, -1)
+	if err != nil && err != coordination.ErrNoNode {
+		glog.Error("zk.Delete(", zkPath, ") Failed: ", err)
+		apiErr = APIErrWriteRecordFailed
+	}
 	return
 }
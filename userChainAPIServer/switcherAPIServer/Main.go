@@ -6,8 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
 	"github.com/golang/glog"
-	"github.com/samuel/go-zookeeper/zk"
 )
 
 // Zookeeper connection timeout
@@ -27,8 +27,12 @@ type ConfigData struct {
 	// AvailableCoins Available currencies, like {"btc", "bcc", ...}
 	AvailableCoins []string
 
+	// CoordinationBackend Where the coin assignments are stored, "zookeeper" (default) or "etcd"
+	CoordinationBackend string
 	// Zookeeper cluster IP:port list
 	ZKBroker []string
+	// EtcdEndpoints etcd client URLs, like ["http://127.0.0.1:2379"] (only if CoordinationBackend is "etcd")
+	EtcdEndpoints []string
 	// ZKSwitcherWatchDir Zookeeper path monitored by Switcher, ending with a slash
 	ZKSwitcherWatchDir string
 
@@ -44,10 +48,14 @@ type ConfigData struct {
 	ZKSubPoolUpdateBaseDir string
 	// The response timeout time of the jobmaker when the subpool is updated. If the jobmaker does not respond within this time, the API returns an error
 	ZKSubPoolUpdateAckTimeout int
+	// ZKScheduleDir The zookeeper directory of the scheduled switches, ending with a slash. The schedule API is disabled if empty
+	ZKScheduleDir string
+	// EnableSchedule Whether to fire the scheduled switches (only the leader among the API servers fires them)
+	EnableSchedule bool
 }
 
-// zookeeperConn Zookeeper connection object
-var zookeeperConn *zk.Conn
+// coordinationBackend Zookeeper or etcd connection object
+var coordinationBackend coordination.Backend
 
 // Configuration Data
 var configData *ConfigData
@@ -80,25 +88,40 @@ func Main(configFilePath string) {
 	if len(configData.ZKSubPoolUpdateBaseDir) > 0 && configData.ZKSubPoolUpdateBaseDir[len(configData.ZKSubPoolUpdateBaseDir)-1] != '/' {
 		configData.ZKSubPoolUpdateBaseDir += "/"
 	}
+	if len(configData.ZKScheduleDir) > 0 && configData.ZKScheduleDir[len(configData.ZKScheduleDir)-1] != '/' {
+		configData.ZKScheduleDir += "/"
+	}
 
-	// Establish a connection to the Zookeeper cluster
-	conn, _, err := zk.Connect(configData.ZKBroker, time.Duration(zookeeperConnTimeout)*time.Second)
+	// Establish a connection to the Zookeeper or etcd cluster
+	coordinationBackend, err = coordination.NewBackend(coordination.Config{
+		Backend:        configData.CoordinationBackend,
+		ZKBroker:       configData.ZKBroker,
+		EtcdEndpoints:  configData.EtcdEndpoints,
+		SessionTimeout: time.Duration(zookeeperConnTimeout) * time.Second,
+	})
 
 	if err != nil {
-		glog.Fatal("Connect Zookeeper Failed: ", err)
+		glog.Fatal("Connect Zookeeper/etcd Failed: ", err)
 		return
 	}
 
-	zookeeperConn = conn
-
 	// Check and create Zookeeper paths used by StratumSwitcher
-	err = createZookeeperPath(configData.ZKSwitcherWatchDir)
+	err = coordination.CreatePath(coordinationBackend, configData.ZKSwitcherWatchDir)
 
 	if err != nil {
 		glog.Fatal("Create Zookeeper Path Failed: ", err)
 		return
 	}
 
+	if len(configData.ZKScheduleDir) > 0 {
+		err = coordination.CreatePath(coordinationBackend, getScheduleNodeDir())
+
+		if err != nil {
+			glog.Fatal("Create Zookeeper Path Failed: ", err)
+			return
+		}
+	}
+
 	if configData.EnableAPIServer {
 		waitGroup.Add(1)
 		go runAPIServer()
@@ -109,5 +132,10 @@ func Main(configFilePath string) {
 		go RunCronJob()
 	}
 
+	if configData.EnableSchedule && len(configData.ZKScheduleDir) > 0 {
+		waitGroup.Add(1)
+		go RunScheduler()
+	}
+
 	waitGroup.Wait()
 }
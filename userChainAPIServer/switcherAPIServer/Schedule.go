@@ -0,0 +1,309 @@
+package switcherapiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+	"github.com/golang/glog"
+)
+
+// Schedule Switch the sub-account to the currency at the moments matching the cron expression
+type Schedule struct {
+	ID     string `json:"id"`
+	PUName string `json:"puname"`
+	Cron   string `json:"cron"`
+	Coin   string `json:"coin"`
+	// IANA time zone of the cron expression, like "Asia/Shanghai", the local time zone of the server if empty
+	TimeZone string `json:"timezone,omitempty"`
+}
+
+// ScheduleResponse Response of the schedule creation
+type ScheduleResponse struct {
+	APIResponse
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// ScheduleListResponse Response of the schedule list
+type ScheduleListResponse struct {
+	APIResponse
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// getScheduleNodeDir Directory of the schedule nodes, each node is a JSON Schedule named by its id
+func getScheduleNodeDir() string {
+	return configData.ZKScheduleDir + "schedules/"
+}
+
+// getScheduleLeaderNode Ephemeral node of the API server firing the schedules
+func getScheduleLeaderNode() string {
+	return configData.ZKScheduleDir + "leader"
+}
+
+// checkSchedule Check the schedule and normalize its sub-account name
+func checkSchedule(schedule *Schedule) (apiErr *APIError) {
+	schedule.PUName, apiErr = checkPuname(schedule.PUName)
+	if apiErr != nil {
+		return
+	}
+
+	apiErr = checkCoin(schedule.Coin)
+	if apiErr != nil {
+		return
+	}
+
+	if _, err := ParseCronExpression(schedule.Cron); err != nil {
+		return APIErrCronInvalid
+	}
+
+	if _, err := loadScheduleLocation(schedule.TimeZone); err != nil {
+		return APIErrTimeZoneInvalid
+	}
+	return nil
+}
+
+// loadScheduleLocation The time zone of the schedule, the local time zone if empty
+func loadScheduleLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timeZone)
+}
+
+// createSchedule Check the schedule and store it with a new id
+func createSchedule(schedule *Schedule) *APIError {
+	apiErr := checkSchedule(schedule)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	for {
+		schedule.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+		scheduleJSON, _ := json.Marshal(schedule)
+		zkPath := getScheduleNodeDir() + schedule.ID
+
+		err := coordinationBackend.Create(zkPath, scheduleJSON)
+		if err == coordination.ErrNodeExists {
+			// Created by another request at the same time
+			continue
+		}
+		if err != nil {
+			glog.Error("zk.Create(", zkPath, ",", string(scheduleJSON), ") Failed: ", err)
+			return APIErrWriteRecordFailed
+		}
+		return nil
+	}
+}
+
+// listSchedules Read all schedules, or the schedules of a sub-account if puname is not empty
+func listSchedules(puname string) (schedules []*Schedule, apiErr *APIError) {
+	schedules = []*Schedule{}
+
+	// Zookeeper does not accept the path ending with a slash
+	scheduleNodeDir := strings.TrimSuffix(getScheduleNodeDir(), "/")
+	ids, err := coordinationBackend.Children(scheduleNodeDir)
+	if err != nil {
+		glog.Error("zk.Children(", scheduleNodeDir, ") Failed: ", err)
+		return nil, APIErrReadRecordFailed
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		zkPath := getScheduleNodeDir() + id
+		scheduleJSON, _, err := coordinationBackend.Get(zkPath)
+		if err == coordination.ErrNoNode {
+			// Deleted after listed
+			continue
+		}
+		if err != nil {
+			glog.Error("zk.Get(", zkPath, ") Failed: ", err)
+			return nil, APIErrReadRecordFailed
+		}
+
+		schedule := new(Schedule)
+		err = json.Unmarshal(scheduleJSON, schedule)
+		if err != nil {
+			glog.Error("Parse Schedule Failed: ", zkPath, "; ", err, "; ", string(scheduleJSON))
+			continue
+		}
+		schedule.ID = id
+
+		if puname == "" || schedule.PUName == puname {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return
+}
+
+// deleteSchedule Delete the schedule
+func deleteSchedule(id string) *APIError {
+	if len(id) < 1 {
+		return APIErrScheduleIDIsEmpty
+	}
+
+	zkPath := getScheduleNodeDir() + id
+	err := coordinationBackend.Delete(zkPath, -1)
+	if err == coordination.ErrNoNode {
+		return APIErrScheduleIsInexistent
+	}
+	if err != nil {
+		glog.Error("zk.Delete(", zkPath, ") Failed: ", err)
+		return APIErrWriteRecordFailed
+	}
+	return nil
+}
+
+// createScheduleHandle Create a schedule of a sub-account
+func createScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	if len(configData.ZKScheduleDir) == 0 {
+		writeError(w, 403, "API disabled")
+		return
+	}
+
+	schedule := &Schedule{
+		PUName:   req.FormValue("puname"),
+		Cron:     req.FormValue("cron"),
+		Coin:     req.FormValue("coin"),
+		TimeZone: req.FormValue("timezone"),
+	}
+
+	err := createSchedule(schedule)
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
+
+	glog.Info("[schedule] created ", schedule.ID, ": ", schedule.PUName, ": \"", schedule.Cron, "\" ", schedule.TimeZone, " -> ", schedule.Coin)
+
+	response := ScheduleResponse{APIResponse{0, "", true}, schedule}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// listScheduleHandle List the schedules
+func listScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	if len(configData.ZKScheduleDir) == 0 {
+		writeError(w, 403, "API disabled")
+		return
+	}
+
+	puname := req.FormValue("puname")
+	if puname != "" {
+		var err *APIError
+		puname, err = checkPuname(puname)
+		if err != nil {
+			writeError(w, err.ErrNo, err.ErrMsg)
+			return
+		}
+	}
+
+	schedules, err := listSchedules(puname)
+	if err != nil {
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
+
+	response := ScheduleListResponse{APIResponse{0, "", true}, schedules}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// deleteScheduleHandle Delete a schedule
+func deleteScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	if len(configData.ZKScheduleDir) == 0 {
+		writeError(w, 403, "API disabled")
+		return
+	}
+
+	id := req.FormValue("id")
+
+	err := deleteSchedule(id)
+	if err != nil {
+		glog.Info(err, ": ", req.RequestURI)
+		writeError(w, err.ErrNo, err.ErrMsg)
+		return
+	}
+
+	glog.Info("[schedule] deleted ", id)
+	writeSuccess(w)
+}
+
+// isScheduleLeader Whether this API server fires the schedules.
+// The first API server creating the ephemeral leader node is the leader until its session ends.
+func isScheduleLeader(instanceID string) bool {
+	leaderNode := getScheduleLeaderNode()
+
+	leader, _, err := coordinationBackend.Get(leaderNode)
+	if err == coordination.ErrNoNode {
+		err = coordinationBackend.CreateEphemeral(leaderNode, []byte(instanceID))
+		if err == nil {
+			glog.Info("[schedule] became the leader: ", instanceID)
+			return true
+		}
+		if err != coordination.ErrNodeExists {
+			glog.Error("zk.CreateEphemeral(", leaderNode, ") Failed: ", err)
+		}
+		return false
+	}
+	if err != nil {
+		glog.Error("zk.Get(", leaderNode, ") Failed: ", err)
+		return false
+	}
+	return string(leader) == instanceID
+}
+
+// fireSchedules Switch the sub-accounts of the schedules matching the minute
+func fireSchedules(minute time.Time) {
+	schedules, apiErr := listSchedules("")
+	if apiErr != nil {
+		return
+	}
+
+	for _, schedule := range schedules {
+		cron, err := ParseCronExpression(schedule.Cron)
+		if err != nil {
+			glog.Error("[schedule] invalid cron expression of ", schedule.ID, ": ", schedule.Cron)
+			continue
+		}
+		location, err := loadScheduleLocation(schedule.TimeZone)
+		if err != nil {
+			glog.Error("[schedule] invalid time zone of ", schedule.ID, ": ", schedule.TimeZone)
+			continue
+		}
+		if !cron.Match(minute.In(location)) {
+			continue
+		}
+
+		oldCoin, apiErr := changeMiningCoin(schedule.PUName, schedule.Coin)
+		if apiErr != nil {
+			glog.Error("[schedule] ", schedule.ID, ": ", apiErr.ErrMsg, ": ", schedule.PUName, ": ", oldCoin, " -> ", schedule.Coin)
+			continue
+		}
+		glog.Info("[schedule] ", schedule.ID, ": ", schedule.PUName, ": ", oldCoin, " -> ", schedule.Coin)
+	}
+}
+
+// RunScheduler Fire the schedules at the beginning of every minute if this API server is the leader
+func RunScheduler() {
+	defer waitGroup.Done()
+
+	hostname, _ := os.Hostname()
+	instanceID := hostname + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	for {
+		now := time.Now()
+		minute := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(minute.Sub(now))
+
+		if !isScheduleLeader(instanceID) {
+			continue
+		}
+		fireSchedules(minute)
+	}
+}
@@ -0,0 +1,101 @@
+package switcherapiserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BobZombiE69/btcpool-go-modules/coordination"
+)
+
+func TestCronExpression(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCronExpression(expr); err == nil {
+			t.Error("no error: ", expr)
+		}
+	}
+
+	// Monday 2026-10-12 22:30
+	monday := time.Date(2026, 10, 12, 22, 30, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 22, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		expr   string
+		time   time.Time
+		expect bool
+	}{
+		{"* * * * *", monday, true},
+		{"30 22 * * 1-5", monday, true},
+		{"30 22 * * 1-5", sunday, false},
+		{"30 22 * * 7", sunday, true},
+		{"0,15,30,45 * * * *", monday, true},
+		{"*/20 * * * *", monday, false},
+		{"30 20-23/2 * 10 *", monday, true},
+		// Either the day of month or the day of week
+		{"30 22 1 * 1", monday, true},
+		{"30 22 1 * 2", monday, false},
+		{"30 22 12 * *", monday, true},
+	}
+	for _, c := range cases {
+		cron, err := ParseCronExpression(c.expr)
+		if err != nil {
+			t.Error("parse failed: ", c.expr, ": ", err)
+			continue
+		}
+		if cron.Match(c.time) != c.expect {
+			t.Error("match ", c.expr, " at ", c.time, ": ", !c.expect)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	coordinationBackend = coordination.NewMemoryBackend()
+	configData = &ConfigData{
+		AvailableCoins:     []string{"btc", "bcc"},
+		ZKSwitcherWatchDir: "/switcher/",
+		ZKScheduleDir:      "/schedule/",
+	}
+	coordination.CreatePath(coordinationBackend, configData.ZKSwitcherWatchDir)
+	coordination.CreatePath(coordinationBackend, getScheduleNodeDir())
+
+	if err := createSchedule(&Schedule{PUName: "alice", Cron: "0 22 * * *", Coin: "bsv"}); err != APIErrCoinIsInexistent {
+		t.Error("schedule of an unknown coin: ", err)
+	}
+	if err := createSchedule(&Schedule{PUName: "alice", Cron: "0 22 * * *", Coin: "bcc", TimeZone: "Nowhere/City"}); err != APIErrTimeZoneInvalid {
+		t.Error("schedule of an unknown time zone: ", err)
+	}
+
+	schedule := &Schedule{PUName: "alice", Cron: "0 22 * * *", Coin: "bcc", TimeZone: "UTC"}
+	if err := createSchedule(schedule); err != nil {
+		t.Fatal("createSchedule: ", err)
+	}
+	createSchedule(&Schedule{PUName: "bob", Cron: "0 6 * * *", Coin: "btc"})
+
+	schedules, err := listSchedules("alice")
+	if err != nil || len(schedules) != 1 || *schedules[0] != *schedule {
+		t.Error("listSchedules: ", schedules, ", ", err)
+	}
+
+	// Only one API server fires the schedules
+	if !isScheduleLeader("a") || isScheduleLeader("b") || !isScheduleLeader("a") {
+		t.Error("more than one leader")
+	}
+
+	fireSchedules(time.Date(2026, 10, 12, 21, 0, 0, 0, time.UTC))
+	if exists, _ := coordinationBackend.Exists("/switcher/alice"); exists {
+		t.Error("schedule fired at the wrong time")
+	}
+	fireSchedules(time.Date(2026, 10, 12, 22, 0, 0, 0, time.UTC))
+	if coin, _, _ := coordinationBackend.Get("/switcher/alice"); string(coin) != "bcc" {
+		t.Error("coin after the schedule: ", string(coin))
+	}
+
+	if err := deleteSchedule(schedule.ID); err != nil {
+		t.Error("deleteSchedule: ", err)
+	}
+	if err := deleteSchedule(schedule.ID); err != APIErrScheduleIsInexistent {
+		t.Error("delete twice: ", err)
+	}
+	if schedules, _ = listSchedules(""); len(schedules) != 1 {
+		t.Error("schedules after delete: ", len(schedules))
+	}
+}